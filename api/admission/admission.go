@@ -0,0 +1,174 @@
+// Package admission sheds load when the database pool is saturated, failing
+// requests fast with 503 instead of letting them pile up waiting for a
+// connection.
+package admission
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/Paulo-Eduardo/phone_book/problem"
+)
+
+// Reasons a request is shed for.
+const (
+	ReasonQueue    = "queue"
+	ReasonInFlight = "in_flight"
+)
+
+// Pool is the connection pool watched by the controller, a *sql.DB.
+type Pool interface {
+	Stats() sql.DBStats
+}
+
+// Config configures the controller.
+type Config struct {
+	Pool Pool
+	// MaxQueue is how many requests may wait for a connection once every
+	// connection of the pool is in use, or 0 for no bound.
+	MaxQueue int
+	// MaxInFlight is how many requests may be served at once, or 0 for no
+	// bound.
+	MaxInFlight int
+	// RetryAfter is sent to the clients of shed requests.
+	RetryAfter time.Duration
+}
+
+// Controller admits or sheds requests.
+type Controller struct {
+	config Config
+
+	mu       sync.Mutex
+	inFlight int
+}
+
+// New returns a controller for c.
+func New(c Config) *Controller {
+	if c.RetryAfter <= 0 {
+		c.RetryAfter = time.Second
+	}
+	return &Controller{config: c}
+}
+
+// Admit reserves a slot for a request and returns the function releasing it,
+// or the reason the request is shed. Priority requests are always admitted.
+func (c *Controller) Admit(priority bool) (func(), string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !priority {
+		if c.config.MaxInFlight > 0 && c.inFlight >= c.config.MaxInFlight {
+			return nil, ReasonInFlight
+		}
+		if c.config.MaxQueue > 0 && c.queued() >= c.config.MaxQueue {
+			return nil, ReasonQueue
+		}
+	}
+
+	c.inFlight++
+	inFlight.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			c.inFlight--
+			c.mu.Unlock()
+			inFlight.Dec()
+		})
+	}, ""
+}
+
+// queued estimates how many requests are waiting for a connection: while the
+// pool is exhausted, every request in flight past its size is either waiting
+// or about to.
+func (c *Controller) queued() int {
+	if c.config.Pool == nil {
+		return 0
+	}
+	stats := c.config.Pool.Stats()
+	if stats.MaxOpenConnections == 0 || stats.InUse < stats.MaxOpenConnections {
+		return 0
+	}
+	if queued := c.inFlight - stats.InUse; queued > 0 {
+		return queued
+	}
+	return 0
+}
+
+var (
+	controller *Controller
+
+	inFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "api_in_flight_requests",
+		Help: "The number of requests being served",
+	})
+	shed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_shed_requests_total",
+		Help: "The total number of requests shed while the database pool was saturated",
+	}, []string{"reason"})
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "api_db_pool_wait_count_total",
+		Help: "The total number of times a query waited for a database connection",
+	}, func() float64 { return float64(poolStats().WaitCount) })
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "api_db_pool_wait_seconds_total",
+		Help: "The total time queries waited for a database connection",
+	}, func() float64 { return poolStats().WaitDuration.Seconds() })
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "api_db_pool_in_use_connections",
+		Help: "The number of database connections in use",
+	}, func() float64 { return float64(poolStats().InUse) })
+)
+
+func poolStats() sql.DBStats {
+	if c := controller; c != nil && c.config.Pool != nil {
+		return c.config.Pool.Stats()
+	}
+	return sql.DBStats{}
+}
+
+// Setup configures Middleware. Until it is called every request is admitted.
+func Setup(c Config) {
+	controller = New(c)
+}
+
+// Middleware : sheds requests with 503 and Retry-After while the database
+// pool is saturated. It comes before auth.Middleware, which queries the
+// database to check API keys.
+func Middleware(handler http.Handler) http.Handler {
+	return admit(handler, false)
+}
+
+// Priority : counts requests in flight like Middleware but never sheds them,
+// for the health check and the metrics, which must keep answering when the
+// API is overloaded.
+func Priority(handler http.Handler) http.Handler {
+	return admit(handler, true)
+}
+
+func admit(handler http.Handler, priority bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := controller
+		if c == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		release, reason := c.Admit(priority)
+		if release == nil {
+			shed.WithLabelValues(reason).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(c.config.RetryAfter.Seconds()))))
+			problem.Error(w, r, http.StatusServiceUnavailable, "The server is overloaded, try again later.")
+			return
+		}
+		defer release()
+		handler.ServeHTTP(w, r)
+	})
+}
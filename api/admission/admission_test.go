@@ -0,0 +1,81 @@
+package admission
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakePool struct {
+	stats sql.DBStats
+}
+
+func (p *fakePool) Stats() sql.DBStats {
+	return p.stats
+}
+
+func TestAdmitShedsWhenThePoolIsSaturated(t *testing.T) {
+	pool := &fakePool{stats: sql.DBStats{MaxOpenConnections: 2}}
+	c := New(Config{Pool: pool, MaxQueue: 1})
+
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		release, reason := c.Admit(false)
+		if release == nil {
+			t.Fatalf("request %d was shed for %s while the pool had room", i, reason)
+		}
+		releases = append(releases, release)
+	}
+
+	pool.stats.InUse = 2
+	if release, reason := c.Admit(false); release != nil || reason != ReasonQueue {
+		t.Errorf("request past the queue was admitted: %s", reason)
+	}
+	if release, _ := c.Admit(true); release == nil {
+		t.Error("priority request was shed")
+	} else {
+		release()
+	}
+
+	releases[0]()
+	releases[0]()
+	if release, reason := c.Admit(false); release == nil {
+		t.Errorf("request was shed after the queue drained: %s", reason)
+	}
+}
+
+func TestAdmitBoundsRequestsInFlight(t *testing.T) {
+	c := New(Config{MaxInFlight: 1})
+
+	release, _ := c.Admit(false)
+	if next, reason := c.Admit(false); next != nil || reason != ReasonInFlight {
+		t.Errorf("second request was admitted: %s", reason)
+	}
+	release()
+	if next, _ := c.Admit(false); next == nil {
+		t.Error("request was shed after the first one finished")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	Setup(Config{MaxInFlight: 1, RetryAfter: 1500 * time.Millisecond})
+	defer func() { controller = nil }()
+
+	release, _ := controller.Admit(false)
+	defer release()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	rr := httptest.NewRecorder()
+	Middleware(ok).ServeHTTP(rr, httptest.NewRequest("GET", "/api/phonebooks", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "2" {
+		t.Errorf("got status %v and Retry-After %q want 503 and 2", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	rr = httptest.NewRecorder()
+	Priority(ok).ServeHTTP(rr, httptest.NewRequest("GET", "/api/health-check", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("health check got status %v", rr.Code)
+	}
+}
@@ -0,0 +1,240 @@
+package apikey
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var errKeyNotFound = errors.New("api key not found")
+
+// storedKey is a key as read by lookup, across tenants.
+type storedKey struct {
+	Key
+	tenantID string
+	hash     string
+}
+
+func insert(ctx context.Context, key Key, prefix string, hash string, db *sql.DB, timeout int) (int, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `INSERT INTO api_keys
+	(tenant_id,
+	name,
+	prefix,
+	hash,
+	scopes,
+	createdAt,
+	expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		tenantID,
+		key.Name,
+		prefix,
+		hash,
+		strings.Join(key.Scopes, " "),
+		key.CreatedAt,
+		key.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+	insertID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(insertID), nil
+}
+
+func get(ctx context.Context, keyID int, db *sql.DB, timeout int) (*Key, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	row := db.QueryRowContext(ctx, `SELECT
+	keyId,
+	name,
+	prefix,
+	scopes,
+	createdAt,
+	expires_at,
+	last_used_at,
+	revoked_at
+	FROM api_keys
+	WHERE keyId = ? AND tenant_id = ?`, keyID, tenantID)
+
+	key, err := scanKey(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return key, err
+}
+
+func list(ctx context.Context, db *sql.DB, timeout int) ([]Key, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	results, err := db.QueryContext(ctx, `SELECT
+	keyId,
+	name,
+	prefix,
+	scopes,
+	createdAt,
+	expires_at,
+	last_used_at,
+	revoked_at
+	FROM api_keys
+	WHERE tenant_id = ?
+	ORDER BY keyId`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	keys := make([]Key, 0)
+	for results.Next() {
+		key, err := scanKey(results)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, results.Err()
+}
+
+// rotate replaces the token of an active key.
+func rotate(ctx context.Context, keyID int, prefix string, hash string, db *sql.DB, timeout int) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `UPDATE api_keys SET
+	prefix=?,
+	hash=?
+	WHERE keyId = ? AND tenant_id = ? AND revoked_at IS NULL`,
+		prefix,
+		hash,
+		keyID,
+		tenantID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return errKeyNotFound
+	}
+	return nil
+}
+
+func revoke(ctx context.Context, keyID int, db *sql.DB, timeout int) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = ?
+	WHERE keyId = ? AND tenant_id = ? AND revoked_at IS NULL`, time.Now().UTC(), keyID, tenantID)
+	return err
+}
+
+// lookup finds a key by prefix in every tenant. It is the only query of the
+// package that isn't scoped by tenant, since the key is what tells which
+// tenant the request belongs to.
+func lookup(ctx context.Context, prefix string, db *sql.DB, timeout int) (*storedKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	row := db.QueryRowContext(ctx, `SELECT
+	keyId,
+	name,
+	prefix,
+	scopes,
+	createdAt,
+	expires_at,
+	last_used_at,
+	revoked_at,
+	tenant_id,
+	hash
+	FROM api_keys
+	WHERE prefix = ?`, prefix)
+
+	var stored storedKey
+	var scopes string
+	err := row.Scan(
+		&stored.KeyID,
+		&stored.Name,
+		&stored.Prefix,
+		&scopes,
+		&stored.CreatedAt,
+		&stored.ExpiresAt,
+		&stored.LastUsedAt,
+		&stored.RevokedAt,
+		&stored.tenantID,
+		&stored.hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	stored.Scopes = strings.Fields(scopes)
+	return &stored, nil
+}
+
+// touch records that a key was used at now. It only writes when the last
+// recorded use is older than touchInterval, so busy keys don't cost a write
+// per request.
+func touch(ctx context.Context, keyID int, now time.Time, db *sql.DB, timeout int) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `UPDATE api_keys SET last_used_at = ?
+	WHERE keyId = ? AND (last_used_at IS NULL OR last_used_at < ?)`, now, keyID, now.Add(-touchInterval))
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKey(row scanner) (*Key, error) {
+	var key Key
+	var scopes string
+	err := row.Scan(
+		&key.KeyID,
+		&key.Name,
+		&key.Prefix,
+		&scopes,
+		&key.CreatedAt,
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Fields(scopes)
+	return &key, nil
+}
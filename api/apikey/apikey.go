@@ -0,0 +1,133 @@
+// Package apikey issues the API keys callers authenticate with, stores them
+// hashed and verifies them on every request.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+)
+
+// Header is an alternative to "Authorization: Bearer <token>" for clients
+// that can't set the Authorization header.
+const Header = "X-API-Key"
+
+// A token is tokenPrefix, the hex-encoded prefix, "_" and the hex-encoded
+// secret. Only the prefix is stored in clear, to find the key and to tell keys
+// apart in listings.
+const (
+	tokenPrefix = "pbk_"
+	prefixBytes = 6
+	secretBytes = 24
+)
+
+const maxNameLength = 64
+
+var scopePattern = regexp.MustCompile(`^(\*|[a-z]+:(\*|[a-z\-]+))$`)
+
+// defaultScopes are given to keys created without scopes.
+var defaultScopes = []string{"phonebook:read"}
+
+// Key is an API key as shown to administrators. The token itself is never
+// stored, and only returned once by Issued.
+type Key struct {
+	KeyID      int        `json:"keyId"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Issued is a key that was just created or rotated, with the token the
+// caller has to keep.
+type Issued struct {
+	Key
+	Token string `json:"token"`
+}
+
+// active reports whether the key can still be used at now.
+func (k *Key) active(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// generate returns a new random token with its prefix and hash.
+func generate() (token string, prefix string, hash string, err error) {
+	b := make([]byte, prefixBytes+secretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	prefix = hex.EncodeToString(b[:prefixBytes])
+	token = tokenPrefix + prefix + "_" + hex.EncodeToString(b[prefixBytes:])
+	return token, prefix, hashToken(token), nil
+}
+
+// parseToken returns the prefix of a token, and false when the string isn't
+// shaped like one of our tokens at all.
+func parseToken(token string) (string, bool) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return "", false
+	}
+	rest := strings.TrimPrefix(token, tokenPrefix)
+	if len(rest) != 2*prefixBytes+1+2*secretBytes || rest[2*prefixBytes] != '_' {
+		return "", false
+	}
+	return rest[:2*prefixBytes], true
+}
+
+// hashToken is what is stored in place of the token. The tokens are long and
+// random, so a fast hash is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validate checks a key sent to be created, filling in the default scopes.
+func validate(key *Key) []problem.FieldError {
+	var errs []problem.FieldError
+	key.Name = strings.TrimSpace(key.Name)
+	if key.Name == "" {
+		errs = append(errs, problem.FieldError{Field: "name", Message: "is required"})
+	} else if utf8.RuneCountInString(key.Name) > maxNameLength {
+		errs = append(errs, problem.FieldError{Field: "name", Message: fmt.Sprintf("must have at most %d characters", maxNameLength)})
+	}
+	if len(key.Scopes) == 0 {
+		key.Scopes = defaultScopes
+	}
+	for i, scope := range key.Scopes {
+		if !scopePattern.MatchString(scope) {
+			errs = append(errs, problem.FieldError{Field: fmt.Sprintf("scopes[%d]", i), Message: "must look like phonebook:read or admin:*"})
+		}
+	}
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now()) {
+		errs = append(errs, problem.FieldError{Field: "expiresAt", Message: "must be in the future"})
+	}
+	return errs
+}
+
+// unheldScope returns the first of scopes the caller of ctx doesn't hold
+// itself, or "" when it holds them all, so no one can hand out a key allowed
+// to do more than they may.
+func unheldScope(ctx context.Context, scopes []string) string {
+	p, ok := auth.FromContext(ctx)
+	for _, scope := range scopes {
+		if !ok || !p.Allows(scope) {
+			return scope
+		}
+	}
+	return ""
+}
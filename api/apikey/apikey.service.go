@@ -0,0 +1,257 @@
+package apikey
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/admission"
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/compress"
+	"github.com/Paulo-Eduardo/phone_book/cors"
+	"github.com/Paulo-Eduardo/phone_book/logger"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/ratelimit"
+	"github.com/Paulo-Eduardo/phone_book/requestid"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+const apiKeyBasePath = "admin/apikeys"
+
+// permission is required to manage the keys of a tenant.
+const permission = "admin:keys"
+
+// touchInterval is how stale last_used_at may get before it is written again.
+const touchInterval = time.Minute
+
+var db *sql.DB
+var timeout int
+
+func SetupRoutes(apiBasePath string, dbConn *sql.DB, to int) {
+	db = dbConn
+	timeout = to
+	handleKeys := http.HandlerFunc(keysHandler)
+	handleKey := http.HandlerFunc(keyHandler)
+	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, apiKeyBasePath), requestid.Middleware(logger.Middleware(compress.Middleware(cors.Middleware(admission.Middleware(auth.Middleware(tenant.Middleware(ratelimit.Middleware(handleKeys)))))))))
+	http.Handle(fmt.Sprintf("%s/%s/", apiBasePath, apiKeyBasePath), requestid.Middleware(logger.Middleware(compress.Middleware(cors.Middleware(admission.Middleware(auth.Middleware(tenant.Middleware(ratelimit.Middleware(handleKey)))))))))
+}
+
+// Authenticate is an auth.Authenticator for the tokens sent as
+// "Authorization: Bearer <token>" or in the X-API-Key header.
+func Authenticate(r *http.Request) (*auth.Principal, error) {
+	token := r.Header.Get(Header)
+	if token == "" {
+		bearer := r.Header.Get("Authorization")
+		if len(bearer) > 7 && strings.EqualFold(bearer[:7], "Bearer ") {
+			token = strings.TrimSpace(bearer[7:])
+		}
+	}
+	prefix, ok := parseToken(token)
+	if !ok {
+		return nil, nil
+	}
+
+	stored, err := lookup(r.Context(), prefix, db, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil || subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(stored.hash)) != 1 {
+		return nil, auth.ErrInvalidCredentials
+	}
+	now := time.Now().UTC()
+	if !stored.active(now) {
+		return nil, auth.ErrInvalidCredentials
+	}
+
+	if stored.LastUsedAt == nil || now.Sub(*stored.LastUsedAt) > touchInterval {
+		if err := touch(r.Context(), stored.KeyID, now, db, timeout); err != nil {
+			log.Printf("An error accured trying to record the use of api key %s: %v", stored.Prefix, err)
+		}
+	}
+
+	return &auth.Principal{
+		Subject: auth.MethodAPIKey + ":" + stored.Prefix,
+		Name:    stored.Name,
+		Method:  auth.MethodAPIKey,
+		Tenant:  stored.tenantID,
+		Scopes:  stored.Scopes,
+	}, nil
+}
+
+// keysHandler serves GET and POST /admin/apikeys.
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !auth.Check(w, r, permission) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := list(r.Context(), db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to list api keys: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The API keys could not be listed.")
+			return
+		}
+		problem.WriteJSON(w, r, http.StatusOK, keys)
+	case http.MethodPost:
+		var newKey Key
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("An error accured trying to read the body: %v", err)
+			problem.Write(w, r, problem.Malformed("The request body could not be read."))
+			return
+		}
+		if err := json.Unmarshal(bodyBytes, &newKey); err != nil {
+			log.Printf("An error accured trying to parse the body: %v", err)
+			problem.Write(w, r, problem.Malformed("The request body is not a valid API key."))
+			return
+		}
+		if errs := validate(&newKey); len(errs) > 0 {
+			problem.Write(w, r, problem.Validation(errs))
+			return
+		}
+		if scope := unheldScope(r.Context(), newKey.Scopes); scope != "" {
+			problem.Write(w, r, problem.Forbidden(scope))
+			return
+		}
+		issued, err := issue(r.Context(), newKey)
+		if err != nil {
+			log.Printf("An error accured trying to create the api key: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The API key could not be created.")
+			return
+		}
+		problem.WriteJSON(w, r, http.StatusCreated, issued)
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// keyHandler serves a single key:
+//
+//	GET, DELETE /admin/apikeys/{id}
+//	POST        /admin/apikeys/{id}/rotate
+func keyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !auth.Check(w, r, permission) {
+		return
+	}
+
+	urlPathSegments := strings.Split(r.URL.Path, "apikeys/")
+	pathSegments := strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	keyID, err := strconv.Atoi(pathSegments[0])
+	if err != nil || len(pathSegments) > 2 || (len(pathSegments) == 2 && pathSegments[1] != "rotate") {
+		problem.Error(w, r, http.StatusNotFound, "")
+		return
+	}
+
+	if len(pathSegments) == 2 {
+		if r.Method != http.MethodPost {
+			problem.Error(w, r, http.StatusMethodNotAllowed, "")
+			return
+		}
+		issued, err := rotateKey(r.Context(), keyID)
+		if err == errKeyNotFound {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("API key %d does not exist or is revoked.", keyID))
+			return
+		} else if scope, ok := err.(unheldScopeError); ok {
+			problem.Write(w, r, problem.Forbidden(string(scope)))
+			return
+		} else if err != nil {
+			log.Printf("An error accured trying to rotate the api key: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The API key could not be rotated.")
+			return
+		}
+		problem.WriteJSON(w, r, http.StatusOK, issued)
+		return
+	}
+
+	key, err := get(r.Context(), keyID, db, timeout)
+	if err != nil {
+		log.Printf("An error accured trying to get the api key: %v", err)
+		problem.Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if key == nil {
+		problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("API key %d does not exist.", keyID))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		problem.WriteJSON(w, r, http.StatusOK, key)
+	case http.MethodDelete:
+		if err := revoke(r.Context(), keyID, db, timeout); err != nil {
+			log.Printf("An error accured trying to revoke the api key: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The API key could not be revoked.")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// issue creates a key for the tenant of ctx and returns it with its token.
+func issue(ctx context.Context, key Key) (*Issued, error) {
+	token, prefix, hash, err := generate()
+	if err != nil {
+		return nil, err
+	}
+	key.Prefix = prefix
+	key.CreatedAt = time.Now().UTC()
+	key.LastUsedAt = nil
+	key.RevokedAt = nil
+
+	keyID, err := insert(ctx, key, prefix, hash, db, timeout)
+	if err != nil {
+		return nil, err
+	}
+	key.KeyID = keyID
+	return &Issued{Key: key, Token: token}, nil
+}
+
+// unheldScopeError is returned for a key with a scope its rotator doesn't
+// hold, who would otherwise get its token.
+type unheldScopeError string
+
+func (e unheldScopeError) Error() string {
+	return fmt.Sprintf("the %s scope is not held by the caller", string(e))
+}
+
+// rotateKey gives an active key a new token. The old token stops working
+// immediately.
+func rotateKey(ctx context.Context, keyID int) (*Issued, error) {
+	key, err := get(ctx, keyID, db, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil || key.RevokedAt != nil {
+		return nil, errKeyNotFound
+	}
+	if scope := unheldScope(ctx, key.Scopes); scope != "" {
+		return nil, unheldScopeError(scope)
+	}
+
+	token, prefix, hash, err := generate()
+	if err != nil {
+		return nil, err
+	}
+	if err := rotate(ctx, keyID, prefix, hash, db, timeout); err != nil {
+		return nil, err
+	}
+	key.Prefix = prefix
+	return &Issued{Key: *key, Token: token}, nil
+}
@@ -0,0 +1,247 @@
+package apikey
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var mock sqlmock.Sqlmock
+
+// testTenant is the tenant every test runs as.
+const testTenant = "acme"
+
+func TestMain(m *testing.M) {
+	var err error
+	db, mock, err = sqlmock.New()
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	timeout = 15
+	os.Exit(m.Run())
+}
+
+// newRequest is http.NewRequest for a request already authenticated with the
+// given scopes by auth.Middleware and resolved to testTenant.
+func newRequest(method, url string, body io.Reader, scopes ...string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: "apikey:admin", Method: auth.MethodAPIKey, Tenant: testTenant, Scopes: scopes})
+	return req.WithContext(tenant.NewContext(ctx, testTenant)), nil
+}
+
+func lookupRows(token string, expiresAt *time.Time, revokedAt *time.Time) *sqlmock.Rows {
+	prefix, _ := parseToken(token)
+	return sqlmock.NewRows([]string{"keyId", "name", "prefix", "scopes", "createdAt", "expires_at", "last_used_at", "revoked_at", "tenant_id", "hash"}).
+		AddRow(3, "ci", prefix, "phonebook:read phonebook:write", time.Now(), expiresAt, nil, revokedAt, testTenant, hashToken(token))
+}
+
+func TestGeneratedTokensParse(t *testing.T) {
+	token, prefix, hash, err := generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := parseToken(token); !ok || got != prefix {
+		t.Errorf("parseToken(%q) = (%q, %v) want (%q, true)", token, got, ok, prefix)
+	}
+	if hash != hashToken(token) || strings.Contains(hash, prefix) {
+		t.Errorf("unexpected hash %q for %q", hash, token)
+	}
+	if _, ok := parseToken("eyJhbGciOiJSUzI1NiJ9.e30.sig"); ok {
+		t.Error("a JWT was taken for an API key")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	token, _, _, _ := generate()
+	prefix, _ := parseToken(token)
+	past := time.Now().Add(-time.Hour)
+
+	mock.ExpectQuery("SELECT .* FROM api_keys WHERE prefix = \\?").
+		WithArgs(prefix).
+		WillReturnRows(lookupRows(token, nil, nil))
+	mock.ExpectExec("UPDATE api_keys SET last_used_at = \\? WHERE keyId = \\?").
+		WithArgs(sqlmock.AnyArg(), 3, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest("GET", "/api/phonebooks", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	p, err := Authenticate(req)
+	if err != nil || p == nil {
+		t.Fatalf("Authenticate returned (%v, %v)", p, err)
+	}
+	if p.Tenant != testTenant || !p.Allows("phonebook:write") || p.Allows("phonebook:delete") {
+		t.Errorf("Authenticate returned wrong principal: %+v", p)
+	}
+
+	tests := []struct {
+		name string
+		rows *sqlmock.Rows
+		sent string
+	}{
+		{name: "unknown", rows: sqlmock.NewRows([]string{"keyId"}), sent: token},
+		{name: "wrong secret", rows: lookupRows(token, nil, nil), sent: token[:len(token)-4] + "0000"},
+		{name: "expired", rows: lookupRows(token, &past, nil), sent: token},
+		{name: "revoked", rows: lookupRows(token, nil, &past), sent: token},
+	}
+	for _, test := range tests {
+		mock.ExpectQuery("FROM api_keys WHERE prefix = \\?").WillReturnRows(test.rows)
+
+		req := httptest.NewRequest("GET", "/api/phonebooks", nil)
+		req.Header.Set(Header, test.sent)
+		if p, err := Authenticate(req); err != auth.ErrInvalidCredentials {
+			t.Errorf("%s: Authenticate returned (%v, %v) want %v", test.name, p, err, auth.ErrInvalidCredentials)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/api/phonebooks", nil)
+	if p, err := Authenticate(req); p != nil || err != nil {
+		t.Errorf("Authenticate without a key returned (%v, %v)", p, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostKeyHandler(t *testing.T) {
+	handler := http.HandlerFunc(keysHandler)
+
+	mock.ExpectExec("INSERT INTO api_keys").
+		WithArgs(testTenant, "ci", sqlmock.AnyArg(), sqlmock.AnyArg(), "phonebook:read phonebook:write", sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(4, 1))
+
+	req, err := newRequest("POST", "/admin/apikeys", bytes.NewBufferString(`{"name": "ci", "scopes": ["phonebook:read", "phonebook:write"]}`), "admin:*", "phonebook:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var issued Issued
+	if err := json.Unmarshal(rr.Body.Bytes(), &issued); err != nil {
+		t.Fatal(err)
+	}
+	if prefix, ok := parseToken(issued.Token); !ok || prefix != issued.Prefix || issued.KeyID != 4 {
+		t.Errorf("handler returned wrong key: %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostKeyHandlerRefusesScopesTheCallerDoesntHold(t *testing.T) {
+	handler := http.HandlerFunc(keysHandler)
+
+	for _, scopes := range []string{`["*"]`, `["phonebook:*"]`, `["phonebook:read", "phonebook:delete"]`} {
+		req, err := newRequest("POST", "/admin/apikeys", bytes.NewBufferString(`{"name": "ci", "scopes": `+scopes+`}`), "admin:keys", "phonebook:read")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", scopes, status, http.StatusForbidden)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRotateKeyHandlerRefusesKeysWithScopesTheCallerDoesntHold(t *testing.T) {
+	handler := http.HandlerFunc(keyHandler)
+
+	mock.ExpectQuery("FROM api_keys WHERE keyId = \\? AND tenant_id = \\?").
+		WithArgs(3, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"keyId", "name", "prefix", "scopes", "createdAt", "expires_at", "last_used_at", "revoked_at"}).
+			AddRow(3, "ops", "0123456789ab", "*", time.Now(), nil, nil, nil))
+
+	req, err := newRequest("POST", "/admin/apikeys/3/rotate", nil, "admin:keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeysHandlerRequiresAdmin(t *testing.T) {
+	handler := http.HandlerFunc(keysHandler)
+
+	req, err := newRequest("GET", "/admin/apikeys", nil, "phonebook:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+	if !strings.Contains(rr.Body.String(), permission) {
+		t.Errorf("handler didn't name the missing permission: %s", rr.Body.String())
+	}
+}
+
+func TestRotateKeyHandler(t *testing.T) {
+	handler := http.HandlerFunc(keyHandler)
+
+	mock.ExpectQuery("FROM api_keys WHERE keyId = \\? AND tenant_id = \\?").
+		WithArgs(3, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"keyId", "name", "prefix", "scopes", "createdAt", "expires_at", "last_used_at", "revoked_at"}).
+			AddRow(3, "ci", "0123456789ab", "phonebook:read", time.Now(), nil, nil, nil))
+	mock.ExpectExec("UPDATE api_keys SET prefix=\\?, hash=\\? WHERE keyId = \\? AND tenant_id = \\? AND revoked_at IS NULL").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 3, testTenant).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req, err := newRequest("POST", "/admin/apikeys/3/rotate", nil, "admin:keys", "phonebook:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var issued Issued
+	if err := json.Unmarshal(rr.Body.Bytes(), &issued); err != nil {
+		t.Fatal(err)
+	}
+	if issued.Prefix == "0123456789ab" || issued.Token == "" {
+		t.Errorf("handler didn't rotate the key: %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
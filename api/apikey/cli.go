@@ -0,0 +1,120 @@
+package apikey
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+const cliUsage = `usage:
+  main apikey create -name <name> [-tenant <id>] [-scopes phonebook:read,phonebook:write] [-expires 720h]
+  main apikey list [-tenant <id>]
+  main apikey rotate [-tenant <id>] <keyId>
+  main apikey revoke [-tenant <id>] <keyId>`
+
+// operator is the principal of the command line. Whoever runs it can reach
+// the database anyway, so it holds every scope, and may issue any key.
+var operator = &auth.Principal{Subject: auth.MethodCLI, Name: auth.MethodCLI, Method: auth.MethodCLI, Scopes: []string{"*"}}
+
+// RunCLI runs "main apikey <command>", which manages keys straight in the
+// database, for instance to create the first admin key of a tenant.
+func RunCLI(args []string, dbConn *sql.DB, to int, out io.Writer) error {
+	db = dbConn
+	timeout = to
+
+	if len(args) == 0 {
+		return errors.New(cliUsage)
+	}
+	command := args[0]
+
+	flags := flag.NewFlagSet("apikey "+command, flag.ContinueOnError)
+	flags.SetOutput(out)
+	tenantID := flags.String("tenant", tenant.DefaultID, "tenant the key belongs to")
+	name := flags.String("name", "", "name of the key")
+	scopes := flags.String("scopes", strings.Join(defaultScopes, ","), "comma separated scopes")
+	expires := flags.Duration("expires", 0, "lifetime of the key, such as 720h; 0 never expires")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	ctx := tenant.NewContext(auth.NewContext(context.Background(), operator), *tenantID)
+
+	switch command {
+	case "create":
+		key := Key{Name: *name, Scopes: strings.Split(*scopes, ",")}
+		if *expires > 0 {
+			expiresAt := time.Now().UTC().Add(*expires)
+			key.ExpiresAt = &expiresAt
+		}
+		if errs := validate(&key); len(errs) > 0 {
+			return fieldErrors(errs)
+		}
+		issued, err := issue(ctx, key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created API key %d (%s) for tenant %s. Keep the token, it won't be shown again:\n%s\n",
+			issued.KeyID, issued.Prefix, *tenantID, issued.Token)
+	case "list":
+		keys, err := list(ctx, db, timeout)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tSCOPES\tEXPIRES\tLAST USED\tREVOKED")
+		for _, key := range keys {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", key.KeyID, key.Name, key.Prefix,
+				strings.Join(key.Scopes, ","), formatTime(key.ExpiresAt), formatTime(key.LastUsedAt), formatTime(key.RevokedAt))
+		}
+		return tw.Flush()
+	case "rotate", "revoke":
+		if flags.NArg() != 1 {
+			return errors.New(cliUsage)
+		}
+		keyID, err := strconv.Atoi(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("invalid key id %q", flags.Arg(0))
+		}
+		if command == "revoke" {
+			if err := revoke(ctx, keyID, db, timeout); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Revoked API key %d.\n", keyID)
+			return nil
+		}
+		issued, err := rotateKey(ctx, keyID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Rotated API key %d (%s). Keep the token, it won't be shown again:\n%s\n",
+			issued.KeyID, issued.Prefix, issued.Token)
+	default:
+		return errors.New(cliUsage)
+	}
+	return nil
+}
+
+func fieldErrors(errs []problem.FieldError) error {
+	messages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		messages = append(messages, e.Field+" "+e.Message)
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,31 @@
+package apikey
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCLIRotatesKeys(t *testing.T) {
+	mock.ExpectQuery("FROM api_keys WHERE keyId = \\? AND tenant_id = \\?").
+		WithArgs(3, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"keyId", "name", "prefix", "scopes", "createdAt", "expires_at", "last_used_at", "revoked_at"}).
+			AddRow(3, "ops", "0123456789ab", "admin:* phonebook:read", time.Now(), nil, nil, nil))
+	mock.ExpectExec("UPDATE api_keys SET prefix=\\?, hash=\\? WHERE keyId = \\? AND tenant_id = \\? AND revoked_at IS NULL").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 3, testTenant).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var out bytes.Buffer
+	if err := RunCLI([]string{"rotate", "-tenant", testTenant, "3"}, db, timeout, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "Rotated API key 3 ") || strings.Contains(out.String(), "0123456789ab") {
+		t.Errorf("RunCLI printed %q", out.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
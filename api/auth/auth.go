@@ -0,0 +1,77 @@
+// Package auth identifies the caller of a request and what it is allowed to
+// do.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Methods a principal can be authenticated with.
+const (
+	MethodAnonymous = "anonymous"
+	MethodAPIKey    = "apikey"
+	MethodJWT       = "jwt"
+	// MethodCLI is the operator running the command line tools, who reaches
+	// the database directly.
+	MethodCLI = "cli"
+)
+
+// ErrInvalidCredentials is returned by an Authenticator when the request
+// carries a credential of its kind that is unknown, expired or revoked.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// Subject identifies the caller, such as "apikey:3f9c0a1b2d4e".
+	Subject string `json:"subject"`
+	Name    string `json:"name"`
+	Method  string `json:"method"`
+	// Tenant is the tenant the credential belongs to, empty when the caller
+	// may pick one.
+	Tenant string   `json:"tenant,omitempty"`
+	Scopes []string `json:"scopes"`
+	// Roles grant the permissions the policy maps them to, on top of Scopes.
+	Roles []string `json:"roles,omitempty"`
+	// Claims are the claims of the bearer token the caller authenticated
+	// with, nil for other methods.
+	Claims map[string]interface{} `json:"-"`
+}
+
+// anonymous is the principal of every request when authentication is disabled.
+var anonymous = Principal{Subject: MethodAnonymous, Name: MethodAnonymous, Method: MethodAnonymous, Scopes: []string{"*"}}
+
+// Allows reports whether one of the scopes of p, or a permission granted by
+// one of its roles, grants permission.
+func (p *Principal) Allows(permission string) bool {
+	return grants(p.Scopes, permission) || grants(policy.Permissions(p.Roles), permission)
+}
+
+// Authenticator recognises one kind of credential. It returns nil and no
+// error when the request doesn't carry a credential of its kind.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface.
+type AuthenticatorFunc func(r *http.Request) (*Principal, error)
+
+// Authenticate calls f(r).
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Principal, error) {
+	return f(r)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the given principal.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal of a request. Requests that didn't go
+// through Middleware have none.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(*Principal)
+	return p, ok && p != nil
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var (
+	required       = true
+	authenticators []Authenticator
+)
+
+// Setup configures Middleware. When required is false, requests without
+// credentials are let through as an anonymous principal allowed to do
+// everything.
+func Setup(requireCredentials bool, a ...Authenticator) {
+	required = requireCredentials
+	authenticators = a
+}
+
+// Middleware : authenticates the request with the first authenticator that
+// recognises its credential and makes the principal available to the
+// handlers. The tenant a credential belongs to is handed to tenant.Middleware,
+// which has to come after this one.
+func Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		var principal *Principal
+		for _, authenticator := range authenticators {
+			p, err := authenticator.Authenticate(r)
+			if err == ErrInvalidCredentials {
+				unauthorized(w, r, "The credentials are invalid, expired or revoked.")
+				return
+			} else if err != nil {
+				log.Printf("An error accured trying to authenticate the request: %v", err)
+				problem.Error(w, r, http.StatusInternalServerError, "")
+				return
+			}
+			if p != nil {
+				principal = p
+				break
+			}
+		}
+
+		if principal == nil {
+			if required {
+				unauthorized(w, r, "The request must carry an API key or a bearer token.")
+				return
+			}
+			p := anonymous
+			principal = &p
+		}
+
+		ctx := NewContext(r.Context(), principal)
+		if principal.Tenant != "" {
+			ctx = tenant.NewClaimContext(ctx, principal.Tenant)
+		}
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Check reports whether the principal of r has permission, answering the
+// request with 403 when it hasn't.
+func Check(w http.ResponseWriter, r *http.Request, permission string) bool {
+	p, ok := FromContext(r.Context())
+	if !ok {
+		unauthorized(w, r, "The request is not authenticated.")
+		return false
+	}
+	if !p.Allows(permission) {
+		problem.Write(w, r, problem.Forbidden(permission))
+		return false
+	}
+	return true
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, detail string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="phonebook"`)
+	problem.Error(w, r, http.StatusUnauthorized, detail)
+}
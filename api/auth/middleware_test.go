@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var robot = AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+	switch r.Header.Get("Authorization") {
+	case "":
+		return nil, nil
+	case "Bearer good":
+		return &Principal{Subject: "robot", Method: MethodAPIKey, Tenant: "acme", Scopes: []string{"phonebook:*"}}, nil
+	case "Bearer broken":
+		return nil, errors.New("database is down")
+	default:
+		return nil, ErrInvalidCredentials
+	}
+})
+
+func TestMiddleware(t *testing.T) {
+	tenant.Setup(tenant.New("globex", "", tenant.Config{ID: "acme"}, tenant.Config{ID: "globex"}))
+	defer tenant.Setup(tenant.Single(tenant.DefaultID))
+	defer Setup(true)
+
+	tests := []struct {
+		name          string
+		required      bool
+		authorization string
+		method        string
+		status        int
+		subject       string
+		tenant        string
+	}{
+		{name: "valid credential", required: true, authorization: "Bearer good", status: http.StatusOK, subject: "robot", tenant: "acme"},
+		{name: "invalid credential", required: true, authorization: "Bearer bad", status: http.StatusUnauthorized},
+		{name: "missing credential", required: true, status: http.StatusUnauthorized},
+		{name: "authenticator failure", required: true, authorization: "Bearer broken", status: http.StatusInternalServerError},
+		{name: "preflight", required: true, method: http.MethodOptions, status: http.StatusOK},
+		{name: "disabled", required: false, status: http.StatusOK, subject: MethodAnonymous, tenant: "globex"},
+		{name: "disabled still checks credentials", required: false, authorization: "Bearer bad", status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		Setup(test.required, robot)
+
+		var subject, tenantID string
+		handler := Middleware(tenant.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p, ok := FromContext(r.Context()); ok {
+				subject = p.Subject
+			}
+			tenantID, _ = tenant.FromContext(r.Context())
+		})))
+
+		method := test.method
+		if method == "" {
+			method = http.MethodGet
+		}
+		req := httptest.NewRequest(method, "/api/phonebooks", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != test.status || subject != test.subject || tenantID != test.tenant {
+			t.Errorf("%s: got (%v, %q, %q) want (%v, %q, %q)", test.name, rr.Code, subject, tenantID, test.status, test.subject, test.tenant)
+		}
+		if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without WWW-Authenticate", test.name)
+		}
+	}
+}
+
+func TestKeyTenantWinsOverHeader(t *testing.T) {
+	tenant.Setup(tenant.New("", "", tenant.Config{ID: "acme"}, tenant.Config{ID: "globex"}))
+	defer tenant.Setup(tenant.Single(tenant.DefaultID))
+	Setup(true, robot)
+	defer Setup(true)
+
+	handler := Middleware(tenant.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	req := httptest.NewRequest("GET", "/api/phonebooks", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	req.Header.Set(tenant.Header, "globex")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("a key of acme reached globex: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestAllows(t *testing.T) {
+	p := &Principal{Scopes: []string{"phonebook:read", "admin:*"}}
+	tests := map[string]bool{
+		"phonebook:read":   true,
+		"phonebook:write":  false,
+		"admin:keys":       true,
+		"administrator:xx": false,
+	}
+	for permission, want := range tests {
+		if got := p.Allows(permission); got != want {
+			t.Errorf("Allows(%q) = %v want %v", permission, got, want)
+		}
+	}
+	if !(&Principal{Scopes: []string{"*"}}).Allows("phonebook:delete") {
+		t.Error(`"*" should allow every permission`)
+	}
+}
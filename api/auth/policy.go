@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// permissionPattern matches a permission such as "phonebook:read", or a
+// wildcard granting several of them.
+var permissionPattern = regexp.MustCompile(`^(\*|[a-z]+:(\*|[a-z\-]+))$`)
+
+// Policy maps the roles of principals to the permissions they grant.
+type Policy struct {
+	Roles map[string][]string `json:"roles"`
+}
+
+// DefaultPolicy is used until SetPolicy is called: viewers can read, editors
+// can also change and export phonebooks, and admins can do everything,
+// including seeing restricted numbers.
+var DefaultPolicy = Policy{Roles: map[string][]string{
+	"viewer": {"phonebook:read", "phonebook:read-internal"},
+	"editor": {"phonebook:read", "phonebook:read-internal", "phonebook:write", "phonebook:export"},
+	"admin":  {"phonebook:*", "admin:*"},
+}}
+
+var policy = DefaultPolicy
+
+// SetPolicy replaces the policy roles are resolved with.
+func SetPolicy(p Policy) {
+	policy = p
+}
+
+// LoadPolicy reads a policy from a JSON file such as
+//
+//	{"roles": {"intern": ["phonebook:read"], "lead": ["phonebook:read", "phonebook:write"]}}
+func LoadPolicy(path string) (Policy, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Policy{}, err
+	}
+	var p Policy
+	if err := json.Unmarshal(content, &p); err != nil {
+		return Policy{}, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for role, permissions := range p.Roles {
+		for _, permission := range permissions {
+			if !permissionPattern.MatchString(permission) {
+				return Policy{}, fmt.Errorf("invalid permission %q of role %q in %s", permission, role, path)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Permissions returns the permissions granted by roles. Roles the policy
+// doesn't know grant nothing.
+func (p Policy) Permissions(roles []string) []string {
+	var permissions []string
+	for _, role := range roles {
+		permissions = append(permissions, p.Roles[role]...)
+	}
+	return permissions
+}
+
+// grants reports whether one of permissions grants permission. A permission
+// ending in ":*" grants every permission with that prefix, and "*" grants all
+// of them.
+func grants(permissions []string, permission string) bool {
+	for _, p := range permissions {
+		if p == "*" || p == permission {
+			return true
+		}
+		if strings.HasSuffix(p, ":*") && strings.HasPrefix(permission, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writePolicy(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPolicy(t *testing.T) {
+	p, err := LoadPolicy(writePolicy(t, `{"roles": {"intern": ["phonebook:read"], "lead": ["phonebook:read", "phonebook:write"], "admin": ["phonebook:*", "admin:*"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetPolicy(p)
+	defer SetPolicy(DefaultPolicy)
+
+	tests := []struct {
+		roles      []string
+		permission string
+		want       bool
+	}{
+		{roles: []string{"intern"}, permission: "phonebook:read", want: true},
+		{roles: []string{"intern"}, permission: "phonebook:write", want: false},
+		{roles: []string{"lead"}, permission: "phonebook:write", want: true},
+		{roles: []string{"lead"}, permission: "phonebook:delete", want: false},
+		{roles: []string{"intern", "admin"}, permission: "phonebook:delete", want: true},
+		{roles: []string{"admin"}, permission: "admin:keys", want: true},
+		{roles: []string{"viewer"}, permission: "phonebook:read", want: false},
+		{roles: nil, permission: "phonebook:read", want: false},
+	}
+	for _, test := range tests {
+		if got := (&Principal{Roles: test.roles}).Allows(test.permission); got != test.want {
+			t.Errorf("roles %v Allows(%q) = %v want %v", test.roles, test.permission, got, test.want)
+		}
+	}
+}
+
+func TestLoadInvalidPolicy(t *testing.T) {
+	for _, content := range []string{
+		`{"roles": {"intern": ["read everything"]}}`,
+		`{"roles": ["intern"]}`,
+	} {
+		if _, err := LoadPolicy(writePolicy(t, content)); err == nil {
+			t.Errorf("policy %s was loaded", content)
+		}
+	}
+}
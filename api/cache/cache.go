@@ -0,0 +1,180 @@
+// Package cache is an in-process LRU cache whose entries expire after a TTL,
+// reading through to a loader that runs once for concurrent misses of the same
+// key.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Results of a lookup, as counted by the metrics.
+const (
+	resultHit    = "hit"
+	resultMiss   = "miss"
+	resultShared = "shared"
+)
+
+var (
+	lookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_cache_lookups_total",
+		Help: "The total number of cache lookups by result: hit, miss, or shared with a concurrent miss",
+	}, []string{"cache", "result"})
+	evictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_cache_evictions_total",
+		Help: "The total number of entries evicted to keep caches within their size",
+	}, []string{"cache"})
+	entries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "api_cache_entries",
+		Help: "The number of entries held by each cache",
+	}, []string{"cache"})
+)
+
+var errLoadPanicked = errors.New("cache: the load of the value panicked")
+
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// Cache holds up to size entries, each for ttl.
+type Cache struct {
+	name string
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+	calls map[string]*call
+	now   func() time.Time
+}
+
+// call is a load in progress, waited on by the lookups of the same key.
+type call struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// New returns an empty cache. name labels its metrics.
+func New(name string, size int, ttl time.Duration) *Cache {
+	return &Cache{
+		name:  name,
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: map[string]*list.Element{},
+		calls: map[string]*call{},
+		now:   time.Now,
+	}
+}
+
+// Fetch returns the value of key, calling load when it isn't cached. While a
+// load runs, other fetches of the key wait for it instead of loading again.
+// Errors are returned to every waiter and not cached.
+//
+// The load runs on its own, so it must not depend on the context of any of
+// the fetches: each of them stops waiting when its ctx is done, and the load
+// carries on for the others and the cache.
+func (c *Cache) Fetch(ctx context.Context, key string, load func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	if value, ok := c.get(key); ok {
+		c.mu.Unlock()
+		lookups.WithLabelValues(c.name, resultHit).Inc()
+		return value, nil
+	}
+	current, ok := c.calls[key]
+	if ok {
+		lookups.WithLabelValues(c.name, resultShared).Inc()
+	} else {
+		current = &call{done: make(chan struct{})}
+		c.calls[key] = current
+		lookups.WithLabelValues(c.name, resultMiss).Inc()
+		go c.load(key, current, load)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-current.done:
+		return current.value, current.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Cache) load(key string, current *call, load func() (interface{}, error)) {
+	// A load that panics leaves errLoadPanicked to the waiters instead of
+	// blocking them forever, or taking the process down.
+	current.err = errLoadPanicked
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("The load of %s of the %s cache panicked: %v\n%s", key, c.name, r, debug.Stack())
+		}
+		c.mu.Lock()
+		delete(c.calls, key)
+		if current.err == nil {
+			c.set(key, current.value)
+		}
+		c.mu.Unlock()
+		close(current.done)
+	}()
+	current.value, current.err = load()
+}
+
+// Purge drops every entry.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.items = map[string]*list.Element{}
+	entries.WithLabelValues(c.name).Set(0)
+}
+
+// Len returns the number of entries, including expired ones not dropped yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *Cache) get(key string) (interface{}, bool) {
+	element, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := element.Value.(*entry)
+	if !c.now().Before(e.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return e.value, true
+}
+
+func (c *Cache) set(key string, value interface{}) {
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+	c.items[key] = c.order.PushFront(&entry{key: key, value: value, expires: c.now().Add(c.ttl)})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		evictions.WithLabelValues(c.name).Inc()
+	}
+	entries.WithLabelValues(c.name).Set(float64(c.order.Len()))
+}
+
+func (c *Cache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.items, element.Value.(*entry).key)
+	entries.WithLabelValues(c.name).Set(float64(c.order.Len()))
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func value(v interface{}) func() (interface{}, error) {
+	return func() (interface{}, error) { return v, nil }
+}
+
+func TestFetchEvictsTheLeastRecentlyUsed(t *testing.T) {
+	c := New("test", 2, time.Minute)
+	c.Fetch(context.Background(), "a", value(1))
+	c.Fetch(context.Background(), "b", value(2))
+	c.Fetch(context.Background(), "a", value(0))
+	c.Fetch(context.Background(), "c", value(3))
+
+	if got, _ := c.Fetch(context.Background(), "a", value(0)); got != 1 {
+		t.Errorf("recently used entry was evicted: got %v", got)
+	}
+	if got, _ := c.Fetch(context.Background(), "b", value(0)); got != 0 {
+		t.Errorf("least recently used entry was kept: got %v", got)
+	}
+	if c.Len() != 2 {
+		t.Errorf("cache holds %d entries want 2", c.Len())
+	}
+}
+
+func TestFetchExpiresEntries(t *testing.T) {
+	now := time.Now()
+	c := New("test", 10, time.Second)
+	c.now = func() time.Time { return now }
+
+	c.Fetch(context.Background(), "a", value(1))
+	if got, _ := c.Fetch(context.Background(), "a", value(2)); got != 1 {
+		t.Errorf("fresh entry was loaded again: got %v", got)
+	}
+	now = now.Add(time.Second)
+	if got, _ := c.Fetch(context.Background(), "a", value(2)); got != 2 {
+		t.Errorf("expired entry was served: got %v", got)
+	}
+}
+
+func TestFetchDoesNotCacheErrors(t *testing.T) {
+	c := New("test", 10, time.Minute)
+	failure := errors.New("connection refused")
+
+	if _, err := c.Fetch(context.Background(), "a", func() (interface{}, error) { return nil, failure }); err != failure {
+		t.Errorf("got error %v want %v", err, failure)
+	}
+	if got, err := c.Fetch(context.Background(), "a", value(1)); err != nil || got != 1 {
+		t.Errorf("failed load was cached: got %v, %v", got, err)
+	}
+}
+
+func TestFetchSharesConcurrentLoads(t *testing.T) {
+	c := New("test", 10, time.Minute)
+	release := make(chan struct{})
+	loads := 0
+	load := func() (interface{}, error) {
+		loads++
+		<-release
+		return "nayara", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _ = c.Fetch(context.Background(), "a", load)
+	}()
+	// Wait for the first load to start before the others look the key up.
+	for {
+		c.mu.Lock()
+		_, started := c.calls["a"]
+		c.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.Fetch(context.Background(), "a", load)
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Errorf("value was loaded %d times want 1", loads)
+	}
+	for i, got := range results {
+		if got != "nayara" {
+			t.Errorf("fetch %d got %v", i, got)
+		}
+	}
+}
+
+func TestFetchSurvivesAPanickingLoad(t *testing.T) {
+	c := New("test", 10, time.Minute)
+	if _, err := c.Fetch(context.Background(), "a", func() (interface{}, error) { panic("boom") }); err != errLoadPanicked {
+		t.Errorf("fetch of a panicking load got error %v want %v", err, errLoadPanicked)
+	}
+
+	if got, err := c.Fetch(context.Background(), "a", value(1)); err != nil || got != 1 {
+		t.Errorf("fetch after a panic got %v, %v", got, err)
+	}
+}
+
+func TestFetchStopsWaitingWhenItsContextIsDone(t *testing.T) {
+	c := New("test", 10, time.Minute)
+	release := make(chan struct{})
+	load := func() (interface{}, error) {
+		<-release
+		return "nayara", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Fetch(ctx, "a", load); err != context.Canceled {
+		t.Errorf("fetch with a canceled context got error %v want %v", err, context.Canceled)
+	}
+
+	// The load of the canceled fetch carries on for the others.
+	close(release)
+	if got, err := c.Fetch(context.Background(), "a", value("other")); err != nil || got != "nayara" {
+		t.Errorf("fetch after a canceled one got %v, %v", got, err)
+	}
+}
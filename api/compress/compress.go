@@ -0,0 +1,202 @@
+// Package compress compresses responses with the best encoding the client
+// accepts, leaving small responses alone.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultMinSize is the size below which responses are sent uncompressed,
+// since compressing them costs more than it saves.
+const DefaultMinSize = 1024
+
+// Encoding compresses a response for a Content-Encoding.
+type Encoding struct {
+	Name      string
+	NewWriter func(w io.Writer) io.WriteCloser
+}
+
+// encodings are the supported encodings, the preferred first when the client
+// accepts several equally.
+var encodings = []Encoding{
+	{Name: "br", NewWriter: func(w io.Writer) io.WriteCloser {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	}},
+	{Name: "gzip", NewWriter: func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	}},
+}
+
+var minSize = DefaultMinSize
+
+// Register adds an encoding, such as zstd, preferred over the ones already
+// registered. It must be called before serving requests.
+func Register(e Encoding) {
+	encodings = append([]Encoding{e}, encodings...)
+}
+
+// Setup sets the size below which responses are not compressed.
+func Setup(min int) {
+	minSize = min
+}
+
+// Middleware : compresses the response with the encoding preferred by the
+// Accept-Encoding of the request. The response is buffered until it reaches
+// the minimum size; smaller ones are sent as they are. A handler flushing
+// before that streams its response, which is then compressed from the start.
+func Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding, ok := negotiate(r.Header.Get("Accept-Encoding"))
+		if !ok || r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		// Not deferred: a handler aborting the response must not have it
+		// finished as if it were complete.
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, status: http.StatusOK}
+		handler.ServeHTTP(cw, r)
+		cw.close()
+	})
+}
+
+// negotiate returns the encoding with the highest q-value in header, or false
+// when the response should not be compressed.
+func negotiate(header string) (Encoding, bool) {
+	accepted := map[string]float64{}
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		accepted[name] = q
+	}
+
+	var best Encoding
+	bestQ := 0.0
+	for _, e := range encodings {
+		q, ok := accepted[e.Name]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// compressWriter buffers the start of a response to decide whether it is
+// worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding Encoding
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         bytes.Buffer
+	writer      io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	cw.wroteHeader = true
+	if cw.decided {
+		if cw.writer != nil {
+			return cw.writer.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf.Write(b)
+	if cw.buf.Len() >= minSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends what was written so far, compressed since the handler is
+// streaming.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if err := cw.decide(true); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.writer.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// decide writes the header, compressing when asked to and when the response
+// allows it, and then what was buffered.
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified || cw.status < http.StatusOK {
+		compress = false
+	}
+	if compress {
+		h.Set("Content-Encoding", cw.encoding.Name)
+		h.Del("Content-Length")
+		cw.writer = cw.encoding.NewWriter(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if cw.writer != nil {
+		_, err = cw.writer.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+	return err
+}
+
+// close ends the response, sending a response smaller than the minimum size
+// uncompressed.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			return
+		}
+		cw.decide(false)
+	}
+	if cw.writer != nil {
+		cw.writer.Close()
+	}
+}
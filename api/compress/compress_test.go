@@ -0,0 +1,100 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]string{
+		"":                      "",
+		"gzip":                  "gzip",
+		"gzip, deflate, br":     "br",
+		"br;q=0.5, gzip":        "gzip",
+		"*":                     "br",
+		"br;q=0, *":             "gzip",
+		"identity":              "",
+		"gzip;q=0, identity":    "",
+		"deflate, GZIP ;q=0.8 ": "gzip",
+	}
+	for header, want := range tests {
+		got, ok := negotiate(header)
+		if ok != (want != "") || got.Name != want {
+			t.Errorf("negotiate(%q) = %q, %v want %q", header, got.Name, ok, want)
+		}
+	}
+}
+
+func serve(handler http.HandlerFunc, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/phonebooks", nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	rr := httptest.NewRecorder()
+	Middleware(handler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestMiddlewareCompressesLargeResponses(t *testing.T) {
+	body := strings.Repeat(`{"Name":"Nayara","Phone":"47996623579"},`, 100)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(body[:10]))
+		w.Write([]byte(body[10:]))
+	}
+
+	rr := serve(handler, "gzip")
+	if rr.Code != http.StatusCreated || rr.Header().Get("Content-Encoding") != "gzip" || rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("got %v with headers %v", rr.Code, rr.Header())
+	}
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(zr); string(got) != body {
+		t.Errorf("gzip body was %q", got)
+	}
+
+	rr = serve(handler, "br")
+	if got, _ := ioutil.ReadAll(brotli.NewReader(rr.Body)); rr.Header().Get("Content-Encoding") != "br" || string(got) != body {
+		t.Errorf("brotli body was %q", got)
+	}
+}
+
+func TestMiddlewareLeavesSmallResponsesAlone(t *testing.T) {
+	rr := serve(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"status":404}`))
+	}, "gzip")
+
+	if rr.Code != http.StatusNotFound || rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != `{"status":404}` {
+		t.Errorf("got %v %q with headers %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+	if rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("got Vary %q", rr.Header().Get("Vary"))
+	}
+}
+
+func TestMiddlewareCompressesStreams(t *testing.T) {
+	rr := serve(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[1"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(",2]"))
+	}, "gzip")
+
+	if !rr.Flushed || rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("stream was not compressed: %v", rr.Header())
+	}
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(zr); string(got) != "[1,2]" {
+		t.Errorf("stream body was %q", got)
+	}
+}
@@ -9,7 +9,7 @@ import (
 )
 
 func New() *sql.DB {
-	DbConn, err := sql.Open("mysql", fmt.Sprintf("root:password123@tcp(%s)/phonebookdb", os.Getenv("DB_HOST")))
+	DbConn, err := sql.Open("mysql", fmt.Sprintf("root:password123@tcp(%s)/phonebookdb?parseTime=true", os.Getenv("DB_HOST")))
 	if err != nil {
 		log.Fatal(err)
 	}
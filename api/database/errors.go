@@ -0,0 +1,29 @@
+package database
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// errDuplicateEntry is the number of the MySQL error raised when a write
+// breaks a unique index.
+const errDuplicateEntry = 1062
+
+// DuplicateKey returns the name of the unique index err reports a duplicate
+// entry for, and whether it is such an error at all.
+func DuplicateKey(err error) (string, bool) {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != errDuplicateEntry {
+		return "", false
+	}
+	// The message ends with "for key 'name'", or with "for key 'table.name'"
+	// since MySQL 8.0.19.
+	message := strings.TrimSuffix(mysqlErr.Message, "'")
+	key := message[strings.LastIndex(message, "'")+1:]
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		key = key[i+1:]
+	}
+	return key, true
+}
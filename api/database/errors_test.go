@@ -0,0 +1,27 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDuplicateKey(t *testing.T) {
+	tests := []struct {
+		err  error
+		key  string
+		isOK bool
+	}{
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'acme-47996623579' for key 'phonebook_phones_unique'"}, "phonebook_phones_unique", true},
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'acme-nay@example.com' for key 'phonebook_emails.phonebook_emails_unique'"}, "phonebook_emails_unique", true},
+		{&mysql.MySQLError{Number: 1146, Message: "Table 'phonebookdb.phonebooks' doesn't exist"}, "", false},
+		{errors.New("Duplicate entry"), "", false},
+	}
+	for _, test := range tests {
+		key, ok := DuplicateKey(test.err)
+		if key != test.key || ok != test.isOK {
+			t.Errorf("DuplicateKey(%v) = %q, %v, want %q, %v", test.err, key, ok, test.key, test.isOK)
+		}
+	}
+}
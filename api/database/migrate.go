@@ -0,0 +1,187 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// migrationFiles are the changes made to the schema since it was first
+// created, one file each, applied in the order of their version. schema.sql
+// is the schema with all of them applied, for fresh databases.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock names the lock held while migrating, so instances started
+// together don't apply the same migration twice.
+const migrationLock = "phonebookdb.schema_migrations"
+
+// migrationLockTimeout is how long an instance waits for another one to
+// finish migrating.
+const migrationLockTimeout = 5 * time.Minute
+
+// Numbers of the MySQL errors raised when a migration, or part of it, was
+// already applied. Migrations are written to be run again after failing
+// halfway, or on a database created by an older schema.sql without knowing
+// which, so these errors are ignored.
+var alreadyAppliedErrors = map[uint16]bool{
+	1050: true, // table already exists
+	1060: true, // duplicate column name
+	1061: true, // duplicate key name
+	1091: true, // can't drop a column or key that doesn't exist
+	1826: true, // duplicate foreign key constraint name
+}
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INT NOT NULL,
+  name VARCHAR(255) NOT NULL,
+  applied_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (version)
+)`
+
+// Migration is a file of migrations.
+type Migration struct {
+	Version    int
+	Name       string
+	statements []string
+}
+
+// Migrations returns every migration, ordered by version.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		file := entry.Name()
+		parts := strings.SplitN(strings.TrimSuffix(file, ".sql"), "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", file)
+		}
+		if len(migrations) > 0 && migrations[len(migrations)-1].Version == version {
+			return nil, fmt.Errorf("migration %s reuses version %d", file, version)
+		}
+		content, err := migrationFiles.ReadFile(path.Join("migrations", file))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: parts[1], statements: splitStatements(string(content))})
+	}
+	return migrations, nil
+}
+
+// splitStatements returns the statements of a migration, which end with a
+// semicolon at the end of a line, without its comments.
+func splitStatements(content string) []string {
+	var statements []string
+	var statement strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+		if statement.Len() > 0 {
+			statement.WriteString("\n")
+		}
+		statement.WriteString(line)
+		if strings.HasSuffix(line, ";") {
+			statements = append(statements, strings.TrimSuffix(statement.String(), ";"))
+			statement.Reset()
+		}
+	}
+	if statement.Len() > 0 {
+		statements = append(statements, statement.String())
+	}
+	return statements
+}
+
+// Migrate applies the migrations the database is missing, in order, and
+// records them in schema_migrations. It returns the applied ones.
+func Migrate(db *sql.DB) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, migrationLock, int(migrationLockTimeout.Seconds())).Scan(&locked); err != nil {
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		return nil, errors.New("another instance is migrating the database")
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `DO RELEASE_LOCK(?)`, migrationLock); err != nil {
+			log.Printf("An error accured trying to release the migration lock: %v", err)
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, createMigrationsTable); err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, migration := range migrations {
+		if applied[migration.Version] {
+			continue
+		}
+		for _, statement := range migration.statements {
+			if _, err := conn.ExecContext(ctx, statement); err != nil && !alreadyApplied(err) {
+				return done, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+		}
+		if _, err := conn.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, migration.Version, migration.Name); err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+	results, err := conn.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	applied := make(map[int]bool)
+	for results.Next() {
+		var version int
+		if err := results.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, results.Err()
+}
+
+func alreadyApplied(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && alreadyAppliedErrors[mysqlErr.Number]
+}
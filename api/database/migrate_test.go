@@ -0,0 +1,131 @@
+package database
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func expectLock(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT GET_LOCK`).WithArgs(migrationLock, 300).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(1))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestMigrateAppliesTheMissingMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := migrations[len(migrations)-1]
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expectLock(mock)
+	applied := sqlmock.NewRows([]string{"version"})
+	for _, migration := range migrations[:len(migrations)-1] {
+		applied.AddRow(migration.Version)
+	}
+	mock.ExpectQuery(`SELECT version FROM schema_migrations`).WillReturnRows(applied)
+	for i, statement := range last.statements {
+		expectation := mock.ExpectExec(regexp.QuoteMeta(statement))
+		// An already applied statement is carried on from.
+		if i == 0 {
+			expectation.WillReturnError(&mysql.MySQLError{Number: 1060, Message: "Duplicate column name"})
+		} else {
+			expectation.WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+	}
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(last.Version, last.Name).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DO RELEASE_LOCK`).WithArgs(migrationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	done, err := Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 || done[0].Version != last.Version {
+		t.Errorf("Migrate applied %v, want %d", done, last.Version)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrateStopsAtAFailingStatement(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expectLock(mock)
+	mock.ExpectQuery(`SELECT version FROM schema_migrations`).WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectExec(regexp.QuoteMeta(migrations[0].statements[0])).WillReturnError(&mysql.MySQLError{Number: 1142, Message: "CREATE command denied"})
+	mock.ExpectExec(`DO RELEASE_LOCK`).WithArgs(migrationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if done, err := Migrate(db); err == nil || len(done) != 0 {
+		t.Errorf("Migrate returned %v, %v, want the error of the statement", done, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %s has version %d, want %d", migration.Name, migration.Version, i+1)
+		}
+		if len(migration.statements) == 0 {
+			t.Errorf("migration %d_%s has no statements", migration.Version, migration.Name)
+		}
+	}
+}
+
+// schema.sql is for fresh databases, which must not be migrated again.
+func TestSchemaRecordsEveryMigration(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := ioutil.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, migration := range migrations {
+		if !strings.Contains(string(schema), fmt.Sprintf("(%d, '%s')", migration.Version, migration.Name)) {
+			t.Errorf("schema.sql doesn't record the migration %d_%s", migration.Version, migration.Name)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	statements := splitStatements(`-- A comment.
+CREATE TABLE t (
+  id INT NOT NULL
+);
+
+ALTER TABLE t ADD COLUMN name VARCHAR(64) NOT NULL DEFAULT '';
+`)
+	want := []string{"CREATE TABLE t (\nid INT NOT NULL\n)", "ALTER TABLE t ADD COLUMN name VARCHAR(64) NOT NULL DEFAULT ''"}
+	if fmt.Sprint(statements) != fmt.Sprint(want) {
+		t.Errorf("splitStatements returned %q, want %q", statements, want)
+	}
+}
@@ -0,0 +1,23 @@
+-- The phonebooks table predates this file and was created by hand, so it is
+-- only created when missing.
+CREATE TABLE IF NOT EXISTS phonebooks (
+  phonebookId INT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(100) NOT NULL,
+  phone VARCHAR(32) NOT NULL DEFAULT '',
+  email VARCHAR(254) NOT NULL DEFAULT '',
+  PRIMARY KEY (phonebookId)
+);
+
+CREATE TABLE IF NOT EXISTS phonebook_revisions (
+  revisionId BIGINT NOT NULL AUTO_INCREMENT,
+  phonebookId INT NOT NULL,
+  revision INT NOT NULL,
+  action VARCHAR(16) NOT NULL,
+  snapshot JSON NOT NULL,
+  diff JSON NOT NULL,
+  actor VARCHAR(255) NOT NULL,
+  requestId VARCHAR(128) NOT NULL DEFAULT '',
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (revisionId),
+  UNIQUE KEY phonebook_revisions_phonebook_revision (phonebookId, revision)
+);
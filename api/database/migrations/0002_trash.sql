@@ -0,0 +1,3 @@
+ALTER TABLE phonebooks ADD COLUMN deleted_at DATETIME(6) NULL;
+
+ALTER TABLE phonebooks ADD KEY phonebooks_deleted_at (deleted_at);
@@ -0,0 +1,34 @@
+CREATE TABLE IF NOT EXISTS phonebook_phones (
+  phonebookId INT NOT NULL,
+  position INT NOT NULL,
+  label VARCHAR(32) NOT NULL DEFAULT '',
+  number VARCHAR(32) NOT NULL,
+  number_digits VARCHAR(32) NOT NULL,
+  is_primary BOOLEAN NOT NULL DEFAULT FALSE,
+  PRIMARY KEY (phonebookId, position),
+  KEY phonebook_phones_number_digits (number_digits),
+  FOREIGN KEY (phonebookId) REFERENCES phonebooks (phonebookId) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS phonebook_emails (
+  phonebookId INT NOT NULL,
+  position INT NOT NULL,
+  label VARCHAR(32) NOT NULL DEFAULT '',
+  address VARCHAR(254) NOT NULL,
+  is_primary BOOLEAN NOT NULL DEFAULT FALSE,
+  PRIMARY KEY (phonebookId, position),
+  KEY phonebook_emails_address (address),
+  FOREIGN KEY (phonebookId) REFERENCES phonebooks (phonebookId) ON DELETE CASCADE
+);
+
+-- Copy the number and address of the phonebooks stored before, skipping the
+-- ones already copied.
+INSERT INTO phonebook_phones (phonebookId, position, label, number, number_digits, is_primary)
+SELECT phonebookId, 0, 'main', phone, REGEXP_REPLACE(phone, '[^0-9]', ''), TRUE
+FROM phonebooks
+WHERE phone <> '' AND phonebookId NOT IN (SELECT phonebookId FROM phonebook_phones);
+
+INSERT INTO phonebook_emails (phonebookId, position, label, address, is_primary)
+SELECT phonebookId, 0, 'main', email, TRUE
+FROM phonebooks
+WHERE email <> '' AND phonebookId NOT IN (SELECT phonebookId FROM phonebook_emails);
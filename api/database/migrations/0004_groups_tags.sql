@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS phonebook_tags (
+  phonebookId INT NOT NULL,
+  tag VARCHAR(32) NOT NULL,
+  PRIMARY KEY (phonebookId, tag),
+  KEY phonebook_tags_tag (tag),
+  FOREIGN KEY (phonebookId) REFERENCES phonebooks (phonebookId) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS contact_groups (
+  groupId INT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(64) NOT NULL,
+  description VARCHAR(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (groupId),
+  UNIQUE KEY contact_groups_name (name)
+);
+
+CREATE TABLE IF NOT EXISTS contact_group_members (
+  groupId INT NOT NULL,
+  phonebookId INT NOT NULL,
+  PRIMARY KEY (groupId, phonebookId),
+  KEY contact_group_members_phonebook (phonebookId),
+  FOREIGN KEY (groupId) REFERENCES contact_groups (groupId) ON DELETE CASCADE,
+  FOREIGN KEY (phonebookId) REFERENCES phonebooks (phonebookId) ON DELETE CASCADE
+);
@@ -0,0 +1,28 @@
+-- The rows stored before tenants existed belong to the default tenant.
+ALTER TABLE phonebooks ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default' AFTER phonebookId;
+
+ALTER TABLE phonebooks ADD KEY phonebooks_tenant_deleted_at (tenant_id, deleted_at);
+
+ALTER TABLE phonebooks DROP KEY phonebooks_deleted_at;
+
+ALTER TABLE phonebook_phones ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default' AFTER phonebookId;
+
+ALTER TABLE phonebook_phones DROP KEY phonebook_phones_number_digits, ADD KEY phonebook_phones_number_digits (tenant_id, number_digits);
+
+ALTER TABLE phonebook_emails ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default' AFTER phonebookId;
+
+ALTER TABLE phonebook_emails DROP KEY phonebook_emails_address, ADD KEY phonebook_emails_address (tenant_id, address);
+
+ALTER TABLE phonebook_tags ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default' AFTER phonebookId;
+
+ALTER TABLE phonebook_tags DROP KEY phonebook_tags_tag, ADD KEY phonebook_tags_tag (tenant_id, tag);
+
+ALTER TABLE contact_groups ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default' AFTER groupId;
+
+ALTER TABLE contact_groups DROP KEY contact_groups_name, ADD UNIQUE KEY contact_groups_name (tenant_id, name);
+
+ALTER TABLE contact_group_members ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default' AFTER phonebookId;
+
+ALTER TABLE phonebook_revisions ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default' AFTER phonebookId;
+
+ALTER TABLE phonebook_revisions ADD KEY phonebook_revisions_tenant (tenant_id, phonebookId);
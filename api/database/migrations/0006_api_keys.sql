@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+  keyId INT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  name VARCHAR(64) NOT NULL,
+  prefix VARCHAR(16) NOT NULL,
+  hash CHAR(64) NOT NULL,
+  scopes VARCHAR(255) NOT NULL DEFAULT '',
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  expires_at DATETIME(6) NULL,
+  last_used_at DATETIME(6) NULL,
+  revoked_at DATETIME(6) NULL,
+  PRIMARY KEY (keyId),
+  UNIQUE KEY api_keys_prefix (prefix),
+  KEY api_keys_tenant (tenant_id)
+);
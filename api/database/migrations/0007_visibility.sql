@@ -0,0 +1,6 @@
+-- Values stored before visibility existed are public.
+ALTER TABLE phonebooks ADD COLUMN visibility VARCHAR(16) NOT NULL DEFAULT 'public' AFTER email;
+
+ALTER TABLE phonebook_phones ADD COLUMN visibility VARCHAR(16) NOT NULL DEFAULT 'public' AFTER is_primary;
+
+ALTER TABLE phonebook_emails ADD COLUMN visibility VARCHAR(16) NOT NULL DEFAULT 'public' AFTER is_primary;
@@ -0,0 +1,46 @@
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+  subscriptionId INT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  url VARCHAR(2048) NOT NULL,
+  events VARCHAR(255) NOT NULL,
+  visibility VARCHAR(16) NOT NULL DEFAULT 'public',
+  secret VARCHAR(128) NOT NULL,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (subscriptionId),
+  KEY webhook_subscriptions_tenant (tenant_id)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  deliveryId BIGINT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  subscriptionId INT NOT NULL,
+  eventId VARCHAR(64) NOT NULL,
+  eventType VARCHAR(32) NOT NULL,
+  payload JSON NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at DATETIME(6) NULL,
+  last_status_code INT NULL,
+  last_error VARCHAR(1024) NULL,
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  delivered_at DATETIME(6) NULL,
+  PRIMARY KEY (deliveryId),
+  KEY webhook_deliveries_due (status, next_attempt_at),
+  KEY webhook_deliveries_subscription (tenant_id, subscriptionId, deliveryId),
+  FOREIGN KEY (subscriptionId) REFERENCES webhook_subscriptions (subscriptionId) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS webhook_delivery_attempts (
+  attemptId BIGINT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  deliveryId BIGINT NOT NULL,
+  attempt INT NOT NULL,
+  status_code INT NULL,
+  error VARCHAR(1024) NULL,
+  duration_ms BIGINT NOT NULL,
+  attemptedAt DATETIME(6) NOT NULL,
+  PRIMARY KEY (attemptId),
+  KEY webhook_delivery_attempts_delivery (deliveryId),
+  FOREIGN KEY (deliveryId) REFERENCES webhook_deliveries (deliveryId) ON DELETE CASCADE
+);
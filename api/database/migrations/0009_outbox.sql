@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS outbox_events (
+  eventId BIGINT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  eventType VARCHAR(32) NOT NULL,
+  phonebookId INT NOT NULL,
+  payload JSON NOT NULL,
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (eventId)
+);
+
+CREATE TABLE IF NOT EXISTS outbox_checkpoints (
+  sink VARCHAR(255) NOT NULL,
+  eventId BIGINT NOT NULL,
+  updatedAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (sink)
+);
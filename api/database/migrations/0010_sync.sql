@@ -0,0 +1 @@
+ALTER TABLE phonebook_revisions ADD KEY phonebook_revisions_sync (tenant_id, revisionId);
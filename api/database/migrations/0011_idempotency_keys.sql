@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  client VARCHAR(255) NOT NULL,
+  idempotencyKey VARCHAR(255) NOT NULL,
+  requestHash CHAR(64) NOT NULL,
+  status INT NULL,
+  headers JSON NULL,
+  body MEDIUMBLOB NULL,
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  expiresAt DATETIME(6) NOT NULL,
+  PRIMARY KEY (tenant_id, client, idempotencyKey),
+  KEY idempotency_keys_expires (expiresAt)
+);
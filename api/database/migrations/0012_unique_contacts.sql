@@ -0,0 +1,9 @@
+-- The values stored before are left NULL, so they can't break the new
+-- indexes; `main phonebook unique` fills them in once duplicates are merged.
+ALTER TABLE phonebook_phones ADD COLUMN unique_digits VARCHAR(32) NULL AFTER number_digits;
+
+ALTER TABLE phonebook_phones ADD UNIQUE KEY phonebook_phones_unique (tenant_id, unique_digits);
+
+ALTER TABLE phonebook_emails ADD COLUMN unique_address VARCHAR(254) NULL AFTER address;
+
+ALTER TABLE phonebook_emails ADD UNIQUE KEY phonebook_emails_unique (tenant_id, unique_address);
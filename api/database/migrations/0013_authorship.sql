@@ -0,0 +1,21 @@
+ALTER TABLE phonebooks ADD COLUMN created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) AFTER deleted_at;
+
+ALTER TABLE phonebooks ADD COLUMN created_by VARCHAR(255) NOT NULL DEFAULT '' AFTER created_at;
+
+ALTER TABLE phonebooks ADD COLUMN updated_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) AFTER created_by;
+
+ALTER TABLE phonebooks ADD COLUMN updated_by VARCHAR(255) NOT NULL DEFAULT '' AFTER updated_at;
+
+ALTER TABLE phonebooks ADD KEY phonebooks_tenant_updated_at (tenant_id, updated_at);
+
+-- Phonebooks stored before were given the time of the migration; take the
+-- times of their first and last revisions instead. Their authors stay
+-- unknown.
+UPDATE phonebooks p
+JOIN (
+  SELECT phonebookId, MIN(createdAt) AS created_at, MAX(createdAt) AS updated_at
+  FROM phonebook_revisions
+  GROUP BY phonebookId
+) r ON r.phonebookId = p.phonebookId
+SET p.created_at = r.created_at, p.updated_at = r.updated_at
+WHERE p.created_by = '';
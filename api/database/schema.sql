@@ -0,0 +1,245 @@
+-- Schema for the phonebook API with every migration applied. docker-compose
+-- loads this file into a fresh MySQL data directory; existing databases are
+-- brought up to date by the api, which applies the files of migrations/ it
+-- finds missing from schema_migrations when it starts, or with `main migrate`.
+-- Changes to this file go in a new migration too.
+--
+-- Every table carries the tenant_id of the address book the row belongs to,
+-- and every query of the api filters on it.
+
+CREATE DATABASE IF NOT EXISTS phonebookdb;
+USE phonebookdb;
+
+CREATE TABLE IF NOT EXISTS phonebooks (
+  phonebookId INT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  name VARCHAR(100) NOT NULL,
+  phone VARCHAR(32) NOT NULL DEFAULT '',
+  email VARCHAR(254) NOT NULL DEFAULT '',
+  visibility VARCHAR(16) NOT NULL DEFAULT 'public',
+  deleted_at DATETIME(6) NULL,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  created_by VARCHAR(255) NOT NULL DEFAULT '',
+  updated_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  updated_by VARCHAR(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (phonebookId),
+  KEY phonebooks_tenant_deleted_at (tenant_id, deleted_at),
+  KEY phonebooks_tenant_updated_at (tenant_id, updated_at)
+);
+
+-- Every number and address of a phonebook. The phone and email columns of
+-- phonebooks keep a copy of the primary entries for older clients.
+CREATE TABLE IF NOT EXISTS phonebook_phones (
+  phonebookId INT NOT NULL,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  position INT NOT NULL,
+  label VARCHAR(32) NOT NULL DEFAULT '',
+  number VARCHAR(32) NOT NULL,
+  number_digits VARCHAR(32) NOT NULL,
+  -- Set to number_digits where numbers are unique, NULL otherwise and in the
+  -- trash.
+  unique_digits VARCHAR(32) NULL,
+  is_primary BOOLEAN NOT NULL DEFAULT FALSE,
+  visibility VARCHAR(16) NOT NULL DEFAULT 'public',
+  PRIMARY KEY (phonebookId, position),
+  KEY phonebook_phones_number_digits (tenant_id, number_digits),
+  UNIQUE KEY phonebook_phones_unique (tenant_id, unique_digits),
+  FOREIGN KEY (phonebookId) REFERENCES phonebooks (phonebookId) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS phonebook_emails (
+  phonebookId INT NOT NULL,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  position INT NOT NULL,
+  label VARCHAR(32) NOT NULL DEFAULT '',
+  address VARCHAR(254) NOT NULL,
+  -- Set to the lower-cased address where addresses are unique, NULL
+  -- otherwise and in the trash.
+  unique_address VARCHAR(254) NULL,
+  is_primary BOOLEAN NOT NULL DEFAULT FALSE,
+  visibility VARCHAR(16) NOT NULL DEFAULT 'public',
+  PRIMARY KEY (phonebookId, position),
+  KEY phonebook_emails_address (tenant_id, address),
+  UNIQUE KEY phonebook_emails_unique (tenant_id, unique_address),
+  FOREIGN KEY (phonebookId) REFERENCES phonebooks (phonebookId) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS phonebook_tags (
+  phonebookId INT NOT NULL,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  tag VARCHAR(32) NOT NULL,
+  PRIMARY KEY (phonebookId, tag),
+  KEY phonebook_tags_tag (tenant_id, tag),
+  FOREIGN KEY (phonebookId) REFERENCES phonebooks (phonebookId) ON DELETE CASCADE
+);
+
+-- Departments and distribution lists. Deleting a group removes its
+-- memberships, never the phonebooks.
+CREATE TABLE IF NOT EXISTS contact_groups (
+  groupId INT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  name VARCHAR(64) NOT NULL,
+  description VARCHAR(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (groupId),
+  UNIQUE KEY contact_groups_name (tenant_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS contact_group_members (
+  groupId INT NOT NULL,
+  phonebookId INT NOT NULL,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  PRIMARY KEY (groupId, phonebookId),
+  KEY contact_group_members_phonebook (phonebookId),
+  FOREIGN KEY (groupId) REFERENCES contact_groups (groupId) ON DELETE CASCADE,
+  FOREIGN KEY (phonebookId) REFERENCES phonebooks (phonebookId) ON DELETE CASCADE
+);
+
+-- Immutable history of every change made to a phonebook. Rows are never
+-- updated or deleted, and they outlive the phonebook they describe.
+CREATE TABLE IF NOT EXISTS phonebook_revisions (
+  revisionId BIGINT NOT NULL AUTO_INCREMENT,
+  phonebookId INT NOT NULL,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  revision INT NOT NULL,
+  action VARCHAR(16) NOT NULL,
+  snapshot JSON NOT NULL,
+  diff JSON NOT NULL,
+  actor VARCHAR(255) NOT NULL,
+  requestId VARCHAR(128) NOT NULL DEFAULT '',
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (revisionId),
+  UNIQUE KEY phonebook_revisions_phonebook_revision (phonebookId, revision),
+  KEY phonebook_revisions_tenant (tenant_id, phonebookId),
+  KEY phonebook_revisions_sync (tenant_id, revisionId)
+);
+
+-- Keys callers authenticate with. Only a SHA-256 hash of the token is kept;
+-- the prefix is stored in clear to find the key and tell keys apart.
+CREATE TABLE IF NOT EXISTS api_keys (
+  keyId INT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  name VARCHAR(64) NOT NULL,
+  prefix VARCHAR(16) NOT NULL,
+  hash CHAR(64) NOT NULL,
+  scopes VARCHAR(255) NOT NULL DEFAULT '',
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  expires_at DATETIME(6) NULL,
+  last_used_at DATETIME(6) NULL,
+  revoked_at DATETIME(6) NULL,
+  PRIMARY KEY (keyId),
+  UNIQUE KEY api_keys_prefix (prefix),
+  KEY api_keys_tenant (tenant_id)
+);
+
+-- URLs notified of the changes of the phonebooks of a tenant. The secret
+-- signs the deliveries, so it is kept in clear.
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+  subscriptionId INT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  url VARCHAR(2048) NOT NULL,
+  events VARCHAR(255) NOT NULL,
+  visibility VARCHAR(16) NOT NULL DEFAULT 'public',
+  secret VARCHAR(128) NOT NULL,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (subscriptionId),
+  KEY webhook_subscriptions_tenant (tenant_id)
+);
+
+-- Events queued for a subscription in the transaction of the change. Pending
+-- deliveries are sent once next_attempt_at is due; dead ones ran out of
+-- attempts and wait for a redelivery.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  deliveryId BIGINT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  subscriptionId INT NOT NULL,
+  eventId VARCHAR(64) NOT NULL,
+  eventType VARCHAR(32) NOT NULL,
+  payload JSON NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at DATETIME(6) NULL,
+  last_status_code INT NULL,
+  last_error VARCHAR(1024) NULL,
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  delivered_at DATETIME(6) NULL,
+  PRIMARY KEY (deliveryId),
+  KEY webhook_deliveries_due (status, next_attempt_at),
+  KEY webhook_deliveries_subscription (tenant_id, subscriptionId, deliveryId),
+  FOREIGN KEY (subscriptionId) REFERENCES webhook_subscriptions (subscriptionId) ON DELETE CASCADE
+);
+
+-- Log of every attempt at sending a delivery.
+CREATE TABLE IF NOT EXISTS webhook_delivery_attempts (
+  attemptId BIGINT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  deliveryId BIGINT NOT NULL,
+  attempt INT NOT NULL,
+  status_code INT NULL,
+  error VARCHAR(1024) NULL,
+  duration_ms BIGINT NOT NULL,
+  attemptedAt DATETIME(6) NOT NULL,
+  PRIMARY KEY (attemptId),
+  KEY webhook_delivery_attempts_delivery (deliveryId),
+  FOREIGN KEY (deliveryId) REFERENCES webhook_deliveries (deliveryId) ON DELETE CASCADE
+);
+
+-- Changes of phonebooks, recorded in the transaction of the change and
+-- relayed in order to the sinks of the outbox. Rows every sink got are
+-- deleted.
+CREATE TABLE IF NOT EXISTS outbox_events (
+  eventId BIGINT NOT NULL AUTO_INCREMENT,
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  eventType VARCHAR(32) NOT NULL,
+  phonebookId INT NOT NULL,
+  payload JSON NOT NULL,
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (eventId)
+);
+
+-- The last event each sink of the outbox got.
+CREATE TABLE IF NOT EXISTS outbox_checkpoints (
+  sink VARCHAR(255) NOT NULL,
+  eventId BIGINT NOT NULL,
+  updatedAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (sink)
+);
+
+-- Responses of the requests sent with an Idempotency-Key, replayed to their
+-- retries. A row without a status is a request still being carried out.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+  client VARCHAR(255) NOT NULL,
+  idempotencyKey VARCHAR(255) NOT NULL,
+  requestHash CHAR(64) NOT NULL,
+  status INT NULL,
+  headers JSON NULL,
+  body MEDIUMBLOB NULL,
+  createdAt DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  expiresAt DATETIME(6) NOT NULL,
+  PRIMARY KEY (tenant_id, client, idempotencyKey),
+  KEY idempotency_keys_expires (expiresAt)
+);
+
+-- The migrations this file already holds.
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INT NOT NULL,
+  name VARCHAR(255) NOT NULL,
+  applied_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (version)
+);
+
+INSERT IGNORE INTO schema_migrations (version, name) VALUES
+  (1, 'phonebook_revisions'),
+  (2, 'trash'),
+  (3, 'contact_phones_emails'),
+  (4, 'groups_tags'),
+  (5, 'tenants'),
+  (6, 'api_keys'),
+  (7, 'visibility'),
+  (8, 'webhooks'),
+  (9, 'outbox'),
+  (10, 'sync'),
+  (11, 'idempotency_keys'),
+  (12, 'unique_contacts'),
+  (13, 'authorship');
@@ -6,17 +6,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strconv"
 	"strings"
 	"testing"
-)
 
-type Phonebook struct {
-	PhonebookID int    `json:phonebookId`
-	Name        string `json:name`
-	Phone       string `json:phone`
-	Email       string `json:email`
-}
+	"github.com/Paulo-Eduardo/phone_book/phonebook"
+)
 
 func TestShouldInsertANewPhonebook(t *testing.T) {
 	resp, err := CreateNewUser("Teste")
@@ -36,7 +30,7 @@ func TestShouldInsertANewPhonebook(t *testing.T) {
 			resp.StatusCode, http.StatusCreated)
 	}
 
-	id, err := strconv.Atoi(string(respBody))
+	id, err := createdID(respBody)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,7 +67,7 @@ func TestListPhonebooksByName(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	id, err := strconv.Atoi(string(respBody))
+	id, err := createdID(respBody)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -114,7 +108,7 @@ func TestGetPhonebooksById(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	id, err := strconv.Atoi(string(respBody))
+	id, err := createdID(respBody)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -161,7 +155,7 @@ func TestPutPhonebooks(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	id, err := strconv.Atoi(string(respBody))
+	id, err := createdID(respBody)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -172,7 +166,7 @@ func TestPutPhonebooks(t *testing.T) {
 		}
 	}()
 
-	pb := Phonebook{
+	pb := phonebook.Phonebook{
 		PhonebookID: id,
 		Name:        "New Name",
 		Email:       "newemail@t.com",
@@ -181,7 +175,7 @@ func TestPutPhonebooks(t *testing.T) {
 
 	body, err := json.Marshal(pb)
 
-	req, err := http.NewRequest("PUT", fmt.Sprintf("http://localhost:5000/api/phonebooks/%v", string(respBody)), bytes.NewBuffer(body))
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://localhost:5000/api/phonebooks/%d", id), bytes.NewBuffer(body))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -219,6 +213,15 @@ func CreateNewUser(name string) (*http.Response, error) {
 	return resp, nil
 }
 
+// createdID returns the ID of the phonebook a POST answered with.
+func createdID(respBody []byte) (int, error) {
+	var created phonebook.Phonebook
+	if err := json.Unmarshal(respBody, &created); err != nil {
+		return 0, err
+	}
+	return created.PhonebookID, nil
+}
+
 func DeleteUser(id int) (*http.Response, error) {
 	client := &http.Client{}
 
@@ -3,7 +3,9 @@ module github.com/Paulo-Eduardo/phone_book
 go 1.16
 
 require (
-	github.com/DATA-DOG/go-sqlmock v1.5.0 // indirect
-	github.com/go-sql-driver/mysql v1.6.0 // indirect
-	github.com/prometheus/client_golang v1.10.0 // indirect
+	github.com/DATA-DOG/go-sqlmock v1.5.0
+	github.com/andybalholm/brotli v1.0.5
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/prometheus/client_golang v1.10.0
 )
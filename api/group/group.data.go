@@ -0,0 +1,244 @@
+package group
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/database"
+	"github.com/Paulo-Eduardo/phone_book/phonebook"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var errDuplicateName = errors.New("a group with this name already exists")
+
+func insert(ctx context.Context, group Group, db *sql.DB, timeout int) (int, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `INSERT INTO contact_groups
+	(name,
+	description,
+	tenant_id) VALUES (?, ?, ?)`,
+		group.Name,
+		group.Description,
+		tenantID)
+	if err != nil {
+		return 0, duplicateName(err)
+	}
+	insertID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(insertID), nil
+}
+
+func get(ctx context.Context, groupID int, db *sql.DB, timeout int) (*Group, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	row := db.QueryRowContext(ctx, `SELECT
+	g.groupId,
+	g.name,
+	g.description,
+	(SELECT COUNT(*) FROM contact_group_members m
+		JOIN phonebooks p ON p.phonebookId = m.phonebookId
+		WHERE m.groupId = g.groupId AND p.deleted_at IS NULL)
+	FROM contact_groups g
+	WHERE g.groupId = ? AND g.tenant_id = ?`, groupID, tenantID)
+
+	group := &Group{}
+	err = row.Scan(
+		&group.GroupID,
+		&group.Name,
+		&group.Description,
+		&group.MemberCount)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func list(ctx context.Context, db *sql.DB, timeout int) ([]Group, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	results, err := db.QueryContext(ctx, `SELECT
+	g.groupId,
+	g.name,
+	g.description,
+	(SELECT COUNT(*) FROM contact_group_members m
+		JOIN phonebooks p ON p.phonebookId = m.phonebookId
+		WHERE m.groupId = g.groupId AND p.deleted_at IS NULL)
+	FROM contact_groups g
+	WHERE g.tenant_id = ?
+	ORDER BY g.name`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	groups := make([]Group, 0)
+	for results.Next() {
+		var group Group
+		err := results.Scan(
+			&group.GroupID,
+			&group.Name,
+			&group.Description,
+			&group.MemberCount)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, results.Err()
+}
+
+func update(ctx context.Context, group Group, db *sql.DB, timeout int) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, `UPDATE contact_groups SET
+	name=?,
+	description=?
+	WHERE groupId = ? AND tenant_id = ?`,
+		group.Name,
+		group.Description,
+		group.GroupID,
+		tenantID)
+	if err != nil {
+		return duplicateName(err)
+	}
+	phonebook.Invalidate(tenantID)
+	return nil
+}
+
+// remove deletes a group and its memberships. The phonebooks themselves are
+// left untouched.
+func remove(ctx context.Context, groupID int, db *sql.DB, timeout int) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, `DELETE FROM contact_groups WHERE groupId = ? AND tenant_id = ?`, groupID, tenantID)
+	if err != nil {
+		return err
+	}
+	phonebook.Invalidate(tenantID)
+	return nil
+}
+
+func listMembers(ctx context.Context, groupID int, db *sql.DB, timeout int) ([]int, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	results, err := db.QueryContext(ctx, `SELECT m.phonebookId
+	FROM contact_group_members m
+	JOIN phonebooks p ON p.phonebookId = m.phonebookId
+	WHERE m.groupId = ? AND m.tenant_id = ? AND p.deleted_at IS NULL
+	ORDER BY m.phonebookId`, groupID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	phonebookIDs := make([]int, 0)
+	for results.Next() {
+		var phonebookID int
+		if err := results.Scan(&phonebookID); err != nil {
+			return nil, err
+		}
+		phonebookIDs = append(phonebookIDs, phonebookID)
+	}
+	return phonebookIDs, results.Err()
+}
+
+// addMembers adds the given phonebooks to a group, skipping the ones that are
+// already members or don't exist, and returns how many were added.
+func addMembers(ctx context.Context, groupID int, phonebookIDs []int, db *sql.DB, timeout int) (int64, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	placeholders := make([]string, 0, len(phonebookIDs))
+	args := []interface{}{groupID, tenantID}
+	for _, phonebookID := range phonebookIDs {
+		placeholders = append(placeholders, "?")
+		args = append(args, phonebookID)
+	}
+
+	result, err := db.ExecContext(ctx, `INSERT IGNORE INTO contact_group_members
+	(groupId,
+	phonebookId,
+	tenant_id)
+	SELECT ?, phonebookId, tenant_id FROM phonebooks
+	WHERE tenant_id = ? AND phonebookId IN (`+strings.Join(placeholders, ", ")+`) AND deleted_at IS NULL`, args...)
+	if err != nil {
+		return 0, err
+	}
+	phonebook.Invalidate(tenantID)
+	return result.RowsAffected()
+}
+
+func removeMember(ctx context.Context, groupID int, phonebookID int, db *sql.DB, timeout int) (int64, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM contact_group_members
+	WHERE groupId = ? AND phonebookId = ? AND tenant_id = ?`, groupID, phonebookID, tenantID)
+	if err != nil {
+		return 0, err
+	}
+	phonebook.Invalidate(tenantID)
+	return result.RowsAffected()
+}
+
+func duplicateName(err error) error {
+	if _, ok := database.DuplicateKey(err); ok {
+		return errDuplicateName
+	}
+	return err
+}
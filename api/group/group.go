@@ -0,0 +1,16 @@
+package group
+
+// Group is a named set of phonebooks, such as a department or a distribution
+// list. A phonebook can belong to many groups.
+type Group struct {
+	GroupID     int    `json:"groupId"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	MemberCount int    `json:"memberCount"`
+}
+
+// Members is the body used to add phonebooks to a group and the response
+// listing the members of a group.
+type Members struct {
+	PhonebookIDs []int `json:"phonebookIds"`
+}
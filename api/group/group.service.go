@@ -0,0 +1,277 @@
+package group
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Paulo-Eduardo/phone_book/admission"
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/compress"
+	"github.com/Paulo-Eduardo/phone_book/cors"
+	"github.com/Paulo-Eduardo/phone_book/logger"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/ratelimit"
+	"github.com/Paulo-Eduardo/phone_book/requestid"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+const groupBasePath = "groups"
+
+const (
+	maxNameLength        = 64
+	maxDescriptionLength = 255
+	maxMembersPerRequest = 500
+)
+
+// Permissions of the routes: groups are read and changed like the
+// phonebooks they hold.
+const (
+	permissionRead  = "phonebook:read"
+	permissionWrite = "phonebook:write"
+)
+
+var db *sql.DB
+var timeout int
+
+func SetupRoutes(apiBasePath string, dbConn *sql.DB, to int) {
+	db = dbConn
+	timeout = to
+	handleGroups := http.HandlerFunc(groupsHandler)
+	handleGroup := http.HandlerFunc(groupHandler)
+	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, groupBasePath), requestid.Middleware(logger.Middleware(compress.Middleware(cors.Middleware(admission.Middleware(auth.Middleware(tenant.Middleware(ratelimit.Middleware(handleGroups)))))))))
+	http.Handle(fmt.Sprintf("%s/%s/", apiBasePath, groupBasePath), requestid.Middleware(logger.Middleware(compress.Middleware(cors.Middleware(admission.Middleware(auth.Middleware(tenant.Middleware(ratelimit.Middleware(handleGroup)))))))))
+}
+
+// permissionFor returns the permission a request needs.
+func permissionFor(method string) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return permissionRead
+	}
+	return permissionWrite
+}
+
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !auth.Check(w, r, permissionFor(r.Method)) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		groups, err := list(r.Context(), db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to list groups: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The groups could not be listed.")
+			return
+		}
+		problem.WriteJSON(w, r, http.StatusOK, groups)
+	case http.MethodPost:
+		var newGroup Group
+		if !readGroup(w, r, &newGroup) {
+			return
+		}
+		if newGroup.GroupID != 0 {
+			problem.Write(w, r, problem.Validation([]problem.FieldError{{Field: "groupId", Message: "must not be set when creating a group"}}))
+			return
+		}
+		id, err := insert(r.Context(), newGroup, db, timeout)
+		if err == errDuplicateName {
+			problem.Error(w, r, http.StatusConflict, fmt.Sprintf("A group named %q already exists.", newGroup.Name))
+			return
+		} else if err != nil {
+			log.Printf("An error accured trying to insert the group in the database: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The group could not be created.")
+			return
+		}
+		newGroup.GroupID = id
+		problem.WriteJSON(w, r, http.StatusCreated, newGroup)
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// groupHandler serves a single group and its members:
+//
+//	GET, PUT, DELETE /groups/{id}
+//	GET, POST        /groups/{id}/members
+//	DELETE           /groups/{id}/members/{phonebookId}
+func groupHandler(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, "groups/")
+	pathSegments := strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	groupID, err := strconv.Atoi(pathSegments[0])
+	if err != nil {
+		problem.Error(w, r, http.StatusNotFound, "")
+		return
+	}
+
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !auth.Check(w, r, permissionFor(r.Method)) {
+		return
+	}
+
+	group, err := get(r.Context(), groupID, db, timeout)
+	if err != nil {
+		log.Printf("An error accured trying to get the group from id: %v", err)
+		problem.Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if group == nil {
+		problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Group %d does not exist.", groupID))
+		return
+	}
+
+	switch {
+	case len(pathSegments) == 1:
+		groupItemHandler(w, r, group)
+	case len(pathSegments) == 2 && pathSegments[1] == "members":
+		membersHandler(w, r, group)
+	case len(pathSegments) == 3 && pathSegments[1] == "members":
+		phonebookID, err := strconv.Atoi(pathSegments[2])
+		if err != nil {
+			problem.Error(w, r, http.StatusNotFound, "")
+			return
+		}
+		memberHandler(w, r, group, phonebookID)
+	default:
+		problem.Error(w, r, http.StatusNotFound, "")
+	}
+}
+
+func groupItemHandler(w http.ResponseWriter, r *http.Request, group *Group) {
+	switch r.Method {
+	case http.MethodGet:
+		problem.WriteJSON(w, r, http.StatusOK, group)
+	case http.MethodPut:
+		var updatedGroup Group
+		if !readGroup(w, r, &updatedGroup) {
+			return
+		}
+		if updatedGroup.GroupID != group.GroupID {
+			problem.Write(w, r, problem.Validation([]problem.FieldError{{Field: "groupId", Message: "must match the ID in the URL"}}))
+			return
+		}
+		err := update(r.Context(), updatedGroup, db, timeout)
+		if err == errDuplicateName {
+			problem.Error(w, r, http.StatusConflict, fmt.Sprintf("A group named %q already exists.", updatedGroup.Name))
+			return
+		} else if err != nil {
+			log.Printf("An error accured trying to update group: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The group could not be updated.")
+			return
+		}
+		updatedGroup.MemberCount = group.MemberCount
+		problem.WriteJSON(w, r, http.StatusOK, updatedGroup)
+	case http.MethodDelete:
+		if err := remove(r.Context(), group.GroupID, db, timeout); err != nil {
+			log.Printf("An error accured trying to remove group: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The group could not be removed.")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func membersHandler(w http.ResponseWriter, r *http.Request, group *Group) {
+	switch r.Method {
+	case http.MethodGet:
+		phonebookIDs, err := listMembers(r.Context(), group.GroupID, db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to list the group members: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		problem.WriteJSON(w, r, http.StatusOK, Members{PhonebookIDs: phonebookIDs})
+	case http.MethodPost:
+		var members Members
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			problem.Write(w, r, problem.Malformed("The request body could not be read."))
+			return
+		}
+		if err := json.Unmarshal(bodyBytes, &members); err != nil {
+			problem.Write(w, r, problem.Malformed("The request body is not a valid list of members."))
+			return
+		}
+		if len(members.PhonebookIDs) == 0 || len(members.PhonebookIDs) > maxMembersPerRequest {
+			problem.Write(w, r, problem.Validation([]problem.FieldError{{Field: "phonebookIds", Message: fmt.Sprintf("must have between 1 and %d entries", maxMembersPerRequest)}}))
+			return
+		}
+		if _, err := addMembers(r.Context(), group.GroupID, members.PhonebookIDs, db, timeout); err != nil {
+			log.Printf("An error accured trying to add the group members: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The members could not be added.")
+			return
+		}
+		phonebookIDs, err := listMembers(r.Context(), group.GroupID, db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to list the group members: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		problem.WriteJSON(w, r, http.StatusOK, Members{PhonebookIDs: phonebookIDs})
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func memberHandler(w http.ResponseWriter, r *http.Request, group *Group, phonebookID int) {
+	if r.Method != http.MethodDelete {
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	removed, err := removeMember(r.Context(), group.GroupID, phonebookID, db, timeout)
+	if err != nil {
+		log.Printf("An error accured trying to remove the group member: %v", err)
+		problem.Error(w, r, http.StatusInternalServerError, "The member could not be removed.")
+		return
+	}
+	if removed == 0 {
+		problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d is not a member of group %d.", phonebookID, group.GroupID))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// readGroup decodes and validates the group in the request body, writing the
+// problem to the client when it returns false.
+func readGroup(w http.ResponseWriter, r *http.Request, group *Group) bool {
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("An error accured trying to read the body: %v", err)
+		problem.Write(w, r, problem.Malformed("The request body could not be read."))
+		return false
+	}
+	if err := json.Unmarshal(bodyBytes, group); err != nil {
+		log.Printf("An error accured trying to parse the body: %v", err)
+		problem.Write(w, r, problem.Malformed("The request body is not a valid group."))
+		return false
+	}
+	group.Name = strings.TrimSpace(group.Name)
+
+	var errs []problem.FieldError
+	if group.Name == "" {
+		errs = append(errs, problem.FieldError{Field: "name", Message: "is required"})
+	} else if utf8.RuneCountInString(group.Name) > maxNameLength {
+		errs = append(errs, problem.FieldError{Field: "name", Message: fmt.Sprintf("must have at most %d characters", maxNameLength)})
+	}
+	if utf8.RuneCountInString(group.Description) > maxDescriptionLength {
+		errs = append(errs, problem.FieldError{Field: "description", Message: fmt.Sprintf("must have at most %d characters", maxDescriptionLength)})
+	}
+	if len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,306 @@
+package group
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/phonebook"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// testTenant is the tenant every test runs as.
+const testTenant = "acme"
+
+var mock sqlmock.Sqlmock
+
+func TestMain(m *testing.M) {
+	var err error
+	db, mock, err = sqlmock.New()
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	timeout = 15
+	os.Exit(m.Run())
+}
+
+// newRequest is http.NewRequest for a request already resolved to testTenant
+// by tenant.Middleware, made by a caller allowed everything.
+func newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: auth.MethodAnonymous, Method: auth.MethodAnonymous, Scopes: []string{"*"}})
+	return req.WithContext(tenant.NewContext(ctx, testTenant)), nil
+}
+
+func expectGetGroup(id int) {
+	mock.ExpectQuery("SELECT g.groupId, g.name, g.description, .* FROM contact_groups g WHERE g.groupId = \\? AND g.tenant_id = \\?").
+		WithArgs(id, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"groupId", "name", "description", "memberCount"}).
+			AddRow(id, "sales", "Sales team", 2))
+}
+
+func TestPostGroupHandler(t *testing.T) {
+	handler := http.HandlerFunc(groupsHandler)
+
+	mock.ExpectExec("INSERT INTO contact_groups").
+		WithArgs("sales", "Sales team", testTenant).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+
+	req, err := newRequest("POST", "/groups", bytes.NewBufferString(`{"name": " sales ", "description": "Sales team"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+
+	expected := `{"groupId":3,"name":"sales","description":"Sales team","memberCount":0}`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned wrong body: got %v want %v", rr.Body.String(), expected)
+	}
+}
+
+func TestPostDuplicateGroupHandler(t *testing.T) {
+	handler := http.HandlerFunc(groupsHandler)
+
+	mock.ExpectExec("INSERT INTO contact_groups").
+		WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'sales'"})
+
+	req, err := newRequest("POST", "/groups", bytes.NewBufferString(`{"name": "sales"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusConflict)
+	}
+}
+
+func TestDeleteGroupKeepsMembers(t *testing.T) {
+	handler := http.HandlerFunc(groupHandler)
+
+	expectGetGroup(3)
+	mock.ExpectExec("DELETE FROM contact_groups WHERE groupId = \\? AND tenant_id = \\?").
+		WithArgs(3, testTenant).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req, err := newRequest("DELETE", "/groups/3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostGroupMembersHandler(t *testing.T) {
+	handler := http.HandlerFunc(groupHandler)
+
+	expectGetGroup(3)
+	mock.ExpectExec("INSERT IGNORE INTO contact_group_members \\(groupId, phonebookId, tenant_id\\) SELECT \\?, phonebookId, tenant_id FROM phonebooks WHERE tenant_id = \\? AND phonebookId IN \\(\\?, \\?\\)").
+		WithArgs(3, testTenant, 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("SELECT m.phonebookId FROM contact_group_members m").
+		WithArgs(3, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId"}).AddRow(1).AddRow(2))
+
+	req, err := newRequest("POST", "/groups/3/members", bytes.NewBufferString(`{"phonebookIds": [1, 2]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	expected := `{"phonebookIds":[1,2]}`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned wrong body: got %v want %v", rr.Body.String(), expected)
+	}
+}
+
+func TestGetAnotherTenantsGroupHandler(t *testing.T) {
+	handler := http.HandlerFunc(groupHandler)
+
+	mock.ExpectQuery("FROM contact_groups g WHERE g.groupId = \\? AND g.tenant_id = \\?").
+		WithArgs(3, "globex").
+		WillReturnRows(sqlmock.NewRows([]string{"groupId", "name", "description", "memberCount"}))
+
+	req, err := newRequest("DELETE", "/groups/3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(tenant.NewContext(req.Context(), "globex"))
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestViewerCannotChangeGroups(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+	}{
+		{method: "POST", url: "/groups"},
+		{method: "PUT", url: "/groups/3"},
+		{method: "DELETE", url: "/groups/3"},
+		{method: "POST", url: "/groups/3/members"},
+		{method: "DELETE", url: "/groups/3/members/1"},
+	}
+
+	for _, test := range tests {
+		req, err := newRequest(test.method, test.url, bytes.NewBufferString(`{"name": "sales", "phonebookIds": [1]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &auth.Principal{Subject: "jwt:intern", Method: auth.MethodJWT, Roles: []string{"viewer"}}
+		req = req.WithContext(auth.NewContext(req.Context(), p))
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(groupHandler)
+		if test.url == "/groups" {
+			handler = groupsHandler
+		}
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s %s as a viewer returned %v want %v", test.method, test.url, rr.Code, http.StatusForbidden)
+			continue
+		}
+		var body problem.Problem
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if body.Type != problem.TypeForbidden || body.Permission != permissionWrite {
+			t.Errorf("%s %s as a viewer returned %+v want missing %s", test.method, test.url, body, permissionWrite)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("a forbidden request reached the database: %s", err)
+	}
+}
+
+func TestViewerCanReadGroups(t *testing.T) {
+	mock.ExpectQuery("SELECT g.groupId, g.name, g.description").
+		WithArgs(testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"groupId", "name", "description", "memberCount"}).AddRow(3, "sales", "Sales team", 2))
+
+	req, err := newRequest("GET", "/groups", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &auth.Principal{Subject: "jwt:intern", Method: auth.MethodJWT, Roles: []string{"viewer"}}
+	req = req.WithContext(auth.NewContext(req.Context(), p))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(groupsHandler).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Lists of phonebooks filtered by group are cached by the phonebook package,
+// so a change to the members of a group has to drop them.
+func TestChangingTheMembersDropsTheCachedPhonebookLists(t *testing.T) {
+	auth.Setup(false)
+	defer auth.Setup(true)
+	tenant.Setup(tenant.Single(testTenant))
+	defer tenant.Setup(tenant.Single(tenant.DefaultID))
+	phonebook.SetupCache(100, time.Minute)
+	defer phonebook.SetupCache(0, 0)
+	phonebook.SetupRoutes("/api", db, timeout)
+
+	expectList := func() {
+		mock.ExpectQuery("SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks .* JOIN contact_groups g ON g.groupId = m.groupId WHERE g.tenant_id = \\? AND g.name = \\?").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+				AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, ""))
+		mock.ExpectQuery("SELECT phonebookId, label, number, is_primary, visibility FROM phonebook_phones").
+			WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "number", "is_primary", "visibility"}))
+		mock.ExpectQuery("SELECT phonebookId, label, address, is_primary, visibility FROM phonebook_emails").
+			WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "address", "is_primary", "visibility"}))
+		mock.ExpectQuery("SELECT phonebookId, tag FROM phonebook_tags").
+			WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "tag"}))
+	}
+	listSales := func() {
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/phonebooks?group=sales", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("list returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+	}
+
+	// The second list is served from the cache, the third one is not.
+	expectList()
+	listSales()
+	listSales()
+
+	expectGetGroup(3)
+	mock.ExpectExec("DELETE FROM contact_group_members").
+		WithArgs(3, 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	req, err := newRequest("DELETE", "/groups/3/members/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(groupHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	expectList()
+	listSales()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -5,13 +5,15 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/Paulo-Eduardo/phone_book/admission"
 	"github.com/Paulo-Eduardo/phone_book/cors"
 	"github.com/Paulo-Eduardo/phone_book/logger"
+	"github.com/Paulo-Eduardo/phone_book/requestid"
 )
 
 func SetupRoutes(apiBasePath string) {
 	handleHealthCheck := http.HandlerFunc(HealthCheckHandler)
-	http.Handle(fmt.Sprintf("%s/health-check", apiBasePath), logger.Middleware(cors.Middleware(handleHealthCheck)))
+	http.Handle(fmt.Sprintf("%s/health-check", apiBasePath), requestid.Middleware(logger.Middleware(cors.Middleware(admission.Priority(handleHealthCheck)))))
 }
 
 func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,172 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// purgeBatch bounds the expired keys deleted at once.
+const purgeBatch = 1000
+
+// claim records that the request of client with key is being carried out and
+// reports whether it was claimed, or whether another request holds the key
+// already. Claims expire after the lease, and kept responses after the TTL,
+// at which point the key is free again.
+func claim(ctx context.Context, client string, key string, hash string, db *sql.DB, timeout int) (bool, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, `DELETE FROM idempotency_keys
+	WHERE tenant_id = ? AND client = ? AND idempotencyKey = ? AND expiresAt < NOW(6)`, tenantID, client, key)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.ExecContext(ctx, `INSERT IGNORE INTO idempotency_keys
+	(tenant_id,
+	client,
+	idempotencyKey,
+	requestHash,
+	expiresAt) VALUES (?, ?, ?, ?, NOW(6) + INTERVAL ? SECOND)`,
+		tenantID,
+		client,
+		key,
+		hash,
+		int64(lease()/time.Second))
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return claimed == 1, nil
+}
+
+// lookup returns the response kept for the key of client, nil while its
+// request is still running, and the hash of that request. Both are empty when
+// there is no such key anymore.
+func lookup(ctx context.Context, client string, key string, db *sql.DB, timeout int) (*response, string, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	var hash string
+	var status sql.NullInt64
+	var header, body []byte
+	err = db.QueryRowContext(ctx, `SELECT requestHash, status, headers, body
+	FROM idempotency_keys
+	WHERE tenant_id = ? AND client = ? AND idempotencyKey = ?`, tenantID, client, key).
+		Scan(&hash, &status, &header, &body)
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	if !status.Valid {
+		return nil, hash, nil
+	}
+
+	stored := &response{Status: int(status.Int64), Header: http.Header{}, Body: body}
+	if len(header) > 0 {
+		if err := json.Unmarshal(header, &stored.Header); err != nil {
+			return nil, "", err
+		}
+	}
+	return stored, hash, nil
+}
+
+// complete keeps the response of the request holding the key of client for
+// the TTL.
+func complete(ctx context.Context, client string, key string, resp response, db *sql.DB, timeout int) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	header, err := json.Marshal(resp.Header)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, `UPDATE idempotency_keys SET
+	status = ?,
+	headers = ?,
+	body = ?,
+	expiresAt = NOW(6) + INTERVAL ? SECOND
+	WHERE tenant_id = ? AND client = ? AND idempotencyKey = ?`,
+		resp.Status,
+		header,
+		resp.Body,
+		int64(ttl/time.Second),
+		tenantID,
+		client,
+		key)
+	return err
+}
+
+// release frees the key of client, so the request can be retried.
+func release(ctx context.Context, client string, key string, db *sql.DB, timeout int) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, `DELETE FROM idempotency_keys
+	WHERE tenant_id = ? AND client = ? AND idempotencyKey = ?`, tenantID, client, key)
+	return err
+}
+
+// purge deletes up to purgeBatch expired keys of every tenant.
+func purge(ctx context.Context, db *sql.DB, timeout int) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys
+	WHERE expiresAt < NOW(6)
+	LIMIT ?`, purgeBatch)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// StartPurger deletes the expired keys every interval, so keys that are
+// never retried don't pile up.
+func StartPurger(interval time.Duration) {
+	go func() {
+		for {
+			for {
+				purged, err := purge(context.Background(), db, timeout)
+				if err != nil {
+					log.Printf("An error accured trying to purge the idempotency keys: %v", err)
+				}
+				if purged < purgeBatch {
+					break
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
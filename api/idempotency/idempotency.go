@@ -0,0 +1,215 @@
+// Package idempotency lets clients retry a POST safely: a request sent with
+// an Idempotency-Key header is carried out once, and its response is replayed
+// to the retries. Keys are claimed in the database, so retries reaching other
+// instances of the API are caught as well.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// Header is the header clients send the key of a request in.
+const Header = "Idempotency-Key"
+
+// ReplayedHeader is set on the responses replayed from a previous request.
+const ReplayedHeader = "Idempotent-Replayed"
+
+// DefaultTTL is how long responses are kept for retries by default.
+const DefaultTTL = 24 * time.Hour
+
+const maxKeyLength = 255
+
+// Results of the requests sent with a key.
+const (
+	resultExecuted   = "executed"
+	resultReplayed   = "replayed"
+	resultMismatch   = "mismatch"
+	resultInProgress = "in_progress"
+)
+
+var outcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "api_idempotent_requests_total",
+	Help: "The total number of requests sent with an Idempotency-Key, by result",
+}, []string{"result"})
+
+var (
+	db      *sql.DB
+	timeout int
+	ttl     = DefaultTTL
+)
+
+// Setup stores the responses of the requests with a key in dbConn for keep.
+// Until it is called keys are ignored.
+func Setup(dbConn *sql.DB, to int, keep time.Duration) {
+	db = dbConn
+	timeout = to
+	ttl = keep
+}
+
+// lease is how long a claimed key waits for its response before another
+// request may claim it again, in case the instance carrying it out dies. A
+// request runs a few queries, each bounded by the timeout.
+func lease() time.Duration {
+	return 3 * time.Duration(timeout) * time.Second
+}
+
+// response is a response kept for the retries of its request.
+type response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Middleware carries out the POST requests with a key once per client. A
+// retry with the same body gets the first response again; one with another
+// body is refused with 422, and one sent while the first is still running
+// with 409. Only successful responses are kept: a request that failed
+// changed nothing, so its key is freed for the request to be retried.
+func Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if db == nil || key == "" || r.Method != http.MethodPost {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			problem.Write(w, r, problem.Validation([]problem.FieldError{{Field: Header, Message: fmt.Sprintf("must have at most %d characters", maxKeyLength)}}))
+			return
+		}
+		tenantID, err := tenant.Require(r.Context())
+		if err != nil {
+			problem.Error(w, r, http.StatusInternalServerError, "")
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("An error accured trying to read the body: %v", err)
+			problem.Write(w, r, problem.Malformed("The request body could not be read."))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		client := clientOf(r)
+		hash := requestHash(r, body)
+
+		claimed, err := claim(r.Context(), client, key, hash, db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to claim an idempotency key: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The Idempotency-Key could not be checked.")
+			return
+		}
+		if !claimed {
+			stored, storedHash, err := lookup(r.Context(), client, key, db, timeout)
+			switch {
+			case err != nil:
+				log.Printf("An error accured trying to read an idempotency key: %v", err)
+				problem.Error(w, r, http.StatusInternalServerError, "The Idempotency-Key could not be checked.")
+			case storedHash != "" && storedHash != hash:
+				outcomes.WithLabelValues(resultMismatch).Inc()
+				problem.Write(w, r, problem.Validation([]problem.FieldError{{Field: Header, Message: "was already used for a different request"}}))
+			case stored == nil:
+				outcomes.WithLabelValues(resultInProgress).Inc()
+				w.Header().Set("Retry-After", "1")
+				problem.Error(w, r, http.StatusConflict, "A request with this Idempotency-Key is still being processed.")
+			default:
+				outcomes.WithLabelValues(resultReplayed).Inc()
+				replay(w, stored)
+			}
+			return
+		}
+
+		outcomes.WithLabelValues(resultExecuted).Inc()
+		rec := &recorder{ResponseWriter: w, before: w.Header().Clone()}
+		handler.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// The client may be gone already; its retry still needs the key settled.
+		ctx := tenant.NewContext(context.Background(), tenantID)
+		if rec.status < http.StatusOK || rec.status >= http.StatusMultipleChoices {
+			err = release(ctx, client, key, db, timeout)
+		} else {
+			err = complete(ctx, client, key, response{Status: rec.status, Header: rec.header, Body: rec.body.Bytes()}, db, timeout)
+		}
+		if err != nil {
+			log.Printf("An error accured trying to store the response of an idempotency key: %v", err)
+		}
+	})
+}
+
+// clientOf returns who sent r. Keys are only unique per client.
+func clientOf(r *http.Request) string {
+	if p, ok := auth.FromContext(r.Context()); ok && p.Subject != "" {
+		return p.Subject
+	}
+	return auth.MethodAnonymous
+}
+
+// requestHash tells apart the requests reusing a key.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replay sends a kept response again.
+func replay(w http.ResponseWriter, stored *response) {
+	for name, values := range stored.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
+
+// recorder copies the response of a request as it is written, with the
+// headers the handler set itself: the ones of the middlewares around it
+// belong to each request.
+type recorder struct {
+	http.ResponseWriter
+	before http.Header
+
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status != 0 {
+		return
+	}
+	rec.status = status
+	rec.header = http.Header{}
+	for name, values := range rec.Header() {
+		if fmt.Sprint(rec.before[name]) != fmt.Sprint(values) {
+			rec.header[name] = values
+		}
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,171 @@
+package idempotency
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var mock sqlmock.Sqlmock
+
+const client = "apikey:3f9c0a1b2d4e"
+
+func TestMain(m *testing.M) {
+	dbConn, sqlMock, err := sqlmock.New()
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	mock = sqlMock
+	Setup(dbConn, 15, time.Hour)
+	os.Exit(m.Run())
+}
+
+func request(key string, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/api/phonebooks", strings.NewReader(body))
+	req.Header.Set(Header, key)
+	ctx := tenant.NewContext(context.Background(), "acme")
+	ctx = auth.NewContext(ctx, &auth.Principal{Subject: client, Method: auth.MethodAPIKey})
+	return req.WithContext(ctx)
+}
+
+// created answers like a successful POST, counting its calls.
+func created(calls *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set("Location", "/api/phonebooks/7")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("7"))
+	})
+}
+
+func expectClaim(key string, claimed bool) {
+	mock.ExpectExec("DELETE FROM idempotency_keys WHERE tenant_id = \\? AND client = \\? AND idempotencyKey = \\? AND expiresAt < NOW\\(6\\)").
+		WithArgs("acme", client, key).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := int64(0)
+	if claimed {
+		rows = 1
+	}
+	mock.ExpectExec("INSERT IGNORE INTO idempotency_keys \\(tenant_id, client, idempotencyKey, requestHash, expiresAt\\) VALUES \\(\\?, \\?, \\?, \\?, NOW\\(6\\) \\+ INTERVAL \\? SECOND\\)").
+		WithArgs("acme", client, key, sqlmock.AnyArg(), 45).
+		WillReturnResult(sqlmock.NewResult(0, rows))
+}
+
+func TestMiddlewareKeepsTheFirstResponse(t *testing.T) {
+	calls := 0
+	expectClaim("first", true)
+	mock.ExpectExec("UPDATE idempotency_keys SET status = \\?, headers = \\?, body = \\?, expiresAt = NOW\\(6\\) \\+ INTERVAL \\? SECOND WHERE tenant_id = \\? AND client = \\? AND idempotencyKey = \\?").
+		WithArgs(http.StatusCreated, []byte(`{"Location":["/api/phonebooks/7"]}`), []byte("7"), 3600, "acme", client, "first").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := httptest.NewRecorder()
+	Middleware(created(&calls)).ServeHTTP(rr, request("first", `{"Name":"Nayara"}`))
+
+	if rr.Code != http.StatusCreated || rr.Body.String() != "7" || calls != 1 {
+		t.Errorf("got %d %q after %d calls, want 201 \"7\" after 1", rr.Code, rr.Body.String(), calls)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMiddlewareReplaysTheResponseToARetry(t *testing.T) {
+	calls := 0
+	req := request("retry", `{"Name":"Nayara"}`)
+	expectClaim("retry", false)
+	mock.ExpectQuery("SELECT requestHash, status, headers, body FROM idempotency_keys WHERE tenant_id = \\? AND client = \\? AND idempotencyKey = \\?").
+		WithArgs("acme", client, "retry").
+		WillReturnRows(sqlmock.NewRows([]string{"requestHash", "status", "headers", "body"}).
+			AddRow(requestHash(req, []byte(`{"Name":"Nayara"}`)), http.StatusCreated, `{"Location":["/api/phonebooks/7"]}`, "7"))
+
+	rr := httptest.NewRecorder()
+	Middleware(created(&calls)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated || rr.Body.String() != "7" || calls != 0 {
+		t.Errorf("got %d %q after %d calls, want 201 \"7\" after none", rr.Code, rr.Body.String(), calls)
+	}
+	if rr.Header().Get("Location") != "/api/phonebooks/7" || rr.Header().Get(ReplayedHeader) != "true" {
+		t.Errorf("the replay has the headers %v", rr.Header())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMiddlewareRefusesAKeyReusedForAnotherBody(t *testing.T) {
+	calls := 0
+	expectClaim("reused", false)
+	mock.ExpectQuery("SELECT requestHash, status, headers, body FROM idempotency_keys").
+		WillReturnRows(sqlmock.NewRows([]string{"requestHash", "status", "headers", "body"}).
+			AddRow("0123", http.StatusCreated, `{}`, "7"))
+
+	rr := httptest.NewRecorder()
+	Middleware(created(&calls)).ServeHTTP(rr, request("reused", `{"Name":"Paulo"}`))
+
+	if rr.Code != http.StatusUnprocessableEntity || calls != 0 {
+		t.Errorf("got %d after %d calls, want 422 after none", rr.Code, calls)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMiddlewareAsksConcurrentRetriesToWait(t *testing.T) {
+	calls := 0
+	req := request("running", `{"Name":"Nayara"}`)
+	expectClaim("running", false)
+	mock.ExpectQuery("SELECT requestHash, status, headers, body FROM idempotency_keys").
+		WillReturnRows(sqlmock.NewRows([]string{"requestHash", "status", "headers", "body"}).
+			AddRow(requestHash(req, []byte(`{"Name":"Nayara"}`)), nil, nil, nil))
+
+	rr := httptest.NewRecorder()
+	Middleware(created(&calls)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusConflict || rr.Header().Get("Retry-After") != "1" || calls != 0 {
+		t.Errorf("got %d with Retry-After %q after %d calls, want 409 with 1 after none", rr.Code, rr.Header().Get("Retry-After"), calls)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMiddlewareReleasesTheKeyOfAFailedRequest(t *testing.T) {
+	expectClaim("failed", true)
+	mock.ExpectExec("DELETE FROM idempotency_keys WHERE tenant_id = \\? AND client = \\? AND idempotencyKey = \\?$").
+		WithArgs("acme", client, "failed").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := httptest.NewRecorder()
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})).ServeHTTP(rr, request("failed", `{"Name":"Nayara"}`))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want 500", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMiddlewareIgnoresRequestsWithoutAKey(t *testing.T) {
+	calls := 0
+	req := request("", `{"Name":"Nayara"}`)
+
+	rr := httptest.NewRecorder()
+	Middleware(created(&calls)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated || calls != 1 {
+		t.Errorf("got %d after %d calls, want 201 after 1", rr.Code, calls)
+	}
+}
@@ -0,0 +1,212 @@
+// Package live pushes the changes of phonebooks to the clients of
+// GET /phonebooks/stream, over Server-Sent Events or a WebSocket. Changes are
+// taken from the outbox, so only committed changes are pushed, and a client
+// that reconnects with the ID of the last change it got is sent the ones it
+// missed.
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/Paulo-Eduardo/phone_book/outbox"
+	"github.com/Paulo-Eduardo/phone_book/phonebook"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+)
+
+// Defaults of the stream: how many changes may wait for a slow client
+// before it is disconnected, and how often idle connections are pinged.
+const (
+	DefaultBuffer    = 256
+	DefaultHeartbeat = 15 * time.Second
+)
+
+// TypeReset is pushed instead of changes that are no longer in the outbox: the
+// client missed some and must read the phonebooks again.
+const TypeReset = "reset"
+
+var (
+	connections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "api_stream_connections",
+		Help: "Clients connected to the stream of changes.",
+	})
+	droppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "api_stream_dropped_connections_total",
+		Help: "Clients disconnected from the stream for falling behind.",
+	})
+)
+
+// Message is a change pushed to a client. The phonebook is the one after the
+// change, or right before it for deletes, masked for the client.
+type Message struct {
+	ID          int64                `json:"id,omitempty"`
+	Type        string               `json:"type"`
+	PhonebookID int                  `json:"phonebookId,omitempty"`
+	CreatedAt   *time.Time           `json:"createdAt,omitempty"`
+	Phonebook   *phonebook.Phonebook `json:"phonebook,omitempty"`
+}
+
+// Broker is the outbox.Sink fanning the changes out to the clients of the
+// stream connected to this instance.
+type Broker struct {
+	name   string
+	buffer int
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+// subscriber gets the changes of a tenant. Its channel is closed when it
+// falls more than the buffer of the broker behind.
+type subscriber struct {
+	tenant string
+	events chan outbox.Event
+}
+
+// NewBroker returns a broker with the given name, unique to the instance, and
+// buffer of changes per client.
+func NewBroker(name string, buffer int) *Broker {
+	return &Broker{name: name, buffer: buffer, subscribers: map[*subscriber]struct{}{}}
+}
+
+func (b *Broker) Name() string {
+	return b.name
+}
+
+// Send hands events to the subscribers of their tenant. It never blocks: a
+// subscriber whose buffer is full is dropped, and resumes from the outbox
+// once its client reconnects.
+func (b *Broker) Send(ctx context.Context, events []outbox.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+subscribers:
+	for s := range b.subscribers {
+		for _, e := range events {
+			if e.Tenant != s.tenant {
+				continue
+			}
+			select {
+			case s.events <- e:
+			default:
+				delete(b.subscribers, s)
+				close(s.events)
+				droppedTotal.Inc()
+				continue subscribers
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Broker) subscribe(tenantID string) *subscriber {
+	s := &subscriber{tenant: tenantID, events: make(chan outbox.Event, b.buffer)}
+	b.mu.Lock()
+	b.subscribers[s] = struct{}{}
+	b.mu.Unlock()
+	connections.Inc()
+	return s
+}
+
+func (b *Broker) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.events)
+	}
+	b.mu.Unlock()
+	connections.Dec()
+}
+
+// filter selects the changes a client asked for. Empty fields select every
+// change.
+type filter struct {
+	types        map[string]bool
+	phonebookIDs map[int]bool
+	tag          string
+}
+
+// parseFilter reads the filter of a client from the query string:
+// comma-separated event types and phonebook IDs, and a tag.
+func parseFilter(query url.Values) (filter, []problem.FieldError) {
+	var f filter
+	var errs []problem.FieldError
+	if events := query.Get("events"); events != "" {
+		f.types = map[string]bool{}
+		for _, t := range strings.Split(events, ",") {
+			if !knownEvent(t) {
+				errs = append(errs, problem.FieldError{Field: "events", Message: "must list event types among " + strings.Join(phonebook.EventTypes, ", ")})
+				break
+			}
+			f.types[t] = true
+		}
+	}
+	if ids := query.Get("phonebookId"); ids != "" {
+		f.phonebookIDs = map[int]bool{}
+		for _, id := range strings.Split(ids, ",") {
+			phonebookID, err := strconv.Atoi(strings.TrimSpace(id))
+			if err != nil {
+				errs = append(errs, problem.FieldError{Field: "phonebookId", Message: "must list phonebook IDs"})
+				break
+			}
+			f.phonebookIDs[phonebookID] = true
+		}
+	}
+	f.tag = query.Get("tag")
+	return f, errs
+}
+
+func knownEvent(eventType string) bool {
+	for _, e := range phonebook.EventTypes {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (f filter) matches(m *Message) bool {
+	if f.types != nil && !f.types[m.Type] {
+		return false
+	}
+	if f.phonebookIDs != nil && !f.phonebookIDs[m.PhonebookID] {
+		return false
+	}
+	if f.tag != "" {
+		if m.Phonebook == nil {
+			return false
+		}
+		for _, tag := range m.Phonebook.Tags {
+			if tag == f.tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// message returns the change of e as pushed to the client of ctx.
+func message(ctx context.Context, e outbox.Event) (*Message, error) {
+	var data phonebook.EventData
+	if err := json.Unmarshal(e.Data, &data); err != nil {
+		return nil, fmt.Errorf("event %d: %v", e.ID, err)
+	}
+	createdAt := e.CreatedAt
+	return &Message{
+		ID:          e.ID,
+		Type:        e.Type,
+		PhonebookID: e.PhonebookID,
+		CreatedAt:   &createdAt,
+		Phonebook:   phonebook.Redact(ctx, data.Phonebook),
+	}, nil
+}
@@ -0,0 +1,322 @@
+package live
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/cors"
+	"github.com/Paulo-Eduardo/phone_book/logger"
+	"github.com/Paulo-Eduardo/phone_book/outbox"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/ratelimit"
+	"github.com/Paulo-Eduardo/phone_book/requestid"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+const streamPath = "phonebooks/stream"
+
+// permission is required to follow the changes of phonebooks.
+const permission = "phonebook:read"
+
+const (
+	// backlogBatch is the number of missed changes read at once from the
+	// outbox when a client resumes.
+	backlogBatch = 100
+	// writeWait is how long a WebSocket client may take to accept a
+	// message.
+	writeWait = 10 * time.Second
+	// sseRetry is the reconnection delay, in milliseconds, suggested to
+	// EventSource clients.
+	sseRetry = 3000
+)
+
+var errDropped = errors.New("the client fell behind the stream")
+
+var db *sql.DB
+var timeout int
+
+var broker *Broker
+var heartbeat = DefaultHeartbeat
+
+// upgrader accepts WebSockets from any origin: like the rest of the API, the
+// stream authenticates with credentials a browser doesn't send on its own.
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+// Setup sets the broker the clients of the stream subscribe to, and how
+// often idle connections are pinged.
+func Setup(b *Broker, interval time.Duration) {
+	broker = b
+	heartbeat = interval
+}
+
+// SetupRoutes serves the stream. Connections last as long as the client
+// stays, so they are neither compressed nor counted by admission control.
+func SetupRoutes(apiBasePath string, dbConn *sql.DB, to int) {
+	db = dbConn
+	timeout = to
+	handleStream := http.HandlerFunc(streamHandler)
+	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, streamPath), requestid.Middleware(logger.Middleware(cors.Middleware(auth.Middleware(tenant.Middleware(ratelimit.Middleware(handleStream)))))))
+}
+
+// client is a connection to the stream.
+type client interface {
+	send(m *Message) error
+	ping() error
+}
+
+// streamHandler serves GET /phonebooks/stream, as Server-Sent Events or, when
+// the request asks for an upgrade, over a WebSocket.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !auth.Check(w, r, permission) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	f, errs := parseFilter(r.URL.Query())
+	last, resume, err := lastEventID(r)
+	if err != nil {
+		errs = append(errs, problem.FieldError{Field: "Last-Event-ID", Message: "must be the id of a change"})
+	}
+	if len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs))
+		return
+	}
+	tenantID, err := tenant.Require(r.Context())
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	sub := broker.subscribe(tenantID)
+	defer broker.unsubscribe(sub)
+
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		ws := &wsClient{conn: conn}
+		go ws.read(cancel)
+		err = pump(ctx, ws, sub, f, last, resume)
+		ws.close(err)
+		logStreamError(err)
+		return
+	}
+
+	sse, ok := newSSEClient(w)
+	if !ok {
+		problem.Error(w, r, http.StatusInternalServerError, "The stream is not supported by this server.")
+		return
+	}
+	logStreamError(pump(r.Context(), sse, sub, f, last, resume))
+}
+
+func logStreamError(err error) {
+	if err != nil && err != errDropped {
+		log.Printf("An error accured trying to stream the changes: %v", err)
+	}
+}
+
+// lastEventID returns the ID of the last change a resuming client got, sent
+// by EventSource as the Last-Event-ID header or by WebSocket clients as the
+// lastEventId parameter.
+func lastEventID(r *http.Request) (int64, bool, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("lastEventId")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, errors.New("invalid Last-Event-ID")
+	}
+	return id, true, nil
+}
+
+// pump sends c the changes after the event last, when it resumes, and then
+// the changes handed to sub, pinging it while there are none.
+func pump(ctx context.Context, c client, sub *subscriber, f filter, last int64, resume bool) error {
+	if resume {
+		var err error
+		if last, err = catchUp(ctx, c, f, sub.tenant, last); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-sub.events:
+			if !ok {
+				return errDropped
+			}
+			if e.ID <= last {
+				continue
+			}
+			last = e.ID
+			if err := deliver(ctx, c, f, e); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := c.ping(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// catchUp sends c the changes of its tenant after the event last read from
+// the outbox, or a reset when some of them are no longer there, returning the
+// last event read.
+func catchUp(ctx context.Context, c client, f filter, tenantID string, last int64) (int64, error) {
+	retained, err := outbox.Retained(ctx, last, db, timeout)
+	if err != nil {
+		return last, err
+	}
+	if !retained {
+		return last, c.send(&Message{Type: TypeReset})
+	}
+
+	grace := time.Duration(timeout) * time.Second
+	for {
+		events, err := outbox.Read(ctx, last, backlogBatch, grace, db, timeout)
+		if err != nil {
+			return last, err
+		}
+		for _, e := range events {
+			last = e.ID
+			if e.Tenant != tenantID {
+				continue
+			}
+			if err := deliver(ctx, c, f, e); err != nil {
+				return last, err
+			}
+		}
+		if len(events) < backlogBatch {
+			return last, nil
+		}
+	}
+}
+
+func deliver(ctx context.Context, c client, f filter, e outbox.Event) error {
+	m, err := message(ctx, e)
+	if err != nil {
+		return err
+	}
+	if !f.matches(m) {
+		return nil
+	}
+	return c.send(m)
+}
+
+// sseClient is an EventSource client.
+type sseClient struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEClient(w http.ResponseWriter) (*sseClient, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+	flusher.Flush()
+	return &sseClient{w: w, flusher: flusher}, true
+}
+
+func (c *sseClient) send(m *Message) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if m.ID != 0 {
+		if _, err := fmt.Fprintf(c.w, "id: %d\n", m.ID); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(c.w, "event: %s\ndata: %s\n\n", m.Type, body); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+func (c *sseClient) ping() error {
+	if _, err := fmt.Fprint(c.w, ": heartbeat\n\n"); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// wsClient is a WebSocket client, sent every change as a text message.
+type wsClient struct {
+	conn *websocket.Conn
+}
+
+func (c *wsClient) send(m *Message) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteJSON(m)
+}
+
+func (c *wsClient) ping() error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+}
+
+// read discards what the client sends, answering its control messages, and
+// cancels the stream once it leaves or stops answering pings.
+func (c *wsClient) read(cancel context.CancelFunc) {
+	defer cancel()
+	c.conn.SetReadLimit(512)
+	c.conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+	})
+	for {
+		if _, _, err := c.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+// close tells the client why the stream ended: a client that fell behind may
+// reconnect right away with the ID of the last change it got.
+func (c *wsClient) close(err error) {
+	code, text := websocket.CloseNormalClosure, ""
+	if err == errDropped {
+		code, text = websocket.CloseTryAgainLater, err.Error()
+	} else if err != nil {
+		code = websocket.CloseInternalServerErr
+	}
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(writeWait))
+}
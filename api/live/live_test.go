@@ -0,0 +1,252 @@
+package live
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/outbox"
+	"github.com/Paulo-Eduardo/phone_book/phonebook"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var mock sqlmock.Sqlmock
+
+// testTenant is the tenant every test runs as.
+const testTenant = "acme"
+
+func TestMain(m *testing.M) {
+	var err error
+	db, mock, err = sqlmock.New()
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	timeout = 15
+	os.Exit(m.Run())
+}
+
+// newServer serves the stream to a caller of testTenant allowed to read
+// public values only, with a fresh broker.
+func newServer(t *testing.T) *httptest.Server {
+	Setup(NewBroker("test", 8), time.Minute)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := auth.NewContext(r.Context(), &auth.Principal{Subject: "apikey:dashboard", Method: auth.MethodAPIKey, Tenant: testTenant, Scopes: []string{"phonebook:read"}})
+		streamHandler(w, r.WithContext(tenant.NewContext(ctx, testTenant)))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testEvent returns a change of phonebook 7 of tenantID, tagged vip, whose
+// only number is restricted.
+func testEvent(id int64, eventType string, tenantID string) outbox.Event {
+	data, _ := json.Marshal(phonebook.EventData{Phonebook: &phonebook.Phonebook{
+		PhonebookID: 7,
+		Name:        "Nayara",
+		Phone:       "47996623579",
+		Phones:      []phonebook.ContactPhone{{Label: "mobile", Number: "47996623579", Primary: true, Visibility: "restricted"}},
+		Tags:        []string{"vip"},
+	}})
+	return outbox.Event{ID: id, Type: eventType, Tenant: tenantID, PhonebookID: 7, CreatedAt: time.Now().Add(-time.Hour), Data: data}
+}
+
+func eventRows(events ...outbox.Event) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"eventId", "eventType", "tenant_id", "phonebookId", "createdAt", "payload"})
+	for _, e := range events {
+		rows.AddRow(e.ID, e.Type, e.Tenant, e.PhonebookID, e.CreatedAt, []byte(e.Data))
+	}
+	return rows
+}
+
+// waitForSubscriber waits until the client is subscribed to the broker.
+func waitForSubscriber(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		broker.mu.Lock()
+		n := len(broker.subscribers)
+		broker.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the client never subscribed")
+}
+
+// sseEvent is an event read from a stream of Server-Sent Events.
+type sseEvent struct {
+	id, event string
+	data      Message
+}
+
+func readSSE(t *testing.T, reader *bufio.Reader) sseEvent {
+	var e sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if e.event != "" {
+				return e
+			}
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func openSSE(t *testing.T, server *httptest.Server, path string, lastEventID string) *bufio.Reader {
+	req, err := http.NewRequest("GET", server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("stream answered %v with %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+func TestStreamPushesMaskedChanges(t *testing.T) {
+	server := newServer(t)
+	reader := openSSE(t, server, "/api/phonebooks/stream", "")
+	waitForSubscriber(t)
+
+	broker.Send(context.Background(), []outbox.Event{testEvent(1, phonebook.EventUpdated, "other"), testEvent(2, phonebook.EventUpdated, testTenant)})
+
+	e := readSSE(t, reader)
+	if e.id != "2" || e.event != phonebook.EventUpdated || e.data.PhonebookID != 7 {
+		t.Fatalf("stream pushed the wrong change: %+v", e)
+	}
+	if e.data.Phonebook == nil || e.data.Phonebook.Phones[0].Number == "47996623579" || !e.data.Phonebook.Phones[0].Masked {
+		t.Errorf("stream pushed a restricted number unmasked: %+v", e.data.Phonebook)
+	}
+}
+
+func TestStreamResumesFromTheOutbox(t *testing.T) {
+	server := newServer(t)
+
+	mock.ExpectQuery("SELECT MIN\\(eventId\\) FROM outbox_events").
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(3))
+	mock.ExpectQuery("FROM outbox_events WHERE eventId > \\? ORDER BY eventId LIMIT \\?").
+		WithArgs(4, backlogBatch).
+		WillReturnRows(eventRows(testEvent(5, phonebook.EventCreated, testTenant), testEvent(6, phonebook.EventCreated, "other")))
+
+	reader := openSSE(t, server, "/api/phonebooks/stream", "4")
+	if e := readSSE(t, reader); e.id != "5" || e.event != phonebook.EventCreated {
+		t.Fatalf("stream did not resume with the missed change: %+v", e)
+	}
+
+	waitForSubscriber(t)
+	broker.Send(context.Background(), []outbox.Event{testEvent(5, phonebook.EventCreated, testTenant), testEvent(7, phonebook.EventDeleted, testTenant)})
+	if e := readSSE(t, reader); e.id != "7" {
+		t.Errorf("stream pushed %+v after catching up, want change 7 only once", e)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStreamResetsWhenChangesAreGone(t *testing.T) {
+	server := newServer(t)
+
+	mock.ExpectQuery("SELECT MIN\\(eventId\\) FROM outbox_events").
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(40))
+
+	reader := openSSE(t, server, "/api/phonebooks/stream", "4")
+	if e := readSSE(t, reader); e.event != TypeReset || e.id != "" {
+		t.Errorf("stream pushed %+v want a reset", e)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStreamOverWebSocket(t *testing.T) {
+	server := newServer(t)
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/phonebooks/stream?" + url.Values{"events": {phonebook.EventDeleted}, "tag": {"vip"}}.Encode()
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitForSubscriber(t)
+
+	broker.Send(context.Background(), []outbox.Event{testEvent(1, phonebook.EventUpdated, testTenant), testEvent(2, phonebook.EventDeleted, testTenant)})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m Message
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 2 || m.Type != phonebook.EventDeleted {
+		t.Errorf("WebSocket got %+v want change 2 only", m)
+	}
+}
+
+func TestBrokerDropsSlowSubscribers(t *testing.T) {
+	b := NewBroker("test", 2)
+	slow := b.subscribe(testTenant)
+	other := b.subscribe("other")
+	defer b.unsubscribe(slow)
+	defer b.unsubscribe(other)
+
+	events := []outbox.Event{testEvent(1, phonebook.EventUpdated, testTenant), testEvent(2, phonebook.EventUpdated, testTenant), testEvent(3, phonebook.EventUpdated, testTenant)}
+	if err := b.Send(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := <-slow.events; !ok {
+			t.Fatal("buffered changes were lost")
+		}
+	}
+	if _, ok := <-slow.events; ok {
+		t.Error("a subscriber past its buffer was kept")
+	}
+	if len(other.events) != 0 {
+		t.Error("a subscriber got the changes of another tenant")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	f, errs := parseFilter(url.Values{"events": {"phonebook.created,phonebook.deleted"}, "phonebookId": {"7, 9"}})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if !f.matches(&Message{Type: phonebook.EventCreated, PhonebookID: 9}) || f.matches(&Message{Type: phonebook.EventUpdated, PhonebookID: 9}) || f.matches(&Message{Type: phonebook.EventCreated, PhonebookID: 8}) {
+		t.Errorf("filter %+v matches the wrong changes", f)
+	}
+
+	if _, errs := parseFilter(url.Values{"events": {"phonebook.renamed"}, "phonebookId": {"x"}}); len(errs) != 2 {
+		t.Errorf("parseFilter returned %v want 2 errors", errs)
+	}
+}
@@ -1,9 +1,14 @@
 package logger
 
 import (
+	"bufio"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/requestid"
 )
 
 type loggingResponseWriter struct {
@@ -20,6 +25,23 @@ func (lrw *loggingResponseWriter) WriteHeader(code int) {
   lrw.ResponseWriter.WriteHeader(code)
 }
 
+// Flush lets handlers stream their responses through the logger.
+func (lrw *loggingResponseWriter) Flush() {
+  if f, ok := lrw.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+// Hijack lets handlers take over the connection, such as for WebSockets.
+func (lrw *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  h, ok := lrw.ResponseWriter.(http.Hijacker)
+  if !ok {
+    return nil, nil, errors.New("the connection can't be hijacked")
+  }
+  lrw.statusCode = http.StatusSwitchingProtocols
+  return h.Hijack()
+}
+
 
 func Middleware(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -27,7 +49,7 @@ func Middleware(handler http.Handler) http.Handler {
 
 		lrw := NewLoggingResponseWriter(w)
 		defer func() {
-			log.Printf("(HTTP %v) %v %v in %v", lrw.statusCode, r.Method, r.RequestURI, time.Since(t))
+			log.Printf("(HTTP %v) %v %v in %v [%v]", lrw.statusCode, r.Method, r.RequestURI, time.Since(t), requestid.FromContext(r.Context()))
 		}()
 
 		handler.ServeHTTP(lrw, r)
@@ -1,24 +1,88 @@
 package main
 
 import (
+	"database/sql"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/Paulo-Eduardo/phone_book/admission"
+	"github.com/Paulo-Eduardo/phone_book/apikey"
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/compress"
 	"github.com/Paulo-Eduardo/phone_book/database"
+	"github.com/Paulo-Eduardo/phone_book/group"
 	"github.com/Paulo-Eduardo/phone_book/healthcheck"
+	"github.com/Paulo-Eduardo/phone_book/idempotency"
+	"github.com/Paulo-Eduardo/phone_book/live"
+	"github.com/Paulo-Eduardo/phone_book/oidc"
+	"github.com/Paulo-Eduardo/phone_book/outbox"
 	"github.com/Paulo-Eduardo/phone_book/phonebook"
+	"github.com/Paulo-Eduardo/phone_book/ratelimit"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+	"github.com/Paulo-Eduardo/phone_book/webhook"
 	_ "github.com/go-sql-driver/mysql"
 )
 
 const apiBasePath = "/api"
 
+const (
+	defaultTrashRetention     = 30 * 24 * time.Hour
+	defaultTrashPurgeInterval = time.Hour
+)
+
+const (
+	defaultClockSkew   = time.Minute
+	defaultJWKSRefresh = time.Hour
+)
+
+// Default rate limits of each route class, as requests/period.
+const (
+	defaultReadLimit   = "300/1m"
+	defaultWriteLimit  = "60/1m"
+	defaultExportLimit = "10/1m"
+)
+
+// Defaults of the load shedding: how many requests may wait for a database
+// connection, and how long shed clients are told to wait.
+const (
+	defaultMaxQueue       = 16
+	defaultShedRetryAfter = time.Second
+)
+
+// Defaults of the cache of phonebook reads.
+const (
+	defaultCacheSize = 1000
+	defaultCacheTTL  = 5 * time.Second
+)
+
+// defaultWebhookInterval is how often due webhook deliveries are looked for.
+const defaultWebhookInterval = 5 * time.Second
+
+// Defaults of the outbox: how often it is relayed, how long relayed events
+// are kept for the clients of the stream to resume, and the size and number
+// of the files kept by the file sink.
+const (
+	defaultOutboxInterval  = time.Second
+	defaultOutboxRetention = time.Hour
+	defaultOutboxFileSize  = 100 << 20
+	defaultOutboxFiles     = 5
+)
+
+// defaultIdempotencyPurgeInterval is how often expired idempotency keys are
+// deleted.
+const defaultIdempotencyPurgeInterval = time.Hour
+
+// cliTimeout is the query timeout, in seconds, of the command line tools.
+const cliTimeout = 15
+
 func recordMetrics() {
 	go func() {
 		for {
@@ -36,20 +100,243 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(database.New())
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		if err := apikey.RunCLI(os.Args[2:], database.New(), cliTimeout, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "phonebook" {
+		loadTenants()
+		setupUniqueness()
+		if err := phonebook.RunCLI(os.Args[2:], database.New(), cliTimeout, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	recordMetrics()
 
 	argsWithoutProg := os.Args[1:]
 	dbConn := database.New()
+	migrate(dbConn)
 	timeout, err := strconv.Atoi(argsWithoutProg[1])
 	if err != nil {
 		log.Fatal("Timeout must be a integer")
 	}
 
+	loadTenants()
+	setupUniqueness()
+
+	if path := os.Getenv("POLICY_FILE"); path != "" {
+		policy, err := auth.LoadPolicy(path)
+		if err != nil {
+			log.Fatalf("Could not load the policy file: %v", err)
+		}
+		auth.SetPolicy(policy)
+	}
+
+	authenticators := []auth.Authenticator{auth.AuthenticatorFunc(apikey.Authenticate)}
+	if source := os.Getenv("OIDC_JWKS"); source != "" {
+		if os.Getenv("OIDC_ISSUER") == "" || os.Getenv("OIDC_AUDIENCE") == "" {
+			log.Fatalf("OIDC_ISSUER and OIDC_AUDIENCE must be set along with OIDC_JWKS")
+		}
+		tenantClaim := os.Getenv("OIDC_TENANT_CLAIM")
+		if tenantClaim == "" {
+			tenantClaim = "tenant"
+		}
+		rolesClaim := os.Getenv("OIDC_ROLES_CLAIM")
+		if rolesClaim == "" {
+			rolesClaim = "roles"
+		}
+		authenticators = append(authenticators, &oidc.Verifier{
+			Keys:        oidc.NewKeySet(source, durationFromEnv("OIDC_JWKS_REFRESH", defaultJWKSRefresh)),
+			Issuer:      os.Getenv("OIDC_ISSUER"),
+			Audience:    os.Getenv("OIDC_AUDIENCE"),
+			Skew:        durationFromEnv("OIDC_CLOCK_SKEW", defaultClockSkew),
+			TenantClaim: tenantClaim,
+			RolesClaim:  rolesClaim,
+		})
+	}
+	auth.Setup(os.Getenv("AUTH_DISABLED") != "true", authenticators...)
+
+	trustedProxies, err := ratelimit.ParseCIDRs(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("TRUSTED_PROXIES must list addresses or networks: %v", err)
+	}
+	ratelimit.Setup(ratelimit.Config{
+		Limits: map[string]ratelimit.Limit{
+			ratelimit.ClassRead:   limitFromEnv("RATE_LIMIT_READ", defaultReadLimit),
+			ratelimit.ClassWrite:  limitFromEnv("RATE_LIMIT_WRITE", defaultWriteLimit),
+			ratelimit.ClassExport: limitFromEnv("RATE_LIMIT_EXPORT", defaultExportLimit),
+		},
+		ClientQuota:    intFromEnv("DAILY_QUOTA", 0),
+		TrustedProxies: trustedProxies,
+	})
+
+	admission.Setup(admission.Config{
+		Pool:        dbConn,
+		MaxQueue:    intFromEnv("ADMISSION_MAX_QUEUE", defaultMaxQueue),
+		MaxInFlight: intFromEnv("ADMISSION_MAX_IN_FLIGHT", 0),
+		RetryAfter:  durationFromEnv("ADMISSION_RETRY_AFTER", defaultShedRetryAfter),
+	})
+
+	compress.Setup(intFromEnv("COMPRESSION_MIN_SIZE", compress.DefaultMinSize))
+
 	healthcheck.SetupRoutes(apiBasePath)
+	phonebook.SetupCache(intFromEnv("CACHE_SIZE", defaultCacheSize), durationFromEnv("CACHE_TTL", defaultCacheTTL))
+	idempotency.Setup(dbConn, timeout, durationFromEnv("IDEMPOTENCY_TTL", idempotency.DefaultTTL))
+	idempotency.StartPurger(defaultIdempotencyPurgeInterval)
+	phonebook.SetupSync(durationFromEnv("SYNC_TOKEN_TTL", phonebook.DefaultSyncTokenTTL))
 	phonebook.SetupRoutes(apiBasePath, dbConn, timeout)
+	group.SetupRoutes(apiBasePath, dbConn, timeout)
+	apikey.SetupRoutes(apiBasePath, dbConn, timeout)
+	webhook.SetupRoutes(apiBasePath, dbConn, timeout)
+	phonebook.AddPublisher(webhook.Enqueue)
+	phonebook.StartTrashPurger(dbConn, timeout,
+		durationFromEnv("TRASH_RETENTION", defaultTrashRetention),
+		durationFromEnv("TRASH_PURGE_INTERVAL", defaultTrashPurgeInterval))
+
+	broker := live.NewBroker("live:"+instanceName(), intFromEnv("STREAM_BUFFER", live.DefaultBuffer))
+	live.Setup(broker, durationFromEnv("STREAM_HEARTBEAT", live.DefaultHeartbeat))
+	live.SetupRoutes(apiBasePath, dbConn, timeout)
+
+	phonebook.AddPublisher(outbox.Append)
+	relay := outbox.NewRelay(dbConn, timeout, append(outboxSinks(), broker)...)
+	relay.Retention = durationFromEnv("OUTBOX_RETENTION", defaultOutboxRetention)
+	relay.Start(durationFromEnv("OUTBOX_INTERVAL", defaultOutboxInterval))
 
-	http.Handle("/metrics", promhttp.Handler())
+	webhookNetworks, err := ratelimit.ParseCIDRs(os.Getenv("WEBHOOK_ALLOWED_NETWORKS"))
+	if err != nil {
+		log.Fatalf("WEBHOOK_ALLOWED_NETWORKS must list addresses or networks: %v", err)
+	}
+	webhook.AllowNetworks(webhookNetworks)
+	dispatcher := webhook.NewDispatcher(dbConn, timeout)
+	dispatcher.MaxAttempts = intFromEnv("WEBHOOK_MAX_ATTEMPTS", webhook.DefaultMaxAttempts)
+	dispatcher.Backoff = durationFromEnv("WEBHOOK_BACKOFF", webhook.DefaultBackoff)
+	dispatcher.MaxBackoff = durationFromEnv("WEBHOOK_MAX_BACKOFF", webhook.DefaultMaxBackoff)
+	dispatcher.Start(durationFromEnv("WEBHOOK_INTERVAL", defaultWebhookInterval))
+
+	http.Handle("/metrics", admission.Priority(promhttp.Handler()))
 
 	log.Println("Server runnint at port: " + argsWithoutProg[0])
 	log.Fatal(http.ListenAndServe(":"+argsWithoutProg[0], nil))
 }
+
+// migrate brings the schema of the database up to date.
+func migrate(dbConn *sql.DB) {
+	applied, err := database.Migrate(dbConn)
+	for _, migration := range applied {
+		log.Printf("Applied the migration %d_%s", migration.Version, migration.Name)
+	}
+	if err != nil {
+		log.Fatalf("Could not migrate the database: %v", err)
+	}
+}
+
+// loadTenants loads the tenants of the TENANTS_FILE, if any.
+func loadTenants() {
+	path := os.Getenv("TENANTS_FILE")
+	if path == "" {
+		return
+	}
+	registry, err := tenant.Load(path)
+	if err != nil {
+		log.Fatalf("Could not load the tenants file: %v", err)
+	}
+	tenant.Setup(registry)
+}
+
+// setupUniqueness reads the fields unique by default, such as "email,phone",
+// from UNIQUE_FIELDS.
+func setupUniqueness() {
+	var fields []string
+	for _, field := range strings.Split(os.Getenv("UNIQUE_FIELDS"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	if err := phonebook.SetupUniqueness(fields); err != nil {
+		log.Fatalf("UNIQUE_FIELDS must list email or phone: %v", err)
+	}
+}
+
+// outboxSinks returns the sinks of the outbox configured in the environment.
+func outboxSinks() []outbox.Sink {
+	var sinks []outbox.Sink
+	if os.Getenv("OUTBOX_STDOUT") == "true" {
+		sinks = append(sinks, outbox.NewWriterSink("stdout", os.Stdout))
+	}
+	if path := os.Getenv("OUTBOX_FILE"); path != "" {
+		sink, err := outbox.NewFileSink(path,
+			int64(intFromEnv("OUTBOX_FILE_MAX_SIZE", defaultOutboxFileSize)),
+			intFromEnv("OUTBOX_FILE_MAX_FILES", defaultOutboxFiles))
+		if err != nil {
+			log.Fatalf("Could not open the outbox file: %v", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if url := os.Getenv("OUTBOX_URL"); url != "" {
+		sinks = append(sinks, outbox.NewHTTPSink(url))
+	}
+	return sinks
+}
+
+// instanceName tells this instance of the API apart from the others sharing
+// the database.
+func instanceName() string {
+	if name := os.Getenv("INSTANCE_NAME"); name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("Could not name the instance, set INSTANCE_NAME: %v", err)
+	}
+	return name
+}
+
+// durationFromEnv reads a time.Duration such as "720h" from the environment,
+// falling back to def when the variable is not set.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s must be a positive duration such as 720h", name)
+	}
+	return d
+}
+
+// intFromEnv reads a non-negative integer from the environment, falling back
+// to def when the variable is not set.
+func intFromEnv(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("%s must be a positive integer", name)
+	}
+	return n
+}
+
+// limitFromEnv reads a rate limit such as "300/1m" from the environment,
+// falling back to def when the variable is not set.
+func limitFromEnv(name string, def string) ratelimit.Limit {
+	value := os.Getenv(name)
+	if value == "" {
+		value = def
+	}
+	limit, err := ratelimit.ParseLimit(value)
+	if err != nil {
+		log.Fatalf("%s must be a limit such as 300/1m, or 0: %v", name, err)
+	}
+	return limit
+}
@@ -0,0 +1,227 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minRefetchInterval bounds how often an unknown key ID can make the key set
+// be fetched again, so tokens with made-up key IDs can't hammer the provider.
+const minRefetchInterval = 30 * time.Second
+
+// errUnknownKey is returned for tokens signed by a key that isn't in the set,
+// even after fetching it again.
+var errUnknownKey = errors.New("token signed by an unknown key")
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey is a verification key with the algorithm it may be used with.
+type publicKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// KeySet is a JSON Web Key Set read from a file or an URL. It is cached for
+// refresh and fetched again early when a token names a key it doesn't have,
+// which is how providers roll their keys.
+type KeySet struct {
+	source  string
+	refresh time.Duration
+	client  *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]publicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	now         func() time.Time
+}
+
+// NewKeySet returns a key set read from source, an "http://" or "https://"
+// URL or a file path. Nothing is read until the first token is verified.
+func NewKeySet(source string, refresh time.Duration) *KeySet {
+	return &KeySet{
+		source:  source,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		now:     time.Now,
+	}
+}
+
+// key returns the key a token with the given key ID was signed with.
+func (ks *KeySet) key(kid string) (publicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := ks.now()
+	if ks.keys == nil || now.Sub(ks.fetchedAt) > ks.refresh {
+		if err := ks.load(now); err != nil && ks.keys == nil {
+			return publicKey{}, err
+		}
+	}
+	if key, ok := ks.find(kid); ok {
+		return key, nil
+	}
+	if now.Sub(ks.attemptedAt) < minRefetchInterval {
+		return publicKey{}, errUnknownKey
+	}
+	if err := ks.load(now); err != nil {
+		return publicKey{}, err
+	}
+	if key, ok := ks.find(kid); ok {
+		return key, nil
+	}
+	return publicKey{}, errUnknownKey
+}
+
+// find looks kid up. Tokens without a key ID are accepted when the set has a
+// single key.
+func (ks *KeySet) find(kid string) (publicKey, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+// load fetches the set, keeping the previous keys when that fails.
+func (ks *KeySet) load(now time.Time) error {
+	ks.attemptedAt = now
+	content, err := ks.read()
+	if err == nil {
+		var keys map[string]publicKey
+		keys, err = parseKeySet(content)
+		if err == nil {
+			ks.keys = keys
+			ks.fetchedAt = now
+			return nil
+		}
+	}
+	log.Printf("An error accured trying to load the key set from %s: %v", ks.source, err)
+	return err
+}
+
+func (ks *KeySet) read() ([]byte, error) {
+	if !strings.HasPrefix(ks.source, "http://") && !strings.HasPrefix(ks.source, "https://") {
+		return ioutil.ReadFile(ks.source)
+	}
+	resp, err := ks.client.Get(ks.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func parseKeySet(content []byte) (map[string]publicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]publicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+		}
+		// Keys of other types, or meant for another algorithm, are skipped.
+		if key.alg == "" || (k.Alg != "" && k.Alg != key.alg) {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// parseKey decodes a key of one of the supported types. Keys of other types
+// are returned with an empty alg.
+func parseKey(k jwk) (publicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return publicKey{}, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return publicKey{}, errors.New("invalid RSA exponent")
+		}
+		return publicKey{alg: algRS256, key: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return publicKey{}, nil
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return publicKey{}, errors.New("point is not on the curve")
+		}
+		return publicKey{alg: algES256, key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return publicKey{}, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return publicKey{}, errors.New("invalid Ed25519 key size")
+		}
+		return publicKey{alg: algEdDSA, key: ed25519.PublicKey(x)}, nil
+	}
+	return publicKey{}, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
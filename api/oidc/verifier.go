@@ -0,0 +1,259 @@
+// Package oidc authenticates requests carrying a JWT bearer token issued by an
+// OpenID Connect provider, verified offline against the provider's key set.
+package oidc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+)
+
+// Supported signing algorithms.
+const (
+	algRS256 = "RS256"
+	algES256 = "ES256"
+	algEdDSA = "EdDSA"
+)
+
+// Claims are the claims of a verified token, as decoded from JSON. Numbers
+// are json.Number.
+type Claims map[string]interface{}
+
+// String returns a string claim, or "" when it is missing or not a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim holding either a list of strings or a single
+// space-separated string, such as "aud" or "scope".
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// time returns a NumericDate claim.
+func (c Claims) time(name string) (time.Time, bool, error) {
+	v, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, true, fmt.Errorf("claim %s is not a number", name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, true, fmt.Errorf("claim %s is not a number", name)
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true, nil
+}
+
+// Verifier checks the signature and the registered claims of tokens.
+type Verifier struct {
+	Keys *KeySet
+	// Issuer and Audience must match the iss and aud claims. Without them
+	// every token is refused, since the key set of a provider signs the
+	// tokens of all of its apps.
+	Issuer   string
+	Audience string
+	// Skew is the clock difference tolerated when checking exp, nbf and iat.
+	Skew time.Duration
+	// TenantClaim names the claim holding the tenant of the caller. Tokens
+	// without it are refused, or the caller could pick any tenant.
+	TenantClaim string
+	// RolesClaim names the claim holding the roles of the caller, resolved
+	// to permissions by the auth policy.
+	RolesClaim string
+
+	now func() time.Time
+}
+
+// Verify returns the claims of token when it is signed by a key of the set
+// and currently valid.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWS compact serialization")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+	if header.Alg != algRS256 && header.Alg != algES256 && header.Alg != algEdDSA {
+		return nil, fmt.Errorf("algorithm %q is not accepted", header.Alg)
+	}
+
+	key, err := v.Keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.alg != header.Alg {
+		return nil, fmt.Errorf("key %q can't be used with %s", header.Kid, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid signature encoding")
+	}
+	if !verifySignature(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %v", err)
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) validate(claims Claims) error {
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+
+	if v.Issuer == "" || v.Audience == "" {
+		return errors.New("no issuer and audience are configured")
+	}
+	if claims.String("iss") != v.Issuer {
+		return fmt.Errorf("issuer %q is not accepted", claims.String("iss"))
+	}
+	if !contains(claims.Strings("aud"), v.Audience) {
+		return errors.New("token is not meant for this audience")
+	}
+
+	exp, ok, err := claims.time("exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if !now.Before(exp.Add(v.Skew)) {
+		return errors.New("token is expired")
+	}
+	if nbf, ok, err := claims.time("nbf"); err != nil {
+		return err
+	} else if ok && now.Add(v.Skew).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+	if iat, ok, err := claims.time("iat"); err != nil {
+		return err
+	} else if ok && now.Add(v.Skew).Before(iat) {
+		return errors.New("token is issued in the future")
+	}
+	return nil
+}
+
+// Authenticate is an auth.Authenticator for "Authorization: Bearer <jwt>".
+// The claims of the token are available to handlers through
+// auth.Principal.Claims.
+func (v *Verifier) Authenticate(r *http.Request) (*auth.Principal, error) {
+	bearer := r.Header.Get("Authorization")
+	if len(bearer) <= 7 || !strings.EqualFold(bearer[:7], "Bearer ") {
+		return nil, nil
+	}
+	token := strings.TrimSpace(bearer[7:])
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+
+	claims, err := v.Verify(token)
+	if err != nil {
+		log.Printf("An error accured trying to verify the bearer token: %v", err)
+		return nil, auth.ErrInvalidCredentials
+	}
+	tenantID := claims.String(v.TenantClaim)
+	if v.TenantClaim == "" || tenantID == "" {
+		log.Printf("An error accured trying to verify the bearer token: no %q claim", v.TenantClaim)
+		return nil, auth.ErrInvalidCredentials
+	}
+
+	name := claims.String("preferred_username")
+	if name == "" {
+		name = claims.String("email")
+	}
+	scopes := claims.Strings("scope")
+	if scopes == nil {
+		scopes = claims.Strings("scp")
+	}
+	return &auth.Principal{
+		Subject: auth.MethodJWT + ":" + claims.String("sub"),
+		Name:    name,
+		Method:  auth.MethodJWT,
+		Tenant:  tenantID,
+		Scopes:  scopes,
+		Roles:   claims.Strings(v.RolesClaim),
+		Claims:  claims,
+	}, nil
+}
+
+func verifySignature(key publicKey, signed []byte, signature []byte) bool {
+	switch key.alg {
+	case algRS256:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key.key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	case algES256:
+		if len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key.key.(*ecdsa.PublicKey), digest[:], r, s)
+	case algEdDSA:
+		return ed25519.Verify(key.key.(ed25519.PublicKey), signed, signature)
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
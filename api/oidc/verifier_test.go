@@ -0,0 +1,295 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+)
+
+const (
+	testIssuer   = "https://id.example.com"
+	testAudience = "phonebook"
+)
+
+// signer is a locally generated key able to sign tokens and to describe
+// itself as a JWK.
+type signer struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func newSigner(t *testing.T, kid string, alg string) signer {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case algRS256:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case algES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case algEdDSA:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer{kid: kid, alg: alg, key: key}
+}
+
+func (s signer) jwk() map[string]string {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "use": "sig", "n": encode(pub.N.Bytes()), "e": encode(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": encode(pad(pub.X.Bytes())), "y": encode(pad(pub.Y.Bytes()))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": s.kid, "crv": "Ed25519", "x": encode(pub)}
+	}
+	return nil
+}
+
+func (s signer) sign(t *testing.T, alg string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": s.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	var err error
+	digest := sha256.Sum256([]byte(signed))
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, sig *big.Int
+		r, sig, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(pad(r.Bytes()), pad(sig.Bytes())...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func pad(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+func keySetJSON(signers ...signer) []byte {
+	keys := make([]map[string]string, 0, len(signers))
+	for _, s := range signers {
+		keys = append(keys, s.jwk())
+	}
+	b, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return b
+}
+
+func writeKeySet(t *testing.T, signers ...signer) string {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, keySetJSON(signers...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func validClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   testIssuer,
+		"aud":   []string{testAudience, "other"},
+		"sub":   "248289761001",
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"scope": "phonebook:read phonebook:write",
+	}
+}
+
+func TestVerify(t *testing.T) {
+	rs := newSigner(t, "rs", algRS256)
+	es := newSigner(t, "es", algES256)
+	ed := newSigner(t, "ed", algEdDSA)
+	other := newSigner(t, "rs", algRS256)
+
+	now := time.Now()
+	verifier := &Verifier{
+		Keys:     NewKeySet(writeKeySet(t, rs, es, ed), time.Hour),
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		Skew:     time.Minute,
+		now:      func() time.Time { return now },
+	}
+
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := validClaims(now)
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "RS256", token: rs.sign(t, algRS256, validClaims(now)), valid: true},
+		{name: "ES256", token: es.sign(t, algES256, validClaims(now)), valid: true},
+		{name: "EdDSA", token: ed.sign(t, algEdDSA, validClaims(now)), valid: true},
+		{name: "expired within skew", token: rs.sign(t, algRS256, with("exp", now.Add(-30*time.Second).Unix())), valid: true},
+		{name: "expired", token: rs.sign(t, algRS256, with("exp", now.Add(-2*time.Minute).Unix()))},
+		{name: "no expiry", token: rs.sign(t, algRS256, with("exp", nil))},
+		{name: "not valid yet", token: rs.sign(t, algRS256, with("nbf", now.Add(5*time.Minute).Unix()))},
+		{name: "issued in the future", token: rs.sign(t, algRS256, with("iat", now.Add(5*time.Minute).Unix()))},
+		{name: "wrong issuer", token: rs.sign(t, algRS256, with("iss", "https://evil.example.com"))},
+		{name: "wrong audience", token: rs.sign(t, algRS256, with("aud", "other"))},
+		{name: "single audience", token: rs.sign(t, algRS256, with("aud", testAudience)), valid: true},
+		{name: "signed by another key", token: other.sign(t, algRS256, validClaims(now))},
+		{name: "algorithm of another key", token: es.sign(t, algRS256, validClaims(now))},
+		{name: "unsupported algorithm", token: rs.sign(t, "HS256", validClaims(now))},
+		{name: "not a JWT", token: "pbk_0123"},
+	}
+
+	for _, test := range tests {
+		claims, err := verifier.Verify(test.token)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: token was accepted", test.name)
+		}
+		if test.valid && claims.String("sub") != "248289761001" {
+			t.Errorf("%s: wrong claims %v", test.name, claims)
+		}
+	}
+}
+
+func TestVerifyWithoutIssuerAndAudience(t *testing.T) {
+	rs := newSigner(t, "rs", algRS256)
+	keys := NewKeySet(writeKeySet(t, rs), time.Hour)
+	token := rs.sign(t, algRS256, validClaims(time.Now()))
+
+	for _, verifier := range []*Verifier{
+		{Keys: keys, Audience: testAudience},
+		{Keys: keys, Issuer: testIssuer},
+	} {
+		if _, err := verifier.Verify(token); err == nil {
+			t.Errorf("token was accepted by %+v", verifier)
+		}
+	}
+}
+
+func TestNoneAlgorithmIsRejected(t *testing.T) {
+	rs := newSigner(t, "rs", algRS256)
+	verifier := &Verifier{Keys: NewKeySet(writeKeySet(t, rs), time.Hour)}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rs"}`))
+	payload, _ := json.Marshal(validClaims(time.Now()))
+	token := header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+
+	if _, err := verifier.Verify(token); err == nil {
+		t.Error("unsigned token was accepted")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old := newSigner(t, "2026-01", algES256)
+	rotated := newSigner(t, "2026-02", algES256)
+
+	var mu sync.Mutex
+	current := keySetJSON(old)
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		w.Write(current)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	keys := NewKeySet(server.URL, time.Hour)
+	keys.now = clock
+	verifier := &Verifier{Keys: keys, Issuer: testIssuer, Audience: testAudience, now: clock}
+
+	if _, err := verifier.Verify(old.sign(t, algES256, validClaims(now))); err != nil {
+		t.Fatalf("token of the current key was rejected: %v", err)
+	}
+	if _, err := verifier.Verify(old.sign(t, algES256, validClaims(now))); err != nil || fetches != 1 {
+		t.Fatalf("key set was not cached: %v, %d fetches", err, fetches)
+	}
+
+	mu.Lock()
+	current = keySetJSON(old, rotated)
+	mu.Unlock()
+
+	// Right after a fetch, an unknown key ID doesn't fetch the set again.
+	if _, err := verifier.Verify(rotated.sign(t, algES256, validClaims(now))); err == nil || fetches != 1 {
+		t.Fatalf("unknown key ID refetched too early: %v, %d fetches", err, fetches)
+	}
+
+	now = now.Add(minRefetchInterval + time.Second)
+	if _, err := verifier.Verify(rotated.sign(t, algES256, validClaims(now))); err != nil || fetches != 2 {
+		t.Fatalf("token of the rotated key was rejected: %v, %d fetches", err, fetches)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ed := newSigner(t, "ed", algEdDSA)
+	verifier := &Verifier{
+		Keys:        NewKeySet(writeKeySet(t, ed), time.Hour),
+		Issuer:      testIssuer,
+		Audience:    testAudience,
+		TenantClaim: "tenant",
+		RolesClaim:  "roles",
+	}
+
+	claims := validClaims(time.Now())
+	claims["tenant"] = "acme"
+	claims["preferred_username"] = "nayara"
+	claims["roles"] = []string{"admin"}
+	req := httptest.NewRequest("GET", "/api/phonebooks", nil)
+	req.Header.Set("Authorization", "Bearer "+ed.sign(t, algEdDSA, claims))
+
+	p, err := verifier.Authenticate(req)
+	if err != nil || p == nil {
+		t.Fatalf("Authenticate returned (%v, %v)", p, err)
+	}
+	if p.Subject != "jwt:248289761001" || p.Name != "nayara" || p.Tenant != "acme" || !p.Allows("phonebook:write") || !p.Allows("phonebook:delete") || p.Claims["preferred_username"] != "nayara" {
+		t.Errorf("Authenticate returned wrong principal: %+v", p)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+ed.sign(t, algEdDSA, map[string]interface{}{"sub": "x"}))
+	if _, err := verifier.Authenticate(req); err != auth.ErrInvalidCredentials {
+		t.Errorf("invalid token returned %v want %v", err, auth.ErrInvalidCredentials)
+	}
+
+	delete(claims, "tenant")
+	req.Header.Set("Authorization", "Bearer "+ed.sign(t, algEdDSA, claims))
+	if _, err := verifier.Authenticate(req); err != auth.ErrInvalidCredentials {
+		t.Errorf("token without a tenant returned %v want %v", err, auth.ErrInvalidCredentials)
+	}
+
+	req.Header.Set("Authorization", "Bearer pbk_0123456789ab_00")
+	if p, err := verifier.Authenticate(req); p != nil || err != nil {
+		t.Errorf("an API key was taken for a JWT: (%v, %v)", p, err)
+	}
+}
@@ -0,0 +1,123 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// fetch reads up to limit events recorded after the event afterID, in order.
+func fetch(ctx context.Context, afterID int64, limit int, db *sql.DB, timeout int) ([]Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	results, err := db.QueryContext(ctx, `SELECT
+	eventId,
+	eventType,
+	tenant_id,
+	phonebookId,
+	createdAt,
+	payload
+	FROM outbox_events
+	WHERE eventId > ?
+	ORDER BY eventId
+	LIMIT ?`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var events []Event
+	for results.Next() {
+		var e Event
+		var payload []byte
+		if err := results.Scan(&e.ID, &e.Type, &e.Tenant, &e.PhonebookID, &e.CreatedAt, &payload); err != nil {
+			return nil, err
+		}
+		e.Data = payload
+		events = append(events, e)
+	}
+	return events, results.Err()
+}
+
+// checkpoint returns the ID of the last event relayed to a sink, or 0 when
+// it never got one.
+func checkpoint(ctx context.Context, sink string, db *sql.DB, timeout int) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	var eventID int64
+	err := db.QueryRowContext(ctx, `SELECT eventId FROM outbox_checkpoints WHERE sink = ?`, sink).Scan(&eventID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return eventID, err
+}
+
+// saveCheckpoint records that a sink got every event up to eventID.
+func saveCheckpoint(ctx context.Context, sink string, eventID int64, db *sql.DB, timeout int) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `INSERT INTO outbox_checkpoints
+	(sink,
+	eventId,
+	updatedAt) VALUES (?, ?, ?)
+	ON DUPLICATE KEY UPDATE eventId = VALUES(eventId), updatedAt = VALUES(updatedAt)`,
+		sink,
+		eventID,
+		time.Now().UTC())
+	return err
+}
+
+// backlog returns the ID of the last event recorded after afterID and when
+// the first of them was recorded, or 0 and nil when there is none.
+func backlog(ctx context.Context, afterID int64, db *sql.DB, timeout int) (int64, *time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	var lastID sql.NullInt64
+	var oldest sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT MAX(eventId), MIN(createdAt) FROM outbox_events WHERE eventId > ?`, afterID).Scan(&lastID, &oldest)
+	if err != nil || !lastID.Valid {
+		return 0, nil, err
+	}
+	return lastID.Int64, &oldest.Time, nil
+}
+
+// prune deletes up to limit events up to eventID, which every sink got,
+// recorded before the given time.
+func prune(ctx context.Context, eventID int64, before time.Time, limit int, db *sql.DB, timeout int) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM outbox_events WHERE eventId <= ? AND createdAt < ? ORDER BY eventId LIMIT ?`, eventID, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Read returns up to limit events recorded after the event afterID, in
+// order, for readers catching up with the outbox on their own. Like the
+// relay, it stops at a gap in the IDs younger than grace.
+func Read(ctx context.Context, afterID int64, limit int, grace time.Duration, db *sql.DB, timeout int) ([]Event, error) {
+	events, err := fetch(ctx, afterID, limit, db, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return ready(afterID, events, time.Now(), grace), nil
+}
+
+// Retained reports whether every event recorded after the event afterID is
+// still in the outbox, so that Read returns all of them.
+func Retained(ctx context.Context, afterID int64, db *sql.DB, timeout int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	var first sql.NullInt64
+	if err := db.QueryRowContext(ctx, `SELECT MIN(eventId) FROM outbox_events`).Scan(&first); err != nil {
+		return false, err
+	}
+	return !first.Valid || first.Int64 <= afterID+1, nil
+}
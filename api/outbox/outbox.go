@@ -0,0 +1,67 @@
+// Package outbox records the changes of phonebooks in the outbox_events
+// table, in the transaction of the change, and relays them in order to
+// sinks. A change is recorded if and only if it is committed, and every sink
+// gets every event at least once: a sink may see an event again after a
+// failure or a restart, never miss one.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/phonebook"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// visibility is the level events are rendered at: sinks are run by the
+// operators of the API and get every value unmasked.
+const visibility = "restricted"
+
+// Event is a change recorded in the outbox. IDs increase in the order the
+// events were recorded; a sink that gets an event twice can tell by its ID.
+type Event struct {
+	ID          int64           `json:"id"`
+	Type        string          `json:"type"`
+	Tenant      string          `json:"tenant"`
+	PhonebookID int             `json:"phonebookId"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// Sink receives the events relayed from the outbox. Send gets the events in
+// order and must only return once they are stored or delivered; an error
+// sends them again later.
+type Sink interface {
+	// Name identifies the checkpoint of the sink, so it must stay the same
+	// across restarts.
+	Name() string
+	Send(ctx context.Context, events []Event) error
+}
+
+// Append is a phonebook.Publisher recording the event in the outbox, inside
+// the transaction of the change.
+func Append(ctx context.Context, tx *sql.Tx, eventType string, phonebookID int, render phonebook.Render) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(render(visibility))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO outbox_events
+	(tenant_id,
+	eventType,
+	phonebookId,
+	payload,
+	createdAt) VALUES (?, ?, ?, ?, ?)`,
+		tenantID,
+		eventType,
+		phonebookID,
+		data,
+		time.Now().UTC())
+	return err
+}
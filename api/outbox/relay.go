@@ -0,0 +1,207 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults of a Relay.
+const (
+	defaultBatch  = 100
+	pruneBatch    = 1000
+	pruneInterval = time.Minute
+)
+
+var (
+	relayedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_outbox_relayed_events_total",
+		Help: "Events relayed from the outbox, by sink.",
+	}, []string{"sink"})
+	sendErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_outbox_send_errors_total",
+		Help: "Batches of events a sink failed to take, by sink.",
+	}, []string{"sink"})
+	lagEvents = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "api_outbox_lag_events",
+		Help: "Events recorded in the outbox and not relayed to the sink yet.",
+	}, []string{"sink"})
+	lagSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "api_outbox_lag_seconds",
+		Help: "Age of the oldest event not relayed to the sink yet.",
+	}, []string{"sink"})
+)
+
+// Relay drains the outbox to its sinks. Each sink has its own checkpoint and
+// goes at its own pace, so a sink that is down holds back no other.
+type Relay struct {
+	DB      *sql.DB
+	Timeout int
+	Sinks   []Sink
+	// Batch is the number of events sent to a sink at once.
+	Batch int
+	// Grace is how long a missing ID is waited for before the events after
+	// it are relayed: IDs are taken when the events are recorded, so a
+	// transaction still running leaves a gap that it fills when it commits,
+	// and a rolled back one leaves it for good. It must be at least as long
+	// as a write may take.
+	Grace time.Duration
+	// Retention is how long events are kept once every sink got them, for
+	// the readers catching up on their own.
+	Retention time.Duration
+
+	now         func() time.Time
+	mu          sync.Mutex
+	checkpoints map[string]int64
+}
+
+// NewRelay returns a Relay to sinks for writes taking up to to seconds.
+func NewRelay(dbConn *sql.DB, to int, sinks ...Sink) *Relay {
+	return &Relay{
+		DB:          dbConn,
+		Timeout:     to,
+		Sinks:       sinks,
+		Batch:       defaultBatch,
+		Grace:       time.Duration(to) * time.Second,
+		now:         time.Now,
+		checkpoints: map[string]int64{},
+	}
+}
+
+// Start relays the events to every sink every interval, and right away
+// again after a full batch, and deletes the events every sink got.
+func (r *Relay) Start(interval time.Duration) {
+	for _, sink := range r.Sinks {
+		go func(sink Sink) {
+			for {
+				relayed, err := r.relay(context.Background(), sink)
+				if err != nil {
+					log.Printf("An error accured trying to relay the outbox to %s: %v", sink.Name(), err)
+				}
+				if err != nil || relayed < r.Batch {
+					time.Sleep(interval)
+				}
+			}
+		}(sink)
+	}
+	go func() {
+		for {
+			time.Sleep(pruneInterval)
+			if _, err := r.prune(context.Background()); err != nil {
+				log.Printf("An error accured trying to prune the outbox: %v", err)
+			}
+		}
+	}()
+}
+
+// relay sends sink the next batch of events it didn't get, returning how
+// many there were.
+func (r *Relay) relay(ctx context.Context, sink Sink) (int, error) {
+	last, err := r.checkpoint(ctx, sink)
+	if err != nil {
+		return 0, err
+	}
+	events, err := fetch(ctx, last, r.Batch, r.DB, r.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	events = r.ready(last, events)
+
+	if len(events) > 0 {
+		if err := sink.Send(ctx, events); err != nil {
+			sendErrorsTotal.WithLabelValues(sink.Name()).Inc()
+			return 0, err
+		}
+		last = events[len(events)-1].ID
+		if err := saveCheckpoint(ctx, sink.Name(), last, r.DB, r.Timeout); err != nil {
+			return 0, err
+		}
+		r.mu.Lock()
+		r.checkpoints[sink.Name()] = last
+		r.mu.Unlock()
+		relayedTotal.WithLabelValues(sink.Name()).Add(float64(len(events)))
+	}
+
+	return len(events), r.measureLag(ctx, sink.Name(), last)
+}
+
+// checkpoint returns the last event sink got, read from the database the
+// first time.
+func (r *Relay) checkpoint(ctx context.Context, sink Sink) (int64, error) {
+	r.mu.Lock()
+	last, ok := r.checkpoints[sink.Name()]
+	r.mu.Unlock()
+	if ok {
+		return last, nil
+	}
+
+	last, err := checkpoint(ctx, sink.Name(), r.DB, r.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	r.checkpoints[sink.Name()] = last
+	r.mu.Unlock()
+	return last, nil
+}
+
+// ready returns the events that may be relayed after the event last: the
+// ones up to the first gap in their IDs that is younger than Grace. A sink
+// without a checkpoint starts at the first event left.
+func (r *Relay) ready(last int64, events []Event) []Event {
+	return ready(last, events, r.now(), r.Grace)
+}
+
+func ready(last int64, events []Event, now time.Time, grace time.Duration) []Event {
+	for i, e := range events {
+		if last != 0 && e.ID != last+1 && now.Sub(e.CreatedAt) < grace {
+			return events[:i]
+		}
+		last = e.ID
+	}
+	return events
+}
+
+// measureLag updates the lag metrics of a sink that got every event up to
+// last.
+func (r *Relay) measureLag(ctx context.Context, sink string, last int64) error {
+	lastID, oldest, err := backlog(ctx, last, r.DB, r.Timeout)
+	if err != nil {
+		return err
+	}
+	if oldest == nil {
+		lagEvents.WithLabelValues(sink).Set(0)
+		lagSeconds.WithLabelValues(sink).Set(0)
+		return nil
+	}
+	lagEvents.WithLabelValues(sink).Set(float64(lastID - last))
+	lagSeconds.WithLabelValues(sink).Set(r.now().Sub(*oldest).Seconds())
+	return nil
+}
+
+// prune deletes the events every sink got and older than Retention, once the
+// checkpoint of every sink is known.
+func (r *Relay) prune(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	var upTo int64 = -1
+	for _, sink := range r.Sinks {
+		last, ok := r.checkpoints[sink.Name()]
+		if !ok {
+			r.mu.Unlock()
+			return 0, nil
+		}
+		if upTo == -1 || last < upTo {
+			upTo = last
+		}
+	}
+	r.mu.Unlock()
+	if upTo <= 0 {
+		return 0, nil
+	}
+	return prune(ctx, upTo, r.now().UTC().Add(-r.Retention), pruneBatch, r.DB, r.Timeout)
+}
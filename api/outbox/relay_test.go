@@ -0,0 +1,225 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/Paulo-Eduardo/phone_book/phonebook"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var testNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// memorySink keeps the events it is sent, or fails with err.
+type memorySink struct {
+	events []Event
+	err    error
+}
+
+func (s *memorySink) Name() string {
+	return "memory"
+}
+
+func (s *memorySink) Send(ctx context.Context, events []Event) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func newTestRelay(t *testing.T, sink Sink) (*Relay, sqlmock.Sqlmock) {
+	dbConn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbConn.Close() })
+	r := NewRelay(dbConn, 15, sink)
+	r.now = func() time.Time { return testNow }
+	return r, mock
+}
+
+// eventRows returns the rows of events recorded age ago.
+func eventRows(age time.Duration, ids ...int64) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"eventId", "eventType", "tenant_id", "phonebookId", "createdAt", "payload"})
+	for _, id := range ids {
+		rows.AddRow(id, phonebook.EventUpdated, "acme", 7, testNow.Add(-age), []byte(`{"phonebook":{}}`))
+	}
+	return rows
+}
+
+func expectCheckpoint(mock sqlmock.Sqlmock, eventID int64) {
+	rows := sqlmock.NewRows([]string{"eventId"})
+	if eventID > 0 {
+		rows.AddRow(eventID)
+	}
+	mock.ExpectQuery("SELECT eventId FROM outbox_checkpoints WHERE sink = \\?").WithArgs("memory").WillReturnRows(rows)
+}
+
+func expectBacklog(mock sqlmock.Sqlmock, after int64) {
+	mock.ExpectQuery("SELECT MAX\\(eventId\\), MIN\\(createdAt\\) FROM outbox_events WHERE eventId > \\?").
+		WithArgs(after).
+		WillReturnRows(sqlmock.NewRows([]string{"max", "min"}).AddRow(nil, nil))
+}
+
+func ids(events []Event) []int64 {
+	var ids []int64
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestRelaySendsTheEventsInOrderAndCheckpoints(t *testing.T) {
+	sink := &memorySink{}
+	r, mock := newTestRelay(t, sink)
+
+	expectCheckpoint(mock, 0)
+	mock.ExpectQuery("FROM outbox_events WHERE eventId > \\? ORDER BY eventId LIMIT \\?").
+		WithArgs(0, r.Batch).
+		WillReturnRows(eventRows(time.Second, 1, 2, 3))
+	mock.ExpectExec("INSERT INTO outbox_checkpoints").
+		WithArgs("memory", 3, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectBacklog(mock, 3)
+
+	relayed, err := r.relay(context.Background(), sink)
+	if err != nil || relayed != 3 {
+		t.Fatalf("relay() = (%d, %v) want (3, nil)", relayed, err)
+	}
+	if got := ids(sink.events); len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Errorf("sink got events %v want [1 2 3]", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRelayWaitsForARecentGap(t *testing.T) {
+	sink := &memorySink{}
+	r, mock := newTestRelay(t, sink)
+
+	expectCheckpoint(mock, 5)
+	mock.ExpectQuery("FROM outbox_events WHERE eventId > \\?").
+		WithArgs(5, r.Batch).
+		WillReturnRows(eventRows(time.Second, 6, 8, 9))
+	mock.ExpectExec("INSERT INTO outbox_checkpoints").
+		WithArgs("memory", 6, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectBacklog(mock, 6)
+
+	mock.ExpectQuery("FROM outbox_events WHERE eventId > \\?").
+		WithArgs(6, r.Batch).
+		WillReturnRows(eventRows(2*r.Grace, 8, 9))
+	mock.ExpectExec("INSERT INTO outbox_checkpoints").
+		WithArgs("memory", 9, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectBacklog(mock, 9)
+
+	if _, err := r.relay(context.Background(), sink); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(sink.events); len(got) != 1 || got[0] != 6 {
+		t.Fatalf("sink got events %v before the gap was filled, want [6]", got)
+	}
+	if _, err := r.relay(context.Background(), sink); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(sink.events); len(got) != 3 || got[2] != 9 {
+		t.Errorf("sink got events %v once the gap expired, want [6 8 9]", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRelayResendsAfterTheSinkFails(t *testing.T) {
+	sink := &memorySink{err: errors.New("disk full")}
+	r, mock := newTestRelay(t, sink)
+
+	expectCheckpoint(mock, 5)
+	mock.ExpectQuery("FROM outbox_events WHERE eventId > \\?").
+		WithArgs(5, r.Batch).
+		WillReturnRows(eventRows(time.Second, 6, 7))
+	mock.ExpectQuery("FROM outbox_events WHERE eventId > \\?").
+		WithArgs(5, r.Batch).
+		WillReturnRows(eventRows(time.Second, 6, 7))
+	mock.ExpectExec("INSERT INTO outbox_checkpoints").
+		WithArgs("memory", 7, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectBacklog(mock, 7)
+
+	if _, err := r.relay(context.Background(), sink); err == nil {
+		t.Fatal("relay succeeded although the sink failed")
+	}
+	sink.err = nil
+	if relayed, err := r.relay(context.Background(), sink); err != nil || relayed != 2 {
+		t.Fatalf("relay() = (%d, %v) want (2, nil)", relayed, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPruneWaitsForEverySink(t *testing.T) {
+	r, mock := newTestRelay(t, &memorySink{})
+	r.Sinks = append(r.Sinks, NewWriterSink("other", nil))
+
+	if pruned, err := r.prune(context.Background()); err != nil || pruned != 0 {
+		t.Fatalf("prune() = (%d, %v) before the checkpoints are known", pruned, err)
+	}
+
+	r.Retention = time.Hour
+	r.checkpoints["memory"] = 9
+	r.checkpoints["other"] = 4
+	mock.ExpectExec("DELETE FROM outbox_events WHERE eventId <= \\? AND createdAt < \\? ORDER BY eventId LIMIT \\?").
+		WithArgs(4, testNow.Add(-time.Hour), pruneBatch).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+
+	if pruned, err := r.prune(context.Background()); err != nil || pruned != 4 {
+		t.Fatalf("prune() = (%d, %v) want (4, nil)", pruned, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAppendRecordsTheEventInTheTransaction(t *testing.T) {
+	dbConn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbConn.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO outbox_events").
+		WithArgs("acme", phonebook.EventCreated, 7, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var renderedAt string
+	render := func(v string) phonebook.EventData {
+		renderedAt = v
+		return phonebook.EventData{Phonebook: &phonebook.Phonebook{PhonebookID: 7}}
+	}
+	if err := Append(tenant.NewContext(context.Background(), "acme"), tx, phonebook.EventCreated, 7, render); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if renderedAt != visibility {
+		t.Errorf("event rendered at %q want %q", renderedAt, visibility)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
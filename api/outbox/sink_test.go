@@ -0,0 +1,111 @@
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testEvents(ids ...int64) []Event {
+	var events []Event
+	for _, id := range ids {
+		events = append(events, Event{ID: id, Type: "phonebook.updated", Tenant: "acme", PhonebookID: 7, CreatedAt: testNow, Data: json.RawMessage(`{"phonebook":{}}`)})
+	}
+	return events
+}
+
+func TestWriterSinkWritesOneEventPerLine(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink("stdout", &buf)
+	if err := sink.Send(context.Background(), testEvents(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("sink wrote %d lines want 2: %s", len(lines), buf.String())
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil || e.ID != 2 || string(e.Data) != `{"phonebook":{}}` {
+		t.Errorf("sink wrote wrong event: %s (%v)", lines[1], err)
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.ndjson")
+	line, _ := encode(testEvents(1))
+	sink, err := NewFileSink(path, int64(2*len(line)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	for id := int64(1); id <= 7; id++ {
+		if err := sink.Send(context.Background(), testEvents(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string][]int64{path: {7}, path + ".1": {5, 6}, path + ".2": {3, 4}}
+	for file, ids := range want {
+		if got := readIDs(t, file); len(got) != len(ids) || got[0] != ids[0] {
+			t.Errorf("%s has events %v want %v", filepath.Base(file), got, ids)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("sink kept more than 2 rotated files: %v", err)
+	}
+}
+
+func readIDs(t *testing.T, path string) []int64 {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var ids []int64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestHTTPSink(t *testing.T) {
+	status := http.StatusOK
+	var received []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("sink sent Content-Type %q", r.Header.Get("Content-Type"))
+		}
+		received, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	sink := NewHTTPSink(receiver.URL)
+	if err := sink.Send(context.Background(), testEvents(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(received), "\n") != 2 {
+		t.Errorf("receiver got %q want 2 events", received)
+	}
+
+	status = http.StatusBadGateway
+	if err := sink.Send(context.Background(), testEvents(3)); err == nil {
+		t.Error("sink took a batch the receiver refused")
+	}
+}
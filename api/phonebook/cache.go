@@ -0,0 +1,168 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/cache"
+)
+
+// readCache holds the phonebooks read by get and list, or is nil when caching
+// is off. Entries are stored before redaction, so callers always get a copy.
+var readCache *cache.Cache
+
+// generations count the writes of each tenant. Keys include the generation,
+// so a write makes every entry of the tenant unreachable at once, including
+// the ones of loads that were still running.
+var (
+	generationsMu sync.Mutex
+	generations   = map[string]uint64{}
+)
+
+// SetupCache caches up to size reads for ttl. A size of 0 turns caching off.
+func SetupCache(size int, ttl time.Duration) {
+	if size <= 0 || ttl <= 0 {
+		readCache = nil
+		return
+	}
+	readCache = cache.New("phonebooks", size, ttl)
+}
+
+// invalidate drops the cached reads of a tenant after a write.
+func invalidate(tenantID string) {
+	generationsMu.Lock()
+	defer generationsMu.Unlock()
+	generations[tenantID]++
+}
+
+// Invalidate drops the cached reads of a tenant after a write made outside
+// this package that changes which phonebooks a list returns, such as a change
+// to a group.
+func Invalidate(tenantID string) {
+	invalidate(tenantID)
+}
+
+func cacheKey(tenantID string, read string) string {
+	generationsMu.Lock()
+	defer generationsMu.Unlock()
+	return fmt.Sprintf("%s|%d|%s", tenantID, generations[tenantID], read)
+}
+
+// loadContext is the context a read shared by concurrent callers runs with:
+// the values of ctx, such as its tenant and caller, without its deadline or
+// cancellation, which belong to the first caller only.
+type loadContext struct {
+	context.Context
+}
+
+func (loadContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (loadContext) Done() <-chan struct{}       { return nil }
+func (loadContext) Err() error                  { return nil }
+
+// sharedLoad returns the context of a read shared by the callers of ctx and
+// others, bounded by a timeout of its own.
+func sharedLoad(ctx context.Context, timeout int) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(loadContext{ctx}, time.Duration(timeout)*time.Second)
+}
+
+// cachedGet reads a phonebook through the cache. Concurrent reads of the same
+// phonebook share one query, which runs until it is done even when the caller
+// that started it goes away; each caller stops waiting when its ctx is done.
+func cachedGet(ctx context.Context, tenantID string, phonebookID int, db *sql.DB, timeout int) (*Phonebook, error) {
+	if readCache == nil {
+		return queryPhonebook(ctx, tenantID, phonebookID, db, timeout)
+	}
+	value, err := readCache.Fetch(ctx, cacheKey(tenantID, fmt.Sprintf("get:%d", phonebookID)), func() (interface{}, error) {
+		ctx, cancel := sharedLoad(ctx, timeout)
+		defer cancel()
+		return queryPhonebook(ctx, tenantID, phonebookID, db, timeout)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clonePhonebook(value.(*Phonebook)), nil
+}
+
+// maxCachedRows bounds the lists kept in the cache. Longer ones are streamed
+// from the database every time rather than held in memory.
+const maxCachedRows = 1000
+
+// uncachedList is cached in place of a list longer than maxCachedRows, so
+// the next reads go straight to the database.
+type uncachedList struct{}
+
+var errTooLargeToCache = errors.New("the list is too large to be cached")
+
+// cachedList lists phonebooks through the cache, sharing the query of
+// concurrent lists like cachedGet. The clearance of the caller is part of the
+// key, since it decides which numbers and addresses match.
+func cachedList(ctx context.Context, tenantID string, query url.Values, db *sql.DB, timeout int, emit func(*Phonebook) error) error {
+	if readCache == nil {
+		return queryPhonebooks(ctx, tenantID, query, db, timeout, emit)
+	}
+	key := cacheKey(tenantID, fmt.Sprintf("list:%d:%s", clearance(ctx), query.Encode()))
+	value, err := readCache.Fetch(ctx, key, func() (interface{}, error) {
+		ctx, cancel := sharedLoad(ctx, timeout)
+		defer cancel()
+		phonebooks := make([]Phonebook, 0)
+		err := queryPhonebooks(ctx, tenantID, query, db, timeout, func(phonebook *Phonebook) error {
+			if len(phonebooks) == maxCachedRows {
+				return errTooLargeToCache
+			}
+			phonebooks = append(phonebooks, *phonebook)
+			return nil
+		})
+		if err == errTooLargeToCache {
+			return uncachedList{}, nil
+		}
+		return phonebooks, err
+	})
+	if err != nil {
+		return err
+	}
+	if _, ok := value.(uncachedList); ok {
+		return queryPhonebooks(ctx, tenantID, query, db, timeout, emit)
+	}
+	for _, phonebook := range value.([]Phonebook) {
+		if err := emit(clonePhonebook(&phonebook)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clonePhonebook copies a phonebook deep enough that redacting or editing the
+// copy leaves the cached one alone.
+func clonePhonebook(phonebook *Phonebook) *Phonebook {
+	if phonebook == nil {
+		return nil
+	}
+	clone := *phonebook
+	if phonebook.Phones != nil {
+		clone.Phones = append([]ContactPhone{}, phonebook.Phones...)
+	}
+	if phonebook.Emails != nil {
+		clone.Emails = append([]ContactEmail{}, phonebook.Emails...)
+	}
+	if phonebook.Tags != nil {
+		clone.Tags = append([]string{}, phonebook.Tags...)
+	}
+	if phonebook.DeletedAt != nil {
+		deletedAt := *phonebook.DeletedAt
+		clone.DeletedAt = &deletedAt
+	}
+	if phonebook.CreatedAt != nil {
+		createdAt := *phonebook.CreatedAt
+		clone.CreatedAt = &createdAt
+	}
+	if phonebook.UpdatedAt != nil {
+		updatedAt := *phonebook.UpdatedAt
+		clone.UpdatedAt = &updatedAt
+	}
+	return &clone
+}
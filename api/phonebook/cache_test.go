@@ -0,0 +1,148 @@
+package phonebook
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetIsCachedUntilAWrite(t *testing.T) {
+	SetupCache(100, time.Minute)
+	defer SetupCache(0, 0)
+	db, mock := NewMock()
+	defer db.Close()
+
+	query := "SELECT phonebookId, name, phone, email, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\?"
+	expectGet := func(name string) {
+		mock.ExpectQuery(query).WithArgs(1, testTenant).WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", name, "47996623579", "nay.maggioni@gmail.com", "restricted", nil, "", nil, ""))
+		mock.ExpectQuery("SELECT phonebookId, label, number, is_primary, visibility FROM phonebook_phones").
+			WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "number", "is_primary", "visibility"}).
+				AddRow(1, "mobile", "47996623579", true, "public"))
+		mock.ExpectQuery("SELECT phonebookId, label, address, is_primary, visibility FROM phonebook_emails").
+			WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "address", "is_primary", "visibility"}))
+		mock.ExpectQuery("SELECT phonebookId, tag FROM phonebook_tags").
+			WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "tag"}))
+	}
+
+	expectGet("Nayara")
+	first, err := get(testContext(), 1, db, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Redacting what a caller got must not mask the cached phonebook.
+	redact(first, 0)
+
+	second, err := get(testContext(), 1, db, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Phones[0].Number != "47996623579" || second.Phone != "47996623579" {
+		t.Errorf("cached phonebook was changed by a caller: %+v", second)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, nil, "", nil, ""))
+	expectLoadContacts(mock)
+	mock.ExpectExec("UPDATE phonebooks SET deleted_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO phonebook_revisions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	if err := remove(testContext(), 1, db, 15); err != nil {
+		t.Fatal(err)
+	}
+
+	expectGet("Nayara Maggioni")
+	third, err := get(testContext(), 1, db, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Name != "Nayara Maggioni" {
+		t.Errorf("get after a write was served from the cache: %+v", third)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListIsCachedPerQueryAndClearance(t *testing.T) {
+	SetupCache(100, time.Minute)
+	defer SetupCache(0, 0)
+	db, mock := NewMock()
+	defer db.Close()
+
+	expectList := func() {
+		mock.ExpectQuery("SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+				AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, ""))
+		expectLoadContacts(mock)
+	}
+
+	expectList()
+	expectList()
+	expectList()
+	for i := 0; i < 2; i++ {
+		if _, err := list(testContext(), nil, db, 15); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := list(testContext(), map[string][]string{"name": {"Nay"}}, db, 15); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := list(clearedContext(), nil, db, 15); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetSharedLoadOutlivesTheCallerThatStartedIt(t *testing.T) {
+	SetupCache(100, time.Minute)
+	defer SetupCache(0, 0)
+	db, mock := NewMock()
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\?").
+		WithArgs(1, testTenant).
+		WillDelayFor(50 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, ""))
+	expectLoadContacts(mock)
+
+	ctx, cancel := context.WithCancel(testContext())
+	cancel()
+	if _, err := cachedGet(ctx, testTenant, 1, db, 15); err != context.Canceled {
+		t.Errorf("get of a canceled caller returned %v want %v", err, context.Canceled)
+	}
+
+	phonebook, err := cachedGet(testContext(), testTenant, 1, db, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phonebook.Name != "Nayara" {
+		t.Errorf("get returned %+v", phonebook)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClonePhonebookCopiesTheTimestamps(t *testing.T) {
+	created := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	updated := created.Add(time.Hour)
+	deleted := updated.Add(time.Hour)
+	phonebook := &Phonebook{CreatedAt: &created, UpdatedAt: &updated, DeletedAt: &deleted}
+
+	clone := clonePhonebook(phonebook)
+	*clone.CreatedAt = clone.CreatedAt.Add(time.Minute)
+	*clone.UpdatedAt = clone.UpdatedAt.Add(time.Minute)
+	*clone.DeletedAt = clone.DeletedAt.Add(time.Minute)
+
+	if !created.Equal(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)) || !updated.Equal(created.Add(time.Hour)) || !deleted.Equal(updated.Add(time.Hour)) {
+		t.Errorf("editing the clone changed the cached phonebook: %+v", phonebook)
+	}
+}
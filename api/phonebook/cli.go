@@ -0,0 +1,59 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+const cliUsage = `usage:
+  main phonebook unique [-tenant <id>]`
+
+// RunCLI runs "main phonebook <command>". "unique" enforces the uniqueness
+// rules of a tenant on the phonebooks it stored before they were enabled.
+func RunCLI(args []string, dbConn *sql.DB, to int, out io.Writer) error {
+	db = dbConn
+	timeout = to
+
+	if len(args) == 0 {
+		return errors.New(cliUsage)
+	}
+	command := args[0]
+
+	flags := flag.NewFlagSet("phonebook "+command, flag.ContinueOnError)
+	flags.SetOutput(out)
+	tenantID := flags.String("tenant", tenant.DefaultID, "tenant whose phonebooks are checked")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	ctx := tenant.NewContext(context.Background(), *tenantID)
+
+	switch command {
+	case "unique":
+		shared, err := enforceUnique(ctx, db, timeout)
+		if err != nil {
+			return err
+		}
+		if len(shared) > 0 {
+			for _, s := range shared {
+				ids := make([]string, 0, len(s.PhonebookIDs))
+				for _, id := range s.PhonebookIDs {
+					ids = append(ids, strconv.Itoa(id))
+				}
+				fmt.Fprintf(out, "The %s %s is shared by phonebooks %s.\n", s.Field, s.Value, strings.Join(ids, ", "))
+			}
+			return fmt.Errorf("%d values are shared; merge or fix the phonebooks and run again", len(shared))
+		}
+		fmt.Fprintf(out, "Enforced the uniqueness rules of tenant %s.\n", *tenantID)
+	default:
+		return errors.New(cliUsage)
+	}
+	return nil
+}
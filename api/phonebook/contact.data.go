@@ -0,0 +1,233 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// contactBatchSize bounds the number of IDs sent in a single IN clause when
+// loading the numbers, addresses and tags of many phonebooks.
+const contactBatchSize = 500
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// saveContacts replaces the numbers, addresses and tags of a phonebook inside tx,
+// so they are always written atomically with the phonebook itself.
+func saveContacts(ctx context.Context, tx *sql.Tx, phonebook Phonebook) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM phonebook_phones WHERE phonebookId = ? AND tenant_id = ?`, phonebook.PhonebookID, tenantID); err != nil {
+		return err
+	}
+	// Only the first of the numbers or addresses repeated in the phonebook
+	// fills the unique column, or it would collide with itself.
+	uniquePhones, uniqueEmails := uniqueRules(tenantID)
+	if phonebook.DeletedAt != nil {
+		uniquePhones, uniqueEmails = false, false
+	}
+	if len(phonebook.Phones) > 0 {
+		placeholders := make([]string, 0, len(phonebook.Phones))
+		args := make([]interface{}, 0, len(phonebook.Phones)*9)
+		claimed := map[string]bool{}
+		for i, phone := range phonebook.Phones {
+			digits := digitsOnly(phone.Number)
+			var unique interface{}
+			if uniquePhones && !claimed[digits] {
+				unique = digits
+				claimed[digits] = true
+			}
+			placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args, phonebook.PhonebookID, tenantID, i, phone.Label, phone.Number, digits, unique, phone.Primary, normalizeVisibility(phone.Visibility))
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO phonebook_phones
+		(phonebookId,
+		tenant_id,
+		position,
+		label,
+		number,
+		number_digits,
+		unique_digits,
+		is_primary,
+		visibility) VALUES `+strings.Join(placeholders, ", "), args...)
+		if err != nil {
+			return uniqueConflict(ctx, tx, err, phonebook)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM phonebook_emails WHERE phonebookId = ? AND tenant_id = ?`, phonebook.PhonebookID, tenantID); err != nil {
+		return err
+	}
+	if len(phonebook.Emails) > 0 {
+		placeholders := make([]string, 0, len(phonebook.Emails))
+		args := make([]interface{}, 0, len(phonebook.Emails)*8)
+		claimed := map[string]bool{}
+		for i, email := range phonebook.Emails {
+			address := uniqueAddress(email.Address)
+			var unique interface{}
+			if uniqueEmails && !claimed[address] {
+				unique = address
+				claimed[address] = true
+			}
+			placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args, phonebook.PhonebookID, tenantID, i, email.Label, email.Address, unique, email.Primary, normalizeVisibility(email.Visibility))
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO phonebook_emails
+		(phonebookId,
+		tenant_id,
+		position,
+		label,
+		address,
+		unique_address,
+		is_primary,
+		visibility) VALUES `+strings.Join(placeholders, ", "), args...)
+		if err != nil {
+			return uniqueConflict(ctx, tx, err, phonebook)
+		}
+	}
+
+	return saveTags(ctx, tx, phonebook)
+}
+
+// saveTags replaces the tags of a phonebook inside tx.
+func saveTags(ctx context.Context, tx *sql.Tx, phonebook Phonebook) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM phonebook_tags WHERE phonebookId = ? AND tenant_id = ?`, phonebook.PhonebookID, tenantID); err != nil {
+		return err
+	}
+	if len(phonebook.Tags) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, 0, len(phonebook.Tags))
+	args := make([]interface{}, 0, len(phonebook.Tags)*3)
+	for _, tag := range phonebook.Tags {
+		placeholders = append(placeholders, "(?, ?, ?)")
+		args = append(args, phonebook.PhonebookID, tenantID, tag)
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO phonebook_tags
+	(phonebookId,
+	tenant_id,
+	tag) VALUES `+strings.Join(placeholders, ", "), args...)
+	return err
+}
+
+// loadContacts fills in the Phones, Emails and Tags of the given phonebooks.
+func loadContacts(ctx context.Context, q querier, phonebooks []Phonebook) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	index := make(map[int]int, len(phonebooks))
+	for i := range phonebooks {
+		index[phonebooks[i].PhonebookID] = i
+	}
+
+	for start := 0; start < len(phonebooks); start += contactBatchSize {
+		end := start + contactBatchSize
+		if end > len(phonebooks) {
+			end = len(phonebooks)
+		}
+		placeholders := make([]string, 0, end-start)
+		args := make([]interface{}, 0, end-start+1)
+		args = append(args, tenantID)
+		for _, phonebook := range phonebooks[start:end] {
+			placeholders = append(placeholders, "?")
+			args = append(args, phonebook.PhonebookID)
+		}
+		in := strings.Join(placeholders, ", ")
+
+		phones, err := q.QueryContext(ctx, `SELECT phonebookId, label, number, is_primary, visibility
+		FROM phonebook_phones
+		WHERE tenant_id = ? AND phonebookId IN (`+in+`)
+		ORDER BY phonebookId, position`, args...)
+		if err != nil {
+			return err
+		}
+		for phones.Next() {
+			var phonebookID int
+			var phone ContactPhone
+			if err := phones.Scan(&phonebookID, &phone.Label, &phone.Number, &phone.Primary, &phone.Visibility); err != nil {
+				phones.Close()
+				return err
+			}
+			if i, ok := index[phonebookID]; ok {
+				phonebooks[i].Phones = append(phonebooks[i].Phones, phone)
+			}
+		}
+		phones.Close()
+		if err := phones.Err(); err != nil {
+			return err
+		}
+
+		emails, err := q.QueryContext(ctx, `SELECT phonebookId, label, address, is_primary, visibility
+		FROM phonebook_emails
+		WHERE tenant_id = ? AND phonebookId IN (`+in+`)
+		ORDER BY phonebookId, position`, args...)
+		if err != nil {
+			return err
+		}
+		for emails.Next() {
+			var phonebookID int
+			var email ContactEmail
+			if err := emails.Scan(&phonebookID, &email.Label, &email.Address, &email.Primary, &email.Visibility); err != nil {
+				emails.Close()
+				return err
+			}
+			if i, ok := index[phonebookID]; ok {
+				phonebooks[i].Emails = append(phonebooks[i].Emails, email)
+			}
+		}
+		emails.Close()
+		if err := emails.Err(); err != nil {
+			return err
+		}
+
+		tags, err := q.QueryContext(ctx, `SELECT phonebookId, tag
+		FROM phonebook_tags
+		WHERE tenant_id = ? AND phonebookId IN (`+in+`)
+		ORDER BY phonebookId, tag`, args...)
+		if err != nil {
+			return err
+		}
+		for tags.Next() {
+			var phonebookID int
+			var tag string
+			if err := tags.Scan(&phonebookID, &tag); err != nil {
+				tags.Close()
+				return err
+			}
+			if i, ok := index[phonebookID]; ok {
+				phonebooks[i].Tags = append(phonebooks[i].Tags, tag)
+			}
+		}
+		tags.Close()
+		if err := tags.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadContact is loadContacts for a single phonebook.
+func loadContact(ctx context.Context, q querier, phonebook *Phonebook) error {
+	phonebooks := []Phonebook{*phonebook}
+	if err := loadContacts(ctx, q, phonebooks); err != nil {
+		return err
+	}
+	*phonebook = phonebooks[0]
+	return nil
+}
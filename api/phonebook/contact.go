@@ -0,0 +1,188 @@
+package phonebook
+
+import "strings"
+
+// defaultContactLabel is given to the number or address a client sends through
+// the single Phone or Email field.
+const defaultContactLabel = "main"
+
+const (
+	maxContactLabelLength = 32
+	maxContactsPerKind    = 20
+)
+
+// ContactPhone is one of the labelled numbers of a phonebook.
+type ContactPhone struct {
+	Label   string `json:"label"`
+	Number  string `json:"number"`
+	Primary bool   `json:"primary"`
+	// Visibility is one of public, internal or restricted.
+	Visibility string `json:"visibility,omitempty"`
+	// Masked is set in responses when Number is masked for the caller.
+	Masked bool `json:"masked,omitempty"`
+}
+
+// ContactEmail is one of the labelled email addresses of a phonebook.
+type ContactEmail struct {
+	Label   string `json:"label"`
+	Address string `json:"address"`
+	Primary bool   `json:"primary"`
+	// Visibility is one of public, internal or restricted.
+	Visibility string `json:"visibility,omitempty"`
+	// Masked is set in responses when Address is masked for the caller.
+	Masked bool `json:"masked,omitempty"`
+}
+
+// resolveContacts reconciles the single Phone and Email fields older clients
+// send with the Phones and Emails collections, using before (nil when
+// creating) to keep the numbers and tags a legacy client doesn't know about.
+//
+// When a collection is sent it wins and the single field becomes its primary
+// entry. When it is omitted, the single field replaces the primary entry of
+// the stored collection. Entries sent without a visibility keep the one of the
+// stored entry with the same value.
+func resolveContacts(phonebook *Phonebook, before *Phonebook) {
+	if phonebook.Tags == nil && before != nil {
+		phonebook.Tags = before.Tags
+	}
+	phonebook.Tags = normalizeTags(phonebook.Tags)
+	if phonebook.Visibility == "" && before != nil {
+		phonebook.Visibility = before.Visibility
+	}
+	phonebook.Visibility = normalizeVisibility(phonebook.Visibility)
+
+	if phonebook.Phones == nil {
+		var stored []ContactPhone
+		if before != nil {
+			stored = before.Phones
+		}
+		phonebook.Phones = mergeLegacyPhone(stored, phonebook.Phone)
+	} else if len(phonebook.Phones) > 0 && !hasPrimaryPhone(phonebook.Phones) {
+		phonebook.Phones[0].Primary = true
+	}
+	phonebook.Phone = ""
+	for i := range phonebook.Phones {
+		if phonebook.Phones[i].Primary {
+			phonebook.Phone = phonebook.Phones[i].Number
+		}
+	}
+
+	if phonebook.Emails == nil {
+		var stored []ContactEmail
+		if before != nil {
+			stored = before.Emails
+		}
+		phonebook.Emails = mergeLegacyEmail(stored, phonebook.Email)
+	} else if len(phonebook.Emails) > 0 && !hasPrimaryEmail(phonebook.Emails) {
+		phonebook.Emails[0].Primary = true
+	}
+	phonebook.Email = ""
+	for i := range phonebook.Emails {
+		if phonebook.Emails[i].Primary {
+			phonebook.Email = phonebook.Emails[i].Address
+		}
+	}
+
+	resolveVisibility(phonebook, before)
+}
+
+func mergeLegacyPhone(stored []ContactPhone, number string) []ContactPhone {
+	phones := make([]ContactPhone, 0, len(stored)+1)
+	replaced := false
+	for _, phone := range stored {
+		if phone.Primary {
+			if number == "" {
+				continue
+			}
+			phone.Number = number
+			replaced = true
+		}
+		phones = append(phones, phone)
+	}
+	if number != "" && !replaced {
+		phones = append([]ContactPhone{{Label: defaultContactLabel, Number: number, Primary: true}}, phones...)
+	}
+	if len(phones) > 0 && number == "" {
+		phones[0].Primary = true
+	}
+	return phones
+}
+
+func mergeLegacyEmail(stored []ContactEmail, address string) []ContactEmail {
+	emails := make([]ContactEmail, 0, len(stored)+1)
+	replaced := false
+	for _, email := range stored {
+		if email.Primary {
+			if address == "" {
+				continue
+			}
+			email.Address = address
+			replaced = true
+		}
+		emails = append(emails, email)
+	}
+	if address != "" && !replaced {
+		emails = append([]ContactEmail{{Label: defaultContactLabel, Address: address, Primary: true}}, emails...)
+	}
+	if len(emails) > 0 && address == "" {
+		emails[0].Primary = true
+	}
+	return emails
+}
+
+func hasPrimaryPhone(phones []ContactPhone) bool {
+	for _, phone := range phones {
+		if phone.Primary {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrimaryEmail(emails []ContactEmail) bool {
+	for _, email := range emails {
+		if email.Primary {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveVisibility(phonebook *Phonebook, before *Phonebook) {
+	for i := range phonebook.Phones {
+		phone := &phonebook.Phones[i]
+		if phone.Visibility == "" && before != nil {
+			for _, stored := range before.Phones {
+				if stored.Number == phone.Number {
+					phone.Visibility = stored.Visibility
+				}
+			}
+		}
+		phone.Visibility = normalizeVisibility(phone.Visibility)
+		phone.Masked = false
+	}
+	for i := range phonebook.Emails {
+		email := &phonebook.Emails[i]
+		if email.Visibility == "" && before != nil {
+			for _, stored := range before.Emails {
+				if stored.Address == email.Address {
+					email.Visibility = stored.Visibility
+				}
+			}
+		}
+		email.Visibility = normalizeVisibility(email.Visibility)
+		email.Masked = false
+	}
+}
+
+// digitsOnly strips everything but digits from a phone number, so numbers
+// typed with different punctuation can be compared.
+func digitsOnly(number string) string {
+	var b strings.Builder
+	for _, c := range number {
+		if c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,61 @@
+package phonebook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveContactsFromLegacyFields(t *testing.T) {
+	pb := Phonebook{Name: "Nayara", Phone: "47 996623579", Email: "nay.maggioni@gmail.com"}
+
+	resolveContacts(&pb, nil)
+
+	wantPhones := []ContactPhone{{Label: defaultContactLabel, Number: "47 996623579", Primary: true, Visibility: visibilityPublic}}
+	if !reflect.DeepEqual(pb.Phones, wantPhones) {
+		t.Errorf("wrong phones: got %v want %v", pb.Phones, wantPhones)
+	}
+	wantEmails := []ContactEmail{{Label: defaultContactLabel, Address: "nay.maggioni@gmail.com", Primary: true, Visibility: visibilityPublic}}
+	if !reflect.DeepEqual(pb.Emails, wantEmails) {
+		t.Errorf("wrong emails: got %v want %v", pb.Emails, wantEmails)
+	}
+}
+
+func TestResolveContactsKeepsNumbersUnknownToLegacyClients(t *testing.T) {
+	before := &Phonebook{
+		Phone: "47 996623579",
+		Phones: []ContactPhone{
+			{Label: "mobile", Number: "47 996623579", Primary: true},
+			{Label: "work", Number: "47 33334444"},
+		},
+	}
+	pb := Phonebook{Name: "Nayara", Phone: "47 988887777"}
+
+	resolveContacts(&pb, before)
+
+	want := []ContactPhone{
+		{Label: "mobile", Number: "47 988887777", Primary: true, Visibility: visibilityPublic},
+		{Label: "work", Number: "47 33334444", Visibility: visibilityPublic},
+	}
+	if !reflect.DeepEqual(pb.Phones, want) {
+		t.Errorf("wrong phones: got %v want %v", pb.Phones, want)
+	}
+	if before.Phones[0].Number != "47 996623579" {
+		t.Errorf("resolveContacts changed the stored phonebook: %v", before.Phones)
+	}
+}
+
+func TestResolveContactsUsesThePrimaryOfTheCollection(t *testing.T) {
+	pb := Phonebook{
+		Name: "Nayara",
+		Phones: []ContactPhone{
+			{Label: "work", Number: "47 33334444"},
+			{Label: "mobile", Number: "47 996623579", Primary: true},
+		},
+	}
+
+	resolveContacts(&pb, nil)
+
+	if pb.Phone != "47 996623579" {
+		t.Errorf("wrong phone: got %v want %v", pb.Phone, "47 996623579")
+	}
+}
@@ -0,0 +1,345 @@
+package phonebook
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Weights of what a pair of phonebooks is scored on. A shared number or
+// address is strong evidence on its own, while a similar name only adds to it:
+// many people share a first name.
+const (
+	phoneWeight = 0.5
+	emailWeight = 0.5
+	nameWeight  = 0.4
+)
+
+// minNameSimilarity is the similarity below which names are not counted.
+const minNameSimilarity = 0.75
+
+// Numbers are compared on their last matchedPhoneDigits digits, so the same
+// number typed with and without its country or area code matches. Numbers
+// shorter than minComparedPhoneDigits are not compared at all.
+const (
+	matchedPhoneDigits     = 8
+	minComparedPhoneDigits = 6
+)
+
+// Reasons a pair of phonebooks was found to be a likely duplicate.
+const (
+	reasonPhone = "phone"
+	reasonEmail = "email"
+	reasonName  = "name"
+)
+
+// Pairs scoring at least defaultMinDuplicateScore are listed unless the client
+// asks otherwise, up to defaultDuplicateLimit of them.
+const (
+	defaultMinDuplicateScore = 0.5
+	defaultDuplicateLimit    = 100
+	maxDuplicateLimit        = 1000
+)
+
+// Duplicate is a pair of phonebooks that are likely the same contact, with
+// how likely it is, from 0 to 1, and what they have in common.
+type Duplicate struct {
+	Phonebooks []Phonebook `json:"phonebooks"`
+	Score      float64     `json:"score"`
+	Reasons    []string    `json:"reasons"`
+}
+
+// Candidate is a stored phonebook a new one is likely a duplicate of.
+type Candidate struct {
+	Phonebook Phonebook `json:"phonebook"`
+	Score     float64   `json:"score"`
+	Reasons   []string  `json:"reasons"`
+}
+
+// fingerprint holds what a phonebook is compared on. Only the numbers and
+// addresses visible at a clearance are in it, so a match never tells a
+// caller about a value it can't see.
+type fingerprint struct {
+	phones map[string]bool
+	emails map[string]bool
+	name   []string
+}
+
+func fingerprintOf(phonebook *Phonebook, clearance int) fingerprint {
+	f := fingerprint{
+		phones: map[string]bool{},
+		emails: map[string]bool{},
+		name:   nameTokens(phonebook.Name),
+	}
+
+	phones := phonebook.Phones
+	if len(phones) == 0 && phonebook.Phone != "" {
+		phones = []ContactPhone{{Number: phonebook.Phone}}
+	}
+	for _, phone := range phones {
+		if maskedLevel(phonebook, phone.Visibility) > clearance {
+			continue
+		}
+		if key := phoneKey(phone.Number); key != "" {
+			f.phones[key] = true
+		}
+	}
+
+	emails := phonebook.Emails
+	if len(emails) == 0 && phonebook.Email != "" {
+		emails = []ContactEmail{{Address: phonebook.Email}}
+	}
+	for _, email := range emails {
+		if maskedLevel(phonebook, email.Visibility) > clearance {
+			continue
+		}
+		if key := emailKey(email.Address); key != "" {
+			f.emails[key] = true
+		}
+	}
+	return f
+}
+
+// blockingKeys returns the keys of the phonebooks f is compared with: the
+// ones sharing a number, an address or the first letters of a name token.
+// Comparing every pair of a large tenant would take too long.
+func (f fingerprint) blockingKeys() []string {
+	seen := map[string]bool{}
+	var keys []string
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for phone := range f.phones {
+		add("phone:" + phone)
+	}
+	for email := range f.emails {
+		add("email:" + email)
+	}
+	for _, token := range f.name {
+		if runes := []rune(token); len(runes) >= 2 {
+			add("name:" + string(runes[:2]))
+		}
+	}
+	return keys
+}
+
+// compare scores how likely two fingerprints are of the same contact.
+func compare(a, b fingerprint) (float64, []string) {
+	score := 0.0
+	var reasons []string
+	if shares(a.phones, b.phones) {
+		score += phoneWeight
+		reasons = append(reasons, reasonPhone)
+	}
+	if shares(a.emails, b.emails) {
+		score += emailWeight
+		reasons = append(reasons, reasonEmail)
+	}
+	if similarity := nameSimilarity(a.name, b.name); similarity >= minNameSimilarity {
+		score += nameWeight * similarity
+		reasons = append(reasons, reasonName)
+	}
+	return math.Min(1, math.Round(score*100)/100), reasons
+}
+
+func shares(a, b map[string]bool) bool {
+	for key := range a {
+		if b[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// findDuplicates returns the pairs of phonebooks scoring at least minScore,
+// most likely first, compared on the values visible at clearance.
+func findDuplicates(phonebooks []Phonebook, clearance int, minScore float64) []Duplicate {
+	fingerprints := make([]fingerprint, len(phonebooks))
+	blocks := map[string][]int{}
+	for i := range phonebooks {
+		fingerprints[i] = fingerprintOf(&phonebooks[i], clearance)
+		for _, key := range fingerprints[i].blockingKeys() {
+			blocks[key] = append(blocks[key], i)
+		}
+	}
+
+	duplicates := make([]Duplicate, 0)
+	compared := map[[2]int]bool{}
+	for _, block := range blocks {
+		for x := 0; x < len(block); x++ {
+			for y := x + 1; y < len(block); y++ {
+				pair := [2]int{block[x], block[y]}
+				if compared[pair] {
+					continue
+				}
+				compared[pair] = true
+
+				score, reasons := compare(fingerprints[pair[0]], fingerprints[pair[1]])
+				if score < minScore || len(reasons) == 0 {
+					continue
+				}
+				duplicates = append(duplicates, Duplicate{
+					Phonebooks: []Phonebook{phonebooks[pair[0]], phonebooks[pair[1]]},
+					Score:      score,
+					Reasons:    reasons,
+				})
+			}
+		}
+	}
+
+	sort.Slice(duplicates, func(i, j int) bool {
+		a, b := duplicates[i], duplicates[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Phonebooks[0].PhonebookID != b.Phonebooks[0].PhonebookID {
+			return a.Phonebooks[0].PhonebookID < b.Phonebooks[0].PhonebookID
+		}
+		return a.Phonebooks[1].PhonebookID < b.Phonebooks[1].PhonebookID
+	})
+	return duplicates
+}
+
+// findCandidates returns the stored phonebooks a new phonebook is likely a
+// duplicate of, most likely first. The new phonebook is compared on all of
+// its values, since the caller sent them, and the stored ones on the values
+// visible at clearance.
+func findCandidates(phonebook *Phonebook, stored []Phonebook, clearance int, minScore float64) []Candidate {
+	f := fingerprintOf(phonebook, visibilityRank(visibilityRestricted))
+	keys := map[string]bool{}
+	for _, key := range f.blockingKeys() {
+		keys[key] = true
+	}
+
+	candidates := make([]Candidate, 0)
+	for i := range stored {
+		other := fingerprintOf(&stored[i], clearance)
+		blocked := false
+		for _, key := range other.blockingKeys() {
+			blocked = blocked || keys[key]
+		}
+		if !blocked {
+			continue
+		}
+		score, reasons := compare(f, other)
+		if score >= minScore && len(reasons) > 0 {
+			candidates = append(candidates, Candidate{Phonebook: stored[i], Score: score, Reasons: reasons})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	return candidates
+}
+
+// phoneKey returns the digits a number is compared on, or "" when it is too
+// short to tell anything.
+func phoneKey(number string) string {
+	digits := digitsOnly(number)
+	if len(digits) < minComparedPhoneDigits {
+		return ""
+	}
+	if len(digits) > matchedPhoneDigits {
+		digits = digits[len(digits)-matchedPhoneDigits:]
+	}
+	return digits
+}
+
+// emailKey returns the address an email is compared on, or "" when it isn't
+// an address.
+func emailKey(address string) string {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if strings.LastIndex(address, "@") <= 0 {
+		return ""
+	}
+	return address
+}
+
+// foldAccents replaces the accented letters common in names by their plain
+// letter, so "Aurélio" and "Aurelio" are the same name.
+var foldAccents = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a", "ä", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "õ", "o", "ö", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ç", "c", "ñ", "n",
+)
+
+// nameTokens returns the words of a name, lower-cased, without accents and
+// sorted, so "Maggioni, Nayara" and "nayara maggioni" have the same tokens.
+func nameTokens(name string) []string {
+	tokens := strings.FieldsFunc(foldAccents.Replace(strings.ToLower(name)), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	sort.Strings(tokens)
+	return tokens
+}
+
+// nameSimilarity compares two names, from 0 for nothing in common to 1 for
+// the same name. Names typed slightly differently are close to 1, and a name
+// whose every word is in the other, as a first name alone is in the full
+// name, scores 0.9.
+func nameSimilarity(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	x, y := []rune(strings.Join(a, " ")), []rune(strings.Join(b, " "))
+	longest := len(x)
+	if len(y) > longest {
+		longest = len(y)
+	}
+	similarity := 1 - float64(levenshtein(x, y))/float64(longest)
+	if similarity < 0.9 && (contains(a, b) || contains(b, a)) {
+		similarity = 0.9
+	}
+	return similarity
+}
+
+// contains reports whether every token of b is in a.
+func contains(a, b []string) bool {
+	for _, token := range b {
+		i := sort.SearchStrings(a, token)
+		if i == len(a) || a[i] != token {
+			return false
+		}
+	}
+	return true
+}
+
+// levenshtein returns the number of runes to insert, delete or replace to
+// turn a into b.
+func levenshtein(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
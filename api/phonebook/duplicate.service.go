@@ -0,0 +1,161 @@
+package phonebook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+)
+
+// duplicatesHandler serves GET /phonebooks/duplicates?minScore=<score>&limit=<n>.
+func duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodOptions:
+		return
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	query := r.URL.Query()
+	var errs []problem.FieldError
+	minScore := defaultMinDuplicateScore
+	if value := query.Get("minScore"); value != "" {
+		var err error
+		minScore, err = strconv.ParseFloat(value, 64)
+		if err != nil || minScore <= 0 || minScore > 1 {
+			errs = append(errs, problem.FieldError{Field: "minScore", Message: "must be a number above 0 and up to 1"})
+		}
+	}
+	limit := defaultDuplicateLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxDuplicateLimit {
+			errs = append(errs, problem.FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(maxDuplicateLimit)})
+		}
+	}
+	if len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs))
+		return
+	}
+
+	phonebooks, err := list(r.Context(), url.Values{}, db, timeout)
+	if err != nil {
+		log.Printf("An error accured trying to list the phonebooks: %v", err)
+		problem.Error(w, r, http.StatusInternalServerError, "The duplicates could not be listed.")
+		return
+	}
+	level := clearance(r.Context())
+	duplicates := findDuplicates(phonebooks, level, minScore)
+	if len(duplicates) > limit {
+		duplicates = duplicates[:limit]
+	}
+	for i := range duplicates {
+		for j := range duplicates[i].Phonebooks {
+			redact(&duplicates[i].Phonebooks[j], level)
+		}
+	}
+	problem.WriteJSON(w, r, http.StatusOK, duplicates)
+}
+
+// likelyDuplicates returns the stored phonebooks a new phonebook is likely a
+// duplicate of, masked for the caller of ctx.
+func likelyDuplicates(ctx context.Context, phonebook Phonebook) ([]Candidate, error) {
+	phonebooks, err := list(ctx, url.Values{}, db, timeout)
+	if err != nil {
+		return nil, err
+	}
+	resolveContacts(&phonebook, nil)
+	level := clearance(ctx)
+	candidates := findCandidates(&phonebook, phonebooks, level, defaultMinDuplicateScore)
+	for i := range candidates {
+		redact(&candidates[i].Phonebook, level)
+	}
+	return candidates, nil
+}
+
+// mergeHandler serves POST /phonebooks/merge. It needs phonebook:delete as
+// well, since the merged phonebooks are moved to the trash.
+func mergeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		return
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !auth.Check(w, r, permissionDelete) {
+		return
+	}
+
+	var m Merge
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("An error accured trying to read the body: %v", err)
+		problem.Write(w, r, problem.Malformed("The request body could not be read."))
+		return
+	}
+	if err := json.Unmarshal(bodyBytes, &m); err != nil {
+		log.Printf("An error accured trying to parse the body: %v", err)
+		problem.Write(w, r, problem.Malformed("The request body is not a valid merge."))
+		return
+	}
+	if errs := validateMerge(m); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs))
+		return
+	}
+
+	sources := make(map[int]*Phonebook, len(m.PhonebookIDs))
+	for _, id := range m.PhonebookIDs {
+		phonebook, err := get(r.Context(), id, db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to get the item from id: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if phonebook == nil {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d does not exist.", id))
+			return
+		}
+		sources[id] = phonebook
+	}
+
+	// Check what the merge would give before running it, as for a PUT.
+	preview := mergePhonebooks(m, sources)
+	resolveContacts(&preview, sources[m.survivor()])
+	if errs := validate(preview); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs))
+		return
+	}
+	level := clearance(r.Context())
+	for _, source := range sources {
+		if disclosed := disclosedLevel(&preview, source, level); disclosed > 0 {
+			problem.Write(w, r, problem.Forbidden(clearancePermission(disclosed)))
+			return
+		}
+	}
+
+	merged, err := merge(r.Context(), m, db, timeout)
+	if err == errPhonebookNotFound {
+		problem.Error(w, r, http.StatusNotFound, "One of the phonebooks no longer exists.")
+		return
+	} else if writeConflict(w, r, err) {
+		return
+	} else if err != nil {
+		log.Printf("An error accured trying to merge phonebooks: %v", err)
+		problem.Error(w, r, http.StatusInternalServerError, "The phonebooks could not be merged.")
+		return
+	}
+	redact(merged, level)
+	problem.WriteJSON(w, r, http.StatusOK, merged)
+}
@@ -0,0 +1,101 @@
+package phonebook
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestFindDuplicatesMatchesNumbersTypedDifferently(t *testing.T) {
+	phonebooks := []Phonebook{
+		{PhonebookID: 1, Name: "Nayara", Phones: []ContactPhone{{Number: "+55 47 99662-3579", Primary: true}}},
+		{PhonebookID: 2, Name: "Paulo Eduardo", Phones: []ContactPhone{{Number: "47 3333-4444", Primary: true}}},
+		{PhonebookID: 3, Name: "nayara maggioni", Phones: []ContactPhone{{Number: "(47) 99662 3579", Primary: true}}},
+	}
+
+	duplicates := findDuplicates(phonebooks, 0, defaultMinDuplicateScore)
+	if len(duplicates) != 1 {
+		t.Fatalf("findDuplicates returned %d pairs, want 1: %+v", len(duplicates), duplicates)
+	}
+	d := duplicates[0]
+	if d.Phonebooks[0].PhonebookID != 1 || d.Phonebooks[1].PhonebookID != 3 {
+		t.Errorf("findDuplicates paired %d and %d, want 1 and 3", d.Phonebooks[0].PhonebookID, d.Phonebooks[1].PhonebookID)
+	}
+	if !reflect.DeepEqual(d.Reasons, []string{reasonPhone, reasonName}) || d.Score != 0.86 {
+		t.Errorf("findDuplicates scored %v for %v, want 0.86 for phone and name", d.Score, d.Reasons)
+	}
+}
+
+func TestFindDuplicatesIgnoresValuesTheCallerCantSee(t *testing.T) {
+	phonebooks := []Phonebook{
+		{PhonebookID: 1, Name: "Nayara", Emails: []ContactEmail{{Address: "nay@example.com", Visibility: visibilityRestricted}}},
+		{PhonebookID: 2, Name: "Paulo", Emails: []ContactEmail{{Address: "NAY@example.com", Visibility: visibilityPublic}}},
+	}
+
+	if duplicates := findDuplicates(phonebooks, visibilityRank(visibilityInternal), defaultMinDuplicateScore); len(duplicates) != 0 {
+		t.Errorf("findDuplicates matched a restricted address: %+v", duplicates)
+	}
+	if duplicates := findDuplicates(phonebooks, visibilityRank(visibilityRestricted), defaultMinDuplicateScore); len(duplicates) != 1 {
+		t.Errorf("findDuplicates returned %d pairs with clearance, want 1", len(duplicates))
+	}
+}
+
+func TestNameSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"Nayara Maggioni", "Maggioni, Nayara", 1},
+		{"Aurélio", "aurelio", 1},
+		{"Nayara", "Nayara Maggioni", 0.9},
+		{"Nayara", "Naiara", 1 - 1.0/6},
+		{"Nayara", "Paulo", 0},
+	}
+	for _, test := range tests {
+		got := nameSimilarity(nameTokens(test.a), nameTokens(test.b))
+		if test.want == 0 && got >= minNameSimilarity || test.want != 0 && got != test.want {
+			t.Errorf("nameSimilarity(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestPostPhonebookHandlerWarnsOfALikelyDuplicate(t *testing.T) {
+	handler := http.HandlerFunc(phonebooksHandler)
+
+	mock.ExpectQuery("SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "phone", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "nay.maggioni@gmail.com", "47996623579", "public", nil, "", nil, ""))
+	mock.ExpectQuery("SELECT phonebookId, label, number, is_primary, visibility FROM phonebook_phones").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "number", "is_primary", "visibility"}).
+			AddRow(1, "main", "47996623579", true, "public"))
+	mock.ExpectQuery("SELECT phonebookId, label, address, is_primary, visibility FROM phonebook_emails").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "address", "is_primary", "visibility"}))
+	mock.ExpectQuery("SELECT phonebookId, tag FROM phonebook_tags").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "tag"}))
+
+	body := []byte(`{"Name": "Nayara Maggioni", "Phone": "+55 (47) 99662-3579"}`)
+	req, err := newRequest("POST", "/phonebooks?checkDuplicates=true", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusConflict)
+	}
+	if !strings.Contains(rr.Body.String(), `"candidates":[{"phonebook":{"PhonebookID":1,`) {
+		t.Errorf("handler returned wrong body: %v", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
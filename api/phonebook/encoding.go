@@ -0,0 +1,332 @@
+package phonebook
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// encoding writes phonebooks in one media type, either a single one or a
+// list of them one at a time. The JSON ones write the representation of the
+// version of the request; the others have a single one of their own.
+type encoding struct {
+	contentType string
+	extension   string
+	// one writes a single phonebook.
+	one func(w io.Writer, version *wireVersion, phonebook *Phonebook) error
+	// begin and end surround the items of a list; item writes its i-th one.
+	begin func(w io.Writer) error
+	item  func(w io.Writer, version *wireVersion, phonebook *Phonebook, i int) error
+	end   func(w io.Writer) error
+}
+
+// encodings are the media types phonebooks can be read in, by their type.
+// The first one is used when the client accepts anything.
+var encodings = []*encoding{
+	{
+		contentType: "application/json",
+		extension:   "json",
+		one: func(w io.Writer, version *wireVersion, phonebook *Phonebook) error {
+			return writeMarshalled(w, version.encode(phonebook), json.Marshal, "", "")
+		},
+		begin: writeString("["),
+		item: func(w io.Writer, version *wireVersion, phonebook *Phonebook, i int) error {
+			separator := ","
+			if i == 0 {
+				separator = ""
+			}
+			return writeMarshalled(w, version.encode(phonebook), json.Marshal, separator, "")
+		},
+		end: writeString("]"),
+	},
+	{
+		contentType: ndjsonContentType,
+		extension:   "ndjson",
+		one: func(w io.Writer, version *wireVersion, phonebook *Phonebook) error {
+			return writeMarshalled(w, version.encode(phonebook), json.Marshal, "", "\n")
+		},
+		begin: writeString(""),
+		item: func(w io.Writer, version *wireVersion, phonebook *Phonebook, i int) error {
+			return writeMarshalled(w, version.encode(phonebook), json.Marshal, "", "\n")
+		},
+		end: writeString(""),
+	},
+	{
+		contentType: "application/xml",
+		extension:   "xml",
+		one: func(w io.Writer, _ *wireVersion, phonebook *Phonebook) error {
+			return writeMarshalled(w, newXMLPhonebook(phonebook), xml.Marshal, xml.Header, "")
+		},
+		begin: writeString(xml.Header + "<phonebooks>"),
+		item: func(w io.Writer, _ *wireVersion, phonebook *Phonebook, i int) error {
+			return writeMarshalled(w, newXMLPhonebook(phonebook), xml.Marshal, "", "")
+		},
+		end: writeString("</phonebooks>"),
+	},
+	{
+		contentType: "text/csv",
+		extension:   "csv",
+		one: func(w io.Writer, _ *wireVersion, phonebook *Phonebook) error {
+			if err := writeCSV(w, csvHeader); err != nil {
+				return err
+			}
+			return writeCSV(w, csvRecord(phonebook))
+		},
+		begin: func(w io.Writer) error {
+			return writeCSV(w, csvHeader)
+		},
+		item: func(w io.Writer, _ *wireVersion, phonebook *Phonebook, i int) error {
+			return writeCSV(w, csvRecord(phonebook))
+		},
+		end: writeString(""),
+	},
+	{
+		contentType: "text/vcard",
+		extension:   "vcf",
+		one: func(w io.Writer, _ *wireVersion, phonebook *Phonebook) error {
+			return writeVCard(w, phonebook)
+		},
+		begin: writeString(""),
+		item: func(w io.Writer, _ *wireVersion, phonebook *Phonebook, i int) error {
+			return writeVCard(w, phonebook)
+		},
+		end: writeString(""),
+	},
+}
+
+// negotiateEncoding returns the encoding the Accept header of a request
+// prefers, or nil when it accepts none of them. Each encoding gets the
+// q-value of the most specific media range matching it, and ties go to the
+// one listed first.
+func negotiateEncoding(accept string) *encoding {
+	if strings.TrimSpace(accept) == "" {
+		return encodings[0]
+	}
+
+	type mediaRange struct {
+		pattern string
+		q       float64
+	}
+	var ranges []mediaRange
+	for _, item := range strings.Split(accept, ",") {
+		parts := strings.Split(item, ";")
+		pattern := strings.ToLower(strings.TrimSpace(parts[0]))
+		if pattern == "text/x-vcard" {
+			pattern = "text/vcard"
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		if pattern != "" {
+			ranges = append(ranges, mediaRange{pattern, q})
+		}
+	}
+
+	var best *encoding
+	bestQ := 0.0
+	for _, e := range encodings {
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			if s := mediaTypeSpecificity(r.pattern, e.contentType); s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// mediaTypeSpecificity returns how specifically pattern, such as "text/*",
+// matches contentType, or -1 when it doesn't.
+func mediaTypeSpecificity(pattern string, contentType string) int {
+	switch {
+	case pattern == contentType:
+		return 2
+	case pattern == "*/*":
+		return 0
+	case strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*")):
+		return 1
+	}
+	return -1
+}
+
+func writeString(s string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		if s == "" {
+			return nil
+		}
+		_, err := io.WriteString(w, s)
+		return err
+	}
+}
+
+func writeMarshalled(w io.Writer, v interface{}, marshal func(interface{}) ([]byte, error), prefix string, suffix string) error {
+	b, err := marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, prefix+string(b)+suffix)
+	return err
+}
+
+// xmlPhonebook is the XML form of a phonebook.
+type xmlPhonebook struct {
+	XMLName     xml.Name   `xml:"phonebook"`
+	PhonebookID int        `xml:"id,attr"`
+	Name        string     `xml:"name"`
+	Phone       string     `xml:"phone,omitempty"`
+	Email       string     `xml:"email,omitempty"`
+	Visibility  string     `xml:"visibility,omitempty"`
+	Phones      *xmlPhones `xml:"phones,omitempty"`
+	Emails      *xmlEmails `xml:"emails,omitempty"`
+	Tags        *xmlTags   `xml:"tags,omitempty"`
+}
+
+type xmlPhones struct {
+	Phones []xmlEntry `xml:"phone"`
+}
+
+type xmlEmails struct {
+	Emails []xmlEntry `xml:"email"`
+}
+
+type xmlTags struct {
+	Tags []string `xml:"tag"`
+}
+
+type xmlEntry struct {
+	Label      string `xml:"label,attr"`
+	Primary    bool   `xml:"primary,attr,omitempty"`
+	Visibility string `xml:"visibility,attr,omitempty"`
+	Masked     bool   `xml:"masked,attr,omitempty"`
+	Value      string `xml:",chardata"`
+}
+
+func newXMLPhonebook(phonebook *Phonebook) xmlPhonebook {
+	x := xmlPhonebook{
+		PhonebookID: phonebook.PhonebookID,
+		Name:        phonebook.Name,
+		Phone:       phonebook.Phone,
+		Email:       phonebook.Email,
+		Visibility:  phonebook.Visibility,
+	}
+	if len(phonebook.Phones) > 0 {
+		x.Phones = &xmlPhones{}
+		for _, phone := range phonebook.Phones {
+			x.Phones.Phones = append(x.Phones.Phones, xmlEntry{phone.Label, phone.Primary, phone.Visibility, phone.Masked, phone.Number})
+		}
+	}
+	if len(phonebook.Emails) > 0 {
+		x.Emails = &xmlEmails{}
+		for _, email := range phonebook.Emails {
+			x.Emails.Emails = append(x.Emails.Emails, xmlEntry{email.Label, email.Primary, email.Visibility, email.Masked, email.Address})
+		}
+	}
+	if len(phonebook.Tags) > 0 {
+		x.Tags = &xmlTags{Tags: phonebook.Tags}
+	}
+	return x
+}
+
+// csvHeader names the columns of the CSV form. Numbers, addresses and tags
+// are joined with "; ", each entry written as label:value.
+var csvHeader = []string{"phonebookId", "name", "phone", "email", "visibility", "phones", "emails", "tags"}
+
+func csvRecord(phonebook *Phonebook) []string {
+	phones := make([]string, 0, len(phonebook.Phones))
+	for _, phone := range phonebook.Phones {
+		phones = append(phones, phone.Label+":"+phone.Number)
+	}
+	emails := make([]string, 0, len(phonebook.Emails))
+	for _, email := range phonebook.Emails {
+		emails = append(emails, email.Label+":"+email.Address)
+	}
+	return []string{
+		strconv.Itoa(phonebook.PhonebookID),
+		phonebook.Name,
+		phonebook.Phone,
+		phonebook.Email,
+		phonebook.Visibility,
+		strings.Join(phones, "; "),
+		strings.Join(emails, "; "),
+		strings.Join(phonebook.Tags, "; "),
+	}
+}
+
+func writeCSV(w io.Writer, record []string) error {
+	cw := csv.NewWriter(w)
+	cw.Write(record)
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeVCard writes a phonebook as a vCard 4.0 (RFC 6350).
+func writeVCard(w io.Writer, phonebook *Phonebook) error {
+	lines := []string{
+		"BEGIN:VCARD",
+		"VERSION:4.0",
+		"UID:urn:phonebook:" + strconv.Itoa(phonebook.PhonebookID),
+		"FN:" + vcardEscape(phonebook.Name),
+	}
+	for _, phone := range phonebook.Phones {
+		lines = append(lines, "TEL"+vcardParams(phone.Label, phone.Primary)+":"+vcardEscape(phone.Number))
+	}
+	if len(phonebook.Phones) == 0 && phonebook.Phone != "" {
+		lines = append(lines, "TEL:"+vcardEscape(phonebook.Phone))
+	}
+	for _, email := range phonebook.Emails {
+		lines = append(lines, "EMAIL"+vcardParams(email.Label, email.Primary)+":"+vcardEscape(email.Address))
+	}
+	if len(phonebook.Emails) == 0 && phonebook.Email != "" {
+		lines = append(lines, "EMAIL:"+vcardEscape(phonebook.Email))
+	}
+	if len(phonebook.Tags) > 0 {
+		tags := make([]string, len(phonebook.Tags))
+		for i, tag := range phonebook.Tags {
+			tags[i] = vcardEscape(tag)
+		}
+		lines = append(lines, "CATEGORIES:"+strings.Join(tags, ","))
+	}
+	lines = append(lines, "END:VCARD")
+
+	_, err := io.WriteString(w, strings.Join(lines, "\r\n")+"\r\n")
+	return err
+}
+
+func vcardParams(label string, primary bool) string {
+	params := ""
+	if label != "" {
+		params += ";TYPE=" + vcardParamValue(label)
+	}
+	if primary {
+		params += ";PREF=1"
+	}
+	return params
+}
+
+// vcardParamValue quotes a parameter value holding characters that would end
+// it.
+func vcardParamValue(value string) string {
+	value = strings.ReplaceAll(value, `"`, "'")
+	if strings.ContainsAny(value, ";:,") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+var vcardEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`)
+
+func vcardEscape(value string) string {
+	return vcardEscaper.Replace(value)
+}
@@ -0,0 +1,101 @@
+package phonebook
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                                      "application/json",
+		"*/*":                                   "application/json",
+		"application/xml":                       "application/xml",
+		"text/csv;q=0.5, text/vcard":            "text/vcard",
+		"text/x-vcard":                          "text/vcard",
+		"text/*":                                "text/csv",
+		"application/json;q=0, application/*":   "application/x-ndjson",
+		"text/html, application/xml, */*;q=0.1": "application/xml",
+		"text/html, application/xml;q=0.9, */*": "application/json",
+	}
+	for accept, want := range tests {
+		e := negotiateEncoding(accept)
+		if e == nil || e.contentType != want {
+			t.Errorf("negotiateEncoding(%q) = %v want %s", accept, e, want)
+		}
+	}
+	for _, accept := range []string{"text/html", "application/json;q=0"} {
+		if e := negotiateEncoding(accept); e != nil {
+			t.Errorf("negotiateEncoding(%q) = %s want none", accept, e.contentType)
+		}
+	}
+}
+
+func encodingSample() *Phonebook {
+	return &Phonebook{
+		PhonebookID: 7,
+		Name:        "Maggioni, Nayara",
+		Phone:       "+55 47 99662-3579",
+		Email:       "nay.maggioni@gmail.com",
+		Visibility:  visibilityPublic,
+		Phones: []ContactPhone{
+			{Label: "mobile", Number: "+55 47 99662-3579", Primary: true, Visibility: visibilityPublic},
+			{Label: "work", Number: "+55 47 3333-0000", Visibility: visibilityPublic},
+		},
+		Emails: []ContactEmail{{Label: "main", Address: "nay.maggioni@gmail.com", Primary: true, Visibility: visibilityPublic}},
+		Tags:   []string{"family"},
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	tests := map[string]string{
+		"application/xml": `<?xml version="1.0" encoding="UTF-8"?>
+<phonebook id="7"><name>Maggioni, Nayara</name><phone>+55 47 99662-3579</phone><email>nay.maggioni@gmail.com</email><visibility>public</visibility>` +
+			`<phones><phone label="mobile" primary="true" visibility="public">+55 47 99662-3579</phone><phone label="work" visibility="public">+55 47 3333-0000</phone></phones>` +
+			`<emails><email label="main" primary="true" visibility="public">nay.maggioni@gmail.com</email></emails><tags><tag>family</tag></tags></phonebook>`,
+		"text/csv": "phonebookId,name,phone,email,visibility,phones,emails,tags\n" +
+			`7,"Maggioni, Nayara",+55 47 99662-3579,nay.maggioni@gmail.com,public,mobile:+55 47 99662-3579; work:+55 47 3333-0000,main:nay.maggioni@gmail.com,family` + "\n",
+		"text/vcard": "BEGIN:VCARD\r\nVERSION:4.0\r\nUID:urn:phonebook:7\r\nFN:Maggioni\\, Nayara\r\n" +
+			"TEL;TYPE=mobile;PREF=1:+55 47 99662-3579\r\nTEL;TYPE=work:+55 47 3333-0000\r\n" +
+			"EMAIL;TYPE=main;PREF=1:nay.maggioni@gmail.com\r\nCATEGORIES:family\r\nEND:VCARD\r\n",
+	}
+	for contentType, want := range tests {
+		var b bytes.Buffer
+		if err := negotiateEncoding(contentType).one(&b, v1, encodingSample()); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != want {
+			t.Errorf("%s:\ngot  %q\nwant %q", contentType, b.String(), want)
+		}
+	}
+}
+
+func TestGetPhonebooksHandlerNegotiatesTheEncoding(t *testing.T) {
+	expectTwoPhonebooks()
+
+	req, err := newRequest("GET", "/phonebooks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/xml")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(phonebooksHandler).ServeHTTP(rr, req)
+
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<phonebooks><phonebook id="1"><name>Nayara</name><phone>nay.maggioni@gmail.com</phone><email>47996623579</email><visibility>public</visibility></phonebook>` +
+		`<phonebook id="2"><name>Paulo Eduardo</name><phone>pauloes.dev@gmail.com</phone><email>47996623579</email><visibility>public</visibility></phonebook></phonebooks>`
+	if rr.Body.String() != want {
+		t.Errorf("handler returned %s want %s", rr.Body.String(), want)
+	}
+	if rr.Header().Get("Content-Type") != "application/xml" || rr.Header().Get("Vary") != "Accept" {
+		t.Errorf("handler returned headers %v", rr.Header())
+	}
+
+	req.Header.Set("Accept", "text/html")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(phonebooksHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotAcceptable {
+		t.Errorf("handler returned %v want %v", rr.Code, http.StatusNotAcceptable)
+	}
+}
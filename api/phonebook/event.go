@@ -0,0 +1,86 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Types of the events published for the changes of phonebooks.
+const (
+	EventCreated  = "phonebook.created"
+	EventUpdated  = "phonebook.updated"
+	EventDeleted  = "phonebook.deleted"
+	EventRestored = "phonebook.restored"
+)
+
+// EventTypes are every event type, as subscribers may ask for them.
+var EventTypes = []string{EventCreated, EventUpdated, EventDeleted, EventRestored}
+
+// EventData is the data of an event: the phonebook after the change, or
+// right before it for deletes.
+type EventData struct {
+	Phonebook *Phonebook `json:"phonebook"`
+}
+
+// Render returns the data of an event for a receiver cleared to see values
+// up to the given visibility level, with the values above it masked.
+type Render func(visibility string) EventData
+
+// Publisher is called inside the transaction of every change of a phonebook,
+// so whatever it records is committed if and only if the change is. An
+// error rolls the change back.
+type Publisher func(ctx context.Context, tx *sql.Tx, eventType string, phonebookID int, render Render) error
+
+var publishers []Publisher
+
+// AddPublisher registers p for the changes of every phonebook. It must be
+// called before serving requests.
+func AddPublisher(p Publisher) {
+	publishers = append(publishers, p)
+}
+
+// eventType returns the event published for a revision action.
+func eventType(action string, before *Phonebook) string {
+	switch action {
+	case actionCreate:
+		return EventCreated
+	case actionDelete:
+		return EventDeleted
+	case actionRestore:
+		return EventRestored
+	case actionRevert:
+		// Reverting a purged phonebook creates it again.
+		if before == nil {
+			return EventCreated
+		}
+		if before.DeletedAt != nil {
+			return EventRestored
+		}
+	}
+	return EventUpdated
+}
+
+// publish hands a change to the publishers.
+func publish(ctx context.Context, tx *sql.Tx, action string, phonebookID int, before, after *Phonebook) error {
+	if len(publishers) == 0 {
+		return nil
+	}
+	changed := after
+	if changed == nil {
+		changed = before
+	}
+	render := func(visibility string) EventData {
+		phonebook := clonePhonebook(changed)
+		phonebook.DeletedAt = nil
+		redact(phonebook, visibilityRank(visibility))
+		return EventData{Phonebook: phonebook}
+	}
+
+	typ := eventType(action, before)
+	for _, p := range publishers {
+		if err := p(ctx, tx, typ, phonebookID, render); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// withPublisher registers p for the rest of the test.
+func withPublisher(t *testing.T, p Publisher) {
+	saved := publishers
+	publishers = nil
+	AddPublisher(p)
+	t.Cleanup(func() { publishers = saved })
+}
+
+func expectInsertInternal(mock sqlmock.Sqlmock, pb Phonebook) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO phonebooks`).WithArgs(
+		pb.Name,
+		pb.Phone,
+		pb.Email,
+		visibilityInternal,
+		sqlmock.AnyArg(),
+		anonymousActor,
+		sqlmock.AnyArg(),
+		anonymousActor,
+		testTenant).WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSaveContacts(mock)
+	mock.ExpectExec(`INSERT INTO phonebook_revisions`).
+		WithArgs(1, actionCreate, sqlmock.AnyArg(), sqlmock.AnyArg(), anonymousActor, "", testTenant, 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestChangesArePublishedInTheirTransaction(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	var published []string
+	var public, restricted EventData
+	withPublisher(t, func(ctx context.Context, tx *sql.Tx, eventType string, phonebookID int, render Render) error {
+		if tx == nil || phonebookID != 1 {
+			t.Errorf("publisher called with tx %v for phonebook %d", tx, phonebookID)
+		}
+		published = append(published, eventType)
+		public = render(visibilityPublic)
+		restricted = render(visibilityRestricted)
+		return nil
+	})
+
+	pb := Phonebook{Name: "Nayara", Email: "nay.maggion@gmail.com", Phone: "47 996623579", Visibility: visibilityInternal}
+	expectInsertInternal(mock, pb)
+	mock.ExpectCommit()
+
+	if _, err := insert(testContext(), pb, db, 15); err != nil {
+		t.Fatalf("error was not expected while inserting: %s", err)
+	}
+	if len(published) != 1 || published[0] != EventCreated {
+		t.Fatalf("published %v want [%s]", published, EventCreated)
+	}
+	if restricted.Phonebook.Phone != pb.Phone {
+		t.Errorf("restricted render has phone %q want %q", restricted.Phonebook.Phone, pb.Phone)
+	}
+	if public.Phonebook.Phone == pb.Phone || public.Phonebook.Email == pb.Email {
+		t.Errorf("public render does not mask an internal phonebook: %+v", public.Phonebook)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAFailedPublisherRollsTheChangeBack(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	withPublisher(t, func(ctx context.Context, tx *sql.Tx, eventType string, phonebookID int, render Render) error {
+		return errors.New("queue unavailable")
+	})
+
+	pb := Phonebook{Name: "Nayara", Email: "nay.maggion@gmail.com", Phone: "47 996623579", Visibility: visibilityInternal}
+	expectInsertInternal(mock, pb)
+	mock.ExpectRollback()
+
+	if _, err := insert(testContext(), pb, db, 15); err == nil {
+		t.Fatal("insert succeeded although its event could not be published")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEventTypeOfARevert(t *testing.T) {
+	deletedAt := time.Now()
+	deleted := &Phonebook{DeletedAt: &deletedAt}
+	cases := []struct {
+		action string
+		before *Phonebook
+		want   string
+	}{
+		{actionCreate, nil, EventCreated},
+		{actionUpdate, &Phonebook{}, EventUpdated},
+		{actionDelete, &Phonebook{}, EventDeleted},
+		{actionRestore, &Phonebook{}, EventRestored},
+		{actionRevert, nil, EventCreated},
+		{actionRevert, &Phonebook{}, EventUpdated},
+		{actionRevert, deleted, EventRestored},
+	}
+	for _, c := range cases {
+		if got := eventType(c.action, c.before); got != c.want {
+			t.Errorf("eventType(%s, %v) = %s want %s", c.action, c.before, got, c.want)
+		}
+	}
+}
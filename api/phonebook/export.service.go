@@ -0,0 +1,61 @@
+package phonebook
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// permissionExport is needed to export phonebooks.
+const permissionExport = "phonebook:export"
+
+// exportHandler serves GET /phonebooks/export, every phonebook matching the
+// same filters as the list, read straight from the database as a download.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tenantID, err := tenant.Require(r.Context())
+		if err != nil {
+			problem.Error(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if errs := validateListQuery(r.URL.Query()); len(errs) > 0 {
+			problem.Write(w, r, problem.Validation(errs))
+			return
+		}
+		pw := newPhonebookWriter(w, r)
+		if pw == nil {
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="phonebooks.`+pw.encoding.extension+`"`)
+		writePhonebooks(w, r, pw, func(emit func(*Phonebook) error) error {
+			return queryPhonebooks(r.Context(), tenantID, r.URL.Query(), db, timeout, emit)
+		})
+	case http.MethodOptions:
+		return
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// writePhonebooks streams the phonebooks read by stream to pw. An error
+// before anything was sent is reported with a problem; after that, the
+// connection is dropped so the client can tell the response is incomplete.
+func writePhonebooks(w http.ResponseWriter, r *http.Request, pw *phonebookWriter, stream func(emit func(*Phonebook) error) error) {
+	err := stream(pw.write)
+	if err == nil {
+		err = pw.close()
+	}
+	if err == nil {
+		return
+	}
+
+	log.Printf("An error accured trying to list user: %v", err)
+	if pw.started() {
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Del("Content-Disposition")
+	problem.Error(w, r, http.StatusInternalServerError, "The phonebooks could not be listed.")
+}
@@ -0,0 +1,125 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// merge combines the phonebooks of m into the survivor, moves the others to
+// the trash and hands their group memberships over to the survivor, all in
+// one transaction. Each phonebook gets a revision. It returns the survivor as
+// merged.
+func merge(ctx context.Context, m Merge, db *sql.DB, timeout int) (*Phonebook, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock in the order of the IDs, so concurrent merges can't deadlock.
+	ids := append([]int{}, m.PhonebookIDs...)
+	sort.Ints(ids)
+	sources := make(map[int]*Phonebook, len(ids))
+	for _, id := range ids {
+		phonebook, err := getForUpdate(ctx, tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if phonebook == nil || phonebook.DeletedAt != nil {
+			return nil, errPhonebookNotFound
+		}
+		sources[id] = phonebook
+	}
+
+	survivor := sources[m.survivor()]
+	merged := mergePhonebooks(m, sources)
+	resolveContacts(&merged, survivor)
+	touch(ctx, &merged)
+
+	// The survivor takes over the unique numbers and addresses of the others.
+	others := m.merged()
+	for _, id := range others {
+		if err := releaseUnique(ctx, tx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE phonebooks SET
+	name=?,
+	phone=?,
+	email=?,
+	visibility=?,
+	updated_at=?,
+	updated_by=?
+	WHERE phonebookId = ? AND tenant_id = ?`,
+		merged.Name,
+		merged.Phone,
+		merged.Email,
+		merged.Visibility,
+		merged.UpdatedAt,
+		merged.UpdatedBy,
+		merged.PhonebookID,
+		tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveContacts(ctx, tx, merged); err != nil {
+		return nil, err
+	}
+	if err := writeRevision(ctx, tx, actionUpdate, merged.PhonebookID, survivor, &merged); err != nil {
+		return nil, err
+	}
+
+	placeholders := make([]string, 0, len(others))
+	args := make([]interface{}, 0, len(others)+2)
+	args = append(args, merged.PhonebookID, tenantID)
+	for _, id := range others {
+		placeholders = append(placeholders, "?")
+		args = append(args, id)
+	}
+	in := strings.Join(placeholders, ", ")
+	_, err = tx.ExecContext(ctx, `INSERT IGNORE INTO contact_group_members
+	(groupId,
+	phonebookId,
+	tenant_id)
+	SELECT groupId, ?, tenant_id FROM contact_group_members
+	WHERE tenant_id = ? AND phonebookId IN (`+in+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM contact_group_members
+	WHERE tenant_id = ? AND phonebookId IN (`+in+`)`, args[1:]...)
+	if err != nil {
+		return nil, err
+	}
+
+	deletedAt := time.Now().UTC()
+	for _, id := range others {
+		_, err = tx.ExecContext(ctx, `UPDATE phonebooks SET deleted_at = ? WHERE phonebookId = ? AND tenant_id = ?`, deletedAt, id, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeRevision(ctx, tx, actionDelete, id, sources[id], nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	invalidate(tenantID)
+	return &merged, nil
+}
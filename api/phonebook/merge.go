@@ -0,0 +1,154 @@
+package phonebook
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Paulo-Eduardo/phone_book/problem"
+)
+
+// maxMergedPhonebooks bounds the phonebooks combined by a single merge.
+const maxMergedPhonebooks = 10
+
+// Fields whose surviving value a merge can take from any of the phonebooks.
+var mergeFields = []string{"name", "phone", "email", "visibility"}
+
+// Merge is the body of POST /phonebooks/merge. The phonebooks are combined
+// into Survivor, the first of them unless set, and the others are moved to
+// the trash. Fields picks, by field, the phonebook whose value survives; the
+// survivor's is kept for the fields left out. Numbers, addresses, tags and
+// group memberships of all of them are kept.
+type Merge struct {
+	PhonebookIDs []int          `json:"phonebookIds"`
+	Survivor     int            `json:"survivor,omitempty"`
+	Fields       map[string]int `json:"fields,omitempty"`
+}
+
+// survivor returns the phonebook the others are merged into.
+func (m Merge) survivor() int {
+	if m.Survivor == 0 && len(m.PhonebookIDs) > 0 {
+		return m.PhonebookIDs[0]
+	}
+	return m.Survivor
+}
+
+// merged returns the phonebooks merged into the survivor.
+func (m Merge) merged() []int {
+	survivor := m.survivor()
+	ids := make([]int, 0, len(m.PhonebookIDs))
+	for _, id := range m.PhonebookIDs {
+		if id != survivor {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// validateMerge checks a merge sent by a client and returns one FieldError per
+// problem found.
+func validateMerge(m Merge) []problem.FieldError {
+	var errs []problem.FieldError
+
+	listed := make(map[int]bool, len(m.PhonebookIDs))
+	for _, id := range m.PhonebookIDs {
+		if listed[id] {
+			errs = append(errs, problem.FieldError{Field: "phonebookIds", Message: fmt.Sprintf("must not list phonebook %d twice", id)})
+		}
+		listed[id] = true
+	}
+	if len(m.PhonebookIDs) < 2 || len(m.PhonebookIDs) > maxMergedPhonebooks {
+		errs = append(errs, problem.FieldError{Field: "phonebookIds", Message: fmt.Sprintf("must list between 2 and %d phonebooks", maxMergedPhonebooks)})
+	}
+	if m.Survivor != 0 && !listed[m.Survivor] {
+		errs = append(errs, problem.FieldError{Field: "survivor", Message: "must be one of phonebookIds"})
+	}
+
+	for field, id := range m.Fields {
+		known := false
+		for _, f := range mergeFields {
+			known = known || f == field
+		}
+		if !known {
+			errs = append(errs, problem.FieldError{Field: "fields." + field, Message: "must be name, phone, email or visibility"})
+		} else if !listed[id] {
+			errs = append(errs, problem.FieldError{Field: "fields." + field, Message: "must be one of phonebookIds, not " + strconv.Itoa(id)})
+		}
+	}
+	return errs
+}
+
+// mergePhonebooks combines sources, keyed by ID, as m asks. Numbers and
+// addresses typed differently are kept once, and the ones coming from the
+// other phonebooks keep the level they had there, so the merge never
+// discloses them.
+func mergePhonebooks(m Merge, sources map[int]*Phonebook) Phonebook {
+	survivor := sources[m.survivor()]
+	merged := *clonePhonebook(survivor)
+	merged.DeletedAt = nil
+	pick := func(field string) *Phonebook {
+		if id, ok := m.Fields[field]; ok {
+			return sources[id]
+		}
+		return survivor
+	}
+
+	phones := map[string]bool{}
+	for _, phone := range merged.Phones {
+		phones[comparablePhone(phone.Number)] = true
+	}
+	emails := map[string]bool{}
+	for _, email := range merged.Emails {
+		emails[comparableEmail(email.Address)] = true
+	}
+	for _, id := range m.merged() {
+		source := sources[id]
+		for _, phone := range source.Phones {
+			if key := comparablePhone(phone.Number); !phones[key] {
+				phones[key] = true
+				phone.Primary = false
+				phone.Visibility = visibilityLevels[maskedLevel(source, phone.Visibility)]
+				merged.Phones = append(merged.Phones, phone)
+			}
+		}
+		for _, email := range source.Emails {
+			if key := comparableEmail(email.Address); !emails[key] {
+				emails[key] = true
+				email.Primary = false
+				email.Visibility = visibilityLevels[maskedLevel(source, email.Visibility)]
+				merged.Emails = append(merged.Emails, email)
+			}
+		}
+		merged.Tags = append(merged.Tags, source.Tags...)
+	}
+	merged.Tags = normalizeTags(merged.Tags)
+
+	merged.Name = pick("name").Name
+	merged.Visibility = pick("visibility").Visibility
+	if phone := pick("phone").Phone; phone != "" {
+		for i := range merged.Phones {
+			merged.Phones[i].Primary = comparablePhone(merged.Phones[i].Number) == comparablePhone(phone)
+		}
+	}
+	if email := pick("email").Email; email != "" {
+		for i := range merged.Emails {
+			merged.Emails[i].Primary = comparableEmail(merged.Emails[i].Address) == comparableEmail(email)
+		}
+	}
+	return merged
+}
+
+// comparablePhone returns what two numbers must share to be the same number.
+func comparablePhone(number string) string {
+	if key := phoneKey(number); key != "" {
+		return key
+	}
+	return digitsOnly(number)
+}
+
+// comparableEmail returns what two addresses must share to be the same one.
+func comparableEmail(address string) string {
+	if key := emailKey(address); key != "" {
+		return key
+	}
+	return address
+}
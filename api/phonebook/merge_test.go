@@ -0,0 +1,128 @@
+package phonebook
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMergePhonebooks(t *testing.T) {
+	sources := map[int]*Phonebook{
+		1: {
+			PhonebookID: 1,
+			Name:        "Nayara",
+			Phone:       "47996623579",
+			Phones:      []ContactPhone{{Label: "main", Number: "47996623579", Primary: true, Visibility: visibilityPublic}},
+			Tags:        []string{"family"},
+			Visibility:  visibilityPublic,
+		},
+		2: {
+			PhonebookID: 2,
+			Name:        "Nayara Maggioni",
+			Phone:       "+55 47 99662-3579",
+			Email:       "nay.maggioni@gmail.com",
+			Phones: []ContactPhone{
+				{Label: "main", Number: "+55 47 99662-3579", Primary: true, Visibility: visibilityPublic},
+				{Label: "work", Number: "47 3333-4444", Visibility: visibilityPublic},
+			},
+			Emails:     []ContactEmail{{Label: "main", Address: "nay.maggioni@gmail.com", Primary: true, Visibility: visibilityPublic}},
+			Tags:       []string{"family", "friends"},
+			Visibility: visibilityInternal,
+		},
+	}
+
+	merged := mergePhonebooks(Merge{PhonebookIDs: []int{1, 2}, Fields: map[string]int{"name": 2}}, sources)
+
+	if merged.PhonebookID != 1 || merged.Name != "Nayara Maggioni" || merged.Visibility != visibilityPublic {
+		t.Errorf("mergePhonebooks kept %d %q %s, want 1 \"Nayara Maggioni\" public", merged.PhonebookID, merged.Name, merged.Visibility)
+	}
+	wantPhones := []ContactPhone{
+		{Label: "main", Number: "47996623579", Primary: true, Visibility: visibilityPublic},
+		{Label: "work", Number: "47 3333-4444", Visibility: visibilityInternal},
+	}
+	if !reflect.DeepEqual(merged.Phones, wantPhones) {
+		t.Errorf("mergePhonebooks returned the numbers %+v, want %+v", merged.Phones, wantPhones)
+	}
+	if len(merged.Emails) != 1 || merged.Emails[0].Visibility != visibilityInternal {
+		t.Errorf("mergePhonebooks returned the addresses %+v, want the internal one of 2", merged.Emails)
+	}
+	if !reflect.DeepEqual(merged.Tags, []string{"family", "friends"}) {
+		t.Errorf("mergePhonebooks returned the tags %v", merged.Tags)
+	}
+}
+
+func TestValidateMerge(t *testing.T) {
+	tests := []struct {
+		merge Merge
+		want  []string
+	}{
+		{Merge{PhonebookIDs: []int{1, 2}, Survivor: 2, Fields: map[string]int{"email": 1}}, nil},
+		{Merge{PhonebookIDs: []int{1}}, []string{"phonebookIds"}},
+		{Merge{PhonebookIDs: []int{1, 1}}, []string{"phonebookIds"}},
+		{Merge{PhonebookIDs: []int{1, 2}, Survivor: 3}, []string{"survivor"}},
+		{Merge{PhonebookIDs: []int{1, 2}, Fields: map[string]int{"tags": 1, "name": 3}}, []string{"fields.name", "fields.tags"}},
+	}
+	for _, test := range tests {
+		rejected := map[string]bool{}
+		for _, err := range validateMerge(test.merge) {
+			rejected[err.Field] = true
+		}
+		var fields []string
+		for field := range rejected {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		if !reflect.DeepEqual(fields, test.want) {
+			t.Errorf("validateMerge(%+v) rejected %v, want %v", test.merge, fields, test.want)
+		}
+	}
+}
+
+func TestMergeMovesTheOthersToTheTrash(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	for _, id := range []int{1, 2} {
+		mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+			WithArgs(id, testTenant).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+				AddRow(id, "Nayara", "", "", "public", nil, nil, "", nil, ""))
+		expectLoadContacts(mock)
+	}
+	mock.ExpectExec("UPDATE phonebooks SET name=\\?, phone=\\?, email=\\?, visibility=\\?, updated_at=\\?, updated_by=\\? WHERE phonebookId = \\? AND tenant_id = \\?").
+		WithArgs("Nayara", "", "", visibilityPublic, sqlmock.AnyArg(), anonymousActor, 2, testTenant).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM phonebook_phones").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM phonebook_emails").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM phonebook_tags").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO phonebook_revisions").
+		WithArgs(2, actionUpdate, sqlmock.AnyArg(), sqlmock.AnyArg(), anonymousActor, "", testTenant, 2, testTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT IGNORE INTO contact_group_members \\(groupId, phonebookId, tenant_id\\) SELECT groupId, \\?, tenant_id FROM contact_group_members WHERE tenant_id = \\? AND phonebookId IN \\(\\?\\)").
+		WithArgs(2, testTenant, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM contact_group_members WHERE tenant_id = \\? AND phonebookId IN \\(\\?\\)").
+		WithArgs(testTenant, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE phonebooks SET deleted_at = \\? WHERE phonebookId = \\? AND tenant_id = \\?").
+		WithArgs(sqlmock.AnyArg(), 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO phonebook_revisions").
+		WithArgs(1, actionDelete, sqlmock.AnyArg(), sqlmock.AnyArg(), anonymousActor, "", testTenant, 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+
+	merged, err := merge(testContext(), Merge{PhonebookIDs: []int{2, 1}}, db, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.PhonebookID != 2 {
+		t.Errorf("merge kept phonebook %d, want 2", merged.PhonebookID)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
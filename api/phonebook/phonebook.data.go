@@ -3,43 +3,112 @@ package phonebook
 import (
 	"context"
 	"database/sql"
-	"log"
+	"errors"
 	"net/url"
+	"strings"
 	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var (
+	errPhonebookNotFound   = errors.New("phonebook not found")
+	errContactLimitReached = errors.New("the tenant reached its maximum number of phonebooks")
+	errInvalidSort         = errors.New("invalid sort")
 )
 
-func insert(phoneBook Phonebook, db *sql.DB, timeout int) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+// insert stores a new phonebook and returns it as stored, with its ID and
+// normalised contacts.
+func insert(ctx context.Context, phoneBook Phonebook, db *sql.DB, timeout int) (*Phonebook, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
 	defer cancel()
-	result, err := db.ExecContext(ctx, `INSERT INTO phonebooks
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := checkContactLimit(ctx, tx, tenantID); err != nil {
+		return nil, err
+	}
+
+	resolveContacts(&phoneBook, nil)
+	touch(ctx, &phoneBook)
+	phoneBook.CreatedAt, phoneBook.CreatedBy = phoneBook.UpdatedAt, phoneBook.UpdatedBy
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO phonebooks
 	(name,
 	phone,
-	email) VALUES (?, ?, ?)`,
+	email,
+	visibility,
+	created_at,
+	created_by,
+	updated_at,
+	updated_by,
+	tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		phoneBook.Name,
 		phoneBook.Phone,
-		phoneBook.Email)
+		phoneBook.Email,
+		phoneBook.Visibility,
+		phoneBook.CreatedAt,
+		phoneBook.CreatedBy,
+		phoneBook.UpdatedAt,
+		phoneBook.UpdatedBy,
+		tenantID)
 
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	insertID, err := result.LastInsertId()
 	if err != nil {
-		return 0, nil
+		return nil, err
+	}
+
+	phoneBook.PhonebookID = int(insertID)
+	if err := saveContacts(ctx, tx, phoneBook); err != nil {
+		return nil, err
 	}
-	return int(insertID), nil
+	if err := writeRevision(ctx, tx, actionCreate, phoneBook.PhonebookID, nil, &phoneBook); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	invalidate(tenantID)
+	return &phoneBook, nil
+}
+
+func get(ctx context.Context, phonebookID int, db *sql.DB, timeout int) (*Phonebook, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cachedGet(ctx, tenantID, phonebookID, db, timeout)
 }
 
-func get(phonebookID int, db *sql.DB, timeout int) (*Phonebook, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+func queryPhonebook(ctx context.Context, tenantID string, phonebookID int, db *sql.DB, timeout int) (*Phonebook, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
 	defer cancel()
-	row := db.QueryRowContext(ctx, "SELECT phonebookId, name, phone, email FROM phonebooks WHERE phonebookId = ?", phonebookID)
+	row := db.QueryRowContext(ctx, "SELECT phonebookId, name, phone, email, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = ? AND tenant_id = ? AND deleted_at IS NULL", phonebookID, tenantID)
 
 	phonebook := &Phonebook{}
 	err := row.Scan(
 		&phonebook.PhonebookID,
 		&phonebook.Name,
 		&phonebook.Phone,
-		&phonebook.Email)
+		&phonebook.Email,
+		&phonebook.Visibility,
+		&phonebook.CreatedAt,
+		&phonebook.CreatedBy,
+		&phonebook.UpdatedAt,
+		&phonebook.UpdatedBy)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -47,103 +116,393 @@ func get(phonebookID int, db *sql.DB, timeout int) (*Phonebook, error) {
 		return nil, err
 	}
 
+	if err := loadContact(ctx, db, phonebook); err != nil {
+		return nil, err
+	}
 	return phonebook, nil
 }
 
-func remove(phonebookID int, db *sql.DB, timeout int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+// getForUpdate reads a phonebook inside tx, including one that is in the
+// trash, and locks its row until the transaction ends.
+func getForUpdate(ctx context.Context, tx *sql.Tx, phonebookID int) (*Phonebook, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	row := tx.QueryRowContext(ctx, "SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = ? AND tenant_id = ? FOR UPDATE", phonebookID, tenantID)
+
+	phonebook := &Phonebook{}
+	err = row.Scan(
+		&phonebook.PhonebookID,
+		&phonebook.Name,
+		&phonebook.Phone,
+		&phonebook.Email,
+		&phonebook.Visibility,
+		&phonebook.DeletedAt,
+		&phonebook.CreatedAt,
+		&phonebook.CreatedBy,
+		&phonebook.UpdatedAt,
+		&phonebook.UpdatedBy)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := loadContact(ctx, tx, phonebook); err != nil {
+		return nil, err
+	}
+	return phonebook, nil
+}
+
+func remove(ctx context.Context, phonebookID int, db *sql.DB, timeout int) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
 	defer cancel()
-	_, err := db.ExecContext(ctx, `DELETE FROM phonebooks where phonebookId = ?`, phonebookID)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getForUpdate(ctx, tx, phonebookID)
+	if err != nil {
+		return err
+	}
+	if before == nil || before.DeletedAt != nil {
+		return errPhonebookNotFound
+	}
+
+	deleted := *before
+	touch(ctx, &deleted)
+	_, err = tx.ExecContext(ctx, `UPDATE phonebooks SET
+	deleted_at=?,
+	updated_at=?,
+	updated_by=?
+	WHERE phonebookId = ? AND tenant_id = ?`,
+		deleted.UpdatedAt,
+		deleted.UpdatedAt,
+		deleted.UpdatedBy,
+		phonebookID,
+		tenantID)
 	if err != nil {
 		return err
 	}
+	if err := releaseUnique(ctx, tx, phonebookID); err != nil {
+		return err
+	}
+
+	if err := writeRevision(ctx, tx, actionDelete, phonebookID, before, nil); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	invalidate(tenantID)
 	return nil
 }
 
-func update(phonebook Phonebook, db *sql.DB, timeout int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+// update replaces a phonebook out of the trash and returns it as stored.
+func update(ctx context.Context, phonebook Phonebook, db *sql.DB, timeout int) (*Phonebook, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
 	defer cancel()
-	_, err := db.ExecContext(ctx, `UPDATE phonebooks SET
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	before, err := getForUpdate(ctx, tx, phonebook.PhonebookID)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil || before.DeletedAt != nil {
+		return nil, errPhonebookNotFound
+	}
+
+	resolveContacts(&phonebook, before)
+	phonebook.CreatedAt, phonebook.CreatedBy = before.CreatedAt, before.CreatedBy
+	touch(ctx, &phonebook)
+
+	_, err = tx.ExecContext(ctx, `UPDATE phonebooks SET
 	name=?,
 	phone=?,
-	email=?
-	WHERE phonebookId = ?`,
+	email=?,
+	visibility=?,
+	updated_at=?,
+	updated_by=?
+	WHERE phonebookId = ? AND tenant_id = ?`,
 		phonebook.Name,
 		phonebook.Phone,
 		phonebook.Email,
-		phonebook.PhonebookID)
+		phonebook.Visibility,
+		phonebook.UpdatedAt,
+		phonebook.UpdatedBy,
+		phonebook.PhonebookID,
+		tenantID)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
-}
 
-func list(query url.Values, db *sql.DB, timeout int) ([]Phonebook, error) {
-	if query["name"] != nil {
-		return searchForName(query.Get("name"), db, timeout)
+	if err := saveContacts(ctx, tx, phonebook); err != nil {
+		return nil, err
+	}
+	if err := writeRevision(ctx, tx, actionUpdate, phonebook.PhonebookID, before, &phonebook); err != nil {
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
-	defer cancel()
-	results, err := db.QueryContext(ctx,
-		`SELECT 
-		phonebookId,
-		name,
-		email,
-		phone
-		FROM phonebooks`)
-
-	if err != nil {
+	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
-	defer results.Close()
+	invalidate(tenantID)
+	return &phonebook, nil
+}
 
+func list(ctx context.Context, query url.Values, db *sql.DB, timeout int) ([]Phonebook, error) {
 	phonebooks := make([]Phonebook, 0)
+	err := streamList(ctx, query, db, timeout, func(phonebook *Phonebook) error {
+		phonebooks = append(phonebooks, *phonebook)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return phonebooks, nil
+}
 
-	for results.Next() {
-		var phonebook Phonebook
-		results.Scan(
-			&phonebook.PhonebookID,
-			&phonebook.Name,
-			&phonebook.Email,
-			&phonebook.Phone)
+// streamList calls emit with each phonebook matching query, in batches read
+// from the database, so the whole list is never held in memory.
+func streamList(ctx context.Context, query url.Values, db *sql.DB, timeout int, emit func(*Phonebook) error) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+	return cachedList(ctx, tenantID, query, db, timeout, emit)
+}
 
-		phonebooks = append(phonebooks, phonebook)
+// queryPhonebooks runs the list query a batch at a time. Each batch is read
+// by its own query, resuming after the last phonebook of the one before, and
+// its cursor is closed before the numbers, addresses and tags are loaded, so a
+// list never holds more than one connection. The queries are bounded by the
+// timeout, not the whole list, so a long export isn't cut off halfway.
+func queryPhonebooks(ctx context.Context, tenantID string, query url.Values, db *sql.DB, timeout int, emit func(*Phonebook) error) error {
+	var conditions []string
+	var args []interface{}
+	// Numbers and addresses the caller can't see must not match, or searching
+	// for them would tell their values away.
+	levels := visibleLevels(clearance(ctx))
+	if query["name"] != nil {
+		conditions = append(conditions, "name LIKE ?")
+		args = append(args, "%"+query.Get("name")+"%")
+	}
+	if query["phone"] != nil {
+		// Match every number of the phonebook, whatever punctuation was used.
+		conditions = append(conditions, "phonebookId IN (SELECT phonebookId FROM phonebook_phones WHERE tenant_id = ? AND number_digits LIKE ?"+visibilityCondition(levels)+")")
+		args = append(args, tenantID, "%"+digitsOnly(query.Get("phone"))+"%")
+		args = append(args, visibilityArgs(levels)...)
+	}
+	if query["email"] != nil {
+		conditions = append(conditions, "phonebookId IN (SELECT phonebookId FROM phonebook_emails WHERE tenant_id = ? AND address LIKE ?"+visibilityCondition(levels)+")")
+		args = append(args, tenantID, "%"+query.Get("email")+"%")
+		args = append(args, visibilityArgs(levels)...)
+	}
+	if (query["phone"] != nil || query["email"] != nil) && levels != nil {
+		conditions = append(conditions, "visibility IN ("+visibilityPlaceholders(levels)+")")
+		args = append(args, visibilityArgs(levels)...)
+	}
+	// Repeated group and tag parameters all have to match.
+	for _, group := range query["group"] {
+		conditions = append(conditions, `phonebookId IN (SELECT m.phonebookId FROM contact_group_members m
+		JOIN contact_groups g ON g.groupId = m.groupId WHERE g.tenant_id = ? AND g.name = ?)`)
+		args = append(args, tenantID, group)
+	}
+	for _, tag := range query["tag"] {
+		conditions = append(conditions, "phonebookId IN (SELECT phonebookId FROM phonebook_tags WHERE tenant_id = ? AND tag = ?)")
+		args = append(args, tenantID, normalizeTag(tag))
+	}
+	if value := query.Get("updated_since"); value != "" {
+		since, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return err
+		}
+		conditions = append(conditions, "updated_at >= ?")
+		args = append(args, since.UTC())
+	}
+	conditions = append(conditions, "tenant_id = ?", "deleted_at IS NULL")
+	args = append(args, tenantID)
+	sort := query.Get("sort")
+	if _, ok := orderBy(sort); !ok {
+		return errInvalidSort
 	}
 
-	return phonebooks, nil
+	var last *Phonebook
+	for {
+		batch, err := queryBatch(ctx, conditions, args, sort, last, db, timeout)
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			if err := emit(&batch[i]); err != nil {
+				return err
+			}
+		}
+		if len(batch) < contactBatchSize {
+			return nil
+		}
+		last = &batch[len(batch)-1]
+	}
 }
 
-func searchForName(name string, db *sql.DB, timeout int) ([]Phonebook, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+// queryBatch reads the batch of a list following last, or the first one when
+// last is nil, with the numbers, addresses and tags of its phonebooks.
+func queryBatch(ctx context.Context, conditions []string, args []interface{}, sort string, last *Phonebook, db *sql.DB, timeout int) ([]Phonebook, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
 	defer cancel()
 
+	conditions = append([]string{}, conditions...)
+	args = append([]interface{}{}, args...)
+	if last != nil {
+		condition, values := after(sort, *last)
+		conditions = append(conditions, condition)
+		args = append(args, values...)
+	}
+	order, _ := orderBy(sort)
+	args = append(args, contactBatchSize)
+
 	results, err := db.QueryContext(ctx, `SELECT
 	phonebookId,
 	name,
-  email,
-	phone
+	email,
+	phone,
+	visibility,
+	created_at,
+	created_by,
+	updated_at,
+	updated_by
 	FROM phonebooks
-	WHERE name LIKE ?`, "%"+name+"%")
-
+	WHERE `+strings.Join(conditions, " AND ")+`
+	ORDER BY `+order+`
+	LIMIT ?`, args...)
 	if err != nil {
-		log.Println(err.Error())
 		return nil, err
 	}
+	defer results.Close()
 
-	phonebooks := make([]Phonebook, 0)
-
+	batch := make([]Phonebook, 0, contactBatchSize)
 	for results.Next() {
 		var phonebook Phonebook
-		results.Scan(
+		err := results.Scan(
 			&phonebook.PhonebookID,
 			&phonebook.Name,
 			&phonebook.Email,
-			&phonebook.Phone)
+			&phonebook.Phone,
+			&phonebook.Visibility,
+			&phonebook.CreatedAt,
+			&phonebook.CreatedBy,
+			&phonebook.UpdatedAt,
+			&phonebook.UpdatedBy)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, phonebook)
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+	results.Close()
 
-		phonebooks = append(phonebooks, phonebook)
+	if err := loadContacts(ctx, db, batch); err != nil {
+		return nil, err
 	}
+	return batch, nil
+}
 
-	return phonebooks, nil
+// listSorts are the columns lists can be sorted on, by the name of their field.
+var listSorts = map[string]string{
+	"name":      "name",
+	"createdAt": "created_at",
+	"updatedAt": "updated_at",
+}
+
+// orderBy returns the ORDER BY clause for the sort parameter of a list, such
+// as "-updatedAt" for the most recently updated first, and whether it is one
+// of listSorts. Phonebooks are listed by ID otherwise, and ties are broken by
+// ID, so batches and pages stay stable.
+func orderBy(sort string) (string, bool) {
+	if sort == "" {
+		return "phonebookId", true
+	}
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		direction, sort = "DESC", sort[1:]
+	}
+	column, ok := listSorts[sort]
+	if !ok {
+		return "", false
+	}
+	return column + " " + direction + ", phonebookId " + direction, true
+}
+
+// after returns the condition for the phonebooks listed after last in the
+// order orderBy gives for sort.
+func after(sort string, last Phonebook) (string, []interface{}) {
+	operator := ">"
+	if strings.HasPrefix(sort, "-") {
+		operator, sort = "<", sort[1:]
+	}
+	var value interface{}
+	switch sort {
+	case "name":
+		value = last.Name
+	case "createdAt":
+		value = last.CreatedAt
+	case "updatedAt":
+		value = last.UpdatedAt
+	default:
+		return "phonebookId " + operator + " ?", []interface{}{last.PhonebookID}
+	}
+	column := listSorts[sort]
+	return "(" + column + " " + operator + " ? OR (" + column + " = ? AND phonebookId " + operator + " ?))", []interface{}{value, value, last.PhonebookID}
+}
+
+// touch records on phonebook that the actor of ctx changed it just now, to
+// the precision the database keeps.
+func touch(ctx context.Context, phonebook *Phonebook) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	phonebook.UpdatedAt = &now
+	phonebook.UpdatedBy = actorFromContext(ctx)
+}
+
+// checkContactLimit enforces the maxContacts setting of the tenant.
+func checkContactLimit(ctx context.Context, tx *sql.Tx, tenantID string) error {
+	config, _ := tenant.Lookup(tenantID)
+	if config.MaxContacts <= 0 {
+		return nil
+	}
+
+	var count int
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM phonebooks
+	WHERE tenant_id = ? AND deleted_at IS NULL`, tenantID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count >= config.MaxContacts {
+		return errContactLimitReached
+	}
+	return nil
 }
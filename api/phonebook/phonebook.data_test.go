@@ -1,13 +1,30 @@
 package phonebook
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
 )
 
+// testTenant is the tenant every test runs as.
+const testTenant = "acme"
+
+// testContext is the context of a request made with authentication disabled.
+func testContext() context.Context {
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: auth.MethodAnonymous, Method: auth.MethodAnonymous, Scopes: []string{"*"}})
+	return tenant.NewContext(ctx, testTenant)
+}
+
 func NewMock() (*sql.DB, sqlmock.Sqlmock) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -16,6 +33,27 @@ func NewMock() (*sql.DB, sqlmock.Sqlmock) {
 	return db, mock
 }
 
+// expectLoadContacts expects the queries run by loadContacts, returning no
+// numbers or addresses.
+func expectLoadContacts(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT phonebookId, label, number, is_primary, visibility FROM phonebook_phones").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "number", "is_primary", "visibility"}))
+	mock.ExpectQuery("SELECT phonebookId, label, address, is_primary, visibility FROM phonebook_emails").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "address", "is_primary", "visibility"}))
+	mock.ExpectQuery("SELECT phonebookId, tag FROM phonebook_tags").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "tag"}))
+}
+
+// expectSaveContacts expects the statements run by saveContacts for a
+// phonebook with one number, one address and no tags.
+func expectSaveContacts(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("DELETE FROM phonebook_phones WHERE phonebookId = \\? AND tenant_id = \\?").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO phonebook_phones").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM phonebook_emails WHERE phonebookId = \\? AND tenant_id = \\?").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO phonebook_emails").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM phonebook_tags WHERE phonebookId = \\? AND tenant_id = \\?").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
 func TestShouldInsertANewPhonebook(t *testing.T) {
 	db, mock := NewMock()
 	defer db.Close()
@@ -26,12 +64,24 @@ func TestShouldInsertANewPhonebook(t *testing.T) {
 		Phone: "47 996623579",
 	}
 
+	mock.ExpectBegin()
 	mock.ExpectExec(`INSERT INTO phonebooks`).WithArgs(
 		pb.Name,
 		pb.Phone,
-		pb.Email).WillReturnResult(sqlmock.NewResult(1, 1))
+		pb.Email,
+		visibilityPublic,
+		sqlmock.AnyArg(),
+		anonymousActor,
+		sqlmock.AnyArg(),
+		anonymousActor,
+		testTenant).WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSaveContacts(mock)
+	mock.ExpectExec(`INSERT INTO phonebook_revisions`).
+		WithArgs(1, actionCreate, sqlmock.AnyArg(), sqlmock.AnyArg(), anonymousActor, "", testTenant, 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	if _, err := insert(pb, db, 15); err != nil {
+	if _, err := insert(testContext(), pb, db, 15); err != nil {
 		t.Errorf("error was not expected while updating stats: %s", err)
 	}
 }
@@ -40,14 +90,15 @@ func TestShouldGetAPhonebookById(t *testing.T) {
 	db, mock := NewMock()
 	defer db.Close()
 
-	query := "SELECT phonebookId, name, phone, email FROM phonebooks WHERE phonebookId = \\?"
+	query := "SELECT phonebookId, name, phone, email, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\?"
 
-	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email"}).
-		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com")
+	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, "")
 
-	mock.ExpectQuery(query).WithArgs(1).WillReturnRows(rows)
+	mock.ExpectQuery(query).WithArgs(1, testTenant).WillReturnRows(rows)
+	expectLoadContacts(mock)
 
-	if _, err := get(1, db, 15); err != nil {
+	if _, err := get(testContext(), 1, db, 15); err != nil {
 		t.Errorf("error was not expected while updating stats: %s", err)
 	}
 }
@@ -56,11 +107,23 @@ func TestShouldDeletePhonebook(t *testing.T) {
 	db, mock := NewMock()
 	defer db.Close()
 
-	query := "DELETE FROM phonebooks where phonebookId = \\?"
+	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, nil, "", nil, "")
 
-	mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(1, testTenant).WillReturnRows(rows)
+	expectLoadContacts(mock)
 
-	if err := remove(1, db, 15); err != nil {
+	query := "UPDATE phonebooks SET deleted_at=\\?, updated_at=\\?, updated_by=\\? WHERE phonebookId = \\? AND tenant_id = \\?"
+
+	mock.ExpectExec(query).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), anonymousActor, 1, testTenant).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO phonebook_revisions`).
+		WithArgs(1, actionDelete, sqlmock.AnyArg(), sqlmock.AnyArg(), anonymousActor, "", testTenant, 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := remove(testContext(), 1, db, 15); err != nil {
 		t.Errorf("error was not expected while updating stats: %s", err)
 	}
 }
@@ -75,11 +138,24 @@ func TestShouldUpdatePhonebook(t *testing.T) {
 		Phone: "47 996623579",
 	}
 
-	query := "UPDATE phonebooks SET name=\\?, phone=\\?, email=\\? WHERE phonebookId = \\?"
+	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow("0", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, nil, "", nil, "")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(pb.PhonebookID, testTenant).WillReturnRows(rows)
+	expectLoadContacts(mock)
+
+	query := "UPDATE phonebooks SET name=\\?, phone=\\?, email=\\?, visibility=\\?, updated_at=\\?, updated_by=\\? WHERE phonebookId = \\? AND tenant_id = \\?"
 
-	mock.ExpectExec(query).WithArgs(pb.Name, pb.Phone, pb.Email, pb.PhonebookID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs(pb.Name, pb.Phone, pb.Email, visibilityPublic, sqlmock.AnyArg(), anonymousActor, pb.PhonebookID, testTenant).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSaveContacts(mock)
+	mock.ExpectExec(`INSERT INTO phonebook_revisions`).
+		WithArgs(pb.PhonebookID, actionUpdate, sqlmock.AnyArg(), sqlmock.AnyArg(), anonymousActor, "", testTenant, pb.PhonebookID, testTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	if err := update(pb, db, 15); err != nil {
+	if _, err := update(testContext(), pb, db, 15); err != nil {
 		t.Errorf("error was not expected while updating stats: %s", err)
 	}
 }
@@ -88,14 +164,15 @@ func TestShouldListPhonebooks(t *testing.T) {
 	db, mock := NewMock()
 	defer db.Close()
 
-	query := "SELECT phonebookId, name, email, phone FROM phonebooks"
-	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email"}).
-		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com").
-		AddRow("2", "Paulo Eduardo", "47996623579", "pauloes.dev@gmail.com")
+	query := "SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks"
+	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, "").
+		AddRow("2", "Paulo Eduardo", "47996623579", "pauloes.dev@gmail.com", "public", nil, "", nil, "")
 
 	mock.ExpectQuery(query).WillReturnRows(rows)
+	expectLoadContacts(mock)
 
-	if _, err := list(nil, db, 15); err != nil {
+	if _, err := list(testContext(), nil, db, 15); err != nil {
 		t.Errorf("error was not expected while updating stats: %s", err)
 	}
 }
@@ -104,14 +181,345 @@ func TestShouldListPhonebooksByName(t *testing.T) {
 	db, mock := NewMock()
 	defer db.Close()
 
-	query := "SELECT phonebookId, name, email, phone FROM phonebooks WHERE name LIKE \\?"
+	query := "SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE name LIKE \\?"
 
-	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email"}).
-		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com")
+	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, "")
 
-	mock.ExpectQuery(query).WithArgs("%Nay%").WillReturnRows(rows)
+	mock.ExpectQuery(query).WithArgs("%Nay%", testTenant, contactBatchSize).WillReturnRows(rows)
+	expectLoadContacts(mock)
 
-	if _, err := searchForName("Nay", db, 15); err != nil {
+	if _, err := list(testContext(), url.Values{"name": {"Nay"}}, db, 15); err != nil {
 		t.Errorf("error was not expected while updating stats: %s", err)
 	}
 }
+
+func TestShouldListPhonebooksByAnyPhoneNumber(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	query := "SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId IN \\(SELECT phonebookId FROM phonebook_phones WHERE tenant_id = \\? AND number_digits LIKE \\?\\) AND tenant_id = \\?"
+
+	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow("1", "Nayara", "nay.maggioni@gmail.com", "47996623579", "public", nil, "", nil, "")
+
+	mock.ExpectQuery(query).WithArgs(testTenant, "%33334444%", testTenant, contactBatchSize).WillReturnRows(rows)
+	mock.ExpectQuery("SELECT phonebookId, label, number, is_primary, visibility FROM phonebook_phones WHERE tenant_id = \\? AND phonebookId IN \\(\\?\\)").
+		WithArgs(testTenant, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "number", "is_primary", "visibility"}).
+			AddRow(1, "mobile", "47996623579", true, "public").
+			AddRow(1, "work", "47 3333-4444", false, "public"))
+	mock.ExpectQuery("SELECT phonebookId, label, address, is_primary, visibility FROM phonebook_emails WHERE tenant_id = \\? AND phonebookId IN \\(\\?\\)").
+		WithArgs(testTenant, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "address", "is_primary", "visibility"}))
+	mock.ExpectQuery("SELECT phonebookId, tag FROM phonebook_tags WHERE tenant_id = \\? AND phonebookId IN \\(\\?\\)").
+		WithArgs(testTenant, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "tag"}))
+
+	phonebooks, err := list(testContext(), url.Values{"phone": {"3333-4444"}}, db, 15)
+	if err != nil {
+		t.Fatalf("error was not expected while listing: %s", err)
+	}
+	if len(phonebooks) != 1 || len(phonebooks[0].Phones) != 2 {
+		t.Errorf("list returned wrong phonebooks: %v", phonebooks)
+	}
+}
+
+func TestShouldNotMatchNumbersTheCallerCantSee(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	query := "SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId IN \\(SELECT phonebookId FROM phonebook_phones WHERE tenant_id = \\? AND number_digits LIKE \\? AND visibility IN \\(\\?, \\?\\)\\) AND visibility IN \\(\\?, \\?\\) AND tenant_id = \\?"
+	mock.ExpectQuery(query).
+		WithArgs(testTenant, "%996623579%", visibilityPublic, visibilityInternal, visibilityPublic, visibilityInternal, testTenant, contactBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}))
+
+	ctx := clearedContext(permissionRead, permissionReadInternal)
+	if _, err := list(ctx, url.Values{"phone": {"99662-3579"}}, db, 15); err != nil {
+		t.Fatalf("error was not expected while listing: %s", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestShouldListPhonebooksByGroupAndTag(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	query := "FROM phonebooks WHERE phonebookId IN \\(SELECT m.phonebookId FROM contact_group_members m JOIN contact_groups g ON g.groupId = m.groupId WHERE g.tenant_id = \\? AND g.name = \\?\\) AND phonebookId IN \\(SELECT phonebookId FROM phonebook_tags WHERE tenant_id = \\? AND tag = \\?\\) AND tenant_id = \\? AND deleted_at IS NULL"
+
+	mock.ExpectQuery(query).
+		WithArgs(testTenant, "sales", testTenant, "vip", testTenant, contactBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}))
+
+	if _, err := list(testContext(), url.Values{"group": {"sales"}, "tag": {"VIP"}}, db, 15); err != nil {
+		t.Errorf("error was not expected while listing: %s", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// tenantScoped fails every statement that doesn't mention tenant_id before
+// matching it like the default matcher.
+var tenantScoped = sqlmock.QueryMatcherFunc(func(expectedSQL, actualSQL string) error {
+	if !strings.Contains(actualSQL, "tenant_id") {
+		return fmt.Errorf("statement is not scoped by tenant: %s", actualSQL)
+	}
+	return sqlmock.QueryMatcherRegexp.Match(expectedSQL, actualSQL)
+})
+
+func TestShouldScopeEveryStatementByTenant(t *testing.T) {
+	tenant.Setup(tenant.New("", "", tenant.Config{ID: testTenant, MaxContacts: 100}))
+	defer tenant.Setup(tenant.Single(tenant.DefaultID))
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(tenantScoped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	pb := Phonebook{Name: "Nayara", Email: "nay.maggion@gmail.com", Phone: "47 996623579", Tags: []string{"vip"}}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT COUNT").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectExec("INSERT INTO phonebooks").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM phonebook_phones").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO phonebook_phones").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM phonebook_emails").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO phonebook_emails").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM phonebook_tags").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO phonebook_tags").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO phonebook_revisions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	mock.ExpectQuery("FROM phonebooks").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "name", "email", "phone", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).AddRow(1, "Nayara", "nay.maggion@gmail.com", "47 996623579", "public", nil, "", nil, ""))
+	expectLoadContacts(mock)
+
+	mock.ExpectQuery("FROM phonebook_revisions").WillReturnRows(
+		sqlmock.NewRows([]string{"phonebookId", "revision", "action", "snapshot", "diff", "actor", "requestId", "createdAt"}))
+
+	mock.ExpectQuery("FROM phonebooks").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "name", "email", "phone", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}))
+
+	ctx := testContext()
+	if _, err := insert(ctx, pb, db, 15); err != nil {
+		t.Fatalf("error was not expected while inserting: %s", err)
+	}
+	query := url.Values{"name": {"Nay"}, "phone": {"9966"}, "email": {"nay"}, "group": {"sales"}, "tag": {"vip"}}
+	if _, err := list(ctx, query, db, 15); err != nil {
+		t.Fatalf("error was not expected while listing: %s", err)
+	}
+	if _, err := listRevisions(ctx, 1, db, 15); err != nil {
+		t.Fatalf("error was not expected while listing revisions: %s", err)
+	}
+	if _, err := listTrash(ctx, db, 15); err != nil {
+		t.Fatalf("error was not expected while listing the trash: %s", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShouldNotReachAnotherTenantsPhonebook(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	// Phonebook 1 belongs to testTenant; the queries of another tenant find
+	// nothing.
+	other := tenant.NewContext(context.Background(), "globex")
+	forUpdate := "SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE"
+	noRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"})
+	}
+
+	mock.ExpectQuery("FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? AND deleted_at IS NULL").
+		WithArgs(1, "globex").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(forUpdate).WithArgs(1, "globex").WillReturnRows(noRows())
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(forUpdate).WithArgs(1, "globex").WillReturnRows(noRows())
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(forUpdate).WithArgs(1, "globex").WillReturnRows(noRows())
+	mock.ExpectRollback()
+
+	if phonebook, err := get(other, 1, db, 15); err != nil || phonebook != nil {
+		t.Errorf("get returned another tenant's phonebook: got (%v, %v)", phonebook, err)
+	}
+	if _, err := update(other, Phonebook{PhonebookID: 1, Name: "Mallory"}, db, 15); err != errPhonebookNotFound {
+		t.Errorf("update returned wrong error: got %v want %v", err, errPhonebookNotFound)
+	}
+	if err := remove(other, 1, db, 15); err != errPhonebookNotFound {
+		t.Errorf("remove returned wrong error: got %v want %v", err, errPhonebookNotFound)
+	}
+	if _, err := restore(other, 1, db, 15); err != errPhonebookNotFound {
+		t.Errorf("restore returned wrong error: got %v want %v", err, errPhonebookNotFound)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShouldRefuseToRunWithoutATenant(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	ctx := context.Background()
+	errs := map[string]error{}
+	_, errs["insert"] = insert(ctx, Phonebook{Name: "Nayara"}, db, 15)
+	_, errs["get"] = get(ctx, 1, db, 15)
+	_, errs["list"] = list(ctx, nil, db, 15)
+	_, errs["update"] = update(ctx, Phonebook{PhonebookID: 1, Name: "Nayara"}, db, 15)
+	errs["remove"] = remove(ctx, 1, db, 15)
+	_, errs["listTrash"] = listTrash(ctx, db, 15)
+	_, errs["restore"] = restore(ctx, 1, db, 15)
+	_, errs["purgeTrash"] = purgeTrash(ctx, time.Now(), db, 15)
+	_, errs["listRevisions"] = listRevisions(ctx, 1, db, 15)
+	_, errs["getRevision"] = getRevision(ctx, 1, 1, db, 15)
+	_, errs["revert"] = revert(ctx, 1, 1, db, 15)
+	_, errs["changeTags"] = changeTags(ctx, 1, []string{"vip"}, nil, db, 15)
+
+	for name, err := range errs {
+		if err != tenant.ErrMissing {
+			t.Errorf("%s returned wrong error: got %v want %v", name, err, tenant.ErrMissing)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShouldEnforceTheContactLimit(t *testing.T) {
+	tenant.Setup(tenant.New("", "", tenant.Config{ID: testTenant, MaxContacts: 2}))
+	defer tenant.Setup(tenant.Single(tenant.DefaultID))
+
+	db, mock := NewMock()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM phonebooks WHERE tenant_id = \\? AND deleted_at IS NULL").
+		WithArgs(testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectRollback()
+
+	if _, err := insert(testContext(), Phonebook{Name: "Nayara"}, db, 15); err != errContactLimitReached {
+		t.Errorf("insert returned wrong error: got %v want %v", err, errContactLimitReached)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShouldListPhonebooksUpdatedSinceByLastUpdate(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	updated := time.Date(2024, 1, 2, 14, 0, 0, 0, time.UTC)
+	rows := sqlmock.NewRows([]string{"id", "name", "email", "phone", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow(1, "Nayara", "", "", "public", updated, "nayara", updated, "paulo")
+	mock.ExpectQuery("FROM phonebooks WHERE updated_at >= \\? AND tenant_id = \\? AND deleted_at IS NULL ORDER BY updated_at DESC, phonebookId DESC").
+		WithArgs(time.Date(2024, 1, 2, 13, 4, 5, 0, time.UTC), testTenant, contactBatchSize).
+		WillReturnRows(rows)
+	expectLoadContacts(mock)
+
+	query := url.Values{"updated_since": {"2024-01-02T15:04:05+02:00"}, "sort": {"-updatedAt"}}
+	phonebooks, err := list(testContext(), query, db, 15)
+	if err != nil {
+		t.Fatalf("error was not expected while listing: %s", err)
+	}
+	if len(phonebooks) != 1 || !phonebooks[0].UpdatedAt.Equal(updated) || phonebooks[0].CreatedBy != "nayara" || phonebooks[0].UpdatedBy != "paulo" {
+		t.Errorf("list returned wrong phonebooks: %+v", phonebooks)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShouldListTheNextBatchAfterTheLastPhonebook(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	columns := []string{"id", "name", "email", "phone", "visibility", "created_at", "created_by", "updated_at", "updated_by"}
+	first := sqlmock.NewRows(columns)
+	for i := 1; i <= contactBatchSize; i++ {
+		first.AddRow(i, "Same name", "", "", "public", nil, "", nil, "")
+	}
+	mock.ExpectQuery("FROM phonebooks WHERE tenant_id = \\? AND deleted_at IS NULL ORDER BY name ASC, phonebookId ASC LIMIT \\?").
+		WithArgs(testTenant, contactBatchSize).
+		WillReturnRows(first)
+	expectLoadContacts(mock)
+	mock.ExpectQuery("FROM phonebooks WHERE tenant_id = \\? AND deleted_at IS NULL AND \\(name > \\? OR \\(name = \\? AND phonebookId > \\?\\)\\) ORDER BY name ASC, phonebookId ASC LIMIT \\?").
+		WithArgs(testTenant, "Same name", "Same name", contactBatchSize, contactBatchSize).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(contactBatchSize+1, "Same name", "", "", "public", nil, "", nil, ""))
+	expectLoadContacts(mock)
+
+	phonebooks, err := list(testContext(), url.Values{"sort": {"name"}}, db, 15)
+	if err != nil {
+		t.Fatalf("error was not expected while listing: %s", err)
+	}
+	if len(phonebooks) != contactBatchSize+1 || phonebooks[contactBatchSize].PhonebookID != contactBatchSize+1 {
+		t.Errorf("list returned %d phonebooks", len(phonebooks))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	for sort, want := range map[string]string{
+		"":           "phonebookId",
+		"name":       "name ASC, phonebookId ASC",
+		"-createdAt": "created_at DESC, phonebookId DESC",
+		"updatedAt":  "updated_at ASC, phonebookId ASC",
+	} {
+		if got, ok := orderBy(sort); !ok || got != want {
+			t.Errorf("orderBy(%q) = %q, %v, want %q", sort, got, ok, want)
+		}
+	}
+	for _, sort := range []string{"email", "-", "updated_at", "name; DROP TABLE phonebooks"} {
+		if _, ok := orderBy(sort); ok {
+			t.Errorf("orderBy(%q) accepted an unknown sort", sort)
+		}
+	}
+}
+
+func TestShouldKeepTheCreationAndStampTheUpdate(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	created := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(1, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow(1, "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, created, "nayara", created, "nayara"))
+	expectLoadContacts(mock)
+	mock.ExpectExec("UPDATE phonebooks SET").
+		WithArgs("Nayara M.", "47996623579", "nay.maggioni@gmail.com", visibilityPublic, sqlmock.AnyArg(), "paulo", 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSaveContacts(mock)
+	mock.ExpectExec("INSERT INTO phonebook_revisions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// Whatever the client sends, the metadata is the data layer's.
+	forged := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	pb := Phonebook{PhonebookID: 1, Name: "Nayara M.", Phone: "47996623579", Email: "nay.maggioni@gmail.com", CreatedAt: &forged, CreatedBy: "mallory", UpdatedAt: &forged, UpdatedBy: "mallory"}
+	updated, err := update(withActor(testContext(), "paulo"), pb, db, 15)
+	if err != nil {
+		t.Fatalf("error was not expected while updating: %s", err)
+	}
+	if !updated.CreatedAt.Equal(created) || updated.CreatedBy != "nayara" {
+		t.Errorf("update changed the creation: %v by %q", updated.CreatedAt, updated.CreatedBy)
+	}
+	if updated.UpdatedAt == nil || !updated.UpdatedAt.After(created) || updated.UpdatedBy != "paulo" {
+		t.Errorf("update stamped the wrong update: %v by %q", updated.UpdatedAt, updated.UpdatedBy)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,8 +1,27 @@
 package phonebook
 
+import "time"
+
+// Phonebook is a contact, and its representation in v1 of the API, where
+// PhonebookID, Name, Phone and Email are named after the fields as they have
+// always been. Phone and Email hold the primary entries of Phones and Emails,
+// so clients that only know the single fields keep working.
+// Visibility is the level of every number and address of the phonebook,
+// unless one of them sets a more sensitive level itself. When it was created
+// and last changed, and by whom, is kept by the data layer; clients can't set
+// it.
 type Phonebook struct {
-	PhonebookID int    `json:phonebookId`
-	Name        string `json:name`
-	Phone       string `json:phone`
-	Email       string `json:email`
+	PhonebookID int            `json:"PhonebookID"`
+	Name        string         `json:"Name"`
+	Phone       string         `json:"Phone"`
+	Email       string         `json:"Email"`
+	Phones      []ContactPhone `json:"phones,omitempty"`
+	Emails      []ContactEmail `json:"emails,omitempty"`
+	Tags        []string       `json:"tags,omitempty"`
+	Visibility  string         `json:"visibility,omitempty"`
+	DeletedAt   *time.Time     `json:"deletedAt,omitempty"`
+	CreatedAt   *time.Time     `json:"createdAt,omitempty"`
+	CreatedBy   string         `json:"createdBy,omitempty"`
+	UpdatedAt   *time.Time     `json:"updatedAt,omitempty"`
+	UpdatedBy   string         `json:"updatedBy,omitempty"`
 }
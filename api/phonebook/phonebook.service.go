@@ -2,161 +2,295 @@ package phonebook
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Paulo-Eduardo/phone_book/admission"
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/compress"
 	"github.com/Paulo-Eduardo/phone_book/cors"
+	"github.com/Paulo-Eduardo/phone_book/idempotency"
 	"github.com/Paulo-Eduardo/phone_book/logger"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/ratelimit"
+	"github.com/Paulo-Eduardo/phone_book/requestid"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
 )
 
 const phonebookBasePath = "phonebooks"
 
+// Permissions checked by the phonebook handlers.
+const (
+	permissionRead   = "phonebook:read"
+	permissionWrite  = "phonebook:write"
+	permissionDelete = "phonebook:delete"
+)
+
 var db *sql.DB
 var timeout int
 
+// apiBase is the path the versions of the API are served below.
+var apiBase string
+
+// SetupRoutes serves the phonebooks in every version of their representation:
+// v1 below apiBasePath and v2 below apiBasePath/v2.
 func SetupRoutes(apiBasePath string, dbCoon *sql.DB, to int) {
 	db = dbCoon
 	timeout = to
-	handlePhonebooks := http.HandlerFunc(phonebooksHandler)
-	handlePhonebook := http.HandlerFunc(phonebookHandler)
-	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, phonebookBasePath), logger.Middleware(cors.Middleware(handlePhonebooks)))
-	http.Handle(fmt.Sprintf("%s/%s/", apiBasePath, phonebookBasePath), logger.Middleware(cors.Middleware(handlePhonebook)))
+	apiBase = apiBasePath
+	for _, version := range []*wireVersion{v1, v2} {
+		handlePhonebooks := serveWireVersion(version, http.HandlerFunc(phonebooksHandler))
+		handlePhonebook := serveWireVersion(version, http.HandlerFunc(phonebookHandler))
+		http.Handle(version.phonebooksURL(), requestid.Middleware(logger.Middleware(compress.Middleware(cors.Middleware(admission.Middleware(auth.Middleware(tenant.Middleware(ratelimit.Middleware(idempotency.Middleware(handlePhonebooks))))))))))
+		http.Handle(version.phonebooksURL()+"/", requestid.Middleware(logger.Middleware(compress.Middleware(cors.Middleware(admission.Middleware(auth.Middleware(tenant.Middleware(ratelimit.Middleware(handlePhonebook)))))))))
+	}
+}
+
+// permissionFor returns the permission a request needs. Deleting a phonebook
+// needs phonebook:delete, while deleting something below it, such as a tag,
+// is an edit.
+func permissionFor(method string, phonebook bool) string {
+	switch {
+	case method == http.MethodGet || method == http.MethodHead:
+		return permissionRead
+	case method == http.MethodDelete && phonebook:
+		return permissionDelete
+	}
+	return permissionWrite
 }
 
 func phonebooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !auth.Check(w, r, permissionFor(r.Method, false)) {
+		return
+	}
+	r = r.WithContext(withActor(r.Context(), actorFromRequest(r)))
+
 	switch r.Method {
 	case http.MethodGet:
-		var phonebookList []Phonebook
-		var err error
-		phonebookList, err = list(r.URL.Query(), db, timeout)
-		if err != nil {
-			log.Printf("An error accured trying to list user: %v", err)
-			io.WriteString(w, err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
+		if errs := validateListQuery(r.URL.Query()); len(errs) > 0 {
+			problem.Write(w, r, problem.Validation(errs))
 			return
 		}
-		phonebooksJson, err := json.Marshal(phonebookList)
-		if err != nil {
-			log.Printf("An error accured trying parse the list of users: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		pw := newPhonebookWriter(w, r)
+		if pw == nil {
 			return
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(phonebooksJson)
+		writePhonebooks(w, r, pw, func(emit func(*Phonebook) error) error {
+			return streamList(r.Context(), r.URL.Query(), db, timeout, emit)
+		})
 	case http.MethodPost:
 		// add a new entry in phonebook list
-		var newPhonebook Phonebook
+		version := wireVersionOf(r.Context())
 		bodyBytes, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Printf("An error accured trying to read the body: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			problem.Write(w, r, problem.Malformed("The request body could not be read."))
 			return
 		}
-		err = json.Unmarshal(bodyBytes, &newPhonebook)
+		newPhonebook, err := version.decode(bodyBytes)
 		if err != nil {
 			log.Printf("An error accured trying to parse the body: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			problem.Write(w, r, problem.Malformed(version.malformed(err)))
 			return
 		}
 		if newPhonebook.PhonebookID != 0 {
 			log.Printf("User passed a body with ID")
-			w.WriteHeader(http.StatusBadRequest)
+			problem.Write(w, r, problem.Validation([]problem.FieldError{{Field: version.idField, Message: "must not be set when creating a phonebook"}}))
 			return
 		}
-		id, err := insert(newPhonebook, db, timeout)
-		if err != nil {
-			log.Printf("An error accured trying to insert the item in the database: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if errs := validate(newPhonebook); len(errs) > 0 {
+			problem.Write(w, r, problem.Validation(errs))
 			return
 		}
-
-		jsonId, err := json.Marshal(id)
-		if err != nil {
-			log.Printf("An error accured trying to parse the result id: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		// Clients opt in to being warned, and send the phonebook again
+		// without checkDuplicates to create it anyway.
+		if r.URL.Query().Get("checkDuplicates") == "true" {
+			candidates, err := likelyDuplicates(r.Context(), newPhonebook)
+			if err != nil {
+				log.Printf("An error accured trying to look for duplicates: %v", err)
+				problem.Error(w, r, http.StatusInternalServerError, "The phonebook could not be created.")
+				return
+			}
+			if len(candidates) > 0 {
+				problem.Write(w, r, problem.Duplicate("The phonebook is likely a duplicate of a stored one.", version.encodeCandidates(candidates)))
+				return
+			}
+		}
+		created, err := insert(r.Context(), newPhonebook, db, timeout)
+		if err == errContactLimitReached {
+			problem.Error(w, r, http.StatusForbidden, "The tenant reached its maximum number of phonebooks.")
+			return
+		} else if writeConflict(w, r, err) {
+			return
+		} else if err != nil {
+			log.Printf("An error accured trying to insert the item in the database: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The phonebook could not be created.")
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
-		w.Write(jsonId)
+		w.Header().Set("Location", fmt.Sprintf("%s/%d", version.phonebooksURL(), created.PhonebookID))
+		redact(created, clearance(r.Context()))
+		problem.WriteJSON(w, r, http.StatusCreated, version.encode(created))
 		return
 	case http.MethodOptions:
 		return
 	}
 }
 
+// validateListQuery checks the parameters of a list that can't be used as
+// they are, before anything is sent.
+func validateListQuery(query url.Values) []problem.FieldError {
+	var errs []problem.FieldError
+	if value := query.Get("updated_since"); value != "" {
+		if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+			errs = append(errs, problem.FieldError{Field: "updated_since", Message: "must be a time such as 2024-01-02T15:04:05Z"})
+		}
+	}
+	if _, ok := orderBy(query.Get("sort")); !ok {
+		errs = append(errs, problem.FieldError{Field: "sort", Message: "must be name, createdAt or updatedAt, prefixed with - for descending order"})
+	}
+	return errs
+}
+
 func phonebookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+	r = r.WithContext(withActor(r.Context(), actorFromRequest(r)))
+
 	urlPathSegments := strings.Split(r.URL.Path, "phonebooks/")
-	phonebookID, err := strconv.Atoi(urlPathSegments[len(urlPathSegments)-1])
+	pathSegments := strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	permission := permissionFor(r.Method, len(pathSegments) == 1)
+	if len(pathSegments) == 1 && pathSegments[0] == "export" {
+		permission = permissionExport
+	}
+	if !auth.Check(w, r, permission) {
+		return
+	}
+	if wireVersionOf(r.Context()) != v1 && !servesV2(pathSegments) {
+		problem.Error(w, r, http.StatusNotFound, "")
+		return
+	}
+	if len(pathSegments) == 1 && pathSegments[0] == "export" {
+		exportHandler(w, r)
+		return
+	}
+	if len(pathSegments) == 1 && pathSegments[0] == "trash" {
+		trashHandler(w, r)
+		return
+	}
+	if len(pathSegments) == 1 && pathSegments[0] == "changes" {
+		changesHandler(w, r)
+		return
+	}
+	if len(pathSegments) == 1 && pathSegments[0] == "duplicates" {
+		duplicatesHandler(w, r)
+		return
+	}
+	if len(pathSegments) == 1 && pathSegments[0] == "merge" {
+		mergeHandler(w, r)
+		return
+	}
+
+	phonebookID, err := strconv.Atoi(pathSegments[0])
 	if err != nil {
 		log.Printf("An error accured trying to parse the query id: %v", err)
-		w.WriteHeader(http.StatusNotFound)
+		problem.Error(w, r, http.StatusNotFound, "")
+		return
+	}
+
+	if len(pathSegments) == 2 && pathSegments[1] == "restore" {
+		restoreHandler(w, r, phonebookID)
+		return
+	}
+
+	if len(pathSegments) > 1 && pathSegments[1] == "tags" {
+		tagHandler(w, r, phonebookID, pathSegments[2:])
+		return
+	}
+
+	if len(pathSegments) > 1 {
+		revisionHandler(w, r, phonebookID, pathSegments[1:])
 		return
 	}
 
-	phonebook, err := get(phonebookID, db, timeout)
+	phonebook, err := get(r.Context(), phonebookID, db, timeout)
 
 	if err != nil {
 		log.Printf("An error accured trying to get the item from id: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.Error(w, r, http.StatusInternalServerError, "")
 		return
 	}
 
 	if phonebook == nil {
 		log.Printf("An error accured trying to parse the query id: %v", err)
-		w.WriteHeader(http.StatusNotFound)
+		problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d does not exist.", phonebookID))
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet:
-		phonebookJSON, err := json.Marshal(phonebook)
-		if err != nil {
-			log.Printf("An error accured trying to parse the phonebook: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(phonebookJSON)
+		writePhonebook(w, r, phonebook)
 	case http.MethodPut:
-		var updatedPhonebook Phonebook
+		version := wireVersionOf(r.Context())
 		bodyBytes, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Printf("An error accured trying to read the body: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			problem.Write(w, r, problem.Malformed("The request body could not be read."))
 			return
 		}
-		err = json.Unmarshal(bodyBytes, &updatedPhonebook)
+		updatedPhonebook, err := version.decode(bodyBytes)
 		if err != nil {
 			log.Printf("An error accured trying to parse the body: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			problem.Write(w, r, problem.Malformed(version.malformed(err)))
 			return
 		}
+		unmask(&updatedPhonebook, phonebook)
 		if updatedPhonebook.PhonebookID != phonebookID {
 			log.Printf("An error accured, user trying to update but ID didn't match")
-			w.WriteHeader(http.StatusBadRequest)
+			problem.Write(w, r, problem.Validation([]problem.FieldError{{Field: version.idField, Message: "must match the ID in the URL"}}))
+			return
+		}
+		if errs := validate(updatedPhonebook); len(errs) > 0 {
+			problem.Write(w, r, problem.Validation(errs))
+			return
+		}
+		if disclosed := disclosedLevel(&updatedPhonebook, phonebook, clearance(r.Context())); disclosed > 0 {
+			problem.Write(w, r, problem.Forbidden(clearancePermission(disclosed)))
 			return
 		}
 
-		err = update(updatedPhonebook, db, timeout)
-		if err != nil {
+		updated, err := update(r.Context(), updatedPhonebook, db, timeout)
+		if err == errPhonebookNotFound {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d does not exist.", phonebookID))
+			return
+		} else if writeConflict(w, r, err) {
+			return
+		} else if err != nil {
 			log.Printf("An error accured trying to update phonebook: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			problem.Error(w, r, http.StatusBadRequest, "The phonebook could not be updated.")
 			return
 		}
-		w.WriteHeader(http.StatusOK)
+		redact(updated, clearance(r.Context()))
+		problem.WriteJSON(w, r, http.StatusOK, version.encode(updated))
 		return
 	case http.MethodDelete:
-		if err := remove(phonebookID, db, timeout); err != nil {
+		err := remove(r.Context(), phonebookID, db, timeout)
+		if err == errPhonebookNotFound {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d does not exist.", phonebookID))
+			return
+		} else if err != nil {
 			log.Printf("An error accured trying to update phonebook: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			problem.Error(w, r, http.StatusBadRequest, "The phonebook could not be removed.")
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -164,6 +298,6 @@ func phonebookHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodOptions:
 		return
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
 	}
 }
@@ -3,14 +3,20 @@ package phonebook
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/problem"
 )
 
 var mock sqlmock.Sqlmock
@@ -25,6 +31,16 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+// newRequest is http.NewRequest for a request already resolved to testTenant
+// by tenant.Middleware.
+func newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(testContext()), nil
+}
+
 func TestPostPhonebookHandler(t *testing.T) {
 	handler := http.HandlerFunc(phonebooksHandler)
 
@@ -41,12 +57,22 @@ func TestPostPhonebookHandler(t *testing.T) {
 		t.Error(err)
 	}
 
+	mock.ExpectBegin()
 	mock.ExpectExec(`INSERT INTO phonebooks`).WithArgs(
 		pb.Name,
 		pb.Phone,
-		pb.Email).WillReturnResult(sqlmock.NewResult(insertedId, 1))
-
-	req, err := http.NewRequest("POST", "/phonebooks", bytes.NewBuffer(body))
+		pb.Email,
+		visibilityPublic,
+		sqlmock.AnyArg(),
+		anonymousActor,
+		sqlmock.AnyArg(),
+		anonymousActor,
+		testTenant).WillReturnResult(sqlmock.NewResult(insertedId, 1))
+	expectSaveContacts(mock)
+	mock.ExpectExec(`INSERT INTO phonebook_revisions`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	req, err := newRequest("POST", "/phonebooks", bytes.NewBuffer(body))
 	if err != nil {
 		t.Error(err)
 	}
@@ -57,26 +83,34 @@ func TestPostPhonebookHandler(t *testing.T) {
 
 	if status := rr.Code; status != http.StatusCreated {
 		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
+			status, http.StatusCreated)
 	}
 
-	if rr.Body.String() != strconv.Itoa(int(insertedId)) {
-		t.Errorf("handler returned wrong inserted id: got %v want %v",
-			insertedId, rr.Body.String())
+	if location := rr.Header().Get("Location"); location != "/phonebooks/"+strconv.Itoa(int(insertedId)) {
+		t.Errorf("handler returned wrong location: got %q", location)
+	}
+
+	var created Phonebook
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.PhonebookID != int(insertedId) || created.Name != pb.Name || len(created.Phones) != 1 || created.Phones[0].Number != pb.Phone || created.Visibility != visibilityPublic {
+		t.Errorf("handler returned wrong phonebook: %+v", created)
 	}
 }
 
 func TestGetPhonebooksHandler(t *testing.T) {
 	handler := http.HandlerFunc(phonebooksHandler)
 
-	query := "SELECT phonebookId, name, email, phone FROM phonebooks"
-	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email"}).
-		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com").
-		AddRow("2", "Paulo Eduardo", "47996623579", "pauloes.dev@gmail.com")
+	query := "SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks"
+	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, "").
+		AddRow("2", "Paulo Eduardo", "47996623579", "pauloes.dev@gmail.com", "public", nil, "", nil, "")
 
 	mock.ExpectQuery(query).WillReturnRows(rows)
+	expectLoadContacts(mock)
 
-	req, err := http.NewRequest("GET", "/phonebooks", nil)
+	req, err := newRequest("GET", "/phonebooks", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -90,11 +124,96 @@ func TestGetPhonebooksHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	if rr.Body.String() != `[{"PhonebookID":1,"Name":"Nayara","Phone":"nay.maggioni@gmail.com","Email":"47996623579"},{"PhonebookID":2,"Name":"Paulo Eduardo","Phone":"pauloes.dev@gmail.com","Email":"47996623579"}]` {
+	if rr.Body.String() != `[{"PhonebookID":1,"Name":"Nayara","Phone":"nay.maggioni@gmail.com","Email":"47996623579","visibility":"public"},{"PhonebookID":2,"Name":"Paulo Eduardo","Phone":"pauloes.dev@gmail.com","Email":"47996623579","visibility":"public"}]` {
 		t.Errorf("handler returned wrong body: got %s, want %s",
 			rr.Body.String(),
-			`[{"PhonebookID":1,"Name":"Nayara","Phone":"nay.maggioni@gmail.com","Email":"47996623579"},
-      {"PhonebookID":2,"Name":"Paulo Eduardo","Phone":"pauloes.dev@gmail.com","Email":"47996623579"}]`)
+			`[{"PhonebookID":1,"Name":"Nayara","Phone":"nay.maggioni@gmail.com","Email":"47996623579","visibility":"public"},
+      {"PhonebookID":2,"Name":"Paulo Eduardo","Phone":"pauloes.dev@gmail.com","Email":"47996623579","visibility":"public"}]`)
+	}
+}
+
+func TestPostInvalidPhonebookHandler(t *testing.T) {
+	handler := http.HandlerFunc(phonebooksHandler)
+
+	body := []byte(`{"name": "", "email": "not an email", "phone": "call me"}`)
+
+	req, err := newRequest("POST", "/phonebooks", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusUnprocessableEntity)
+	}
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != problem.ContentType {
+		t.Errorf("handler returned wrong content type: got %v want %v",
+			contentType, problem.ContentType)
+	}
+
+	var p problem.Problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := map[string]bool{}
+	for _, fieldError := range p.Errors {
+		fields[fieldError.Field] = true
+	}
+	for _, field := range []string{"name", "email", "phone"} {
+		if !fields[field] {
+			t.Errorf("handler didn't report field %v: got %v", field, rr.Body.String())
+		}
+	}
+}
+
+func TestGetPhonebooksHandlerRejectsAnInvalidFilter(t *testing.T) {
+	req, err := newRequest("GET", "/phonebooks?updated_since=yesterday&sort=email", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(phonebooksHandler).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	var p problem.Problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Errors) != 2 || p.Errors[0].Field != "updated_since" || p.Errors[1].Field != "sort" {
+		t.Errorf("handler returned wrong field errors: %+v", p.Errors)
+	}
+}
+
+func TestGetPhonebooksHandlerDoesNotLeakErrors(t *testing.T) {
+	handler := http.HandlerFunc(phonebooksHandler)
+
+	mock.ExpectQuery("SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks").
+		WillReturnError(errors.New("Error 1146: Table 'phonebookdb.phonebooks' doesn't exist"))
+
+	req, err := newRequest("GET", "/phonebooks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusInternalServerError)
+	}
+
+	if strings.Contains(rr.Body.String(), "1146") {
+		t.Errorf("handler leaked the database error: %v", rr.Body.String())
 	}
 }
 
@@ -103,14 +222,15 @@ func TestGetPhonebooksHandler(t *testing.T) {
 func TestGetPhonebookHandler(t *testing.T) {
 	handler := http.HandlerFunc(phonebookHandler)
 
-	query := "SELECT phonebookId, name, phone, email FROM phonebooks WHERE phonebookId = \\?"
+	query := "SELECT phonebookId, name, phone, email, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\?"
 
-	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email"}).
-		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com")
+	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, "")
 
-	mock.ExpectQuery(query).WithArgs(1).WillReturnRows(rows)
+	mock.ExpectQuery(query).WithArgs(1, testTenant).WillReturnRows(rows)
+	expectLoadContacts(mock)
 
-	req, err := http.NewRequest("GET", "/phonebooks/1", nil)
+	req, err := newRequest("GET", "/phonebooks/1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -124,10 +244,10 @@ func TestGetPhonebookHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	if rr.Body.String() != `{"PhonebookID":1,"Name":"Nayara","Phone":"47996623579","Email":"nay.maggioni@gmail.com"}` {
+	if rr.Body.String() != `{"PhonebookID":1,"Name":"Nayara","Phone":"47996623579","Email":"nay.maggioni@gmail.com","visibility":"public"}` {
 		t.Errorf("handler returned wrong body: got %s, want %s",
 			rr.Body.String(),
-			`{"PhonebookID":1,"Name":"Nayara","Phone":"nay.maggioni@gmail.com","Email":"47996623579"}`)
+			`{"PhonebookID":1,"Name":"Nayara","Phone":"nay.maggioni@gmail.com","Email":"47996623579","visibility":"public"}`)
 	}
 }
 
@@ -141,23 +261,34 @@ func TestPutPhonebookHandler(t *testing.T) {
 		Phone:       "47 996623579",
 	}
 
-	query := "SELECT phonebookId, name, phone, email FROM phonebooks WHERE phonebookId = \\?"
+	query := "SELECT phonebookId, name, phone, email, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\?"
+
+	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, "")
 
-	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email"}).
-		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com")
+	mock.ExpectQuery(query).WithArgs(1, testTenant).WillReturnRows(rows)
+	expectLoadContacts(mock)
 
-	mock.ExpectQuery(query).WithArgs(1).WillReturnRows(rows)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(1, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, nil, "", nil, ""))
+	expectLoadContacts(mock)
 
-	query = "UPDATE phonebooks SET name=\\?, phone=\\?, email=\\? WHERE phonebookId = \\?"
+	query = "UPDATE phonebooks SET name=\\?, phone=\\?, email=\\?, visibility=\\?, updated_at=\\?, updated_by=\\? WHERE phonebookId = \\? AND tenant_id = \\?"
 
-	mock.ExpectExec(query).WithArgs(pb.Name, pb.Phone, pb.Email, pb.PhonebookID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs(pb.Name, pb.Phone, pb.Email, visibilityPublic, sqlmock.AnyArg(), anonymousActor, pb.PhonebookID, testTenant).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSaveContacts(mock)
+	mock.ExpectExec(`INSERT INTO phonebook_revisions`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
 	pbJSON, err := json.Marshal(pb)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	req, err := http.NewRequest("PUT", "/phonebooks/1", bytes.NewReader(pbJSON))
+	req, err := newRequest("PUT", "/phonebooks/1", bytes.NewReader(pbJSON))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -170,23 +301,41 @@ func TestPutPhonebookHandler(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusOK)
 	}
+
+	var updated Phonebook
+	if err := json.Unmarshal(rr.Body.Bytes(), &updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.PhonebookID != pb.PhonebookID || updated.Email != pb.Email || len(updated.Emails) == 0 || updated.Emails[0].Address != pb.Email {
+		t.Errorf("handler returned wrong phonebook: %+v", updated)
+	}
 }
 
 func TestDeletePhonebookHandler(t *testing.T) {
 	handler := http.HandlerFunc(phonebookHandler)
 
-	query := "SELECT phonebookId, name, phone, email FROM phonebooks WHERE phonebookId = \\?"
+	query := "SELECT phonebookId, name, phone, email, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\?"
 
-	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email"}).
-		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com")
+	rows := sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, "")
 
-	mock.ExpectQuery(query).WithArgs(1).WillReturnRows(rows)
+	mock.ExpectQuery(query).WithArgs(1, testTenant).WillReturnRows(rows)
+	expectLoadContacts(mock)
 
-	query = "DELETE FROM phonebooks where phonebookId = \\?"
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(1, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, nil, "", nil, ""))
+	expectLoadContacts(mock)
 
-	mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	query = "UPDATE phonebooks SET deleted_at=\\?, updated_at=\\?, updated_by=\\? WHERE phonebookId = \\? AND tenant_id = \\?"
 
-	req, err := http.NewRequest("DELETE", "/phonebooks/1", nil)
+	mock.ExpectExec(query).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), anonymousActor, 1, testTenant).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO phonebook_revisions`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	req, err := newRequest("DELETE", "/phonebooks/1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -200,3 +349,117 @@ func TestDeletePhonebookHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 }
+
+func TestRolesLackingPermissionAreForbidden(t *testing.T) {
+	tests := []struct {
+		role       string
+		method     string
+		url        string
+		permission string
+	}{
+		{role: "viewer", method: "POST", url: "/phonebooks", permission: permissionWrite},
+		{role: "viewer", method: "PUT", url: "/phonebooks/1", permission: permissionWrite},
+		{role: "viewer", method: "POST", url: "/phonebooks/1/tags", permission: permissionWrite},
+		{role: "viewer", method: "POST", url: "/phonebooks/1/restore", permission: permissionWrite},
+		{role: "editor", method: "DELETE", url: "/phonebooks/1", permission: permissionDelete},
+		{role: "viewer", method: "GET", url: "/phonebooks/export", permission: permissionExport},
+		{role: "", method: "GET", url: "/phonebooks/1", permission: permissionRead},
+	}
+
+	for _, test := range tests {
+		req, err := newRequest(test.method, test.url, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &auth.Principal{Subject: "jwt:intern", Method: auth.MethodJWT, Roles: []string{test.role}}
+		req = req.WithContext(auth.NewContext(req.Context(), p))
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(phonebookHandler)
+		if test.url == "/phonebooks" {
+			handler = phonebooksHandler
+		}
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s %s as %q returned %v want %v", test.method, test.url, test.role, rr.Code, http.StatusForbidden)
+			continue
+		}
+		var body problem.Problem
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if body.Type != problem.TypeForbidden || body.Permission != test.permission {
+			t.Errorf("%s %s as %q returned %+v want missing %s", test.method, test.url, test.role, body, test.permission)
+		}
+	}
+}
+
+func TestEditorCanDeleteTags(t *testing.T) {
+	if got := permissionFor(http.MethodDelete, false); got != permissionWrite {
+		t.Errorf("deleting a tag needs %s want %s", got, permissionWrite)
+	}
+	if !(&auth.Principal{Roles: []string{"editor"}}).Allows(permissionFor(http.MethodDelete, false)) {
+		t.Error("editor can't delete tags")
+	}
+}
+
+func expectGetExecutive() {
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\?").
+		WithArgs(1, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow(1, "Paulo Eduardo", "+55 47 99662-3579", "pauloes.dev@gmail.com", visibilityPublic, nil, "", nil, ""))
+	mock.ExpectQuery("SELECT phonebookId, label, number, is_primary, visibility FROM phonebook_phones").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "number", "is_primary", "visibility"}).
+			AddRow(1, "mobile", "+55 47 99662-3579", true, visibilityRestricted))
+	mock.ExpectQuery("SELECT phonebookId, label, address, is_primary, visibility FROM phonebook_emails").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "address", "is_primary", "visibility"}).
+			AddRow(1, "work", "pauloes.dev@gmail.com", true, visibilityPublic))
+	mock.ExpectQuery("SELECT phonebookId, tag FROM phonebook_tags").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "tag"}))
+}
+
+func TestGetPhonebookHandlerMasksRestrictedNumbers(t *testing.T) {
+	expectGetExecutive()
+
+	req, err := newRequest("GET", "/phonebooks/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(clearedContext(permissionRead))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(phonebookHandler).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if strings.Contains(rr.Body.String(), "99662-3579") {
+		t.Errorf("handler leaked the restricted number: %s", rr.Body.String())
+	}
+	var got Phonebook
+	json.Unmarshal(rr.Body.Bytes(), &got)
+	if got.Phones[0].Number != "+55 47 9****-**79" || !got.Phones[0].Masked || got.Emails[0].Address != "pauloes.dev@gmail.com" {
+		t.Errorf("handler returned wrong phonebook: %+v", got)
+	}
+}
+
+func TestPutPhonebookHandlerRefusesToLowerARestrictedNumber(t *testing.T) {
+	expectGetExecutive()
+
+	body := `{"PhonebookID": 1, "Name": "Paulo Eduardo", "phones": [{"label": "mobile", "number": "+55 47 9****-**79", "primary": true, "visibility": "public"}]}`
+	req, err := newRequest("PUT", "/phonebooks/1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(clearedContext(permissionRead, permissionWrite, permissionReadInternal))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(phonebookHandler).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if !strings.Contains(rr.Body.String(), permissionReadRestricted) {
+		t.Errorf("handler didn't name the missing permission: %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,173 @@
+package phonebook
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Paulo-Eduardo/phone_book/problem"
+)
+
+const (
+	maxNameLength  = 100
+	maxPhoneLength = 32
+	maxEmailLength = 254
+
+	minPhoneDigits = 4
+	maxPhoneDigits = 15
+)
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9 ().\-]+$`)
+
+const visibilityMessage = "must be public, internal or restricted"
+
+// validate checks a phonebook sent by a client and returns one FieldError per
+// problem found. An empty result means the phonebook can be stored.
+func validate(phonebook Phonebook) []problem.FieldError {
+	var errs []problem.FieldError
+
+	name := strings.TrimSpace(phonebook.Name)
+	if name == "" {
+		errs = append(errs, problem.FieldError{Field: "name", Message: "is required"})
+	} else if utf8.RuneCountInString(name) > maxNameLength {
+		errs = append(errs, problem.FieldError{Field: "name", Message: fmt.Sprintf("must have at most %d characters", maxNameLength)})
+	}
+
+	if msg := validatePhone(phonebook.Phone); msg != "" {
+		errs = append(errs, problem.FieldError{Field: "phone", Message: msg})
+	}
+
+	if msg := validateEmail(phonebook.Email); msg != "" {
+		errs = append(errs, problem.FieldError{Field: "email", Message: msg})
+	}
+
+	if !validVisibility(phonebook.Visibility) {
+		errs = append(errs, problem.FieldError{Field: "visibility", Message: visibilityMessage})
+	}
+
+	errs = append(errs, validatePhones(phonebook)...)
+	errs = append(errs, validateEmails(phonebook)...)
+	errs = append(errs, validateTags(phonebook.Tags)...)
+
+	return errs
+}
+
+func validatePhones(phonebook Phonebook) []problem.FieldError {
+	var errs []problem.FieldError
+	if len(phonebook.Phones) > maxContactsPerKind {
+		errs = append(errs, problem.FieldError{Field: "phones", Message: fmt.Sprintf("must have at most %d entries", maxContactsPerKind)})
+	}
+
+	primaries := 0
+	for i, phone := range phonebook.Phones {
+		field := fmt.Sprintf("phones[%d]", i)
+		if phone.Number == "" {
+			errs = append(errs, problem.FieldError{Field: field + ".number", Message: "is required"})
+		} else if msg := validatePhone(phone.Number); msg != "" {
+			errs = append(errs, problem.FieldError{Field: field + ".number", Message: msg})
+		}
+		if utf8.RuneCountInString(phone.Label) > maxContactLabelLength {
+			errs = append(errs, problem.FieldError{Field: field + ".label", Message: fmt.Sprintf("must have at most %d characters", maxContactLabelLength)})
+		}
+		if !validVisibility(phone.Visibility) {
+			errs = append(errs, problem.FieldError{Field: field + ".visibility", Message: visibilityMessage})
+		}
+		if phone.Primary {
+			primaries++
+			if phonebook.Phone != "" && phonebook.Phone != phone.Number {
+				errs = append(errs, problem.FieldError{Field: "phone", Message: "must match the primary number in phones"})
+			}
+		}
+	}
+	if primaries > 1 {
+		errs = append(errs, problem.FieldError{Field: "phones", Message: "must have at most one primary number"})
+	}
+	return errs
+}
+
+func validateEmails(phonebook Phonebook) []problem.FieldError {
+	var errs []problem.FieldError
+	if len(phonebook.Emails) > maxContactsPerKind {
+		errs = append(errs, problem.FieldError{Field: "emails", Message: fmt.Sprintf("must have at most %d entries", maxContactsPerKind)})
+	}
+
+	primaries := 0
+	for i, email := range phonebook.Emails {
+		field := fmt.Sprintf("emails[%d]", i)
+		if email.Address == "" {
+			errs = append(errs, problem.FieldError{Field: field + ".address", Message: "is required"})
+		} else if msg := validateEmail(email.Address); msg != "" {
+			errs = append(errs, problem.FieldError{Field: field + ".address", Message: msg})
+		}
+		if utf8.RuneCountInString(email.Label) > maxContactLabelLength {
+			errs = append(errs, problem.FieldError{Field: field + ".label", Message: fmt.Sprintf("must have at most %d characters", maxContactLabelLength)})
+		}
+		if !validVisibility(email.Visibility) {
+			errs = append(errs, problem.FieldError{Field: field + ".visibility", Message: visibilityMessage})
+		}
+		if email.Primary {
+			primaries++
+			if phonebook.Email != "" && phonebook.Email != email.Address {
+				errs = append(errs, problem.FieldError{Field: "email", Message: "must match the primary address in emails"})
+			}
+		}
+	}
+	if primaries > 1 {
+		errs = append(errs, problem.FieldError{Field: "emails", Message: "must have at most one primary address"})
+	}
+	return errs
+}
+
+func validatePhone(phone string) string {
+	if phone == "" {
+		return ""
+	}
+	if len(phone) > maxPhoneLength {
+		return fmt.Sprintf("must have at most %d characters", maxPhoneLength)
+	}
+	if !phonePattern.MatchString(phone) {
+		return "must contain only digits, spaces, parentheses, dots, dashes and a leading +"
+	}
+	digits := 0
+	for _, c := range phone {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	if digits < minPhoneDigits || digits > maxPhoneDigits {
+		return fmt.Sprintf("must have between %d and %d digits", minPhoneDigits, maxPhoneDigits)
+	}
+	return ""
+}
+
+func validateEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	if len(email) > maxEmailLength {
+		return fmt.Sprintf("must have at most %d characters", maxEmailLength)
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || address.Name != "" {
+		return "must be a valid email address"
+	}
+	return ""
+}
+
+func validateTags(tags []string) []problem.FieldError {
+	var errs []problem.FieldError
+	if len(tags) > maxTagsPerContact {
+		errs = append(errs, problem.FieldError{Field: "tags", Message: fmt.Sprintf("must have at most %d entries", maxTagsPerContact)})
+	}
+	for i, tag := range tags {
+		tag = normalizeTag(tag)
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			errs = append(errs, problem.FieldError{Field: fmt.Sprintf("tags[%d]", i), Message: fmt.Sprintf("must have at most %d characters", maxTagLength)})
+		} else if !tagPattern.MatchString(tag) {
+			errs = append(errs, problem.FieldError{Field: fmt.Sprintf("tags[%d]", i), Message: "must contain only letters, digits, spaces, dashes and underscores"})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,55 @@
+package phonebook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAcceptsAValidPhonebook(t *testing.T) {
+	pb := Phonebook{
+		Name:  "Nayara",
+		Email: "nay.maggion@gmail.com",
+		Phone: "+55 (47) 99662-3579",
+	}
+
+	if errs := validate(pb); len(errs) != 0 {
+		t.Errorf("validate returned errors for a valid phonebook: %v", errs)
+	}
+}
+
+func TestValidateRejectsInvalidFields(t *testing.T) {
+	tests := []struct {
+		name  string
+		pb    Phonebook
+		field string
+	}{
+		{"missing name", Phonebook{Name: "  "}, "name"},
+		{"long name", Phonebook{Name: strings.Repeat("a", maxNameLength+1)}, "name"},
+		{"letters in phone", Phonebook{Name: "Nayara", Phone: "47 9966-ABCD"}, "phone"},
+		{"short phone", Phonebook{Name: "Nayara", Phone: "12"}, "phone"},
+		{"email without domain", Phonebook{Name: "Nayara", Email: "nayara@"}, "email"},
+		{"email with display name", Phonebook{Name: "Nayara", Email: "Nayara <nay@gmail.com>"}, "email"},
+	}
+
+	for _, test := range tests {
+		errs := validate(test.pb)
+		if len(errs) != 1 || errs[0].Field != test.field {
+			t.Errorf("%v: got %v want a single error on %v", test.name, errs, test.field)
+		}
+	}
+}
+
+func TestValidateRejectsTwoPrimaryPhones(t *testing.T) {
+	pb := Phonebook{
+		Name: "Nayara",
+		Phones: []ContactPhone{
+			{Label: "mobile", Number: "47 996623579", Primary: true},
+			{Label: "work", Number: "47 33334444", Primary: true},
+		},
+	}
+
+	errs := validate(pb)
+	if len(errs) != 1 || errs[0].Field != "phones" {
+		t.Errorf("got %v want a single error on phones", errs)
+	}
+}
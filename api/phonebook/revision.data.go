@@ -0,0 +1,274 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/requestid"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// writeRevision appends the next revision of phonebookID inside tx and
+// publishes the change. before and after are the states around the change;
+// either may be nil.
+func writeRevision(ctx context.Context, tx *sql.Tx, action string, phonebookID int, before, after *Phonebook) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	snapshot := after
+	if snapshot == nil {
+		snapshot = before
+	}
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	diff, err := diffPhonebooks(before, after)
+	if err != nil {
+		return err
+	}
+	diffJSON, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO phonebook_revisions
+	(phonebookId,
+	revision,
+	action,
+	snapshot,
+	diff,
+	actor,
+	requestId,
+	tenant_id)
+	SELECT ?, COALESCE(MAX(revision), 0) + 1, ?, ?, ?, ?, ?, ?
+	FROM phonebook_revisions WHERE phonebookId = ? AND tenant_id = ?`,
+		phonebookID,
+		action,
+		snapshotJSON,
+		diffJSON,
+		actorFromContext(ctx),
+		requestid.FromContext(ctx),
+		tenantID,
+		phonebookID,
+		tenantID)
+	if err != nil {
+		return err
+	}
+
+	return publish(ctx, tx, action, phonebookID, before, after)
+}
+
+func listRevisions(ctx context.Context, phonebookID int, db *sql.DB, timeout int) ([]Revision, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	results, err := db.QueryContext(ctx, `SELECT
+	phonebookId,
+	revision,
+	action,
+	snapshot,
+	diff,
+	actor,
+	requestId,
+	createdAt
+	FROM phonebook_revisions
+	WHERE phonebookId = ? AND tenant_id = ?
+	ORDER BY revision`, phonebookID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	revisions := make([]Revision, 0)
+	for results.Next() {
+		revision, err := scanRevision(results)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, *revision)
+	}
+
+	return revisions, results.Err()
+}
+
+func getRevision(ctx context.Context, phonebookID int, revision int, db *sql.DB, timeout int) (*Revision, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	row := db.QueryRowContext(ctx, `SELECT
+	phonebookId,
+	revision,
+	action,
+	snapshot,
+	diff,
+	actor,
+	requestId,
+	createdAt
+	FROM phonebook_revisions
+	WHERE phonebookId = ? AND revision = ? AND tenant_id = ?`, phonebookID, revision, tenantID)
+
+	rev, err := scanRevision(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return rev, err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRevision(row scanner) (*Revision, error) {
+	var revision Revision
+	var snapshot, diff []byte
+	err := row.Scan(
+		&revision.PhonebookID,
+		&revision.Revision,
+		&revision.Action,
+		&snapshot,
+		&diff,
+		&revision.Actor,
+		&revision.RequestID,
+		&revision.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(snapshot, &revision.Snapshot); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(diff, &revision.Diff); err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// revert restores phonebookID to the snapshot stored in the given revision.
+// Trashed phonebooks are restored, and purged ones are recreated with their
+// original ID.
+func revert(ctx context.Context, phonebookID int, revision int, db *sql.DB, timeout int) (*Phonebook, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var snapshot []byte
+	err = tx.QueryRowContext(ctx, `SELECT snapshot FROM phonebook_revisions
+	WHERE phonebookId = ? AND revision = ? AND tenant_id = ?`, phonebookID, revision, tenantID).Scan(&snapshot)
+	if err == sql.ErrNoRows {
+		return nil, errRevisionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var restored Phonebook
+	if err := json.Unmarshal(snapshot, &restored); err != nil {
+		return nil, err
+	}
+	restored.PhonebookID = phonebookID
+	restored.DeletedAt = nil
+	resolveContacts(&restored, nil)
+
+	before, err := getForUpdate(ctx, tx, phonebookID)
+	if err != nil {
+		return nil, err
+	}
+	// Bringing a phonebook back out of the trash, or after it was purged,
+	// counts against the limit like creating it.
+	if before == nil || before.DeletedAt != nil {
+		if err := checkContactLimit(ctx, tx, tenantID); err != nil {
+			return nil, err
+		}
+	}
+
+	// A purged phonebook comes back with the creation of its snapshot, when
+	// it has one.
+	touch(ctx, &restored)
+	if before != nil {
+		restored.CreatedAt, restored.CreatedBy = before.CreatedAt, before.CreatedBy
+	} else if restored.CreatedAt == nil {
+		restored.CreatedAt, restored.CreatedBy = restored.UpdatedAt, restored.UpdatedBy
+	}
+
+	if before == nil {
+		_, err = tx.ExecContext(ctx, `INSERT INTO phonebooks
+		(phonebookId,
+		name,
+		phone,
+		email,
+		visibility,
+		created_at,
+		created_by,
+		updated_at,
+		updated_by,
+		tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			restored.PhonebookID,
+			restored.Name,
+			restored.Phone,
+			restored.Email,
+			normalizeVisibility(restored.Visibility),
+			restored.CreatedAt,
+			restored.CreatedBy,
+			restored.UpdatedAt,
+			restored.UpdatedBy,
+			tenantID)
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE phonebooks SET
+		name=?,
+		phone=?,
+		email=?,
+		visibility=?,
+		deleted_at=NULL,
+		updated_at=?,
+		updated_by=?
+		WHERE phonebookId = ? AND tenant_id = ?`,
+			restored.Name,
+			restored.Phone,
+			restored.Email,
+			normalizeVisibility(restored.Visibility),
+			restored.UpdatedAt,
+			restored.UpdatedBy,
+			restored.PhonebookID,
+			tenantID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveContacts(ctx, tx, restored); err != nil {
+		return nil, err
+	}
+	if err := writeRevision(ctx, tx, actionRevert, phonebookID, before, &restored); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	invalidate(tenantID)
+	return &restored, nil
+}
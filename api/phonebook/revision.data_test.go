@@ -0,0 +1,120 @@
+package phonebook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+func TestDiffPhonebooksReportsChangedFields(t *testing.T) {
+	before := &Phonebook{PhonebookID: 1, Name: "Nayara", Phone: "47996623579", Email: "nay.maggioni@gmail.com"}
+	after := &Phonebook{PhonebookID: 1, Name: "Nayara", Phone: "47996623579", Email: "nayara@gmail.com"}
+
+	diff, err := diffPhonebooks(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diff) != 1 {
+		t.Fatalf("diff has wrong number of fields: got %v want 1", diff)
+	}
+	if change := diff["Email"]; change.From != before.Email || change.To != after.Email {
+		t.Errorf("diff has wrong change for Email: got %v", change)
+	}
+}
+
+func TestDiffPhonebooksLeavesTheMetadataOut(t *testing.T) {
+	created := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	updated := created.Add(time.Hour)
+	before := &Phonebook{PhonebookID: 1, Name: "Nayara", CreatedAt: &created, CreatedBy: "nayara", UpdatedAt: &created, UpdatedBy: "nayara"}
+	after := &Phonebook{PhonebookID: 1, Name: "Nayara M.", CreatedAt: &created, CreatedBy: "nayara", UpdatedAt: &updated, UpdatedBy: "paulo"}
+
+	diff, err := diffPhonebooks(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := diff["Name"]; len(diff) != 1 || !ok {
+		t.Errorf("diff has wrong fields: got %v want only Name", diff)
+	}
+}
+
+func TestShouldRevertADeletedPhonebook(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	ctx := withActor(testContext(), "paulo")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT snapshot FROM phonebook_revisions WHERE phonebookId = \\? AND revision = \\? AND tenant_id = \\?").
+		WithArgs(7, 2, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"snapshot"}).
+			AddRow(`{"PhonebookID":7,"Name":"Nayara","Phone":"47996623579","Email":"nay.maggioni@gmail.com"}`))
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(7, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}))
+	mock.ExpectExec("INSERT INTO phonebooks \\(phonebookId, name, phone, email, visibility, created_at, created_by, updated_at, updated_by, tenant_id\\)").
+		WithArgs(7, "Nayara", "47996623579", "nay.maggioni@gmail.com", visibilityPublic, sqlmock.AnyArg(), "paulo", sqlmock.AnyArg(), "paulo", testTenant).
+		WillReturnResult(sqlmock.NewResult(7, 1))
+	expectSaveContacts(mock)
+	mock.ExpectExec("INSERT INTO phonebook_revisions").
+		WithArgs(7, actionRevert, sqlmock.AnyArg(), sqlmock.AnyArg(), "paulo", "", testTenant, 7, testTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	restored, err := revert(ctx, 7, 2, db, 15)
+	if err != nil {
+		t.Fatalf("error was not expected while reverting: %s", err)
+	}
+	if restored.Name != "Nayara" {
+		t.Errorf("revert restored the wrong phonebook: %v", restored)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShouldNotRevertAPurgedPhonebookOverTheContactLimit(t *testing.T) {
+	tenant.Setup(tenant.New("", "", tenant.Config{ID: testTenant, MaxContacts: 2}))
+	defer tenant.Setup(tenant.Single(tenant.DefaultID))
+
+	db, mock := NewMock()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT snapshot FROM phonebook_revisions WHERE phonebookId = \\? AND revision = \\? AND tenant_id = \\?").
+		WithArgs(7, 2, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"snapshot"}).
+			AddRow(`{"PhonebookID":7,"Name":"Nayara","Phone":"47996623579","Email":"nay.maggioni@gmail.com"}`))
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(7, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM phonebooks WHERE tenant_id = \\? AND deleted_at IS NULL").
+		WithArgs(testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectRollback()
+
+	if _, err := revert(testContext(), 7, 2, db, 15); err != errContactLimitReached {
+		t.Errorf("revert returned wrong error: got %v want %v", err, errContactLimitReached)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShouldNotRevertToAMissingRevision(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT snapshot FROM phonebook_revisions").
+		WithArgs(7, 9, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"snapshot"}))
+	mock.ExpectRollback()
+
+	if _, err := revert(testContext(), 7, 9, db, 15); err != errRevisionNotFound {
+		t.Errorf("revert returned wrong error: got %v want %v", err, errRevisionNotFound)
+	}
+}
@@ -0,0 +1,104 @@
+package phonebook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+)
+
+const (
+	actionCreate  = "create"
+	actionUpdate  = "update"
+	actionDelete  = "delete"
+	actionRevert  = "revert"
+	actionRestore = "restore"
+)
+
+const anonymousActor = "anonymous"
+
+var errRevisionNotFound = errors.New("revision not found")
+
+// Revision is an immutable record of a single change made to a phonebook.
+// Snapshot holds the full phonebook as it was after the change, or right
+// before it for deletes, so any revision can be restored.
+type Revision struct {
+	PhonebookID int                    `json:"phonebookId"`
+	Revision    int                    `json:"revision"`
+	Action      string                 `json:"action"`
+	Snapshot    Phonebook              `json:"snapshot"`
+	Diff        map[string]FieldChange `json:"diff"`
+	Actor       string                 `json:"actor"`
+	RequestID   string                 `json:"requestId,omitempty"`
+	CreatedAt   time.Time              `json:"createdAt"`
+}
+
+// FieldChange holds the value of a field before and after a change.
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+type actorKey struct{}
+
+// withActor returns a copy of ctx recording who is making the change, so the
+// data layer can attribute the revisions it writes.
+func withActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return anonymousActor
+}
+
+// diffPhonebooks compares the JSON representation of two phonebooks field by
+// field, so new fields are picked up without touching this function.
+func diffPhonebooks(before, after *Phonebook) (map[string]FieldChange, error) {
+	beforeFields, err := phonebookFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := phonebookFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := map[string]FieldChange{}
+	for field, value := range afterFields {
+		if !reflect.DeepEqual(beforeFields[field], value) {
+			diff[field] = FieldChange{From: beforeFields[field], To: value}
+		}
+	}
+	for field, value := range beforeFields {
+		if _, ok := afterFields[field]; !ok {
+			diff[field] = FieldChange{From: value, To: nil}
+		}
+	}
+	return diff, nil
+}
+
+// metadataFields change with every revision, which records them itself, so
+// they are left out of its diff.
+var metadataFields = []string{"createdAt", "createdBy", "updatedAt", "updatedBy"}
+
+func phonebookFields(phonebook *Phonebook) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if phonebook == nil {
+		return fields, nil
+	}
+	phonebookJSON, err := json.Marshal(phonebook)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(phonebookJSON, &fields); err != nil {
+		return nil, err
+	}
+	for _, field := range metadataFields {
+		delete(fields, field)
+	}
+	return fields, nil
+}
@@ -0,0 +1,113 @@
+package phonebook
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+)
+
+// actorHeader names the caller making a change, used to attribute revisions.
+const actorHeader = "X-Actor"
+
+// actorFromRequest names the authenticated principal, falling back to the
+// X-Actor header when authentication is disabled.
+func actorFromRequest(r *http.Request) string {
+	if p, ok := auth.FromContext(r.Context()); ok && p.Method != auth.MethodAnonymous {
+		return p.Subject
+	}
+	if actor := strings.TrimSpace(r.Header.Get(actorHeader)); actor != "" {
+		return actor
+	}
+	return anonymousActor
+}
+
+// revisionHandler serves the history of a single phonebook:
+//
+//	GET  /phonebooks/{id}/history
+//	GET  /phonebooks/{id}/history/{rev}
+//	POST /phonebooks/{id}/revert/{rev}
+//
+// History stays available after the phonebook is deleted.
+func revisionHandler(w http.ResponseWriter, r *http.Request, phonebookID int, segments []string) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	switch {
+	case segments[0] == "history" && len(segments) == 1:
+		if r.Method != http.MethodGet {
+			problem.Error(w, r, http.StatusMethodNotAllowed, "")
+			return
+		}
+		revisions, err := listRevisions(r.Context(), phonebookID, db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to list the revisions: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if len(revisions) == 0 {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d has no history.", phonebookID))
+			return
+		}
+		level := clearance(r.Context())
+		for i := range revisions {
+			redactRevision(&revisions[i], level)
+		}
+		problem.WriteJSON(w, r, http.StatusOK, revisions)
+	case segments[0] == "history" && len(segments) == 2:
+		if r.Method != http.MethodGet {
+			problem.Error(w, r, http.StatusMethodNotAllowed, "")
+			return
+		}
+		rev, err := strconv.Atoi(segments[1])
+		if err != nil {
+			problem.Error(w, r, http.StatusNotFound, "")
+			return
+		}
+		revision, err := getRevision(r.Context(), phonebookID, rev, db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to get the revision: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if revision == nil {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d has no revision %d.", phonebookID, rev))
+			return
+		}
+		redactRevision(revision, clearance(r.Context()))
+		problem.WriteJSON(w, r, http.StatusOK, revision)
+	case segments[0] == "revert" && len(segments) == 2:
+		if r.Method != http.MethodPost {
+			problem.Error(w, r, http.StatusMethodNotAllowed, "")
+			return
+		}
+		rev, err := strconv.Atoi(segments[1])
+		if err != nil {
+			problem.Error(w, r, http.StatusNotFound, "")
+			return
+		}
+		restored, err := revert(r.Context(), phonebookID, rev, db, timeout)
+		if err == errRevisionNotFound {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d has no revision %d.", phonebookID, rev))
+			return
+		} else if err == errContactLimitReached {
+			problem.Error(w, r, http.StatusForbidden, "The tenant reached its maximum number of phonebooks.")
+			return
+		} else if writeConflict(w, r, err) {
+			return
+		} else if err != nil {
+			log.Printf("An error accured trying to revert the phonebook: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The phonebook could not be reverted.")
+			return
+		}
+		redact(restored, clearance(r.Context()))
+		problem.WriteJSON(w, r, http.StatusOK, restored)
+	default:
+		problem.Error(w, r, http.StatusNotFound, "")
+	}
+}
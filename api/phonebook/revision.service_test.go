@@ -0,0 +1,66 @@
+package phonebook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetPhonebookHistoryHandler(t *testing.T) {
+	handler := http.HandlerFunc(phonebookHandler)
+
+	rows := sqlmock.NewRows([]string{"phonebookId", "revision", "action", "snapshot", "diff", "actor", "requestId", "createdAt"}).
+		AddRow(1, 1, actionCreate, `{"PhonebookID":1,"Name":"Nayara","Phone":"","Email":""}`, `{}`, "paulo", "abc", time.Now()).
+		AddRow(1, 2, actionDelete, `{"PhonebookID":1,"Name":"Nayara","Phone":"","Email":""}`, `{}`, "paulo", "def", time.Now())
+
+	mock.ExpectQuery("SELECT phonebookId, revision, action, snapshot, diff, actor, requestId, createdAt FROM phonebook_revisions WHERE phonebookId = \\? AND tenant_id = \\?").
+		WithArgs(1, testTenant).WillReturnRows(rows)
+
+	req, err := newRequest("GET", "/phonebooks/1/history", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	var revisions []Revision
+	if err := json.Unmarshal(rr.Body.Bytes(), &revisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[1].Action != actionDelete {
+		t.Errorf("handler returned wrong history: %v", rr.Body.String())
+	}
+}
+
+func TestGetMissingPhonebookRevisionHandler(t *testing.T) {
+	handler := http.HandlerFunc(phonebookHandler)
+
+	mock.ExpectQuery("FROM phonebook_revisions WHERE phonebookId = \\? AND revision = \\? AND tenant_id = \\?").
+		WithArgs(1, 5, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "revision", "action", "snapshot", "diff", "actor", "requestId", "createdAt"}))
+
+	req, err := newRequest("GET", "/phonebooks/1/history/5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
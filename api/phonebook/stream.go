@@ -0,0 +1,112 @@
+package phonebook
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Paulo-Eduardo/phone_book/problem"
+)
+
+// ndjsonContentType is the media type of newline-delimited JSON, one
+// phonebook per line.
+const ndjsonContentType = "application/x-ndjson"
+
+// phonebookWriter writes phonebooks to a response as they are read, in the
+// media type negotiated with the client. Values above the clearance of the
+// caller are masked on the way out.
+type phonebookWriter struct {
+	w         http.ResponseWriter
+	encoding  *encoding
+	version   *wireVersion
+	clearance int
+	written   int
+}
+
+// newPhonebookWriter returns a writer for the response to r, or answers 406
+// and returns nil when the client accepts none of the encodings.
+func newPhonebookWriter(w http.ResponseWriter, r *http.Request) *phonebookWriter {
+	e := negotiate(w, r)
+	if e == nil {
+		return nil
+	}
+	return &phonebookWriter{w: w, encoding: e, version: wireVersionOf(r.Context()), clearance: clearance(r.Context())}
+}
+
+// negotiate returns the encoding of the response to r, or answers 406 and
+// returns nil.
+func negotiate(w http.ResponseWriter, r *http.Request) *encoding {
+	w.Header().Add("Vary", "Accept")
+	e := negotiateEncoding(r.Header.Get("Accept"))
+	if e == nil {
+		types := make([]string, len(encodings))
+		for i, e := range encodings {
+			types[i] = e.contentType
+		}
+		problem.Error(w, r, http.StatusNotAcceptable, "Phonebooks can be read as "+strings.Join(types, ", ")+".")
+	}
+	return e
+}
+
+// write encodes one phonebook. The response is flushed after the first one,
+// so the client gets its first byte without waiting for the whole list.
+func (pw *phonebookWriter) write(phonebook *Phonebook) error {
+	redact(phonebook, pw.clearance)
+	if pw.written == 0 {
+		if err := pw.begin(); err != nil {
+			return err
+		}
+	}
+	if err := pw.encoding.item(pw.w, pw.version, phonebook, pw.written); err != nil {
+		return err
+	}
+
+	pw.written++
+	if pw.written == 1 {
+		if f, ok := pw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return nil
+}
+
+// close ends the list, which is empty when nothing was written.
+func (pw *phonebookWriter) close() error {
+	if pw.written == 0 {
+		if err := pw.begin(); err != nil {
+			return err
+		}
+	}
+	return pw.encoding.end(pw.w)
+}
+
+// started reports whether part of the response was sent already, after which
+// an error can no longer be reported with a problem.
+func (pw *phonebookWriter) started() bool {
+	return pw.written > 0
+}
+
+func (pw *phonebookWriter) begin() error {
+	pw.w.Header().Set("Content-Type", pw.encoding.contentType)
+	return pw.encoding.begin(pw.w)
+}
+
+// writePhonebook answers with a single phonebook, masked for the caller, in
+// the media type negotiated with the client.
+func writePhonebook(w http.ResponseWriter, r *http.Request, phonebook *Phonebook) {
+	e := negotiate(w, r)
+	if e == nil {
+		return
+	}
+	redact(phonebook, clearance(r.Context()))
+
+	var body bytes.Buffer
+	if err := e.one(&body, wireVersionOf(r.Context()), phonebook); err != nil {
+		log.Printf("An error accured trying to parse the phonebook: %v", err)
+		problem.Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", e.contentType)
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,116 @@
+package phonebook
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func expectTwoPhonebooks() {
+	mock.ExpectQuery("SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, "").
+			AddRow("2", "Paulo Eduardo", "47996623579", "pauloes.dev@gmail.com", "public", nil, "", nil, ""))
+	expectLoadContacts(mock)
+}
+
+func TestGetPhonebooksHandlerStreamsNDJSON(t *testing.T) {
+	expectTwoPhonebooks()
+
+	req, err := newRequest("GET", "/phonebooks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", ndjsonContentType)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(phonebooksHandler).ServeHTTP(rr, req)
+
+	want := `{"PhonebookID":1,"Name":"Nayara","Phone":"nay.maggioni@gmail.com","Email":"47996623579","visibility":"public"}
+{"PhonebookID":2,"Name":"Paulo Eduardo","Phone":"pauloes.dev@gmail.com","Email":"47996623579","visibility":"public"}
+`
+	if rr.Code != http.StatusOK || rr.Body.String() != want {
+		t.Errorf("handler returned %v %q want %q", rr.Code, rr.Body.String(), want)
+	}
+	if got := rr.Header().Get("Content-Type"); got != ndjsonContentType {
+		t.Errorf("handler returned Content-Type %q want %q", got, ndjsonContentType)
+	}
+	if !rr.Flushed {
+		t.Error("handler didn't flush the first phonebook")
+	}
+}
+
+func TestGetPhonebooksHandlerReportsScanErrors(t *testing.T) {
+	mock.ExpectQuery("SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("not a number", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, ""))
+
+	req, err := newRequest("GET", "/phonebooks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(phonebooksHandler).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("handler returned %v want %v: %s", rr.Code, http.StatusInternalServerError, rr.Body.String())
+	}
+}
+
+func TestGetPhonebooksHandlerReportsCursorErrors(t *testing.T) {
+	mock.ExpectQuery("SELECT phonebookId, name, email, phone, visibility, created_at, created_by, updated_at, updated_by FROM phonebooks").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, "", nil, "").
+			AddRow("2", "Paulo Eduardo", "47996623579", "pauloes.dev@gmail.com", "public", nil, "", nil, "").
+			RowError(1, errors.New("connection reset by peer")))
+
+	req, err := newRequest("GET", "/phonebooks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(phonebooksHandler).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("handler returned %v want %v: %s", rr.Code, http.StatusInternalServerError, rr.Body.String())
+	}
+}
+
+func TestWritePhonebooksAbortsAStartedResponse(t *testing.T) {
+	req, err := newRequest("GET", "/phonebooks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	defer func() {
+		if got := recover(); got != http.ErrAbortHandler {
+			t.Errorf("got panic %v want %v", got, http.ErrAbortHandler)
+		}
+	}()
+	writePhonebooks(rr, req, newPhonebookWriter(rr, req), func(emit func(*Phonebook) error) error {
+		emit(&Phonebook{PhonebookID: 1, Name: "Nayara"})
+		return errors.New("connection reset by peer")
+	})
+	t.Error("handler completed a truncated list")
+}
+
+func TestExportHandler(t *testing.T) {
+	expectTwoPhonebooks()
+
+	req, err := newRequest("GET", "/phonebooks/export", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(phonebookHandler).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Disposition") != `attachment; filename="phonebooks.json"` {
+		t.Errorf("handler returned %v with Content-Disposition %q", rr.Code, rr.Header().Get("Content-Disposition"))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,97 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// listChanges returns the phonebooks changed by up to limit revisions after
+// the revision since, each with its latest state in the order of their last
+// change, along with the last of those revisions and whether there are more.
+// Revisions younger than the timeout are left for later: a write still
+// running may yet commit one with a lower ID, which a client past it would
+// never get.
+func listChanges(ctx context.Context, since int64, limit int, db *sql.DB, timeout int) ([]Change, int64, bool, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	results, err := db.QueryContext(ctx, `SELECT
+	revisionId,
+	phonebookId,
+	action,
+	snapshot,
+	createdAt
+	FROM phonebook_revisions
+	WHERE tenant_id = ? AND revisionId > ? AND createdAt <= NOW(6) - INTERVAL ? SECOND
+	ORDER BY revisionId
+	LIMIT ?`, tenantID, since, timeout, limit+1)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer results.Close()
+
+	last := since
+	more := false
+	rows := 0
+	latest := map[int]int64{}
+	changed := map[int]Change{}
+	created := map[int]bool{}
+	for results.Next() {
+		if rows == limit {
+			more = true
+			break
+		}
+		rows++
+
+		var revisionID int64
+		var action string
+		var snapshot []byte
+		var change Change
+		if err := results.Scan(&revisionID, &change.PhonebookID, &action, &snapshot, &change.ChangedAt); err != nil {
+			return nil, 0, false, err
+		}
+		last = revisionID
+		latest[change.PhonebookID] = revisionID
+		if action == actionCreate {
+			created[change.PhonebookID] = true
+		}
+
+		if action == actionDelete {
+			change.Type = changeDeleted
+		} else {
+			var phonebook Phonebook
+			if err := json.Unmarshal(snapshot, &phonebook); err != nil {
+				return nil, 0, false, err
+			}
+			phonebook.DeletedAt = nil
+			change.Phonebook = &phonebook
+			change.Type = changeUpdated
+			if created[change.PhonebookID] {
+				change.Type = changeCreated
+			}
+		}
+		changed[change.PhonebookID] = change
+	}
+	if err := results.Err(); err != nil {
+		return nil, 0, false, err
+	}
+
+	changes := make([]Change, 0, len(changed))
+	for _, change := range changed {
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return latest[changes[i].PhonebookID] < latest[changes[j].PhonebookID]
+	})
+	return changes, last, more, nil
+}
@@ -0,0 +1,96 @@
+package phonebook
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSyncTokenTTL is how long a sync token can be used by default.
+const DefaultSyncTokenTTL = 30 * 24 * time.Hour
+
+// Types of the changes returned to syncing clients.
+const (
+	changeCreated = "created"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+)
+
+// Pages of changes hold defaultChangeLimit revisions unless the client asks
+// for up to maxChangeLimit.
+const (
+	defaultChangeLimit = 500
+	maxChangeLimit     = 1000
+)
+
+var (
+	errInvalidSyncToken = errors.New("invalid sync token")
+	errSyncTokenExpired = errors.New("sync token expired")
+)
+
+var syncTokenTTL = DefaultSyncTokenTTL
+
+// SetupSync sets how long the sync tokens handed to clients can be used.
+func SetupSync(ttl time.Duration) {
+	syncTokenTTL = ttl
+}
+
+// Change is a phonebook created, updated or deleted since a sync token.
+// Created and updated changes carry the phonebook as of the new token;
+// deleted ones are tombstones.
+type Change struct {
+	PhonebookID int        `json:"phonebookId"`
+	Type        string     `json:"type"`
+	Phonebook   *Phonebook `json:"phonebook,omitempty"`
+	ChangedAt   time.Time  `json:"changedAt"`
+}
+
+// ChangeSet is a page of changes, with the token to ask for the next ones.
+// More is set when the next page is ready to be read right away.
+type ChangeSet struct {
+	Changes []Change `json:"changes"`
+	Token   string   `json:"token"`
+	More    bool     `json:"more"`
+}
+
+// syncToken marks the last revision of the tenant a client got.
+type syncToken struct {
+	tenant     string
+	revisionID int64
+	issuedAt   time.Time
+}
+
+func (t syncToken) String() string {
+	raw := fmt.Sprintf("v1.%d.%d.%s", t.revisionID, t.issuedAt.Unix(), t.tenant)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// parseSyncToken reads a token handed to a client of tenantID, refusing
+// tokens of other tenants and the ones older than the TTL.
+func parseSyncToken(s string, tenantID string, now time.Time) (syncToken, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return syncToken{}, errInvalidSyncToken
+	}
+	parts := strings.SplitN(string(raw), ".", 4)
+	if len(parts) != 4 || parts[0] != "v1" || parts[3] != tenantID {
+		return syncToken{}, errInvalidSyncToken
+	}
+	revisionID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || revisionID < 0 {
+		return syncToken{}, errInvalidSyncToken
+	}
+	issuedAt, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return syncToken{}, errInvalidSyncToken
+	}
+
+	t := syncToken{tenant: tenantID, revisionID: revisionID, issuedAt: time.Unix(issuedAt, 0)}
+	if now.Sub(t.issuedAt) > syncTokenTTL {
+		return syncToken{}, errSyncTokenExpired
+	}
+	return t, nil
+}
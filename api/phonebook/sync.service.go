@@ -0,0 +1,75 @@
+package phonebook
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// changesHandler serves GET /phonebooks/changes?since=<token>&limit=<n>.
+// Without since it returns every phonebook, as the first sync of a client.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodOptions:
+		return
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	tenantID, err := tenant.Require(r.Context())
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	now := time.Now()
+	query := r.URL.Query()
+
+	var since int64
+	var errs []problem.FieldError
+	if value := query.Get("since"); value != "" {
+		token, err := parseSyncToken(value, tenantID, now)
+		if err == errSyncTokenExpired {
+			problem.Write(w, r, problem.ResyncRequired("The sync token expired. Read every phonebook again by asking for the changes without since."))
+			return
+		} else if err != nil {
+			errs = append(errs, problem.FieldError{Field: "since", Message: "must be a token returned by this endpoint"})
+		}
+		since = token.revisionID
+	}
+	limit := defaultChangeLimit
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxChangeLimit {
+			errs = append(errs, problem.FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(maxChangeLimit)})
+		}
+	}
+	if len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs))
+		return
+	}
+
+	changes, last, more, err := listChanges(r.Context(), since, limit, db, timeout)
+	if err != nil {
+		log.Printf("An error accured trying to list the changes: %v", err)
+		problem.Error(w, r, http.StatusInternalServerError, "The changes could not be listed.")
+		return
+	}
+	level := clearance(r.Context())
+	for _, change := range changes {
+		if change.Phonebook != nil {
+			redact(change.Phonebook, level)
+		}
+	}
+
+	problem.WriteJSON(w, r, http.StatusOK, ChangeSet{
+		Changes: changes,
+		Token:   syncToken{tenant: tenantID, revisionID: last, issuedAt: now}.String(),
+		More:    more,
+	})
+}
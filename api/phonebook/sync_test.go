@@ -0,0 +1,127 @@
+package phonebook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSyncTokenRoundTrip(t *testing.T) {
+	now := time.Now()
+	token := syncToken{tenant: testTenant, revisionID: 42, issuedAt: now}.String()
+
+	got, err := parseSyncToken(token, testTenant, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.revisionID != 42 {
+		t.Errorf("parseSyncToken returned revision %d, want 42", got.revisionID)
+	}
+
+	if _, err := parseSyncToken(token, "globex", now); err != errInvalidSyncToken {
+		t.Errorf("a token of another tenant returned %v, want %v", err, errInvalidSyncToken)
+	}
+	if _, err := parseSyncToken("not a token", testTenant, now); err != errInvalidSyncToken {
+		t.Errorf("a malformed token returned %v, want %v", err, errInvalidSyncToken)
+	}
+	if _, err := parseSyncToken(token, testTenant, now.Add(syncTokenTTL+time.Second)); err != errSyncTokenExpired {
+		t.Errorf("an old token returned %v, want %v", err, errSyncTokenExpired)
+	}
+}
+
+func TestListChangesKeepsTheLatestChangeOfEachPhonebook(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	changedAt := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	rows := sqlmock.NewRows([]string{"revisionId", "phonebookId", "action", "snapshot", "createdAt"}).
+		AddRow(11, 1, actionCreate, `{"PhonebookID":1,"Name":"Nayara"}`, changedAt).
+		AddRow(12, 2, actionUpdate, `{"PhonebookID":2,"Name":"Paulo"}`, changedAt).
+		AddRow(13, 1, actionUpdate, `{"PhonebookID":1,"Name":"Nayara Maggioni"}`, changedAt).
+		AddRow(14, 3, actionDelete, `{"PhonebookID":3,"Name":"Old"}`, changedAt).
+		AddRow(15, 2, actionUpdate, `{"PhonebookID":2,"Name":"Paulo Eduardo"}`, changedAt)
+	mock.ExpectQuery("SELECT revisionId, phonebookId, action, snapshot, createdAt FROM phonebook_revisions WHERE tenant_id = \\? AND revisionId > \\? AND createdAt <= NOW\\(6\\) - INTERVAL \\? SECOND ORDER BY revisionId LIMIT \\?").
+		WithArgs(testTenant, 10, 15, 5).
+		WillReturnRows(rows)
+
+	changes, last, more, err := listChanges(testContext(), 10, 4, db, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != 14 || !more {
+		t.Errorf("listChanges returned last %d and more %v, want 14 and true", last, more)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("listChanges returned %d changes, want 3", len(changes))
+	}
+
+	if c := changes[0]; c.PhonebookID != 2 || c.Type != changeUpdated || c.Phonebook.Name != "Paulo" {
+		t.Errorf("first change is %+v, want phonebook 2 updated as Paulo", c)
+	}
+	if c := changes[1]; c.PhonebookID != 1 || c.Type != changeCreated || c.Phonebook.Name != "Nayara Maggioni" {
+		t.Errorf("second change is %+v, want phonebook 1 created as Nayara Maggioni", c)
+	}
+	if c := changes[2]; c.PhonebookID != 3 || c.Type != changeDeleted || c.Phonebook != nil {
+		t.Errorf("third change is %+v, want a tombstone of phonebook 3", c)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetChangesHandlerWithAnExpiredToken(t *testing.T) {
+	handler := http.HandlerFunc(phonebookHandler)
+
+	token := syncToken{tenant: testTenant, revisionID: 42, issuedAt: time.Now().Add(-syncTokenTTL - time.Hour)}
+	req, err := newRequest("GET", "/phonebooks/changes?since="+token.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusGone {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusGone)
+	}
+	if !strings.Contains(rr.Body.String(), "/problems/full-resync-required") {
+		t.Errorf("handler returned wrong body: %v", rr.Body.String())
+	}
+}
+
+func TestGetChangesHandler(t *testing.T) {
+	handler := http.HandlerFunc(phonebookHandler)
+
+	rows := sqlmock.NewRows([]string{"revisionId", "phonebookId", "action", "snapshot", "createdAt"}).
+		AddRow(7, 1, actionDelete, `{"PhonebookID":1,"Name":"Nayara"}`, time.Now())
+	mock.ExpectQuery("SELECT revisionId, phonebookId, action, snapshot, createdAt FROM phonebook_revisions").
+		WithArgs(testTenant, 0, 15, defaultChangeLimit+1).
+		WillReturnRows(rows)
+
+	req, err := newRequest("GET", "/phonebooks/changes", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	if !strings.Contains(rr.Body.String(), `"type":"deleted"`) || !strings.Contains(rr.Body.String(), `"more":false`) {
+		t.Errorf("handler returned wrong body: %v", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,66 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// changeTags adds and removes tags of a phonebook, recording the change as a
+// new revision, and returns the resulting tags.
+func changeTags(ctx context.Context, phonebookID int, add []string, remove []string, db *sql.DB, timeout int) ([]string, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	before, err := getForUpdate(ctx, tx, phonebookID)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil || before.DeletedAt != nil {
+		return nil, errPhonebookNotFound
+	}
+
+	removed := make(map[string]bool, len(remove))
+	for _, tag := range normalizeTags(remove) {
+		removed[tag] = true
+	}
+	tags := make([]string, 0, len(before.Tags)+len(add))
+	for _, tag := range append(append([]string{}, before.Tags...), add...) {
+		if !removed[normalizeTag(tag)] {
+			tags = append(tags, tag)
+		}
+	}
+
+	after := *before
+	after.Tags = normalizeTags(tags)
+	touch(ctx, &after)
+	if err := saveTags(ctx, tx, after); err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE phonebooks SET updated_at = ?, updated_by = ? WHERE phonebookId = ? AND tenant_id = ?`, after.UpdatedAt, after.UpdatedBy, phonebookID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeRevision(ctx, tx, actionUpdate, phonebookID, before, &after); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	invalidate(tenantID)
+	return after.Tags, nil
+}
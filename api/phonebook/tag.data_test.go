@@ -0,0 +1,48 @@
+package phonebook
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestShouldAddAndRemoveTags(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(1, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, nil, "", nil, ""))
+	mock.ExpectQuery("FROM phonebook_phones").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "number", "is_primary", "visibility"}))
+	mock.ExpectQuery("FROM phonebook_emails").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "label", "address", "is_primary", "visibility"}))
+	mock.ExpectQuery("FROM phonebook_tags").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "tag"}).
+			AddRow(1, "family").
+			AddRow(1, "vip"))
+	mock.ExpectExec("DELETE FROM phonebook_tags WHERE phonebookId = \\? AND tenant_id = \\?").
+		WithArgs(1, testTenant).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO phonebook_tags \\(phonebookId, tenant_id, tag\\) VALUES \\(\\?, \\?, \\?\\), \\(\\?, \\?, \\?\\)").
+		WithArgs(1, testTenant, "family", 1, testTenant, "sales").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("UPDATE phonebooks SET updated_at = \\?, updated_by = \\? WHERE phonebookId = \\? AND tenant_id = \\?").
+		WithArgs(sqlmock.AnyArg(), anonymousActor, 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO phonebook_revisions").
+		WithArgs(1, actionUpdate, sqlmock.AnyArg(), sqlmock.AnyArg(), anonymousActor, "", testTenant, 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	tags, err := changeTags(testContext(), 1, []string{" Sales ", "family"}, []string{"VIP"}, db, 15)
+	if err != nil {
+		t.Fatalf("error was not expected while tagging: %s", err)
+	}
+	if want := []string{"family", "sales"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("changeTags returned wrong tags: got %v want %v", tags, want)
+	}
+}
@@ -0,0 +1,43 @@
+package phonebook
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	maxTagLength      = 32
+	maxTagsPerContact = 50
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9 _\-]*$`)
+
+// Tags is the body used to add tags to a phonebook and the response listing
+// the tags of a phonebook.
+type Tags struct {
+	Tags []string `json:"tags"`
+}
+
+// normalizeTag makes tags case insensitive and free of surrounding spaces.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// normalizeTags normalizes every tag and drops the empty and duplicated ones,
+// keeping the order they were sent in.
+func normalizeTags(tags []string) []string {
+	if tags == nil {
+		return nil
+	}
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
@@ -0,0 +1,83 @@
+package phonebook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/Paulo-Eduardo/phone_book/problem"
+)
+
+// tagHandler serves the tags of a single phonebook:
+//
+//	GET, POST /phonebooks/{id}/tags
+//	DELETE    /phonebooks/{id}/tags/{tag}
+func tagHandler(w http.ResponseWriter, r *http.Request, phonebookID int, segments []string) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		phonebook, err := get(r.Context(), phonebookID, db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to get the item from id: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if phonebook == nil {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d does not exist.", phonebookID))
+			return
+		}
+		writeTags(w, r, phonebook.Tags)
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		var tags Tags
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			problem.Write(w, r, problem.Malformed("The request body could not be read."))
+			return
+		}
+		if err := json.Unmarshal(bodyBytes, &tags); err != nil {
+			problem.Write(w, r, problem.Malformed("The request body is not a valid list of tags."))
+			return
+		}
+		if errs := validateTags(tags.Tags); len(errs) > 0 {
+			problem.Write(w, r, problem.Validation(errs))
+			return
+		}
+		updated, err := changeTags(r.Context(), phonebookID, tags.Tags, nil, db, timeout)
+		if err == errPhonebookNotFound {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d does not exist.", phonebookID))
+			return
+		} else if err != nil {
+			log.Printf("An error accured trying to tag phonebook: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The tags could not be added.")
+			return
+		}
+		writeTags(w, r, updated)
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		updated, err := changeTags(r.Context(), phonebookID, nil, []string{segments[0]}, db, timeout)
+		if err == errPhonebookNotFound {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d does not exist.", phonebookID))
+			return
+		} else if err != nil {
+			log.Printf("An error accured trying to untag phonebook: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The tag could not be removed.")
+			return
+		}
+		writeTags(w, r, updated)
+	case len(segments) <= 1:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+	default:
+		problem.Error(w, r, http.StatusNotFound, "")
+	}
+}
+
+func writeTags(w http.ResponseWriter, r *http.Request, tags []string) {
+	if tags == nil {
+		tags = []string{}
+	}
+	problem.WriteJSON(w, r, http.StatusOK, Tags{Tags: tags})
+}
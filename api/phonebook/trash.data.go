@@ -0,0 +1,145 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+func listTrash(ctx context.Context, db *sql.DB, timeout int) ([]Phonebook, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	results, err := db.QueryContext(ctx, `SELECT
+	phonebookId,
+	name,
+	email,
+	phone,
+	visibility,
+	deleted_at,
+	created_at,
+	created_by,
+	updated_at,
+	updated_by
+	FROM phonebooks
+	WHERE tenant_id = ? AND deleted_at IS NOT NULL
+	ORDER BY deleted_at DESC`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	phonebooks := make([]Phonebook, 0)
+	for results.Next() {
+		var phonebook Phonebook
+		err := results.Scan(
+			&phonebook.PhonebookID,
+			&phonebook.Name,
+			&phonebook.Email,
+			&phonebook.Phone,
+			&phonebook.Visibility,
+			&phonebook.DeletedAt,
+			&phonebook.CreatedAt,
+			&phonebook.CreatedBy,
+			&phonebook.UpdatedAt,
+			&phonebook.UpdatedBy)
+		if err != nil {
+			return nil, err
+		}
+
+		phonebooks = append(phonebooks, phonebook)
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+	results.Close()
+
+	if err := loadContacts(ctx, db, phonebooks); err != nil {
+		return nil, err
+	}
+	return phonebooks, nil
+}
+
+// restore takes a phonebook out of the trash.
+func restore(ctx context.Context, phonebookID int, db *sql.DB, timeout int) (*Phonebook, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	before, err := getForUpdate(ctx, tx, phonebookID)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil || before.DeletedAt == nil {
+		return nil, errPhonebookNotFound
+	}
+	if err := checkContactLimit(ctx, tx, tenantID); err != nil {
+		return nil, err
+	}
+
+	restored := *before
+	restored.DeletedAt = nil
+	touch(ctx, &restored)
+	_, err = tx.ExecContext(ctx, `UPDATE phonebooks SET
+	deleted_at=NULL,
+	updated_at=?,
+	updated_by=?
+	WHERE phonebookId = ? AND tenant_id = ?`,
+		restored.UpdatedAt,
+		restored.UpdatedBy,
+		phonebookID,
+		tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := claimUnique(ctx, tx, restored); err != nil {
+		return nil, err
+	}
+	if err := writeRevision(ctx, tx, actionRestore, phonebookID, before, &restored); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	invalidate(tenantID)
+	return &restored, nil
+}
+
+// purgeTrash permanently deletes the phonebooks of the tenant trashed before
+// cutoff. Their revisions are kept, so they can still be brought back with
+// revert.
+func purgeTrash(ctx context.Context, cutoff time.Time, db *sql.DB, timeout int) (int64, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM phonebooks
+	WHERE tenant_id = ? AND deleted_at IS NOT NULL AND deleted_at < ?`, tenantID, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
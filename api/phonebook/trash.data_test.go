@@ -0,0 +1,150 @@
+package phonebook
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+func TestShouldPurgeOldTrash(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	cutoff := time.Now().UTC().Add(-time.Hour)
+
+	mock.ExpectExec("DELETE FROM phonebooks WHERE tenant_id = \\? AND deleted_at IS NOT NULL AND deleted_at < \\?").
+		WithArgs(testTenant, cutoff).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	purged, err := purgeTrash(testContext(), cutoff, db, 15)
+	if err != nil {
+		t.Fatalf("error was not expected while purging: %s", err)
+	}
+	if purged != 3 {
+		t.Errorf("purgeTrash returned wrong count: got %v want 3", purged)
+	}
+}
+
+func TestShouldRestoreATrashedPhonebook(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(1, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", time.Now(), nil, "", nil, ""))
+	expectLoadContacts(mock)
+	mock.ExpectExec("UPDATE phonebooks SET deleted_at=NULL, updated_at=\\?, updated_by=\\? WHERE phonebookId = \\? AND tenant_id = \\?").
+		WithArgs(sqlmock.AnyArg(), anonymousActor, 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO phonebook_revisions").
+		WithArgs(1, actionRestore, sqlmock.AnyArg(), sqlmock.AnyArg(), anonymousActor, "", testTenant, 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	restored, err := restore(testContext(), 1, db, 15)
+	if err != nil {
+		t.Fatalf("error was not expected while restoring: %s", err)
+	}
+	if restored.DeletedAt != nil {
+		t.Errorf("restored phonebook is still deleted: %v", restored.DeletedAt)
+	}
+	if restored.UpdatedAt == nil || restored.UpdatedBy != anonymousActor {
+		t.Errorf("restored phonebook wasn't stamped: %v by %q", restored.UpdatedAt, restored.UpdatedBy)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// sameTime matches a time, and then only that time again.
+type sameTime struct {
+	at *time.Time
+}
+
+func (m *sameTime) Match(v driver.Value) bool {
+	at, ok := v.(time.Time)
+	if !ok {
+		return false
+	}
+	if m.at == nil {
+		m.at = &at
+	}
+	return at.Equal(*m.at)
+}
+
+func TestShouldStampATrashedPhonebook(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(1, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, nil, "", nil, ""))
+	expectLoadContacts(mock)
+	// The phonebook is trashed and updated at the same time.
+	deletedAt := &sameTime{}
+	mock.ExpectExec("UPDATE phonebooks SET deleted_at=\\?, updated_at=\\?, updated_by=\\? WHERE phonebookId = \\? AND tenant_id = \\?").
+		WithArgs(deletedAt, deletedAt, anonymousActor, 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO phonebook_revisions").
+		WithArgs(1, actionDelete, sqlmock.AnyArg(), sqlmock.AnyArg(), anonymousActor, "", testTenant, 1, testTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := remove(testContext(), 1, db, 15); err != nil {
+		t.Fatalf("error was not expected while trashing: %s", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestShouldNotRestoreAPhonebookOutOfTheTrash(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(1, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", nil, nil, "", nil, ""))
+	expectLoadContacts(mock)
+	mock.ExpectRollback()
+
+	if _, err := restore(testContext(), 1, db, 15); err != errPhonebookNotFound {
+		t.Errorf("restore returned wrong error: got %v want %v", err, errPhonebookNotFound)
+	}
+}
+
+func TestShouldNotRestoreOverTheContactLimit(t *testing.T) {
+	tenant.Setup(tenant.New("", "", tenant.Config{ID: testTenant, MaxContacts: 2}))
+	defer tenant.Setup(tenant.Single(tenant.DefaultID))
+
+	db, mock := NewMock()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT phonebookId, name, phone, email, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE phonebookId = \\? AND tenant_id = \\? FOR UPDATE").
+		WithArgs(1, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "phone", "email", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+			AddRow("1", "Nayara", "47996623579", "nay.maggioni@gmail.com", "public", time.Now(), nil, "", nil, ""))
+	expectLoadContacts(mock)
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM phonebooks WHERE tenant_id = \\? AND deleted_at IS NULL").
+		WithArgs(testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectRollback()
+
+	if _, err := restore(testContext(), 1, db, 15); err != errContactLimitReached {
+		t.Errorf("restore returned wrong error: got %v want %v", err, errContactLimitReached)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,86 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// trashHandler serves GET /phonebooks/trash.
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		phonebooks, err := listTrash(r.Context(), db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to list the trash: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The trash could not be listed.")
+			return
+		}
+		level := clearance(r.Context())
+		for i := range phonebooks {
+			redact(&phonebooks[i], level)
+		}
+		problem.WriteJSON(w, r, http.StatusOK, wireVersionOf(r.Context()).encodeAll(phonebooks))
+	case http.MethodOptions:
+		return
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// restoreHandler serves POST /phonebooks/{id}/restore.
+func restoreHandler(w http.ResponseWriter, r *http.Request, phonebookID int) {
+	switch r.Method {
+	case http.MethodPost:
+		restored, err := restore(r.Context(), phonebookID, db, timeout)
+		if err == errPhonebookNotFound {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Phonebook %d is not in the trash.", phonebookID))
+			return
+		} else if err == errContactLimitReached {
+			problem.Error(w, r, http.StatusForbidden, "The tenant reached its maximum number of phonebooks.")
+			return
+		} else if writeConflict(w, r, err) {
+			return
+		} else if err != nil {
+			log.Printf("An error accured trying to restore phonebook: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The phonebook could not be restored.")
+			return
+		}
+		redact(restored, clearance(r.Context()))
+		problem.WriteJSON(w, r, http.StatusOK, wireVersionOf(r.Context()).encode(restored))
+	case http.MethodOptions:
+		return
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// StartTrashPurger permanently deletes, every interval, the phonebooks that
+// have been in the trash for longer than the retention of their tenant, or
+// retention when the tenant doesn't configure one.
+func StartTrashPurger(dbConn *sql.DB, to int, retention time.Duration, interval time.Duration) {
+	go func() {
+		for {
+			for _, config := range tenant.All() {
+				keep := retention
+				if config.TrashRetention > 0 {
+					keep = time.Duration(config.TrashRetention)
+				}
+				ctx := tenant.NewContext(context.Background(), config.ID)
+				purged, err := purgeTrash(ctx, time.Now().UTC().Add(-keep), dbConn, to)
+				if err != nil {
+					log.Printf("An error accured trying to purge the trash of tenant %s: %v", config.ID, err)
+				} else if purged > 0 {
+					log.Printf("Purged %d phonebooks from the trash of tenant %s", purged, config.ID)
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,40 @@
+package phonebook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetTrashHandler(t *testing.T) {
+	handler := http.HandlerFunc(phonebookHandler)
+
+	rows := sqlmock.NewRows([]string{"id", "name", "email", "phone", "visibility", "deleted_at", "created_at", "created_by", "updated_at", "updated_by"}).
+		AddRow("1", "Nayara", "nay.maggioni@gmail.com", "47996623579", "public", time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC), nil, "", nil, "")
+
+	mock.ExpectQuery("SELECT phonebookId, name, email, phone, visibility, deleted_at, created_at, created_by, updated_at, updated_by FROM phonebooks WHERE tenant_id = \\? AND deleted_at IS NOT NULL").
+		WillReturnRows(rows)
+	expectLoadContacts(mock)
+
+	req, err := newRequest("GET", "/phonebooks/trash", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if !strings.Contains(rr.Body.String(), `"deletedAt":"2021-05-01T10:00:00Z"`) {
+		t.Errorf("handler returned wrong body: %v", rr.Body.String())
+	}
+}
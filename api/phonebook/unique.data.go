@@ -0,0 +1,121 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// sharedValue is a number or address held by several phonebooks, which
+// keeps a uniqueness rule from being enforced.
+type sharedValue struct {
+	Field        string
+	Value        string
+	PhonebookIDs []int
+}
+
+// enforceUnique fills the unique columns of the numbers and addresses of the
+// phonebooks of the tenant stored before its rules were enabled. When
+// phonebooks share values it returns them instead and changes nothing, so
+// they can be merged or fixed first.
+func enforceUnique(ctx context.Context, db *sql.DB, timeout int) ([]sharedValue, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+	phone, email := uniqueRules(tenantID)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var shared []sharedValue
+	if phone {
+		values, err := querySharedValues(ctx, tx, uniquePhone, `SELECT c.number_digits, GROUP_CONCAT(DISTINCT c.phonebookId ORDER BY c.phonebookId)
+		FROM phonebook_phones c JOIN phonebooks p ON p.phonebookId = c.phonebookId
+		WHERE c.tenant_id = ? AND p.deleted_at IS NULL
+		GROUP BY c.number_digits
+		HAVING COUNT(DISTINCT c.phonebookId) > 1`, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		shared = append(shared, values...)
+	}
+	if email {
+		values, err := querySharedValues(ctx, tx, uniqueEmail, `SELECT LOWER(c.address), GROUP_CONCAT(DISTINCT c.phonebookId ORDER BY c.phonebookId)
+		FROM phonebook_emails c JOIN phonebooks p ON p.phonebookId = c.phonebookId
+		WHERE c.tenant_id = ? AND p.deleted_at IS NULL
+		GROUP BY LOWER(c.address)
+		HAVING COUNT(DISTINCT c.phonebookId) > 1`, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		shared = append(shared, values...)
+	}
+	if len(shared) > 0 {
+		return shared, nil
+	}
+
+	// Repeated values of a phonebook only fill the column once, as in
+	// saveContacts.
+	if phone {
+		_, err = tx.ExecContext(ctx, `UPDATE phonebook_phones c
+		JOIN phonebooks p ON p.phonebookId = c.phonebookId
+		JOIN (SELECT phonebookId, number_digits, MIN(position) AS position FROM phonebook_phones
+		WHERE tenant_id = ? GROUP BY phonebookId, number_digits) f
+		ON f.phonebookId = c.phonebookId AND f.position = c.position
+		SET c.unique_digits = c.number_digits
+		WHERE c.tenant_id = ? AND p.deleted_at IS NULL`, tenantID, tenantID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if email {
+		_, err = tx.ExecContext(ctx, `UPDATE phonebook_emails c
+		JOIN phonebooks p ON p.phonebookId = c.phonebookId
+		JOIN (SELECT phonebookId, LOWER(address) AS address, MIN(position) AS position FROM phonebook_emails
+		WHERE tenant_id = ? GROUP BY phonebookId, LOWER(address)) f
+		ON f.phonebookId = c.phonebookId AND f.position = c.position
+		SET c.unique_address = LOWER(c.address)
+		WHERE c.tenant_id = ? AND p.deleted_at IS NULL`, tenantID, tenantID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, tx.Commit()
+}
+
+func querySharedValues(ctx context.Context, tx *sql.Tx, field string, query string, args ...interface{}) ([]sharedValue, error) {
+	results, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var shared []sharedValue
+	for results.Next() {
+		var value, ids string
+		if err := results.Scan(&value, &ids); err != nil {
+			return nil, err
+		}
+		s := sharedValue{Field: field, Value: value}
+		for _, id := range strings.Split(ids, ",") {
+			phonebookID, err := strconv.Atoi(id)
+			if err != nil {
+				return nil, err
+			}
+			s.PhonebookIDs = append(s.PhonebookIDs, phonebookID)
+		}
+		shared = append(shared, s)
+	}
+	return shared, results.Err()
+}
@@ -0,0 +1,180 @@
+package phonebook
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Paulo-Eduardo/phone_book/database"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+// Fields that can be made unique across the phonebooks of a tenant.
+const (
+	uniqueEmail = "email"
+	uniquePhone = "phone"
+)
+
+// Unique indexes enforcing the rules. Only the numbers and addresses of
+// phonebooks out of the trash under a rule fill the columns they cover, and
+// NULLs never collide.
+const (
+	uniquePhoneIndex = "phonebook_phones_unique"
+	uniqueEmailIndex = "phonebook_emails_unique"
+)
+
+// uniqueFields are the fields unique in the tenants that don't set their own.
+var uniqueFields []string
+
+// SetupUniqueness makes fields, "email" and "phone", unique across the
+// phonebooks of the tenants that don't set their own rules.
+func SetupUniqueness(fields []string) error {
+	for _, field := range fields {
+		if field != uniqueEmail && field != uniquePhone {
+			return fmt.Errorf("invalid unique field %q", field)
+		}
+	}
+	uniqueFields = fields
+	return nil
+}
+
+// uniqueRules reports whether numbers and addresses are unique in a tenant.
+func uniqueRules(tenantID string) (phone bool, email bool) {
+	fields := uniqueFields
+	if config, _ := tenant.Lookup(tenantID); config.Unique != nil {
+		fields = config.Unique
+	}
+	for _, field := range fields {
+		phone = phone || field == uniquePhone
+		email = email || field == uniqueEmail
+	}
+	return phone, email
+}
+
+// conflictError is returned by the writes that would give a phonebook a
+// number or address another phonebook of the tenant holds, where those are
+// unique.
+type conflictError struct {
+	Field       string
+	PhonebookID int
+	// Hidden is set when the caller may not see the value the phonebook
+	// holds, and so may not learn which phonebook holds it.
+	Hidden bool
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("the %s is already used by phonebook %d", e.Field, e.PhonebookID)
+}
+
+// problem returns the problem a handler answers with.
+func (e *conflictError) problem() problem.Problem {
+	if e.Hidden {
+		return problem.Conflict(
+			fmt.Sprintf("The %s is already in use.", e.Field),
+			[]problem.FieldError{{Field: e.Field, Message: "must be unique"}},
+			0)
+	}
+	return problem.Conflict(
+		fmt.Sprintf("The %s is already used by phonebook %d.", e.Field, e.PhonebookID),
+		[]problem.FieldError{{Field: e.Field, Message: "must be unique"}},
+		e.PhonebookID)
+}
+
+// writeConflict answers with 409 when err is a *conflictError, and reports
+// whether it did.
+func writeConflict(w http.ResponseWriter, r *http.Request, err error) bool {
+	var conflict *conflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+	problem.Write(w, r, conflict.problem())
+	return true
+}
+
+// uniqueConflict turns the error of a write of the contacts of phonebook
+// breaking a unique index into a *conflictError naming the phonebook holding
+// the value, unless the value is above the clearance of the caller, and
+// returns other errors as they are.
+func uniqueConflict(ctx context.Context, tx *sql.Tx, err error, phonebook Phonebook) error {
+	index, ok := database.DuplicateKey(err)
+	if !ok {
+		return err
+	}
+	tenantID, tenantErr := tenant.Require(ctx)
+	if tenantErr != nil {
+		return tenantErr
+	}
+
+	var field, query string
+	var values []interface{}
+	switch index {
+	case uniquePhoneIndex:
+		field, query = uniquePhone, "SELECT c.phonebookId, c.visibility, p.visibility FROM phonebook_phones c JOIN phonebooks p ON p.phonebookId = c.phonebookId WHERE c.tenant_id = ? AND c.phonebookId <> ? AND c.unique_digits IN "
+		for _, phone := range phonebook.Phones {
+			values = append(values, digitsOnly(phone.Number))
+		}
+	case uniqueEmailIndex:
+		field, query = uniqueEmail, "SELECT c.phonebookId, c.visibility, p.visibility FROM phonebook_emails c JOIN phonebooks p ON p.phonebookId = c.phonebookId WHERE c.tenant_id = ? AND c.phonebookId <> ? AND c.unique_address IN "
+		for _, email := range phonebook.Emails {
+			values = append(values, uniqueAddress(email.Address))
+		}
+	default:
+		return err
+	}
+	if len(values) == 0 {
+		return err
+	}
+
+	args := append([]interface{}{tenantID, phonebook.PhonebookID}, values...)
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	var holder Phonebook
+	var visibility string
+	if lookupErr := tx.QueryRowContext(ctx, query+"("+placeholders+") LIMIT 1", args...).Scan(&holder.PhonebookID, &visibility, &holder.Visibility); lookupErr != nil {
+		return err
+	}
+	return &conflictError{Field: field, PhonebookID: holder.PhonebookID, Hidden: maskedLevel(&holder, visibility) > clearance(ctx)}
+}
+
+// uniqueAddress is the value an address is unique on, whatever its case.
+func uniqueAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// releaseUnique frees the numbers and addresses of a phonebook moved to the
+// trash, so other phonebooks may take them.
+func releaseUnique(ctx context.Context, tx *sql.Tx, phonebookID int) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+	phone, email := uniqueRules(tenantID)
+	if phone {
+		if _, err := tx.ExecContext(ctx, `UPDATE phonebook_phones SET unique_digits = NULL WHERE phonebookId = ? AND tenant_id = ?`, phonebookID, tenantID); err != nil {
+			return err
+		}
+	}
+	if email {
+		if _, err := tx.ExecContext(ctx, `UPDATE phonebook_emails SET unique_address = NULL WHERE phonebookId = ? AND tenant_id = ?`, phonebookID, tenantID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimUnique takes the numbers and addresses of a phonebook back out of the
+// trash again, failing with a *conflictError when another phonebook took one
+// of them meanwhile.
+func claimUnique(ctx context.Context, tx *sql.Tx, phonebook Phonebook) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+	if phone, email := uniqueRules(tenantID); !phone && !email {
+		return nil
+	}
+	return saveContacts(ctx, tx, phonebook)
+}
@@ -0,0 +1,175 @@
+package phonebook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+func TestUniqueRules(t *testing.T) {
+	if err := SetupUniqueness([]string{uniqueEmail}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetupUniqueness(nil)
+	tenant.Setup(tenant.New("", "", tenant.Config{ID: testTenant}, tenant.Config{ID: "globex", Unique: []string{uniquePhone}}, tenant.Config{ID: "initech", Unique: []string{}}))
+	defer tenant.Setup(tenant.Single(tenant.DefaultID))
+
+	for id, want := range map[string][2]bool{
+		testTenant: {false, true},
+		"globex":   {true, false},
+		"initech":  {false, false},
+	} {
+		phone, email := uniqueRules(id)
+		if phone != want[0] || email != want[1] {
+			t.Errorf("uniqueRules(%q) = %v, %v, want %v, %v", id, phone, email, want[0], want[1])
+		}
+	}
+
+	if err := SetupUniqueness([]string{"name"}); err == nil {
+		t.Error("expected an error for a field that can't be unique")
+	}
+}
+
+func TestPostPhonebookHandlerConflictsOnAUniquePhone(t *testing.T) {
+	if err := SetupUniqueness([]string{uniquePhone}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetupUniqueness(nil)
+	handler := http.HandlerFunc(phonebooksHandler)
+
+	pb := Phonebook{
+		Name:  "Create",
+		Email: "t.t@t.com",
+		Phone: "(47) 99662-3579",
+	}
+	body, err := json.Marshal(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO phonebooks`).WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec("DELETE FROM phonebook_phones").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO phonebook_phones").
+		WithArgs(2, testTenant, 0, sqlmock.AnyArg(), pb.Phone, "47996623579", "47996623579", true, visibilityPublic).
+		WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'acme-47996623579' for key 'phonebook_phones.phonebook_phones_unique'"})
+	mock.ExpectQuery("SELECT c.phonebookId, c.visibility, p.visibility FROM phonebook_phones c JOIN phonebooks p (.+) WHERE c.tenant_id = \\? AND c.phonebookId <> \\? AND c.unique_digits IN").
+		WithArgs(testTenant, 2, "47996623579").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "visibility", "visibility"}).AddRow(7, visibilityRestricted, visibilityPublic))
+	mock.ExpectRollback()
+
+	req, err := newRequest("POST", "/phonebooks", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	var p problem.Problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != problem.TypeConflict || p.ConflictingID != 7 {
+		t.Errorf("handler returned wrong problem: %+v", p)
+	}
+	if len(p.Errors) != 1 || p.Errors[0].Field != uniquePhone {
+		t.Errorf("handler returned wrong field errors: %+v", p.Errors)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostPhonebookHandlerHidesTheHolderOfAValueAboveTheClearance(t *testing.T) {
+	if err := SetupUniqueness([]string{uniqueEmail}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetupUniqueness(nil)
+	handler := http.HandlerFunc(phonebooksHandler)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO phonebooks`).WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec("DELETE FROM phonebook_phones").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM phonebook_emails").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO phonebook_emails").
+		WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'acme-ceo@example.com' for key 'phonebook_emails.phonebook_emails_unique'"})
+	mock.ExpectQuery("SELECT c.phonebookId, c.visibility, p.visibility FROM phonebook_emails c JOIN phonebooks p (.+) WHERE c.tenant_id = \\? AND c.phonebookId <> \\? AND c.unique_address IN").
+		WithArgs(testTenant, 2, "ceo@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"phonebookId", "visibility", "visibility"}).AddRow(7, visibilityRestricted, visibilityPublic))
+	mock.ExpectRollback()
+
+	req, err := newRequest("POST", "/phonebooks", bytes.NewBufferString(`{"Name": "Probe", "Email": "CEO@example.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(clearedContext(permissionRead, permissionWrite))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	var p problem.Problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != problem.TypeConflict || p.ConflictingID != 0 || strings.Contains(p.Detail, "7") {
+		t.Errorf("handler disclosed the holder of a restricted address: %s", rr.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSaveContactsClaimsRepeatedValuesOnce(t *testing.T) {
+	if err := SetupUniqueness([]string{uniqueEmail}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetupUniqueness(nil)
+	db, mock := NewMock()
+	defer db.Close()
+
+	pb := Phonebook{
+		PhonebookID: 3,
+		Emails: []ContactEmail{
+			{Address: "Nay@Example.com", Primary: true},
+			{Address: "nay@example.com "},
+		},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM phonebook_phones").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM phonebook_emails").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO phonebook_emails").
+		WithArgs(3, testTenant, 0, "", "Nay@Example.com", "nay@example.com", true, visibilityPublic,
+			3, testTenant, 1, "", "nay@example.com ", nil, false, visibilityPublic).
+		WillReturnResult(sqlmock.NewResult(2, 2))
+	mock.ExpectExec("DELETE FROM phonebook_tags").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveContacts(testContext(), tx, pb); err != nil {
+		t.Fatalf("error was not expected while saving contacts: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
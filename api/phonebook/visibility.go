@@ -0,0 +1,355 @@
+package phonebook
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+)
+
+// Visibility levels of a phonebook and of each of its numbers and addresses.
+// The level of a number is the most sensitive of its own and the phonebook's.
+const (
+	visibilityPublic     = "public"
+	visibilityInternal   = "internal"
+	visibilityRestricted = "restricted"
+)
+
+// Permissions needed to see the values of internal and restricted phonebooks,
+// numbers and addresses. Callers without them get masked values.
+const (
+	permissionReadInternal   = "phonebook:read-internal"
+	permissionReadRestricted = "phonebook:read-restricted"
+)
+
+// visibilityLevels are the levels in increasing order of sensitivity.
+var visibilityLevels = []string{visibilityPublic, visibilityInternal, visibilityRestricted}
+
+// visibilityRank orders the levels. Records written before visibility existed
+// have none and are public.
+func visibilityRank(visibility string) int {
+	switch visibility {
+	case visibilityInternal:
+		return 1
+	case visibilityRestricted:
+		return 2
+	}
+	return 0
+}
+
+func validVisibility(visibility string) bool {
+	return visibility == "" || visibility == visibilityPublic || visibility == visibilityInternal || visibility == visibilityRestricted
+}
+
+// normalizeVisibility returns the level stored for visibility.
+func normalizeVisibility(visibility string) string {
+	if visibility == "" {
+		return visibilityPublic
+	}
+	return visibility
+}
+
+// clearance returns the rank of the most sensitive level the caller of ctx may
+// see.
+func clearance(ctx context.Context) int {
+	p, ok := auth.FromContext(ctx)
+	switch {
+	case !ok:
+		return 0
+	case p.Allows(permissionReadRestricted):
+		return visibilityRank(visibilityRestricted)
+	case p.Allows(permissionReadInternal):
+		return visibilityRank(visibilityInternal)
+	}
+	return 0
+}
+
+// visibleLevels returns the levels a caller with the given clearance may see,
+// or nil when it may see all of them.
+func visibleLevels(clearance int) []string {
+	if clearance >= len(visibilityLevels)-1 {
+		return nil
+	}
+	return visibilityLevels[:clearance+1]
+}
+
+// visibilityCondition restricts the visibility column of a number or address
+// to levels, or is empty when every level is visible.
+func visibilityCondition(levels []string) string {
+	if levels == nil {
+		return ""
+	}
+	return " AND visibility IN (" + visibilityPlaceholders(levels) + ")"
+}
+
+func visibilityPlaceholders(levels []string) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", len(levels)), ", ")
+}
+
+func visibilityArgs(levels []string) []interface{} {
+	args := make([]interface{}, 0, len(levels))
+	for _, level := range levels {
+		args = append(args, level)
+	}
+	return args
+}
+
+// maskedLevel returns the level a value of a phonebook is at.
+func maskedLevel(phonebook *Phonebook, visibility string) int {
+	if rank := visibilityRank(phonebook.Visibility); rank > visibilityRank(visibility) {
+		return rank
+	}
+	return visibilityRank(visibility)
+}
+
+// Redact returns a copy of phonebook with the numbers and addresses the
+// caller of ctx may not see masked, for the packages serving phonebooks on
+// their own.
+func Redact(ctx context.Context, phonebook *Phonebook) *Phonebook {
+	clone := clonePhonebook(phonebook)
+	if clone != nil {
+		redact(clone, clearance(ctx))
+	}
+	return clone
+}
+
+// redact masks the numbers and addresses of phonebook above the given
+// clearance, so they never reach a caller that may not see them. It reports
+// whether anything was masked. The name is never masked.
+func redact(phonebook *Phonebook, clearance int) bool {
+	masked := false
+
+	phones := make([]ContactPhone, len(phonebook.Phones))
+	for i, phone := range phonebook.Phones {
+		if maskedLevel(phonebook, phone.Visibility) > clearance {
+			if phone.Primary {
+				phonebook.Phone = maskPhone(phone.Number)
+			}
+			phone.Number = maskPhone(phone.Number)
+			phone.Masked = true
+			masked = true
+		}
+		phones[i] = phone
+	}
+	if phonebook.Phones != nil {
+		phonebook.Phones = phones
+	}
+	if len(phonebook.Phones) == 0 && phonebook.Phone != "" && maskedLevel(phonebook, "") > clearance {
+		phonebook.Phone = maskPhone(phonebook.Phone)
+		masked = true
+	}
+
+	emails := make([]ContactEmail, len(phonebook.Emails))
+	for i, email := range phonebook.Emails {
+		if maskedLevel(phonebook, email.Visibility) > clearance {
+			if email.Primary {
+				phonebook.Email = maskEmail(email.Address)
+			}
+			email.Address = maskEmail(email.Address)
+			email.Masked = true
+			masked = true
+		}
+		emails[i] = email
+	}
+	if phonebook.Emails != nil {
+		phonebook.Emails = emails
+	}
+	if len(phonebook.Emails) == 0 && phonebook.Email != "" && maskedLevel(phonebook, "") > clearance {
+		phonebook.Email = maskEmail(phonebook.Email)
+		masked = true
+	}
+
+	return masked
+}
+
+// unmask puts back the stored values of the numbers and addresses a caller
+// sent back masked, as read from a GET, so saving a phonebook doesn't
+// overwrite values the caller can't see.
+func unmask(phonebook *Phonebook, stored *Phonebook) {
+	for i, phone := range phonebook.Phones {
+		for _, s := range stored.Phones {
+			if s.Label == phone.Label && phone.Number == maskPhone(s.Number) {
+				phonebook.Phones[i].Number = s.Number
+				break
+			}
+		}
+	}
+	if phonebook.Phone != "" && phonebook.Phone == maskPhone(stored.Phone) {
+		phonebook.Phone = stored.Phone
+	}
+
+	for i, email := range phonebook.Emails {
+		for _, s := range stored.Emails {
+			if s.Label == email.Label && email.Address == maskEmail(s.Address) {
+				phonebook.Emails[i].Address = s.Address
+				break
+			}
+		}
+	}
+	if phonebook.Email != "" && phonebook.Email == maskEmail(stored.Email) {
+		phonebook.Email = stored.Email
+	}
+}
+
+// redactRevision masks the snapshot of a revision and both sides of the
+// changes of its numbers and addresses. Each side is masked as the phonebook
+// was on that side of the change, so a value that was removed, replaced or
+// made public is masked in the old side even though the snapshot no longer
+// holds it.
+func redactRevision(revision *Revision, clearance int) {
+	from, to, err := revisionSides(revision)
+	redact(&revision.Snapshot, clearance)
+	if err != nil {
+		log.Printf("An error accured trying to redact revision %d of phonebook %d: %v", revision.Revision, revision.PhonebookID, err)
+	}
+
+	var fromFields, toFields map[string]interface{}
+	if err == nil {
+		redact(from, clearance)
+		redact(to, clearance)
+		fromFields, err = phonebookFields(from)
+	}
+	if err == nil {
+		toFields, err = phonebookFields(to)
+	}
+	for _, field := range []string{"Phone", "Email", "phones", "emails"} {
+		if _, ok := revision.Diff[field]; !ok {
+			continue
+		}
+		if err != nil {
+			revision.Diff[field] = FieldChange{From: maskedChange, To: maskedChange}
+		} else {
+			revision.Diff[field] = FieldChange{From: fromFields[field], To: toFields[field]}
+		}
+	}
+}
+
+// revisionSides returns the phonebook before and after the change of a
+// revision, from its snapshot and the sides of its diff.
+func revisionSides(revision *Revision) (*Phonebook, *Phonebook, error) {
+	snapshot, err := phonebookFields(&revision.Snapshot)
+	if err != nil {
+		return nil, nil, err
+	}
+	side := func(value func(FieldChange) interface{}) (*Phonebook, error) {
+		fields := map[string]interface{}{}
+		for field, v := range snapshot {
+			fields[field] = v
+		}
+		for field, change := range revision.Diff {
+			if v := value(change); v != nil {
+				fields[field] = v
+			} else {
+				delete(fields, field)
+			}
+		}
+		fieldsJSON, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		var phonebook Phonebook
+		if err := json.Unmarshal(fieldsJSON, &phonebook); err != nil {
+			return nil, err
+		}
+		return &phonebook, nil
+	}
+	from, err := side(func(change FieldChange) interface{} { return change.From })
+	if err != nil {
+		return nil, nil, err
+	}
+	to, err := side(func(change FieldChange) interface{} { return change.To })
+	if err != nil {
+		return nil, nil, err
+	}
+	return from, to, nil
+}
+
+// maskedChange replaces both sides of a change of the diff of a revision
+// that could not be masked value by value.
+const maskedChange = "***"
+
+// clearancePermission returns the permission needed to see values at level.
+func clearancePermission(level int) string {
+	if level >= visibilityRank(visibilityRestricted) {
+		return permissionReadRestricted
+	}
+	return permissionReadInternal
+}
+
+// disclosedLevel returns the level of the most sensitive value the caller
+// can't see whose level saving phonebook over stored would lower, which would
+// disclose it, or 0 when there is none. Levels left out of phonebook keep the
+// stored ones, as they do once saved.
+func disclosedLevel(phonebook *Phonebook, stored *Phonebook, clearance int) int {
+	disclosed := 0
+	lowered := func(from int, to int) {
+		if from > clearance && to < from && from > disclosed {
+			disclosed = from
+		}
+	}
+	kept := func(visibility string, storedVisibility string) string {
+		if visibility == "" {
+			return storedVisibility
+		}
+		return visibility
+	}
+
+	resolved := &Phonebook{Visibility: kept(phonebook.Visibility, stored.Visibility)}
+	lowered(visibilityRank(stored.Visibility), visibilityRank(resolved.Visibility))
+	for _, s := range stored.Phones {
+		for _, phone := range phonebook.Phones {
+			if phone.Number == s.Number {
+				lowered(maskedLevel(stored, s.Visibility), maskedLevel(resolved, kept(phone.Visibility, s.Visibility)))
+			}
+		}
+	}
+	for _, s := range stored.Emails {
+		for _, email := range phonebook.Emails {
+			if email.Address == s.Address {
+				lowered(maskedLevel(stored, s.Visibility), maskedLevel(resolved, kept(email.Visibility, s.Visibility)))
+			}
+		}
+	}
+	return disclosed
+}
+
+// maskPhone hides the digits of a number but its leading groups, such as the
+// country and area codes, the first digit of the subscriber number and the
+// last two, keeping the punctuation: "+55 47 99662-3579" becomes
+// "+55 47 9****-**79". Short subscriber numbers keep fewer digits.
+func maskPhone(number string) string {
+	subscriber := strings.LastIndex(number, " ") + 1
+	digits := len(digitsOnly(number[subscriber:]))
+
+	var b strings.Builder
+	b.WriteString(number[:subscriber])
+	seen := 0
+	for _, c := range number[subscriber:] {
+		if c < '0' || c > '9' {
+			b.WriteRune(c)
+			continue
+		}
+		keep := (seen == 0 && digits >= 6) || (seen >= digits-2 && digits >= 4)
+		if keep {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('*')
+		}
+		seen++
+	}
+	return b.String()
+}
+
+// maskEmail keeps the first character of the local part and the domain of an
+// address: "nay.maggioni@gmail.com" becomes "n***@gmail.com".
+func maskEmail(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at <= 0 {
+		return "***"
+	}
+	first, _ := utf8.DecodeRuneInString(address)
+	return string(first) + "***" + address[at:]
+}
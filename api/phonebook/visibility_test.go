@@ -0,0 +1,199 @@
+package phonebook
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+)
+
+// clearedContext is testContext for a caller holding the given permissions.
+func clearedContext(permissions ...string) context.Context {
+	return auth.NewContext(testContext(), &auth.Principal{Subject: "jwt:intern", Method: auth.MethodJWT, Scopes: permissions})
+}
+
+func TestMaskPhone(t *testing.T) {
+	tests := map[string]string{
+		"+55 47 99662-3579": "+55 47 9****-**79",
+		"47996623579":       "4********79",
+		"(47) 3333-4444":    "(47) 3***-**44",
+		"1234":              "**34",
+		"123":               "***",
+	}
+	for number, want := range tests {
+		if got := maskPhone(number); got != want {
+			t.Errorf("maskPhone(%q) = %q want %q", number, got, want)
+		}
+	}
+}
+
+func TestMaskEmail(t *testing.T) {
+	tests := map[string]string{
+		"nay.maggioni@gmail.com": "n***@gmail.com",
+		"a@b.co":                 "a***@b.co",
+		"broken":                 "***",
+	}
+	for address, want := range tests {
+		if got := maskEmail(address); got != want {
+			t.Errorf("maskEmail(%q) = %q want %q", address, got, want)
+		}
+	}
+}
+
+func TestClearance(t *testing.T) {
+	tests := []struct {
+		ctx  context.Context
+		want int
+	}{
+		{ctx: testContext(), want: visibilityRank(visibilityRestricted)},
+		{ctx: clearedContext(permissionRead), want: visibilityRank(visibilityPublic)},
+		{ctx: clearedContext(permissionRead, permissionReadInternal), want: visibilityRank(visibilityInternal)},
+		{ctx: clearedContext("phonebook:*"), want: visibilityRank(visibilityRestricted)},
+		{ctx: context.Background(), want: visibilityRank(visibilityPublic)},
+	}
+	for i, test := range tests {
+		if got := clearance(test.ctx); got != test.want {
+			t.Errorf("%d: clearance = %d want %d", i, got, test.want)
+		}
+	}
+}
+
+func executive() *Phonebook {
+	return &Phonebook{
+		Name:       "Paulo Eduardo",
+		Phone:      "+55 47 99662-3579",
+		Email:      "pauloes.dev@gmail.com",
+		Visibility: visibilityInternal,
+		Phones: []ContactPhone{
+			{Label: "mobile", Number: "+55 47 99662-3579", Primary: true, Visibility: visibilityRestricted},
+			{Label: "office", Number: "+55 47 3333-4444", Visibility: visibilityPublic},
+		},
+		Emails: []ContactEmail{
+			{Label: "work", Address: "pauloes.dev@gmail.com", Primary: true, Visibility: visibilityPublic},
+		},
+	}
+}
+
+func TestRedact(t *testing.T) {
+	internal := executive()
+	if !redact(internal, visibilityRank(visibilityInternal)) {
+		t.Fatal("redact didn't mask the restricted number")
+	}
+	if internal.Phone != "+55 47 9****-**79" || !internal.Phones[0].Masked || internal.Phones[0].Number != internal.Phone {
+		t.Errorf("restricted number was not masked: %+v", internal)
+	}
+	if internal.Phones[1].Number != "+55 47 3333-4444" || internal.Emails[0].Masked {
+		t.Errorf("internal values were masked for an internal caller: %+v", internal)
+	}
+
+	// The phonebook is internal, so its public values are internal too.
+	public := executive()
+	redact(public, visibilityRank(visibilityPublic))
+	if public.Phones[1].Number != "+55 47 3***-**44" || public.Email != "p***@gmail.com" || public.Emails[0].Address != public.Email {
+		t.Errorf("internal values were not masked for a public caller: %+v", public)
+	}
+	if public.Name != "Paulo Eduardo" {
+		t.Errorf("name was masked: %q", public.Name)
+	}
+
+	stored := executive()
+	if redact(stored, visibilityRank(visibilityRestricted)) || stored.Phone != "+55 47 99662-3579" {
+		t.Errorf("values were masked for a restricted caller: %+v", stored)
+	}
+}
+
+func TestRedactRevisionMasksRemovedValues(t *testing.T) {
+	before := &Phonebook{
+		PhonebookID: 3,
+		Name:        "Paulo Eduardo",
+		Phone:       "+55 47 99662-3579",
+		Visibility:  visibilityPublic,
+		Phones: []ContactPhone{
+			{Label: "mobile", Number: "+55 47 99662-3579", Primary: true, Visibility: visibilityRestricted},
+			{Label: "work", Number: "+55 47 3333-4444", Visibility: visibilityPublic},
+		},
+	}
+	after := &Phonebook{
+		PhonebookID: 3,
+		Name:        "Paulo Eduardo",
+		Phone:       "+55 47 3333-4444",
+		Visibility:  visibilityPublic,
+		Phones:      []ContactPhone{{Label: "work", Number: "+55 47 3333-4444", Primary: true, Visibility: visibilityPublic}},
+	}
+	diff, err := diffPhonebooks(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision := &Revision{PhonebookID: 3, Revision: 2, Action: actionUpdate, Snapshot: *after, Diff: diff}
+
+	redactRevision(revision, visibilityRank(visibilityPublic))
+
+	body, err := json.Marshal(revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), "99662-3579") {
+		t.Errorf("the removed restricted number leaked: %s", body)
+	}
+	if revision.Diff["Phone"].From != "+55 47 9****-**79" || revision.Diff["Phone"].To != "+55 47 3333-4444" {
+		t.Errorf("the change of the primary number was masked wrong: %+v", revision.Diff["Phone"])
+	}
+	if !strings.Contains(string(body), `"number":"+55 47 3333-4444"`) {
+		t.Errorf("the public number was masked: %s", body)
+	}
+}
+
+func TestUnmaskPutsBackStoredValues(t *testing.T) {
+	stored := executive()
+	sent := executive()
+	redact(sent, visibilityRank(visibilityPublic))
+	sent.Name = "Paulo"
+
+	unmask(sent, stored)
+
+	if sent.Phone != stored.Phone || sent.Phones[0].Number != stored.Phones[0].Number || sent.Phones[1].Number != stored.Phones[1].Number || sent.Email != stored.Email {
+		t.Errorf("masked values were not put back: %+v", sent)
+	}
+	if errs := validate(*sent); len(errs) > 0 {
+		t.Errorf("unmasked phonebook is invalid: %v", errs)
+	}
+}
+
+func TestDisclosedLevel(t *testing.T) {
+	internalCaller := visibilityRank(visibilityInternal)
+
+	lowered := executive()
+	lowered.Phones[0].Visibility = visibilityPublic
+	if got := disclosedLevel(lowered, executive(), internalCaller); got != visibilityRank(visibilityRestricted) {
+		t.Errorf("lowering a restricted number disclosed %d want %d", got, visibilityRank(visibilityRestricted))
+	}
+
+	public := executive()
+	public.Visibility = visibilityPublic
+	public.Phones[0].Visibility = visibilityRestricted
+	if got := disclosedLevel(public, executive(), internalCaller); got != 0 {
+		t.Errorf("lowering an internal phonebook as an internal caller disclosed %d", got)
+	}
+	if got := disclosedLevel(public, executive(), visibilityRank(visibilityPublic)); got != visibilityRank(visibilityInternal) {
+		t.Errorf("lowering an internal phonebook as a public caller disclosed %d want %d", got, visibilityRank(visibilityInternal))
+	}
+
+	raised := executive()
+	raised.Phones[1].Visibility = visibilityRestricted
+	if got := disclosedLevel(raised, executive(), visibilityRank(visibilityPublic)); got != 0 {
+		t.Errorf("raising a level disclosed %d", got)
+	}
+
+	// A v1 client leaving the levels out keeps the stored ones.
+	omitted := executive()
+	omitted.Visibility = ""
+	for i := range omitted.Phones {
+		omitted.Phones[i].Visibility = ""
+	}
+	omitted.Emails[0].Visibility = ""
+	if got := disclosedLevel(omitted, executive(), visibilityRank(visibilityPublic)); got != 0 {
+		t.Errorf("leaving the levels out disclosed %d", got)
+	}
+}
@@ -0,0 +1,238 @@
+package phonebook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// wireVersion is a version of the JSON representation of phonebooks, served
+// below its own path. Handlers decode and encode phonebooks through the
+// version of the request, so both share the rest of their code.
+type wireVersion struct {
+	// prefix is the path of the version below the API base path.
+	prefix string
+	// idField is the name of the ID in the representation, for the errors
+	// about it.
+	idField string
+	encode  func(phonebook *Phonebook) interface{}
+	decode  func(body []byte) (Phonebook, error)
+}
+
+// v1 is the Phonebook struct as it has always been encoded.
+var v1 = &wireVersion{
+	prefix:  "",
+	idField: "phonebookId",
+	encode: func(phonebook *Phonebook) interface{} {
+		return phonebook
+	},
+	decode: func(body []byte) (Phonebook, error) {
+		var phonebook Phonebook
+		err := json.Unmarshal(body, &phonebook)
+		return phonebook, err
+	},
+}
+
+// v2 is PhonebookV2.
+var v2 = &wireVersion{
+	prefix:  "/v2",
+	idField: "id",
+	encode: func(phonebook *Phonebook) interface{} {
+		return newPhonebookV2(phonebook)
+	},
+	decode: decodeV2,
+}
+
+type wireVersionKey struct{}
+
+// withWireVersion returns a copy of ctx for a request to version.
+func withWireVersion(ctx context.Context, version *wireVersion) context.Context {
+	return context.WithValue(ctx, wireVersionKey{}, version)
+}
+
+// wireVersionOf returns the version a request was made to, v1 unless said
+// otherwise.
+func wireVersionOf(ctx context.Context) *wireVersion {
+	if version, ok := ctx.Value(wireVersionKey{}).(*wireVersion); ok {
+		return version
+	}
+	return v1
+}
+
+// serveWireVersion serves the requests to handler in version.
+func serveWireVersion(version *wireVersion, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(withWireVersion(r.Context(), version)))
+	})
+}
+
+// phonebooksURL is the path of the phonebooks in version, the Location of the
+// created ones is below it.
+func (version *wireVersion) phonebooksURL() string {
+	return fmt.Sprintf("%s%s/%s", apiBase, version.prefix, phonebookBasePath)
+}
+
+// malformed returns the detail of the problem for a body that could not be
+// decoded with err. v1 never told why.
+func (version *wireVersion) malformed(err error) string {
+	if version == v1 {
+		return "The request body is not a valid phonebook."
+	}
+	return fmt.Sprintf("The request body is not a valid phonebook: %s.", strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// encodeAll encodes phonebooks in version.
+func (version *wireVersion) encodeAll(phonebooks []Phonebook) interface{} {
+	if version == v1 {
+		return phonebooks
+	}
+	encoded := make([]interface{}, len(phonebooks))
+	for i := range phonebooks {
+		encoded[i] = version.encode(&phonebooks[i])
+	}
+	return encoded
+}
+
+// encodeCandidates encodes the phonebooks of likely duplicates in version.
+func (version *wireVersion) encodeCandidates(candidates []Candidate) interface{} {
+	if version == v1 {
+		return candidates
+	}
+	type candidate struct {
+		Phonebook interface{} `json:"phonebook"`
+		Score     float64     `json:"score"`
+		Reasons   []string    `json:"reasons"`
+	}
+	encoded := make([]candidate, len(candidates))
+	for i := range candidates {
+		encoded[i] = candidate{version.encode(&candidates[i].Phonebook), candidates[i].Score, candidates[i].Reasons}
+	}
+	return encoded
+}
+
+// servesV2 reports whether the route of pathSegments, below /phonebooks/, is
+// served in v2. The history, tags, changes, duplicates and merges of the
+// phonebooks are only served in v1 for now.
+func servesV2(pathSegments []string) bool {
+	switch len(pathSegments) {
+	case 1:
+		return pathSegments[0] != "changes" && pathSegments[0] != "duplicates" && pathSegments[0] != "merge"
+	case 2:
+		return pathSegments[1] == "restore"
+	}
+	return false
+}
+
+// PhonebookV2 is a phonebook in v2 of the API. Every field is always sent:
+// lists are empty rather than null, and only the fields that can be unknown,
+// such as who created a phonebook stored before that was kept, or when a
+// phonebook out of the trash was deleted, are null. The numbers and addresses
+// are only in Phones and Emails.
+//
+// Requests may only send these fields. Phones, Emails and Tags replace the
+// stored ones, being cleared when null or left out, and Visibility keeps the
+// stored level when left out. The fields kept by the data layer are ignored.
+type PhonebookV2 struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Phones     []PhoneV2  `json:"phones"`
+	Emails     []EmailV2  `json:"emails"`
+	Tags       []string   `json:"tags"`
+	Visibility string     `json:"visibility"`
+	CreatedAt  *time.Time `json:"createdAt"`
+	CreatedBy  *string    `json:"createdBy"`
+	UpdatedAt  *time.Time `json:"updatedAt"`
+	UpdatedBy  *string    `json:"updatedBy"`
+	DeletedAt  *time.Time `json:"deletedAt"`
+}
+
+// PhoneV2 is one of the labelled numbers of a PhonebookV2.
+type PhoneV2 struct {
+	Label      string `json:"label"`
+	Number     string `json:"number"`
+	Primary    bool   `json:"primary"`
+	Visibility string `json:"visibility"`
+	Masked     bool   `json:"masked"`
+}
+
+// EmailV2 is one of the labelled addresses of a PhonebookV2.
+type EmailV2 struct {
+	Label      string `json:"label"`
+	Address    string `json:"address"`
+	Primary    bool   `json:"primary"`
+	Visibility string `json:"visibility"`
+	Masked     bool   `json:"masked"`
+}
+
+// errTrailingData is returned for a body holding more than a phonebook.
+var errTrailingData = errors.New("unexpected data after the phonebook")
+
+func newPhonebookV2(phonebook *Phonebook) PhonebookV2 {
+	p := PhonebookV2{
+		ID:         phonebook.PhonebookID,
+		Name:       phonebook.Name,
+		Phones:     make([]PhoneV2, len(phonebook.Phones)),
+		Emails:     make([]EmailV2, len(phonebook.Emails)),
+		Tags:       append([]string{}, phonebook.Tags...),
+		Visibility: phonebook.Visibility,
+		CreatedAt:  phonebook.CreatedAt,
+		CreatedBy:  optionalString(phonebook.CreatedBy),
+		UpdatedAt:  phonebook.UpdatedAt,
+		UpdatedBy:  optionalString(phonebook.UpdatedBy),
+		DeletedAt:  phonebook.DeletedAt,
+	}
+	for i, phone := range phonebook.Phones {
+		p.Phones[i] = PhoneV2(phone)
+	}
+	for i, email := range phonebook.Emails {
+		p.Emails[i] = EmailV2(email)
+	}
+	return p
+}
+
+// phonebook returns what p asks to store.
+func (p PhonebookV2) phonebook() Phonebook {
+	phonebook := Phonebook{
+		PhonebookID: p.ID,
+		Name:        p.Name,
+		Phones:      make([]ContactPhone, len(p.Phones)),
+		Emails:      make([]ContactEmail, len(p.Emails)),
+		Tags:        append([]string{}, p.Tags...),
+		Visibility:  p.Visibility,
+	}
+	for i, phone := range p.Phones {
+		phonebook.Phones[i] = ContactPhone(phone)
+	}
+	for i, email := range p.Emails {
+		phonebook.Emails[i] = ContactEmail(email)
+	}
+	return phonebook
+}
+
+// decodeV2 reads a PhonebookV2, refusing the fields it doesn't have.
+func decodeV2(body []byte) (Phonebook, error) {
+	var p PhonebookV2
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return Phonebook{}, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return Phonebook{}, errTrailingData
+	}
+	return p.phonebook(), nil
+}
+
+// optionalString returns nil for the empty string.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
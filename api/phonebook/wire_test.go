@@ -0,0 +1,210 @@
+package phonebook
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func wireSample() []*Phonebook {
+	created := time.Date(2024, 1, 2, 15, 4, 5, 123456000, time.UTC)
+	updated := time.Date(2024, 3, 4, 9, 30, 0, 0, time.UTC)
+	return []*Phonebook{
+		{
+			PhonebookID: 7,
+			Name:        "Maggioni, Nayara",
+			Phone:       "+55 47 99662-3579",
+			Email:       "nay.maggioni@gmail.com",
+			Visibility:  visibilityPublic,
+			Phones: []ContactPhone{
+				{Label: "mobile", Number: "+55 47 99662-3579", Primary: true, Visibility: visibilityPublic},
+				{Label: "home", Number: "+55 47 ****-**00", Visibility: visibilityRestricted, Masked: true},
+			},
+			Emails:    []ContactEmail{{Label: "main", Address: "nay.maggioni@gmail.com", Primary: true, Visibility: visibilityPublic}},
+			Tags:      []string{"family", "vip"},
+			CreatedAt: &created,
+			CreatedBy: "alice",
+			UpdatedAt: &updated,
+			UpdatedBy: "bob",
+		},
+		{PhonebookID: 8, Name: "Bare"},
+	}
+}
+
+// checkGolden compares got with the golden file name, or rewrites it when
+// the tests run with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s:\ngot  %s\nwant %s", path, got, want)
+	}
+}
+
+// The v1 golden files were written before v2 existed, and must not change.
+func TestWireGolden(t *testing.T) {
+	for name, version := range map[string]*wireVersion{"v1": v1, "v2": v2} {
+		sample := wireSample()
+
+		var one bytes.Buffer
+		if err := negotiateEncoding("application/json").one(&one, version, sample[0]); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, name+"/phonebook.json", one.Bytes())
+
+		for contentType, file := range map[string]string{"application/json": "phonebooks.json", ndjsonContentType: "phonebooks.ndjson"} {
+			e := negotiateEncoding(contentType)
+			var list bytes.Buffer
+			if err := e.begin(&list); err != nil {
+				t.Fatal(err)
+			}
+			for i, phonebook := range sample {
+				if err := e.item(&list, version, phonebook, i); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := e.end(&list); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, name+"/"+file, list.Bytes())
+		}
+	}
+}
+
+func TestDecodeV2(t *testing.T) {
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "v2", "phonebook.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	phonebook, err := decodeV2(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := wireSample()[0]
+	if phonebook.PhonebookID != want.PhonebookID || phonebook.Name != want.Name || len(phonebook.Phones) != 2 || !phonebook.Phones[1].Masked || len(phonebook.Tags) != 2 {
+		t.Errorf("decodeV2 returned %+v", phonebook)
+	}
+	if phonebook.Phone != "" || phonebook.CreatedAt != nil || phonebook.UpdatedBy != "" {
+		t.Errorf("decodeV2 took the fields kept by the data layer: %+v", phonebook)
+	}
+
+	phonebook, err = decodeV2([]byte(`{"name":"Bare","phones":null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phonebook.Phones == nil || phonebook.Emails == nil || phonebook.Tags == nil {
+		t.Errorf("decodeV2 left lists to keep: %+v", phonebook)
+	}
+
+	for _, body := range []string{
+		`{"name":"Legacy","phone":"1234-1234"}`,
+		`{"PhonebookID":0,"name":"Legacy"}`,
+		`{"name":"Nested","phones":[{"number":"1234-1234","type":"mobile"}]}`,
+		`{"name":"Twice"}{"name":"Twice"}`,
+	} {
+		if _, err := decodeV2([]byte(body)); err == nil {
+			t.Errorf("decodeV2(%s) expected an error", body)
+		}
+	}
+}
+
+func TestPostPhonebookHandlerInV2(t *testing.T) {
+	handler := serveWireVersion(v2, http.HandlerFunc(phonebooksHandler))
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO phonebooks`).WithArgs(
+		"Create",
+		"1234-1234",
+		"t.t@t.com",
+		visibilityPublic,
+		sqlmock.AnyArg(),
+		anonymousActor,
+		sqlmock.AnyArg(),
+		anonymousActor,
+		testTenant).WillReturnResult(sqlmock.NewResult(2, 1))
+	expectSaveContacts(mock)
+	mock.ExpectExec(`INSERT INTO phonebook_revisions`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	req, err := newRequest("POST", "/v2/phonebooks", bytes.NewBufferString(`{"name":"Create","phones":[{"label":"mobile","number":"1234-1234"}],"emails":[{"label":"work","address":"t.t@t.com"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+	if location := rr.Header().Get("Location"); location != "/v2/phonebooks/2" {
+		t.Errorf("handler returned wrong location: got %q", location)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if string(fields["id"]) != "2" || string(fields["tags"]) != "[]" || string(fields["deletedAt"]) != "null" {
+		t.Errorf("handler returned wrong phonebook: %s", rr.Body)
+	}
+	if _, ok := fields["PhonebookID"]; ok {
+		t.Errorf("handler returned v1 fields: %s", rr.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostPhonebookHandlerInV2RejectsUnknownFields(t *testing.T) {
+	handler := serveWireVersion(v2, http.HandlerFunc(phonebooksHandler))
+
+	req, err := newRequest("POST", "/v2/phonebooks", bytes.NewBufferString(`{"name":"Create","phone":"1234-1234"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if !bytes.Contains(rr.Body.Bytes(), []byte(`unknown field \"phone\"`)) {
+		t.Errorf("handler returned wrong problem: %s", rr.Body)
+	}
+}
+
+func TestPhonebookHandlerInV2ServesOnlyItsRoutes(t *testing.T) {
+	handler := serveWireVersion(v2, http.HandlerFunc(phonebookHandler))
+
+	for _, path := range []string{"/v2/phonebooks/changes", "/v2/phonebooks/duplicates", "/v2/phonebooks/7/history", "/v2/phonebooks/7/tags"} {
+		req, err := newRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("GET %s returned wrong status code: got %v want %v", path, rr.Code, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Package problem renders errors as RFC 7807 "application/problem+json"
+// documents so every handler reports failures the same way.
+package problem
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/Paulo-Eduardo/phone_book/requestid"
+)
+
+// ContentType is the media type of problem documents.
+const ContentType = "application/problem+json"
+
+// Problem types used by the API. Generic failures use "about:blank", in which
+// case the title is the HTTP status text.
+const (
+	TypeDefault    = "about:blank"
+	TypeValidation = "/problems/validation-error"
+	TypeMalformed  = "/problems/malformed-request"
+	TypeForbidden  = "/problems/missing-permission"
+	TypeResync     = "/problems/full-resync-required"
+	TypeDuplicate  = "/problems/likely-duplicate"
+	TypeConflict   = "/problems/unique-conflict"
+)
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	// Permission is the permission the caller lacks, for TypeForbidden.
+	Permission string `json:"permission,omitempty"`
+	// Candidates are the stored records the request likely duplicates, for
+	// TypeDuplicate.
+	Candidates interface{} `json:"candidates,omitempty"`
+	// ConflictingID is the ID of the record holding the unique values of
+	// Errors, for TypeConflict.
+	ConflictingID int `json:"conflictingId,omitempty"`
+}
+
+// FieldError describes why a single field of the request was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// New returns a generic problem for the given status code.
+func New(status int, detail string) Problem {
+	return Problem{
+		Type:   TypeDefault,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// Malformed returns a problem for a request body that could not be read or parsed.
+func Malformed(detail string) Problem {
+	return Problem{
+		Type:   TypeMalformed,
+		Title:  "Malformed request",
+		Status: http.StatusBadRequest,
+		Detail: detail,
+	}
+}
+
+// Validation returns a problem listing every field that failed validation.
+func Validation(errs []FieldError) Problem {
+	return Problem{
+		Type:   TypeValidation,
+		Title:  "Validation failed",
+		Status: http.StatusUnprocessableEntity,
+		Detail: "One or more fields are invalid.",
+		Errors: errs,
+	}
+}
+
+// Forbidden returns a problem for a caller lacking the given permission.
+func Forbidden(permission string) Problem {
+	return Problem{
+		Type:       TypeForbidden,
+		Title:      "Missing permission",
+		Status:     http.StatusForbidden,
+		Detail:     fmt.Sprintf("The %s permission is required.", permission),
+		Permission: permission,
+	}
+}
+
+// ResyncRequired returns a problem for a client that can no longer catch up
+// with changes and must read everything again.
+func ResyncRequired(detail string) Problem {
+	return Problem{
+		Type:   TypeResync,
+		Title:  "Full resync required",
+		Status: http.StatusGone,
+		Detail: detail,
+	}
+}
+
+// Duplicate returns a problem for a request that would create a likely
+// duplicate of the given candidates.
+func Duplicate(detail string, candidates interface{}) Problem {
+	return Problem{
+		Type:       TypeDuplicate,
+		Title:      "Likely duplicate",
+		Status:     http.StatusConflict,
+		Detail:     detail,
+		Candidates: candidates,
+	}
+}
+
+// Conflict returns a problem for a request giving the fields of errs values
+// that must be unique and that the record conflictingID holds already.
+func Conflict(detail string, errs []FieldError, conflictingID int) Problem {
+	return Problem{
+		Type:          TypeConflict,
+		Title:         "Unique value already used",
+		Status:        http.StatusConflict,
+		Detail:        detail,
+		Errors:        errs,
+		ConflictingID: conflictingID,
+	}
+}
+
+// Write sends p to the client, filling in the instance and request ID from r.
+func Write(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Instance == "" {
+		p.Instance = r.URL.Path
+	}
+	if p.RequestID == "" {
+		p.RequestID = requestid.FromContext(r.Context())
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("An error accured trying to encode a problem: %v", err)
+		w.WriteHeader(p.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
+
+// Error is a shorthand for Write(w, r, New(status, detail)).
+func Error(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	Write(w, r, New(status, detail))
+}
+
+// WriteJSON sends v to the client as a JSON document with the given status,
+// or a 500 problem when it can't be encoded.
+func WriteJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("An error accured trying to encode the response: %v", err)
+		Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
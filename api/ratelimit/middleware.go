@@ -0,0 +1,193 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var rejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "api_rate_limited_requests_total",
+	Help: "The total number of requests rejected by the rate limits or the daily quotas",
+}, []string{"class", "reason"})
+
+// Config configures Middleware.
+type Config struct {
+	// Limits are the limits of each route class.
+	Limits map[string]Limit
+	// ClientQuota is the number of requests each client may send per UTC
+	// day, or 0 for no quota. Tenants set their own in the tenants file.
+	ClientQuota int
+	// TrustedProxies are the proxies whose X-Forwarded-For is believed when
+	// telling anonymous clients apart by IP.
+	TrustedProxies []*net.IPNet
+}
+
+var (
+	limiter     *Limiter
+	quotas      = NewQuotas()
+	clientQuota int
+	trusted     []*net.IPNet
+)
+
+// Setup configures Middleware. Until it is called nothing is limited.
+func Setup(c Config) {
+	limiter = New(c.Limits)
+	quotas = NewQuotas()
+	clientQuota = c.ClientQuota
+	trusted = c.TrustedProxies
+}
+
+// ParseCIDRs reads a comma-separated list of networks such as
+// "10.0.0.0/8,192.168.1.10". Single addresses are taken as networks of one.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Middleware : takes a token from the bucket of the client for the class of
+// the route and counts the request against the daily quotas, answering 429
+// when either is exhausted. It needs the principal and the tenant, so it comes
+// after auth.Middleware and tenant.Middleware.
+func Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || limiter == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		class := classify(r)
+		client := clientKey(r)
+		d := limiter.Take(class, client)
+		if !d.Limit.unlimited() {
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit.Requests))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(d.Reset.Seconds())))
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", d.Limit.Requests, int(d.Limit.Period.Seconds())))
+		}
+		if !d.Allowed {
+			rejected.WithLabelValues(class, "rate").Inc()
+			tooManyRequests(w, r, d.RetryAfter, fmt.Sprintf("The %s rate limit of %s is exceeded.", class, d.Limit))
+			return
+		}
+
+		if id, ok := tenant.FromContext(r.Context()); ok {
+			if config, ok := tenant.Lookup(id); ok && config.DailyQuota > 0 {
+				if ok, renewal := quotas.Use("tenant:"+id, config.DailyQuota); !ok {
+					rejected.WithLabelValues(class, "tenant_quota").Inc()
+					tooManyRequests(w, r, renewal, fmt.Sprintf("The daily quota of %d requests of the tenant is used up.", config.DailyQuota))
+					return
+				}
+			}
+		}
+		if clientQuota > 0 {
+			if ok, renewal := quotas.Use("client:"+client, clientQuota); !ok {
+				rejected.WithLabelValues(class, "client_quota").Inc()
+				tooManyRequests(w, r, renewal, fmt.Sprintf("The daily quota of %d requests is used up.", clientQuota))
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, detail string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	problem.Error(w, r, http.StatusTooManyRequests, detail)
+}
+
+// classify returns the route class of a request.
+func classify(r *http.Request) string {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/export"):
+		return ClassExport
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return ClassRead
+	}
+	return ClassWrite
+}
+
+// clientKey identifies the client of a request: its API key or user when it
+// is authenticated, its IP address otherwise.
+func clientKey(r *http.Request) string {
+	if p, ok := auth.FromContext(r.Context()); ok && p.Method != auth.MethodAnonymous {
+		return p.Subject
+	}
+	return "ip:" + clientIP(r)
+}
+
+// clientIP returns the address of the client. Behind trusted proxies it is
+// the last address of X-Forwarded-For that isn't one of them, since the
+// addresses before it can be made up by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrusted(host) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrusted(hops[i]) {
+			return hops[i]
+		}
+		host = hops[i]
+	}
+	return host
+}
+
+func isTrusted(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
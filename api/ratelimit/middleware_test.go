@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func request(method string, path string, p *auth.Principal) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	ctx := tenant.NewContext(context.Background(), "acme")
+	if p != nil {
+		ctx = auth.NewContext(ctx, p)
+	}
+	return req.WithContext(ctx)
+}
+
+func TestMiddlewareLimitsEachClassAndClient(t *testing.T) {
+	Setup(Config{Limits: map[string]Limit{
+		ClassRead:  {Requests: 2, Period: time.Minute},
+		ClassWrite: {Requests: 1, Period: time.Minute},
+	}})
+	defer Setup(Config{})
+	key := &auth.Principal{Subject: "apikey:3f9c0a1b2d4e", Method: auth.MethodAPIKey}
+
+	tests := []struct {
+		method    string
+		principal *auth.Principal
+		status    int
+		remaining string
+	}{
+		{method: "GET", principal: key, status: http.StatusOK, remaining: "1"},
+		{method: "GET", principal: key, status: http.StatusOK, remaining: "0"},
+		{method: "GET", principal: key, status: http.StatusTooManyRequests, remaining: "0"},
+		{method: "POST", principal: key, status: http.StatusOK, remaining: "0"},
+		{method: "GET", principal: nil, status: http.StatusOK, remaining: "1"},
+	}
+	for i, test := range tests {
+		rr := httptest.NewRecorder()
+		Middleware(ok).ServeHTTP(rr, request(test.method, "/api/phonebooks", test.principal))
+
+		if rr.Code != test.status {
+			t.Errorf("%d: got status %v want %v", i, rr.Code, test.status)
+		}
+		if got := rr.Header().Get("RateLimit-Remaining"); got != test.remaining {
+			t.Errorf("%d: got RateLimit-Remaining %q want %q", i, got, test.remaining)
+		}
+		if test.status == http.StatusTooManyRequests && rr.Header().Get("Retry-After") != "30" {
+			t.Errorf("%d: got Retry-After %q want 30", i, rr.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestMiddlewareEnforcesDailyQuotas(t *testing.T) {
+	tenant.Setup(tenant.New("", "", tenant.Config{ID: "acme", DailyQuota: 1}))
+	defer tenant.Setup(tenant.Single(tenant.DefaultID))
+	Setup(Config{})
+	defer Setup(Config{})
+
+	rr := httptest.NewRecorder()
+	Middleware(ok).ServeHTTP(rr, request("GET", "/api/phonebooks", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("first request got %v", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	Middleware(ok).ServeHTTP(rr, request("GET", "/api/phonebooks", nil))
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("request over the tenant quota got %v, Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseCIDRs("10.0.0.0/8, 192.0.2.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted = proxies
+	defer func() { trusted = nil }()
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{remote: "203.0.113.7:5123", forwarded: "198.51.100.1", want: "203.0.113.7"},
+		{remote: "10.1.2.3:5123", forwarded: "198.51.100.1", want: "198.51.100.1"},
+		{remote: "10.1.2.3:5123", forwarded: "6.6.6.6, 198.51.100.1, 192.0.2.10", want: "198.51.100.1"},
+		{remote: "10.1.2.3:5123", forwarded: "", want: "10.1.2.3"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/api/phonebooks", nil)
+		req.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if got := clientIP(req); got != test.want {
+			t.Errorf("clientIP(%s, %q) = %s want %s", test.remote, test.forwarded, got, test.want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := map[string]string{
+		"GET /api/phonebooks":              ClassRead,
+		"DELETE /api/phonebooks/1":         ClassWrite,
+		"GET /api/phonebooks/export":       ClassExport,
+		"POST /api/admin/apikeys/3/rotate": ClassWrite,
+	}
+	for route, want := range tests {
+		parts := strings.SplitN(route, " ", 2)
+		method, path := parts[0], parts[1]
+		if got := classify(httptest.NewRequest(method, path, nil)); got != want {
+			t.Errorf("classify(%s) = %s want %s", route, got, want)
+		}
+	}
+}
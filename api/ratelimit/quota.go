@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Quotas counts the requests of clients and tenants per UTC day. Counts are
+// kept in memory, so each instance of the API enforces its own.
+type Quotas struct {
+	mu   sync.Mutex
+	day  string
+	used map[string]int
+	now  func() time.Time
+}
+
+// NewQuotas returns empty counters.
+func NewQuotas() *Quotas {
+	return &Quotas{used: map[string]int{}, now: time.Now}
+}
+
+// Use counts a request against key when it is still under quota and reports
+// whether it was, along with the time left until the quota is renewed.
+func (q *Quotas) Use(key string, quota int) (bool, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now().UTC()
+	if day := now.Format("2006-01-02"); day != q.day {
+		q.day = day
+		q.used = map[string]int{}
+	}
+	renewal := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+
+	if q.used[key] >= quota {
+		return false, renewal
+	}
+	q.used[key]++
+	return true, renewal
+}
@@ -0,0 +1,156 @@
+// Package ratelimit throttles clients with token buckets, one per client and
+// route class, and enforces optional daily quotas per client and tenant.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route classes, each limited separately.
+const (
+	ClassRead   = "read"
+	ClassWrite  = "write"
+	ClassExport = "export"
+)
+
+// idleBucketTTL is how long the bucket of a client that stopped sending
+// requests is kept, so the table doesn't grow with every IP ever seen.
+const idleBucketTTL = 10 * time.Minute
+
+// Limit lets a client send Requests per Period, in bursts of up to Requests.
+// The zero Limit doesn't limit anything.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseLimit reads a limit written as "300/1m". "0" means no limit.
+func ParseLimit(s string) (Limit, error) {
+	if s == "0" {
+		return Limit{}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("limit %q is not written as requests/period", s)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests <= 0 {
+		return Limit{}, fmt.Errorf("limit %q must allow a positive number of requests", s)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return Limit{}, fmt.Errorf("limit %q must have a positive period", s)
+	}
+	return Limit{Requests: requests, Period: period}, nil
+}
+
+func (l Limit) unlimited() bool {
+	return l.Requests == 0
+}
+
+// rate returns how many tokens are added per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+func (l Limit) String() string {
+	if l.unlimited() {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Decision is the outcome of taking a token.
+type Decision struct {
+	Allowed bool
+	Limit   Limit
+	// Remaining is the number of requests the client can still send at once.
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, when it isn't.
+	RetryAfter time.Duration
+}
+
+// Limiter holds the buckets of every client.
+type Limiter struct {
+	limits map[string]Limit
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// New returns a limiter with the given limit per route class. Classes without
+// a limit are not limited.
+func New(limits map[string]Limit) *Limiter {
+	return &Limiter{
+		limits:  limits,
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// Take takes a token from the bucket of client for class.
+func (l *Limiter) Take(class string, client string) Decision {
+	limit := l.limits[class]
+	if limit.unlimited() {
+		return Decision{Allowed: true}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	key := class + "|" + client
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Requests), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Requests), b.tokens+now.Sub(b.last).Seconds()*limit.rate())
+	b.last = now
+
+	d := Decision{Limit: limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = seconds((1 - b.tokens) / limit.rate())
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = seconds((float64(limit.Requests) - b.tokens) / limit.rate())
+	return d
+}
+
+// sweep drops the buckets that have been full for a while, which are the same
+// as no bucket at all.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleBucketTTL {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > idleBucketTTL {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// seconds rounds a number of seconds up to a whole second duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s)) * time.Second
+}
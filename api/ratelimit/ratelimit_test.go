@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := map[string]Limit{
+		"300/1m": {Requests: 300, Period: time.Minute},
+		"5/1s":   {Requests: 5, Period: time.Second},
+		"0":      {},
+	}
+	for s, want := range tests {
+		got, err := ParseLimit(s)
+		if err != nil || got != want {
+			t.Errorf("ParseLimit(%q) = %v, %v want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"300", "0/1m", "-1/1m", "10/soon", "10/0s"} {
+		if _, err := ParseLimit(s); err == nil {
+			t.Errorf("ParseLimit(%q) was accepted", s)
+		}
+	}
+}
+
+func TestTakeRefillsOverTime(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	l := New(map[string]Limit{ClassWrite: {Requests: 3, Period: 3 * time.Second}})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if d := l.Take(ClassWrite, "apikey:a"); !d.Allowed || d.Remaining != 2-i {
+			t.Fatalf("request %d: %+v", i, d)
+		}
+	}
+	d := l.Take(ClassWrite, "apikey:a")
+	if d.Allowed || d.RetryAfter != time.Second || d.Reset != 3*time.Second {
+		t.Errorf("burst was not limited: %+v", d)
+	}
+	if d := l.Take(ClassWrite, "apikey:b"); !d.Allowed {
+		t.Errorf("another client was limited: %+v", d)
+	}
+	if d := l.Take(ClassRead, "apikey:a"); !d.Allowed {
+		t.Errorf("a class without a limit was limited: %+v", d)
+	}
+
+	now = now.Add(time.Second)
+	if d := l.Take(ClassWrite, "apikey:a"); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("bucket was not refilled: %+v", d)
+	}
+}
+
+func TestIdleBucketsAreDropped(t *testing.T) {
+	now := time.Now()
+	l := New(map[string]Limit{ClassRead: {Requests: 1, Period: time.Second}})
+	l.now = func() time.Time { return now }
+
+	l.Take(ClassRead, "ip:192.0.2.1")
+	now = now.Add(2 * idleBucketTTL)
+	l.Take(ClassRead, "ip:192.0.2.2")
+
+	if _, ok := l.buckets[ClassRead+"|ip:192.0.2.1"]; ok || len(l.buckets) != 1 {
+		t.Errorf("idle bucket was kept: %v", l.buckets)
+	}
+}
+
+func TestQuotasRenewEveryDay(t *testing.T) {
+	now := time.Date(2026, 10, 19, 23, 59, 0, 0, time.UTC)
+	q := NewQuotas()
+	q.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := q.Use("tenant:acme", 2); !ok {
+			t.Fatalf("request %d was over quota", i)
+		}
+	}
+	if ok, renewal := q.Use("tenant:acme", 2); ok || renewal != time.Minute {
+		t.Errorf("quota was not enforced: %v, %v", ok, renewal)
+	}
+
+	now = now.Add(time.Minute)
+	if ok, _ := q.Use("tenant:acme", 2); !ok {
+		t.Error("quota was not renewed at midnight")
+	}
+}
@@ -0,0 +1,61 @@
+package tenant
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Paulo-Eduardo/phone_book/problem"
+)
+
+// Header lets callers that are not bound to a tenant choose one.
+const Header = "X-Tenant-ID"
+
+// Middleware : resolves the tenant of the request from the authenticated
+// credential, the X-Tenant-ID header or the subdomain, in that order, falling
+// back to the default tenant. Requests naming two different tenants or an
+// unknown one are rejected.
+func Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		id, status, detail := resolve(registry, r)
+		if status != 0 {
+			problem.Error(w, r, status, detail)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+func resolve(reg *Registry, r *http.Request) (string, int, string) {
+	candidates := []string{
+		claimFromContext(r.Context()),
+		r.Header.Get(Header),
+		reg.subdomain(r.Host),
+	}
+
+	id := ""
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		if id == "" {
+			id = candidate
+		} else if candidate != id {
+			return "", http.StatusForbidden, "The request names more than one tenant."
+		}
+	}
+	if id == "" {
+		id = reg.DefaultTenant
+	}
+	if id == "" {
+		return "", http.StatusBadRequest, fmt.Sprintf("The tenant must be given in the %s header.", Header)
+	}
+	if _, ok := reg.Lookup(id); !ok {
+		return "", http.StatusBadRequest, fmt.Sprintf("Tenant %q is not known.", id)
+	}
+	return id, 0, ""
+}
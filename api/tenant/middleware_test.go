@@ -0,0 +1,69 @@
+package tenant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testRegistry() *Registry {
+	return New("", "phonebook.example.com",
+		Config{ID: "acme", Subdomain: "acme"},
+		Config{ID: "globex", Subdomain: "globex"})
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		header string
+		claim  string
+		want   string
+		status int
+	}{
+		{name: "header", host: "localhost:5000", header: "acme", want: "acme"},
+		{name: "subdomain", host: "globex.phonebook.example.com:5000", want: "globex"},
+		{name: "claim", host: "localhost", claim: "acme", want: "acme"},
+		{name: "claim and matching header", host: "localhost", claim: "acme", header: "acme", want: "acme"},
+		{name: "claim and other header", host: "localhost", claim: "acme", header: "globex", status: http.StatusForbidden},
+		{name: "header and other subdomain", host: "acme.phonebook.example.com", header: "globex", status: http.StatusForbidden},
+		{name: "unknown tenant", host: "localhost", header: "initech", status: http.StatusBadRequest},
+		{name: "no tenant and no default", host: "localhost", status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/api/phonebooks", nil)
+		req.Host = test.host
+		if test.header != "" {
+			req.Header.Set(Header, test.header)
+		}
+		if test.claim != "" {
+			req = req.WithContext(NewClaimContext(req.Context(), test.claim))
+		}
+
+		id, status, _ := resolve(testRegistry(), req)
+		if id != test.want || status != test.status {
+			t.Errorf("%v: got (%q, %v) want (%q, %v)", test.name, id, status, test.want, test.status)
+		}
+	}
+}
+
+func TestMiddlewareScopesTheRequest(t *testing.T) {
+	Setup(testRegistry())
+	defer Setup(Single(DefaultID))
+
+	var got string
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = FromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/api/phonebooks", nil)
+	req.Header.Set(Header, "globex")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || got != "globex" {
+		t.Errorf("middleware resolved wrong tenant: got (%q, %v) want (%q, %v)", got, rr.Code, "globex", http.StatusOK)
+	}
+}
@@ -0,0 +1,218 @@
+// Package tenant resolves which address book a request belongs to and holds
+// the per-tenant configuration.
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultID is the only tenant of a deployment without a tenants file.
+const DefaultID = "default"
+
+// ErrMissing is returned by the data layer when it is called without a tenant,
+// so no query can ever run unscoped.
+var ErrMissing = errors.New("no tenant in context")
+
+var idPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9\-]{0,63}$`)
+
+// Config is the configuration of a single tenant. Zero values mean "use the
+// deployment default".
+type Config struct {
+	ID             string   `json:"id"`
+	Name           string   `json:"name"`
+	Subdomain      string   `json:"subdomain"`
+	MaxContacts    int      `json:"maxContacts"`
+	TrashRetention Duration `json:"trashRetention"`
+	// DailyQuota bounds the requests the tenant may make per UTC day.
+	DailyQuota int `json:"dailyQuota"`
+	// Unique lists the fields no two phonebooks of the tenant may share,
+	// "email" and "phone". Left out, the deployment default applies; empty,
+	// nothing is unique.
+	Unique []string `json:"unique"`
+}
+
+// Duration is a time.Duration written as a string such as "720h" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Registry holds every known tenant and how to recognise them from a request.
+type Registry struct {
+	DefaultTenant string   `json:"defaultTenant"`
+	BaseDomain    string   `json:"baseDomain"`
+	Tenants       []Config `json:"tenants"`
+
+	byID        map[string]Config
+	bySubdomain map[string]string
+}
+
+// New returns a registry of the given tenants.
+func New(defaultTenant string, baseDomain string, tenants ...Config) *Registry {
+	r := &Registry{DefaultTenant: defaultTenant, BaseDomain: baseDomain, Tenants: tenants}
+	r.index()
+	return r
+}
+
+// Single returns a registry with one tenant that every request resolves to.
+func Single(id string) *Registry {
+	return New(id, "", Config{ID: id, Name: id})
+}
+
+// Load reads a registry from a JSON file such as:
+//
+//	{
+//	  "defaultTenant": "",
+//	  "baseDomain": "phonebook.example.com",
+//	  "tenants": [{"id": "acme", "name": "Acme", "subdomain": "acme", "maxContacts": 5000}]
+//	}
+func Load(path string) (*Registry, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Registry
+	if err := json.Unmarshal(content, &r); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for _, config := range r.Tenants {
+		if !idPattern.MatchString(config.ID) {
+			return nil, fmt.Errorf("invalid tenant id %q in %s", config.ID, path)
+		}
+		for _, field := range config.Unique {
+			if field != "email" && field != "phone" {
+				return nil, fmt.Errorf("invalid unique field %q of tenant %q in %s", field, config.ID, path)
+			}
+		}
+	}
+	r.index()
+	if r.DefaultTenant != "" {
+		if _, ok := r.byID[r.DefaultTenant]; !ok {
+			return nil, fmt.Errorf("default tenant %q is not configured in %s", r.DefaultTenant, path)
+		}
+	}
+	return &r, nil
+}
+
+func (r *Registry) index() {
+	r.byID = make(map[string]Config, len(r.Tenants))
+	r.bySubdomain = make(map[string]string, len(r.Tenants))
+	for _, config := range r.Tenants {
+		r.byID[config.ID] = config
+		if config.Subdomain != "" {
+			r.bySubdomain[strings.ToLower(config.Subdomain)] = config.ID
+		}
+	}
+}
+
+// Lookup returns the configuration of a tenant.
+func (r *Registry) Lookup(id string) (Config, bool) {
+	config, ok := r.byID[id]
+	return config, ok
+}
+
+// All returns every configured tenant, ordered by ID.
+func (r *Registry) All() []Config {
+	all := make([]Config, 0, len(r.byID))
+	for _, config := range r.byID {
+		all = append(all, config)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all
+}
+
+// subdomain returns the tenant whose subdomain prefixes host under the base
+// domain, such as "acme" for "acme.phonebook.example.com:5000".
+func (r *Registry) subdomain(host string) string {
+	if r.BaseDomain == "" {
+		return ""
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	host = strings.ToLower(host)
+	suffix := "." + strings.ToLower(r.BaseDomain)
+	if !strings.HasSuffix(host, suffix) {
+		return ""
+	}
+	label := strings.TrimSuffix(host, suffix)
+	if strings.Contains(label, ".") {
+		return ""
+	}
+	return r.bySubdomain[label]
+}
+
+var registry = Single(DefaultID)
+
+// Setup replaces the registry used by Middleware and Lookup.
+func Setup(r *Registry) {
+	registry = r
+}
+
+// Lookup returns the configuration of a tenant from the registry in use.
+func Lookup(id string) (Config, bool) {
+	return registry.Lookup(id)
+}
+
+// All returns every tenant of the registry in use.
+func All() []Config {
+	return registry.All()
+}
+
+type contextKey struct{}
+type claimKey struct{}
+
+// NewContext returns a copy of ctx scoped to the given tenant.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the tenant a request was resolved to.
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(contextKey{}).(string)
+	return id, ok && id != ""
+}
+
+// Require is FromContext for the data layer: it fails with ErrMissing instead
+// of letting a query run without a tenant.
+func Require(ctx context.Context) (string, error) {
+	id, ok := FromContext(ctx)
+	if !ok {
+		return "", ErrMissing
+	}
+	return id, nil
+}
+
+// NewClaimContext records the tenant an authenticated credential belongs to.
+// It takes precedence over the header and the subdomain, which must agree with
+// it when present.
+func NewClaimContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, claimKey{}, id)
+}
+
+func claimFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(claimKey{}).(string)
+	return id
+}
@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// errForbiddenAddress is returned for a delivery to an address of the
+// network the api runs in.
+var errForbiddenAddress = errors.New("webhook: deliveries to loopback, private and link-local addresses are not allowed")
+
+// internalNetworks hold the addresses deliveries are never sent to unless
+// allowed: the api itself, its private network, link-local addresses such as
+// the metadata service of cloud instances, and the unspecified, multicast
+// and reserved ones.
+var internalNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// allowedNetworks are the internal networks deliveries may be sent to all
+// the same, such as a receiver running next to the api.
+var allowedNetworks []*net.IPNet
+
+// AllowNetworks lets deliveries reach the given networks, although they are
+// internal.
+func AllowNetworks(networks []*net.IPNet) {
+	allowedNetworks = networks
+}
+
+// allowedAddress reports whether deliveries may be sent to ip.
+func allowedAddress(ip net.IP) bool {
+	for _, network := range allowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAddress refuses the connections to the addresses deliveries may not
+// be sent to. It runs once the host is resolved, right before connecting, so
+// a name resolving to an internal address is caught too.
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !allowedAddress(ip) {
+		return fmt.Errorf("%w: %s", errForbiddenAddress, host)
+	}
+	return nil
+}
+
+// newClient returns the client deliveries are sent with. It only connects to
+// allowed addresses, and doesn't follow redirects, which could lead anywhere:
+// a redirect fails the attempt like any other status that isn't 2xx.
+func newClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkAddress,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   defaultTimeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
@@ -0,0 +1,188 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults of a Dispatcher.
+const (
+	DefaultMaxAttempts = 8
+	DefaultBackoff     = 30 * time.Second
+	DefaultMaxBackoff  = 6 * time.Hour
+	defaultBatch       = 50
+	defaultTimeout     = 10 * time.Second
+)
+
+// maxErrorSize bounds the part of a failed response kept in the log.
+const maxErrorSize = 512
+
+var deliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "api_webhook_deliveries_total",
+	Help: "Attempts at sending webhook deliveries, by result: delivered, failed (to be retried) or dead.",
+}, []string{"result"})
+
+// Dispatcher sends the deliveries that are due. Several dispatchers may share
+// a database: each claims its own deliveries.
+type Dispatcher struct {
+	DB      *sql.DB
+	Timeout int
+	// Client sends the deliveries; a response taking longer than its
+	// Timeout fails the attempt. The default one refuses internal addresses
+	// outside of AllowNetworks and doesn't follow redirects.
+	Client *http.Client
+	// MaxAttempts is the number of attempts before a delivery is dead.
+	MaxAttempts int
+	// Backoff is the wait after the first failed attempt, doubled after
+	// every other one up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Batch is the number of deliveries claimed and sent at once.
+	Batch int
+
+	now func() time.Time
+}
+
+// NewDispatcher returns a Dispatcher with the defaults.
+func NewDispatcher(dbConn *sql.DB, to int) *Dispatcher {
+	return &Dispatcher{
+		DB:          dbConn,
+		Timeout:     to,
+		Client:      newClient(),
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+		Batch:       defaultBatch,
+		now:         time.Now,
+	}
+}
+
+// Start sends the due deliveries every interval, and right away again after
+// a full batch.
+func (d *Dispatcher) Start(interval time.Duration) {
+	go func() {
+		for {
+			sent, err := d.dispatch(context.Background())
+			if err != nil {
+				log.Printf("An error accured trying to dispatch webhooks: %v", err)
+			}
+			if sent < d.Batch {
+				time.Sleep(interval)
+			}
+		}
+	}()
+}
+
+// lease is how long a claimed delivery is left to its dispatcher: twice as
+// long as an attempt may take.
+func (d *Dispatcher) lease() time.Duration {
+	timeout := d.Client.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return 2 * timeout
+}
+
+// dispatch claims a batch of due deliveries and sends them concurrently,
+// returning how many there were.
+func (d *Dispatcher) dispatch(ctx context.Context) (int, error) {
+	claimed, err := claim(ctx, d.now().UTC(), d.lease(), d.Batch, d.DB, d.Timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range claimed {
+		wg.Add(1)
+		go func(p pending) {
+			defer wg.Done()
+			d.deliver(ctx, p)
+		}(p)
+	}
+	wg.Wait()
+	return len(claimed), nil
+}
+
+// deliver sends p once and records the outcome.
+func (d *Dispatcher) deliver(ctx context.Context, p pending) {
+	a := d.send(ctx, p)
+	status := StatusPending
+	var next *time.Time
+	switch {
+	case a.Error == "":
+		status = StatusDelivered
+	case a.Attempt >= d.MaxAttempts:
+		status = StatusDead
+	default:
+		at := a.AttemptedAt.Add(d.backoff(a.Attempt))
+		next = &at
+	}
+	deliveriesTotal.WithLabelValues(map[string]string{
+		StatusDelivered: "delivered",
+		StatusPending:   "failed",
+		StatusDead:      "dead",
+	}[status]).Inc()
+
+	if err := recordAttempt(ctx, p, a, status, next, d.DB, d.Timeout); err != nil {
+		log.Printf("An error accured trying to record the attempt at webhook delivery %d: %v", p.deliveryID, err)
+	}
+}
+
+// send posts the payload of p to its subscription. Any 2xx response
+// delivers it.
+func (d *Dispatcher) send(ctx context.Context, p pending) (a Attempt) {
+	start := d.now().UTC()
+	a = Attempt{Attempt: p.attempts + 1, AttemptedAt: start}
+	defer func() {
+		a.DurationMs = d.now().Sub(start).Milliseconds()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(p.payload))
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	timestamp := start.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEventID, p.eventID)
+	req.Header.Set(HeaderEventType, p.eventType)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(p.secret, timestamp, p.payload))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	defer resp.Body.Close()
+	a.StatusCode = resp.StatusCode
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorSize))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		a.Error = fmt.Sprintf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return a
+}
+
+// backoff is the wait after the given failed attempt.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	wait := d.Backoff
+	for i := 1; i < attempt && wait < d.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.MaxBackoff {
+		wait = d.MaxBackoff
+	}
+	return wait
+}
@@ -0,0 +1,191 @@
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testSecret = "whsec_test"
+
+var testNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestDispatcher returns a dispatcher on a stub database whose clock
+// stands still at testNow, allowed to reach the loopback receivers of the
+// tests.
+func newTestDispatcher(t *testing.T) (*Dispatcher, sqlmock.Sqlmock) {
+	dbConn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbConn.Close() })
+	AllowNetworks(mustParseCIDRs("127.0.0.0/8", "::1/128"))
+	t.Cleanup(func() { AllowNetworks(nil) })
+	d := NewDispatcher(dbConn, 15)
+	d.now = func() time.Time { return testNow }
+	return d, mock
+}
+
+// expectClaim expects a delivery to url, attempted attempts times already,
+// to be claimed.
+func expectClaim(mock sqlmock.Sqlmock, d *Dispatcher, url string, attempts int) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM webhook_deliveries d JOIN webhook_subscriptions s (.+) FOR UPDATE SKIP LOCKED").
+		WithArgs(StatusPending, testNow, d.Batch).
+		WillReturnRows(sqlmock.NewRows([]string{"deliveryId", "tenant_id", "eventId", "eventType", "payload", "attempts", "url", "secret"}).
+			AddRow(9, "acme", "evt_1", "phonebook.created", []byte(`{"id":"evt_1"}`), attempts, url, testSecret))
+	mock.ExpectExec("UPDATE webhook_deliveries SET next_attempt_at=\\? WHERE deliveryId = \\?").
+		WithArgs(testNow.Add(d.lease()), 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+// expectAttempt expects the outcome of an attempt to be recorded.
+func expectAttempt(mock sqlmock.Sqlmock, status string, attempt int, next interface{}, statusCode interface{}, deliveredAt interface{}) {
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE webhook_deliveries SET").
+		WithArgs(status, attempt, next, statusCode, sqlmock.AnyArg(), deliveredAt, 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO webhook_delivery_attempts").
+		WithArgs("acme", 9, attempt, statusCode, sqlmock.AnyArg(), sqlmock.AnyArg(), testNow).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestDispatcherSendsSignedDeliveries(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+		if err != nil || !Verify(testSecret, timestamp, body, r.Header.Get(HeaderSignature)) {
+			t.Errorf("delivery is not signed: %v", r.Header)
+		}
+		received <- r
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	d, mock := newTestDispatcher(t)
+	expectClaim(mock, d, receiver.URL, 0)
+	expectAttempt(mock, StatusDelivered, 1, nil, http.StatusNoContent, testNow)
+
+	sent, err := d.dispatch(context.Background())
+	if err != nil || sent != 1 {
+		t.Fatalf("dispatch() = (%d, %v) want (1, nil)", sent, err)
+	}
+	r := <-received
+	if r.Header.Get(HeaderEventID) != "evt_1" || r.Header.Get(HeaderEventType) != "phonebook.created" {
+		t.Errorf("delivery has wrong headers: %v", r.Header)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDispatcherRetriesFailedDeliveries(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	d, mock := newTestDispatcher(t)
+	expectClaim(mock, d, receiver.URL, 2)
+	expectAttempt(mock, StatusPending, 3, testNow.Add(4*DefaultBackoff), http.StatusServiceUnavailable, nil)
+
+	if _, err := d.dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDispatcherGivesUpAfterTheLastAttempt(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer receiver.Close()
+
+	d, mock := newTestDispatcher(t)
+	expectClaim(mock, d, receiver.URL, d.MaxAttempts-1)
+	expectAttempt(mock, StatusDead, d.MaxAttempts, nil, http.StatusGone, nil)
+
+	if _, err := d.dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDispatcherRetriesUnreachableReceivers(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	url := receiver.URL
+	receiver.Close()
+
+	d, mock := newTestDispatcher(t)
+	expectClaim(mock, d, url, 0)
+	expectAttempt(mock, StatusPending, 1, testNow.Add(DefaultBackoff), nil, nil)
+
+	if _, err := d.dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDispatcherRefusesInternalAddresses(t *testing.T) {
+	hit := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+	}))
+	defer receiver.Close()
+
+	d, mock := newTestDispatcher(t)
+	AllowNetworks(nil)
+	expectClaim(mock, d, receiver.URL, 0)
+	expectAttempt(mock, StatusPending, 1, testNow.Add(DefaultBackoff), nil, nil)
+
+	if _, err := d.dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if hit {
+		t.Error("delivery was sent to a loopback address")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDispatcherDoesNotFollowRedirects(t *testing.T) {
+	followed := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metadata" {
+			followed = true
+			return
+		}
+		http.Redirect(w, r, "/metadata", http.StatusFound)
+	}))
+	defer receiver.Close()
+
+	d, mock := newTestDispatcher(t)
+	expectClaim(mock, d, receiver.URL, 0)
+	expectAttempt(mock, StatusPending, 1, testNow.Add(DefaultBackoff), http.StatusFound, nil)
+
+	if _, err := d.dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if followed {
+		t.Error("the redirect of a receiver was followed")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
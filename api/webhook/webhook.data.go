@@ -0,0 +1,550 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/phonebook"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var (
+	errSubscriptionNotFound = errors.New("webhook subscription not found")
+	errDeliveryNotFound     = errors.New("webhook delivery not found")
+)
+
+// maxListedDeliveries bounds the deliveries listed at once, the latest first.
+const maxListedDeliveries = 100
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func insertSubscription(ctx context.Context, s Subscription, db *sql.DB, timeout int) (int, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `INSERT INTO webhook_subscriptions
+	(tenant_id,
+	url,
+	events,
+	visibility,
+	secret,
+	active,
+	createdAt) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		tenantID,
+		s.URL,
+		strings.Join(s.Events, " "),
+		s.Visibility,
+		s.Secret,
+		s.Active,
+		s.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	insertID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(insertID), nil
+}
+
+func getSubscription(ctx context.Context, subscriptionID int, db *sql.DB, timeout int) (*Subscription, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	row := db.QueryRowContext(ctx, `SELECT
+	subscriptionId,
+	url,
+	events,
+	visibility,
+	active,
+	createdAt
+	FROM webhook_subscriptions
+	WHERE subscriptionId = ? AND tenant_id = ?`, subscriptionID, tenantID)
+
+	s, err := scanSubscription(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return s, err
+}
+
+func listSubscriptions(ctx context.Context, db *sql.DB, timeout int) ([]Subscription, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	results, err := db.QueryContext(ctx, `SELECT
+	subscriptionId,
+	url,
+	events,
+	visibility,
+	active,
+	createdAt
+	FROM webhook_subscriptions
+	WHERE tenant_id = ?
+	ORDER BY subscriptionId`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	subscriptions := make([]Subscription, 0)
+	for results.Next() {
+		s, err := scanSubscription(results)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, *s)
+	}
+	return subscriptions, results.Err()
+}
+
+func updateSubscription(ctx context.Context, s Subscription, db *sql.DB, timeout int) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, `UPDATE webhook_subscriptions SET
+	url=?,
+	events=?,
+	visibility=?,
+	active=?
+	WHERE subscriptionId = ? AND tenant_id = ?`,
+		s.URL,
+		strings.Join(s.Events, " "),
+		s.Visibility,
+		s.Active,
+		s.SubscriptionID,
+		tenantID)
+	return err
+}
+
+// deleteSubscription removes a subscription with its deliveries.
+func deleteSubscription(ctx context.Context, subscriptionID int, db *sql.DB, timeout int) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, `DELETE FROM webhook_subscriptions WHERE subscriptionId = ? AND tenant_id = ?`, subscriptionID, tenantID)
+	return err
+}
+
+func scanSubscription(row scanner) (*Subscription, error) {
+	var s Subscription
+	var events string
+	err := row.Scan(
+		&s.SubscriptionID,
+		&s.URL,
+		&events,
+		&s.Visibility,
+		&s.Active,
+		&s.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	s.Events = strings.Fields(events)
+	return &s, nil
+}
+
+// Enqueue is a phonebook.Publisher queueing a delivery of the event for every
+// active subscription of the tenant to its type, inside the transaction of
+// the change.
+func Enqueue(ctx context.Context, tx *sql.Tx, eventType string, phonebookID int, render phonebook.Render) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	results, err := tx.QueryContext(ctx, `SELECT
+	subscriptionId,
+	url,
+	events,
+	visibility,
+	active,
+	createdAt
+	FROM webhook_subscriptions
+	WHERE tenant_id = ? AND active = TRUE`, tenantID)
+	if err != nil {
+		return err
+	}
+	var subscriptions []Subscription
+	for results.Next() {
+		s, err := scanSubscription(results)
+		if err != nil {
+			results.Close()
+			return err
+		}
+		if s.subscribes(eventType) {
+			subscriptions = append(subscriptions, *s)
+		}
+	}
+	results.Close()
+	if err := results.Err(); err != nil {
+		return err
+	}
+	if len(subscriptions) == 0 {
+		return nil
+	}
+
+	eventID, err := generateEventID()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, s := range subscriptions {
+		payload, err := json.Marshal(Event{
+			ID:        eventID,
+			Type:      eventType,
+			Tenant:    tenantID,
+			CreatedAt: now,
+			Data:      render(s.Visibility),
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO webhook_deliveries
+		(tenant_id,
+		subscriptionId,
+		eventId,
+		eventType,
+		payload,
+		status,
+		attempts,
+		next_attempt_at,
+		createdAt) VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?)`,
+			tenantID,
+			s.SubscriptionID,
+			eventID,
+			eventType,
+			payload,
+			StatusPending,
+			now,
+			now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const deliveryColumns = `deliveryId,
+	subscriptionId,
+	eventId,
+	eventType,
+	status,
+	attempts,
+	next_attempt_at,
+	last_status_code,
+	last_error,
+	createdAt,
+	delivered_at`
+
+// listDeliveries lists the latest deliveries of a subscription, only the
+// ones with the given status unless it is empty.
+func listDeliveries(ctx context.Context, subscriptionID int, status string, db *sql.DB, timeout int) ([]Delivery, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	conditions := "subscriptionId = ? AND tenant_id = ?"
+	args := []interface{}{subscriptionID, tenantID}
+	if status != "" {
+		conditions += " AND status = ?"
+		args = append(args, status)
+	}
+	args = append(args, maxListedDeliveries)
+
+	results, err := db.QueryContext(ctx, `SELECT `+deliveryColumns+`
+	FROM webhook_deliveries
+	WHERE `+conditions+`
+	ORDER BY deliveryId DESC
+	LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	deliveries := make([]Delivery, 0)
+	for results.Next() {
+		d, err := scanDelivery(results)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, results.Err()
+}
+
+// getDelivery reads a delivery of a subscription with the log of its
+// attempts.
+func getDelivery(ctx context.Context, subscriptionID int, deliveryID int64, db *sql.DB, timeout int) (*Delivery, error) {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	row := db.QueryRowContext(ctx, `SELECT `+deliveryColumns+`
+	FROM webhook_deliveries
+	WHERE deliveryId = ? AND subscriptionId = ? AND tenant_id = ?`, deliveryID, subscriptionID, tenantID)
+	d, err := scanDelivery(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	results, err := db.QueryContext(ctx, `SELECT
+	attempt,
+	status_code,
+	error,
+	duration_ms,
+	attemptedAt
+	FROM webhook_delivery_attempts
+	WHERE deliveryId = ? AND tenant_id = ?
+	ORDER BY attemptId`, deliveryID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	for results.Next() {
+		var a Attempt
+		var statusCode sql.NullInt64
+		var attemptError sql.NullString
+		if err := results.Scan(&a.Attempt, &statusCode, &attemptError, &a.DurationMs, &a.AttemptedAt); err != nil {
+			return nil, err
+		}
+		a.StatusCode = int(statusCode.Int64)
+		a.Error = attemptError.String
+		d.Log = append(d.Log, a)
+	}
+	return d, results.Err()
+}
+
+// redeliver queues a delivery again, with a fresh budget of attempts.
+func redeliver(ctx context.Context, subscriptionID int, deliveryID int64, db *sql.DB, timeout int) error {
+	tenantID, err := tenant.Require(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `UPDATE webhook_deliveries SET
+	status=?,
+	attempts=0,
+	next_attempt_at=?
+	WHERE deliveryId = ? AND subscriptionId = ? AND tenant_id = ?`,
+		StatusPending,
+		time.Now().UTC(),
+		deliveryID,
+		subscriptionID,
+		tenantID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errDeliveryNotFound
+	}
+	return nil
+}
+
+func scanDelivery(row scanner) (*Delivery, error) {
+	var d Delivery
+	var statusCode sql.NullInt64
+	var lastError sql.NullString
+	err := row.Scan(
+		&d.DeliveryID,
+		&d.SubscriptionID,
+		&d.EventID,
+		&d.EventType,
+		&d.Status,
+		&d.Attempts,
+		&d.NextAttemptAt,
+		&statusCode,
+		&lastError,
+		&d.CreatedAt,
+		&d.DeliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	d.LastStatusCode = int(statusCode.Int64)
+	d.LastError = lastError.String
+	if d.Status != StatusPending {
+		d.NextAttemptAt = nil
+	}
+	return &d, nil
+}
+
+// pending is a delivery claimed by the dispatcher, with what it takes to
+// send it.
+type pending struct {
+	deliveryID int64
+	tenantID   string
+	eventID    string
+	eventType  string
+	payload    []byte
+	attempts   int
+	url        string
+	secret     string
+}
+
+// claim takes up to limit deliveries due at now, of every tenant, and leases
+// them until now+lease, so that other dispatchers skip them and a delivery
+// claimed by a dispatcher that stopped is sent again once the lease expires.
+func claim(ctx context.Context, now time.Time, lease time.Duration, limit int, db *sql.DB, timeout int) ([]pending, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results, err := tx.QueryContext(ctx, `SELECT
+	d.deliveryId,
+	d.tenant_id,
+	d.eventId,
+	d.eventType,
+	d.payload,
+	d.attempts,
+	s.url,
+	s.secret
+	FROM webhook_deliveries d
+	JOIN webhook_subscriptions s ON s.subscriptionId = d.subscriptionId
+	WHERE d.status = ? AND d.next_attempt_at <= ? AND s.active = TRUE
+	ORDER BY d.next_attempt_at, d.deliveryId
+	LIMIT ?
+	FOR UPDATE SKIP LOCKED`, StatusPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	var claimed []pending
+	for results.Next() {
+		var p pending
+		if err := results.Scan(&p.deliveryID, &p.tenantID, &p.eventID, &p.eventType, &p.payload, &p.attempts, &p.url, &p.secret); err != nil {
+			results.Close()
+			return nil, err
+		}
+		claimed = append(claimed, p)
+	}
+	results.Close()
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, p := range claimed {
+		_, err := tx.ExecContext(ctx, `UPDATE webhook_deliveries SET next_attempt_at=? WHERE deliveryId = ?`, now.Add(lease), p.deliveryID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return claimed, tx.Commit()
+}
+
+// recordAttempt logs an attempt at sending p and moves the delivery to
+// status, to be tried again at next when it is still pending.
+func recordAttempt(ctx context.Context, p pending, a Attempt, status string, next *time.Time, db *sql.DB, timeout int) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deliveredAt *time.Time
+	if status == StatusDelivered {
+		deliveredAt = &a.AttemptedAt
+	}
+	var statusCode *int
+	if a.StatusCode != 0 {
+		statusCode = &a.StatusCode
+	}
+	var lastError *string
+	if a.Error != "" {
+		lastError = &a.Error
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE webhook_deliveries SET
+	status=?,
+	attempts=?,
+	next_attempt_at=?,
+	last_status_code=?,
+	last_error=?,
+	delivered_at=?
+	WHERE deliveryId = ?`,
+		status,
+		a.Attempt,
+		next,
+		statusCode,
+		lastError,
+		deliveredAt,
+		p.deliveryID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO webhook_delivery_attempts
+	(tenant_id,
+	deliveryId,
+	attempt,
+	status_code,
+	error,
+	duration_ms,
+	attemptedAt) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		p.tenantID,
+		p.deliveryID,
+		a.Attempt,
+		statusCode,
+		lastError,
+		a.DurationMs,
+		a.AttemptedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,193 @@
+// Package webhook notifies the subscriptions of a tenant of the changes of
+// its phonebooks. Deliveries are queued in the transaction of the change and
+// sent by a dispatcher, signed with the secret of the subscription and
+// retried with exponential backoff until they succeed or are given up as dead
+// letters.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/phonebook"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+)
+
+// Headers sent with every delivery. The signature is "sha256=" and the
+// hex-encoded HMAC-SHA256 of the timestamp, "." and the body, keyed with the
+// secret of the subscription.
+const (
+	HeaderEventID   = "X-Webhook-Id"
+	HeaderEventType = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Statuses of a delivery. Dead deliveries ran out of attempts and wait for a
+// manual redelivery.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+const (
+	secretPrefix  = "whsec_"
+	secretBytes   = 24
+	maxSecretSize = 128
+)
+
+// visibilities are the levels a subscription may be cleared for, as in
+// phonebooks.
+var visibilities = []string{"public", "internal", "restricted"}
+
+// Subscription is a URL notified of some of the events of a tenant. Its
+// Secret is only returned when it is created.
+type Subscription struct {
+	SubscriptionID int      `json:"subscriptionId"`
+	URL            string   `json:"url"`
+	Events         []string `json:"events"`
+	// Visibility is the most sensitive level of the numbers and addresses
+	// sent unmasked. It defaults to public.
+	Visibility string    `json:"visibility"`
+	Secret     string    `json:"secret,omitempty"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Event is the body of a delivery.
+type Event struct {
+	ID        string              `json:"id"`
+	Type      string              `json:"type"`
+	Tenant    string              `json:"tenant"`
+	CreatedAt time.Time           `json:"createdAt"`
+	Data      phonebook.EventData `json:"data"`
+}
+
+// Delivery is an event queued for a subscription, with the log of its
+// attempts when read on its own.
+type Delivery struct {
+	DeliveryID     int64      `json:"deliveryId"`
+	SubscriptionID int        `json:"subscriptionId"`
+	EventID        string     `json:"eventId"`
+	EventType      string     `json:"eventType"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"nextAttemptAt,omitempty"`
+	LastStatusCode int        `json:"lastStatusCode,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+	Log            []Attempt  `json:"log,omitempty"`
+}
+
+// Attempt is one try at sending a delivery.
+type Attempt struct {
+	Attempt     int       `json:"attempt"`
+	StatusCode  int       `json:"statusCode,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	DurationMs  int64     `json:"durationMs"`
+	AttemptedAt time.Time `json:"attemptedAt"`
+}
+
+// Sign returns the signature of a delivery body sent at timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the one of body sent at timestamp,
+// for receivers written in Go.
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// generateSecret returns a new random secret.
+func generateSecret() (string, error) {
+	b := make([]byte, secretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return secretPrefix + hex.EncodeToString(b), nil
+}
+
+// generateEventID returns a new random event ID, which receivers can use to
+// drop the duplicates of a delivery retried after they had received it.
+func generateEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "evt_" + hex.EncodeToString(b), nil
+}
+
+// subscribes reports whether s wants events of type eventType.
+func (s *Subscription) subscribes(eventType string) bool {
+	for _, e := range s.Events {
+		if e == eventType || e == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks a subscription sent to be created or updated, filling in
+// the defaults.
+func validate(s *Subscription) []problem.FieldError {
+	var errs []problem.FieldError
+	s.URL = strings.TrimSpace(s.URL)
+	if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs = append(errs, problem.FieldError{Field: "url", Message: "must be an absolute http or https URL"})
+	} else if ip := net.ParseIP(u.Hostname()); ip != nil && !allowedAddress(ip) {
+		errs = append(errs, problem.FieldError{Field: "url", Message: "must not be a loopback, private or link-local address"})
+	}
+	if len(s.Events) == 0 {
+		errs = append(errs, problem.FieldError{Field: "events", Message: "must list at least one event type, or *"})
+	}
+	for i, e := range s.Events {
+		if !knownEvent(e) {
+			errs = append(errs, problem.FieldError{Field: fmt.Sprintf("events[%d]", i), Message: "must be one of " + strings.Join(phonebook.EventTypes, ", ") + " or *"})
+		}
+	}
+	if s.Visibility == "" {
+		s.Visibility = visibilities[0]
+	} else if !knownVisibility(s.Visibility) {
+		errs = append(errs, problem.FieldError{Field: "visibility", Message: "must be one of " + strings.Join(visibilities, ", ")})
+	}
+	if len(s.Secret) > maxSecretSize {
+		errs = append(errs, problem.FieldError{Field: "secret", Message: fmt.Sprintf("must have at most %d characters", maxSecretSize)})
+	}
+	return errs
+}
+
+func knownEvent(eventType string) bool {
+	if eventType == "*" {
+		return true
+	}
+	for _, e := range phonebook.EventTypes {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func knownVisibility(visibility string) bool {
+	for _, v := range visibilities {
+		if v == visibility {
+			return true
+		}
+	}
+	return false
+}
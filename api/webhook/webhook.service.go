@@ -0,0 +1,237 @@
+package webhook
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Paulo-Eduardo/phone_book/admission"
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/compress"
+	"github.com/Paulo-Eduardo/phone_book/cors"
+	"github.com/Paulo-Eduardo/phone_book/logger"
+	"github.com/Paulo-Eduardo/phone_book/problem"
+	"github.com/Paulo-Eduardo/phone_book/ratelimit"
+	"github.com/Paulo-Eduardo/phone_book/requestid"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+const webhookBasePath = "admin/webhooks"
+
+// permission is required to manage the webhooks of a tenant.
+const permission = "admin:webhooks"
+
+var db *sql.DB
+var timeout int
+
+func SetupRoutes(apiBasePath string, dbConn *sql.DB, to int) {
+	db = dbConn
+	timeout = to
+	handleSubscriptions := http.HandlerFunc(subscriptionsHandler)
+	handleSubscription := http.HandlerFunc(subscriptionHandler)
+	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, webhookBasePath), requestid.Middleware(logger.Middleware(compress.Middleware(cors.Middleware(admission.Middleware(auth.Middleware(tenant.Middleware(ratelimit.Middleware(handleSubscriptions)))))))))
+	http.Handle(fmt.Sprintf("%s/%s/", apiBasePath, webhookBasePath), requestid.Middleware(logger.Middleware(compress.Middleware(cors.Middleware(admission.Middleware(auth.Middleware(tenant.Middleware(ratelimit.Middleware(handleSubscription)))))))))
+}
+
+// subscriptionsHandler serves GET and POST /admin/webhooks.
+func subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !auth.Check(w, r, permission) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		subscriptions, err := listSubscriptions(r.Context(), db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to list webhook subscriptions: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The webhook subscriptions could not be listed.")
+			return
+		}
+		problem.WriteJSON(w, r, http.StatusOK, subscriptions)
+	case http.MethodPost:
+		newSubscription := Subscription{Active: true}
+		if !readSubscription(w, r, &newSubscription) {
+			return
+		}
+		if newSubscription.Secret == "" {
+			secret, err := generateSecret()
+			if err != nil {
+				log.Printf("An error accured trying to generate a webhook secret: %v", err)
+				problem.Error(w, r, http.StatusInternalServerError, "The webhook subscription could not be created.")
+				return
+			}
+			newSubscription.Secret = secret
+		}
+		newSubscription.CreatedAt = time.Now().UTC()
+		subscriptionID, err := insertSubscription(r.Context(), newSubscription, db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to create the webhook subscription: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The webhook subscription could not be created.")
+			return
+		}
+		newSubscription.SubscriptionID = subscriptionID
+		problem.WriteJSON(w, r, http.StatusCreated, newSubscription)
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// subscriptionHandler serves a single subscription:
+//
+//	GET, PUT, DELETE /admin/webhooks/{id}
+//	GET              /admin/webhooks/{id}/deliveries?status=
+//	GET              /admin/webhooks/{id}/deliveries/{deliveryId}
+//	POST             /admin/webhooks/{id}/deliveries/{deliveryId}/redeliver
+func subscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !auth.Check(w, r, permission) {
+		return
+	}
+
+	urlPathSegments := strings.Split(r.URL.Path, "webhooks/")
+	pathSegments := strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	subscriptionID, err := strconv.Atoi(pathSegments[0])
+	if err != nil || len(pathSegments) > 4 || (len(pathSegments) > 1 && pathSegments[1] != "deliveries") {
+		problem.Error(w, r, http.StatusNotFound, "")
+		return
+	}
+
+	subscription, err := getSubscription(r.Context(), subscriptionID, db, timeout)
+	if err != nil {
+		log.Printf("An error accured trying to get the webhook subscription: %v", err)
+		problem.Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if subscription == nil {
+		problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Webhook subscription %d does not exist.", subscriptionID))
+		return
+	}
+
+	if len(pathSegments) > 1 {
+		deliveriesHandler(w, r, subscriptionID, pathSegments[2:])
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		problem.WriteJSON(w, r, http.StatusOK, subscription)
+	case http.MethodPut:
+		updatedSubscription := *subscription
+		if !readSubscription(w, r, &updatedSubscription) {
+			return
+		}
+		updatedSubscription.SubscriptionID = subscriptionID
+		updatedSubscription.Secret = ""
+		if err := updateSubscription(r.Context(), updatedSubscription, db, timeout); err != nil {
+			log.Printf("An error accured trying to update the webhook subscription: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The webhook subscription could not be updated.")
+			return
+		}
+		problem.WriteJSON(w, r, http.StatusOK, updatedSubscription)
+	case http.MethodDelete:
+		if err := deleteSubscription(r.Context(), subscriptionID, db, timeout); err != nil {
+			log.Printf("An error accured trying to delete the webhook subscription: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The webhook subscription could not be deleted.")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// deliveriesHandler serves the deliveries of a subscription, given the path
+// segments after "deliveries".
+func deliveriesHandler(w http.ResponseWriter, r *http.Request, subscriptionID int, pathSegments []string) {
+	if len(pathSegments) == 0 || pathSegments[0] == "" {
+		if r.Method != http.MethodGet {
+			problem.Error(w, r, http.StatusMethodNotAllowed, "")
+			return
+		}
+		status := r.URL.Query().Get("status")
+		if status != "" && status != StatusPending && status != StatusDelivered && status != StatusDead {
+			problem.Write(w, r, problem.Validation([]problem.FieldError{{Field: "status", Message: fmt.Sprintf("must be one of %s, %s, %s", StatusPending, StatusDelivered, StatusDead)}}))
+			return
+		}
+		deliveries, err := listDeliveries(r.Context(), subscriptionID, status, db, timeout)
+		if err != nil {
+			log.Printf("An error accured trying to list webhook deliveries: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The webhook deliveries could not be listed.")
+			return
+		}
+		problem.WriteJSON(w, r, http.StatusOK, deliveries)
+		return
+	}
+
+	deliveryID, err := strconv.ParseInt(pathSegments[0], 10, 64)
+	if err != nil || (len(pathSegments) == 2 && pathSegments[1] != "redeliver") {
+		problem.Error(w, r, http.StatusNotFound, "")
+		return
+	}
+
+	if len(pathSegments) == 2 {
+		if r.Method != http.MethodPost {
+			problem.Error(w, r, http.StatusMethodNotAllowed, "")
+			return
+		}
+		err := redeliver(r.Context(), subscriptionID, deliveryID, db, timeout)
+		if err == errDeliveryNotFound {
+			problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Webhook delivery %d does not exist.", deliveryID))
+			return
+		} else if err != nil {
+			log.Printf("An error accured trying to redeliver the webhook delivery: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, "The webhook delivery could not be queued again.")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		problem.Error(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	delivery, err := getDelivery(r.Context(), subscriptionID, deliveryID, db, timeout)
+	if err != nil {
+		log.Printf("An error accured trying to get the webhook delivery: %v", err)
+		problem.Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if delivery == nil {
+		problem.Error(w, r, http.StatusNotFound, fmt.Sprintf("Webhook delivery %d does not exist.", deliveryID))
+		return
+	}
+	problem.WriteJSON(w, r, http.StatusOK, delivery)
+}
+
+// readSubscription reads the body of r over s and validates it, writing the
+// problem and returning false when it isn't a valid subscription.
+func readSubscription(w http.ResponseWriter, r *http.Request, s *Subscription) bool {
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("An error accured trying to read the body: %v", err)
+		problem.Write(w, r, problem.Malformed("The request body could not be read."))
+		return false
+	}
+	if err := json.Unmarshal(bodyBytes, s); err != nil {
+		log.Printf("An error accured trying to parse the body: %v", err)
+		problem.Write(w, r, problem.Malformed("The request body is not a valid webhook subscription."))
+		return false
+	}
+	if errs := validate(s); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs))
+		return false
+	}
+	return true
+}
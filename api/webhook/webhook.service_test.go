@@ -0,0 +1,231 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/Paulo-Eduardo/phone_book/auth"
+	"github.com/Paulo-Eduardo/phone_book/phonebook"
+	"github.com/Paulo-Eduardo/phone_book/tenant"
+)
+
+var mock sqlmock.Sqlmock
+
+// testTenant is the tenant every test runs as.
+const testTenant = "acme"
+
+func TestMain(m *testing.M) {
+	var err error
+	db, mock, err = sqlmock.New()
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	timeout = 15
+	os.Exit(m.Run())
+}
+
+// newRequest is http.NewRequest for a request already authenticated with the
+// given scopes by auth.Middleware and resolved to testTenant.
+func newRequest(method, url string, body io.Reader, scopes ...string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: "apikey:admin", Method: auth.MethodAPIKey, Tenant: testTenant, Scopes: scopes})
+	return req.WithContext(tenant.NewContext(ctx, testTenant)), nil
+}
+
+func subscriptionRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"subscriptionId", "url", "events", "visibility", "active", "createdAt"})
+}
+
+func TestPostSubscriptionHandler(t *testing.T) {
+	handler := http.HandlerFunc(subscriptionsHandler)
+
+	mock.ExpectExec("INSERT INTO webhook_subscriptions").
+		WithArgs(testTenant, "https://hooks.example.com", "phonebook.created phonebook.deleted", "public", sqlmock.AnyArg(), true, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+
+	req, err := newRequest("POST", "/admin/webhooks", bytes.NewBufferString(`{"url": "https://hooks.example.com", "events": ["phonebook.created", "phonebook.deleted"]}`), "admin:webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusCreated, rr.Body.String())
+	}
+	var created Subscription
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.SubscriptionID != 2 || !created.Active || !strings.HasPrefix(created.Secret, secretPrefix) {
+		t.Errorf("handler returned wrong subscription: %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSubscriptionsHandlerRequiresAdmin(t *testing.T) {
+	handler := http.HandlerFunc(subscriptionsHandler)
+
+	req, err := newRequest("GET", "/admin/webhooks", nil, "admin:keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+}
+
+func TestGetSubscriptionHandlerHidesTheSecret(t *testing.T) {
+	handler := http.HandlerFunc(subscriptionHandler)
+
+	mock.ExpectQuery("FROM webhook_subscriptions WHERE subscriptionId = \\? AND tenant_id = \\?").
+		WithArgs(2, testTenant).
+		WillReturnRows(subscriptionRows().AddRow(2, "https://hooks.example.com", "*", "internal", true, time.Now()))
+
+	req, err := newRequest("GET", "/admin/webhooks/2", nil, "admin:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if strings.Contains(rr.Body.String(), "secret") || !strings.Contains(rr.Body.String(), `"events":["*"]`) {
+		t.Errorf("handler returned wrong subscription: %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetDeliveryHandlerReturnsTheLog(t *testing.T) {
+	handler := http.HandlerFunc(subscriptionHandler)
+	now := time.Now()
+
+	mock.ExpectQuery("FROM webhook_subscriptions WHERE subscriptionId = \\? AND tenant_id = \\?").
+		WithArgs(2, testTenant).
+		WillReturnRows(subscriptionRows().AddRow(2, "https://hooks.example.com", "*", "public", true, now))
+	mock.ExpectQuery("FROM webhook_deliveries WHERE deliveryId = \\? AND subscriptionId = \\? AND tenant_id = \\?").
+		WithArgs(9, 2, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"deliveryId", "subscriptionId", "eventId", "eventType", "status", "attempts", "next_attempt_at", "last_status_code", "last_error", "createdAt", "delivered_at"}).
+			AddRow(9, 2, "evt_1", "phonebook.created", StatusDead, 2, now, 500, "500 Internal Server Error", now, nil))
+	mock.ExpectQuery("FROM webhook_delivery_attempts WHERE deliveryId = \\? AND tenant_id = \\? ORDER BY attemptId").
+		WithArgs(9, testTenant).
+		WillReturnRows(sqlmock.NewRows([]string{"attempt", "status_code", "error", "duration_ms", "attemptedAt"}).
+			AddRow(1, nil, "connection refused", 3, now).
+			AddRow(2, 500, "500 Internal Server Error", 12, now))
+
+	req, err := newRequest("GET", "/admin/webhooks/2/deliveries/9", nil, "admin:webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var delivery Delivery
+	if err := json.Unmarshal(rr.Body.Bytes(), &delivery); err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != StatusDead || delivery.NextAttemptAt != nil || len(delivery.Log) != 2 || delivery.Log[0].Error != "connection refused" {
+		t.Errorf("handler returned wrong delivery: %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedeliverHandler(t *testing.T) {
+	handler := http.HandlerFunc(subscriptionHandler)
+
+	for _, test := range []struct {
+		affected int64
+		want     int
+	}{{1, http.StatusAccepted}, {0, http.StatusNotFound}} {
+		mock.ExpectQuery("FROM webhook_subscriptions WHERE subscriptionId = \\? AND tenant_id = \\?").
+			WithArgs(2, testTenant).
+			WillReturnRows(subscriptionRows().AddRow(2, "https://hooks.example.com", "*", "public", true, time.Now()))
+		mock.ExpectExec("UPDATE webhook_deliveries SET status=\\?, attempts=0, next_attempt_at=\\? WHERE deliveryId = \\? AND subscriptionId = \\? AND tenant_id = \\?").
+			WithArgs(StatusPending, sqlmock.AnyArg(), 9, 2, testTenant).
+			WillReturnResult(sqlmock.NewResult(0, test.affected))
+
+		req, err := newRequest("POST", "/admin/webhooks/2/deliveries/9/redeliver", nil, "admin:webhooks")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.want {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, test.want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnqueueQueuesAnEventPerSubscription(t *testing.T) {
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM webhook_subscriptions WHERE tenant_id = \\? AND active = TRUE").
+		WithArgs(testTenant).
+		WillReturnRows(subscriptionRows().
+			AddRow(2, "https://hooks.example.com", "phonebook.deleted", "public", true, now).
+			AddRow(3, "https://audit.example.com", "*", "restricted", true, now))
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs(testTenant, 3, sqlmock.AnyArg(), phonebook.EventCreated, sqlmock.AnyArg(), StatusPending, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	ctx := tenant.NewContext(context.Background(), testTenant)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rendered []string
+	render := func(visibility string) phonebook.EventData {
+		rendered = append(rendered, visibility)
+		return phonebook.EventData{Phonebook: &phonebook.Phonebook{PhonebookID: 1}}
+	}
+	if err := Enqueue(ctx, tx, phonebook.EventCreated, 1, render); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rendered) != 1 || rendered[0] != "restricted" {
+		t.Errorf("event rendered for %v want [restricted]", rendered)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSignatureVerifies(t *testing.T) {
+	body := []byte(`{"id":"evt_1"}`)
+	signature := Sign("whsec_test", 1700000000, body)
+	if !strings.HasPrefix(signature, "sha256=") {
+		t.Errorf("signature %q does not start with sha256=", signature)
+	}
+	if !Verify("whsec_test", 1700000000, body, signature) {
+		t.Error("signature does not verify")
+	}
+	if Verify("whsec_other", 1700000000, body, signature) {
+		t.Error("signature verifies with another secret")
+	}
+	if Verify("whsec_test", 1700000001, body, signature) {
+		t.Error("signature verifies at another timestamp")
+	}
+	if Verify("whsec_test", 1700000000, []byte(`{"id":"evt_2"}`), signature) {
+		t.Error("signature verifies another body")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := Subscription{URL: " https://hooks.example.com/phonebooks ", Events: []string{"phonebook.created", "*"}}
+	if errs := validate(&s); len(errs) > 0 {
+		t.Fatalf("valid subscription rejected: %v", errs)
+	}
+	if s.URL != "https://hooks.example.com/phonebooks" || s.Visibility != "public" {
+		t.Errorf("validate did not normalize the subscription: %+v", s)
+	}
+
+	invalid := Subscription{URL: "ftp://hooks.example.com", Events: []string{"phonebook.renamed"}, Visibility: "secret"}
+	fields := map[string]bool{}
+	for _, e := range validate(&invalid) {
+		fields[e.Field] = true
+	}
+	for _, field := range []string{"url", "events[0]", "visibility"} {
+		if !fields[field] {
+			t.Errorf("validate did not reject %s: %v", field, fields)
+		}
+	}
+}
+
+func TestValidateRefusesInternalAddresses(t *testing.T) {
+	for _, url := range []string{"http://127.0.0.1:8080/hooks", "http://169.254.169.254/latest/meta-data", "https://10.0.0.7", "http://[::1]/hooks", "http://[::ffff:192.168.0.1]/hooks"} {
+		s := Subscription{URL: url, Events: []string{"*"}}
+		if errs := validate(&s); len(errs) != 1 || errs[0].Field != "url" {
+			t.Errorf("validate(%s) = %v want an error on url", url, errs)
+		}
+	}
+
+	AllowNetworks(mustParseCIDRs("10.0.0.0/24"))
+	defer AllowNetworks(nil)
+	s := Subscription{URL: "https://10.0.0.7", Events: []string{"*"}}
+	if errs := validate(&s); len(errs) > 0 {
+		t.Errorf("subscription to an allowed network rejected: %v", errs)
+	}
+}
+
+func TestSubscribes(t *testing.T) {
+	s := Subscription{Events: []string{"phonebook.deleted"}}
+	if !s.subscribes("phonebook.deleted") || s.subscribes("phonebook.created") {
+		t.Errorf("subscription to %v subscribes to the wrong events", s.Events)
+	}
+	all := Subscription{Events: []string{"*"}}
+	if !all.subscribes("phonebook.restored") {
+		t.Error("subscription to * does not subscribe to every event")
+	}
+}
+
+func TestBackoffDoublesUpToTheMaximum(t *testing.T) {
+	d := &Dispatcher{Backoff: DefaultBackoff, MaxBackoff: DefaultMaxBackoff}
+	cases := map[int]string{1: "30s", 2: "1m0s", 3: "2m0s", 10: "4h16m0s", 11: "6h0m0s", 40: "6h0m0s"}
+	for attempt, want := range cases {
+		if got := d.backoff(attempt).String(); got != want {
+			t.Errorf("backoff(%d) = %s want %s", attempt, got, want)
+		}
+	}
+}